@@ -1,26 +1,245 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"pest-control/audit"
+	"pest-control/auth"
+	"pest-control/config"
 	"pest-control/handlers"
+	"pest-control/logging"
+	"pest-control/metrics"
 	"pest-control/models"
-	"strings"
+	"pest-control/tracing"
+	"strconv"
+	"syscall"
 	"time"
 )
 
-func logging(f http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("path: %s, method: %s", r.URL.Path, r.Method)
-		f(w, r)
+// withDeadline bounds the context of requests by timeout, so that the
+// datastore operations of a handler give up before the server's WriteTimeout
+func withDeadline(timeout time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceRequests starts a span for each request, named after the route that it
+// matched, which continues the trace of the traceparent header of the caller
+func traceRequests(tracer *tracing.Tracer) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := metrics.RouteTemplate(r)
+			remote, _ := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader))
+			ctx, span := tracer.StartServer(r.Context(), r.Method+" "+route, remote)
+			defer span.Finish()
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.route", route)
+			span.SetAttribute("http.target", r.URL.RequestURI())
+
+			sw := &metrics.StatusWriter{ResponseWriter: w}
+			h.ServeHTTP(sw, r.WithContext(ctx))
+			if sw.Status == 0 {
+				sw.Status = http.StatusOK
+			}
+			span.SetAttribute("http.status_code", sw.Status)
+			if sw.Status >= http.StatusInternalServerError {
+				span.RecordError(errors.New(http.StatusText(sw.Status)))
+			}
+		})
+	}
+}
+
+// logRequests logs each request once it is handled, with its route, status
+// and latency, and the user and conversation that it was for. It keeps the
+// request ID of the caller's X-Request-ID header if it is valid, generates
+// one otherwise, and echoes it in the response. The handlers get a logger
+// carrying the request ID in the request context.
+func logRequests(logger *logging.Logger) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestID := r.Header.Get(logging.RequestIDHeader)
+			if !logging.ValidRequestID(requestID) {
+				requestID = logging.NewRequestID()
+			}
+			w.Header().Set(logging.RequestIDHeader, requestID)
+
+			fields := logging.Fields{
+				"request_id": requestID,
+				"method":     r.Method,
+				"route":      metrics.RouteTemplate(r),
+			}
+			if span := tracing.SpanFromContext(r.Context()); span != nil {
+				fields["trace_id"] = span.SpanContext.TraceID.String()
+			}
+			if conversationID, err := strconv.Atoi(mux.Vars(r)["conversation"]); err == nil {
+				fields["conversation_id"] = conversationID
+			}
+			requestLogger := logger.With(fields)
+			ctx := logging.WithRequestID(r.Context(), requestID)
+			ctx = logging.NewContext(ctx, requestLogger)
+
+			sw := &metrics.StatusWriter{ResponseWriter: w}
+			h.ServeHTTP(sw, r.WithContext(ctx))
+			if sw.Status == 0 {
+				sw.Status = http.StatusOK
+			}
+
+			level := logging.Info
+			if sw.Status >= http.StatusInternalServerError {
+				level = logging.Error
+			}
+			requestLogger.Log(level, "handled request", logging.Fields{
+				"status":     sw.Status,
+				"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			})
+		})
+	}
+}
+
+// newTracer returns the tracer of the configured exporter, which is nil when
+// tracing is disabled
+func newTracer(cfg config.Tracing) *tracing.Tracer {
+	switch cfg.Exporter {
+	case "stdout":
+		return tracing.NewTracer(tracing.NewWriterExporter(os.Stdout), cfg.SampleRatio)
+	case "otlp":
+		exporter := tracing.NewOTLPExporter(cfg.OTLPEndpoint, "pest-control")
+		return tracing.NewTracer(exporter, cfg.SampleRatio)
+	}
+	return nil
+}
+
+// authenticate rejects requests without a valid user with 401 and passes the
+// user ID to f in the request context
+func authenticate(authn auth.Authenticator) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			userID, err := authn.Authenticate(r)
+			if err != nil {
+				logging.FromContext(r.Context()).Info("unable to authenticate request", logging.Fields{
+					"error": err,
+				})
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				handlers.WriteProblem(w, r, handlers.NewProblem(
+					http.StatusUnauthorized, handlers.CodeUnauthorized, "missing or invalid bearer token",
+				))
+				return
+			}
+			tracing.SpanFromContext(r.Context()).SetAttribute("enduser.id", userID)
+			logging.SetField(r.Context(), "user_id", userID)
+			f(w, r.WithContext(auth.WithUserID(r.Context(), userID)))
+		}
+	}
+}
+
+// authenticateService rejects internal requests without the service token
+// with 401
+func authenticateService(service *auth.ServiceToken) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := service.Verify(r); err != nil {
+				logging.FromContext(r.Context()).Info("unable to authenticate internal request", logging.Fields{
+					"error": err,
+				})
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				handlers.WriteProblem(w, r, handlers.NewProblem(
+					http.StatusUnauthorized, handlers.CodeUnauthorized, "missing or invalid service token",
+				))
+				return
+			}
+			f(w, r)
+		}
+	}
+}
+
+// resolveTenant rejects requests without a valid tenant with 400 and passes the
+// tenant ID to f in the request context
+func resolveTenant(resolver auth.TenantResolver) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		if resolver == nil {
+			return f
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			tenant, err := resolver.Tenant(r)
+			if err != nil {
+				logging.FromContext(r.Context()).Info("unable to resolve tenant of request", logging.Fields{
+					"error": err,
+				})
+				handlers.WriteProblem(w, r, handlers.NewProblem(
+					http.StatusBadRequest, handlers.CodeInvalidTenant, "Invalid tenant ID",
+				))
+				return
+			}
+			logging.SetField(r.Context(), "tenant", tenant)
+			f(w, r.WithContext(auth.WithTenant(r.Context(), tenant)))
+		}
+	}
+}
+
+// newTenantResolvers returns the resolvers of the tenant of user requests and
+// of internal requests, which are nil without tenancy. Internal requests
+// don't carry a user's token, so their tenant always comes from the header.
+func newTenantResolvers(
+	cfg *config.Config,
+	authn auth.Authenticator,
+) (auth.TenantResolver, auth.TenantResolver, error) {
+	if cfg.DBConfig().Tenancy == models.NoTenancy {
+		return nil, nil, nil
+	}
+
+	header := auth.TenantHeader{Name: cfg.Tenancy.Header}
+	if cfg.TenantSource() == "header" {
+		if _, ok := authn.(*auth.JWT); ok {
+			logging.Default().Warn("trusting the tenant header, clients can pick their tenant")
+		}
+		return header, header, nil
+	}
+	jwt, ok := authn.(*auth.JWT)
+	if !ok {
+		return nil, nil, errors.New("tenant claims require jwt auth mode")
 	}
+	claim := &auth.TenantClaim{Verifier: jwt.Verifier, Claim: cfg.Tenancy.Claim}
+	return claim, header, nil
+}
+
+// newAuthenticator verifies heimdall's JWTs with the configured HMAC secret
+// or RSA public key. Trusting the User-ID header has to be enabled with the
+// header auth mode.
+func newAuthenticator(cfg config.Auth) (auth.Authenticator, error) {
+	if cfg.Mode == "header" {
+		logging.Default().Warn("trusting the User-ID header, requests must come through heimdall")
+		return auth.Header{}, nil
+	}
+
+	var (
+		verifier *auth.Verifier
+		err      error
+	)
+	if cfg.HMACKeyFile != "" {
+		verifier, err = auth.LoadHMACVerifier(cfg.HMACKeyFile)
+	} else {
+		verifier, err = auth.LoadRSAVerifier(cfg.RSAKeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	verifier.UserClaim = cfg.UserClaim
+	return &auth.JWT{Verifier: verifier}, nil
 }
 
 func getCustomTLSConfig(caFile string) (*tls.Config, error) {
@@ -41,81 +260,376 @@ func getCustomTLSConfig(caFile string) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
-func main() {
-	b := new(strings.Builder)
+func newMongoDB(cfg *config.Config) (*models.DB, error) {
+	var tlsConfig *tls.Config
+
+	if cfg.Mongo.CAFile != "" {
+		var err error
+		tlsConfig, err = getCustomTLSConfig(cfg.Mongo.CAFile)
+		if err != nil {
+			logging.Default().Fatal("failed getting TLS configuration", logging.Fields{"error": err})
+		}
+	}
+
+	return models.NewDB(cfg.Mongo.ConnectionURI(), tlsConfig, cfg.DBConfig())
+}
+
+// serve runs httpSrv until it receives SIGTERM or SIGINT. It then fails the
+// readiness probe, waits for the shutdown delay so that load balancers stop
+// sending it requests, stops accepting connections and drains the in-flight
+// requests for up to the shutdown timeout. A second signal skips the delay.
+func serve(httpSrv *http.Server, cfg config.Server, lifecycle *handlers.Lifecycle) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 1)
+	go func() {
+		if cfg.TLSCertFile != "" {
+			errs <- httpSrv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		errs <- httpSrv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		logging.Default().Info("shutting down", logging.Fields{"signal": sig.String()})
+	}
+
+	lifecycle.ShutDown()
+	select {
+	case <-time.After(time.Duration(cfg.ShutdownDelay)):
+	case sig := <-signals:
+		logging.Default().Info("skipping shutdown delay", logging.Fields{"signal": sig.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed draining requests: %v", err)
+	}
+	return nil
+}
+
+// eachTenantDB calls f with the DB of tenant, or if tenant is empty with db
+// and the DB of every tenant that has a database of its own
+func eachTenantDB(db *models.DB, tenant string, f func(string, *models.DB) error) error {
+	if tenant != "" {
+		return f(tenant, db.TenantDB(tenant))
+	}
+	if err := f("", db); err != nil {
+		return err
+	}
+
+	tenants, err := db.Tenants(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		if err := f(t, db.TenantDB(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	fmt.Fprint(b, "mongodb://")
-	if user := os.Getenv("PESTCONTROL_DB_USER"); user != "" {
-		fmt.Fprintf(b, "%s:%s@", user, os.Getenv("PESTCONTROL_DB_PW"))
+func tenantPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return fmt.Sprintf("tenant %s: ", tenant)
+}
+
+// connectMongoDB loads the configuration of MongoDB with the flags of a
+// subcommand and connects to it. The subcommand exits when either fails.
+func connectMongoDB(flags *flag.FlagSet, args []string) *models.DB {
+	cfg, err := config.Load(flags, args, os.LookupEnv)
+	if err == nil {
+		err = cfg.ValidateMongo()
+	}
+	if err != nil {
+		logging.Default().Fatal("failed configuring MongoDB", logging.Fields{"error": err})
 	}
-	fmt.Fprintf(
-		b,
-		"%s:%s",
-		os.Getenv("PESTCONTROL_DB_HOST"),
-		os.Getenv("PESTCONTROL_DB_PORT"),
+	mongoDB, err := newMongoDB(cfg)
+	if err != nil {
+		logging.Default().Fatal("failed connecting to MongoDB", logging.Fields{"error": err})
+	}
+	return mongoDB
+}
+
+// runBootstrap bootstraps the MongoDB datastore and prints what it changed,
+// so that it can be run as a job before the service is deployed
+func runBootstrap(args []string) {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	validator := flags.Bool("validator", false, "install the $jsonSchema validator")
+	tenantID := flags.String("tenant", "", "only the database of this tenant")
+
+	mongoDB := connectMongoDB(flags, args)
+	defer mongoDB.Disconnect(context.TODO())
+
+	err := eachTenantDB(mongoDB, *tenantID, func(tenant string, db *models.DB) error {
+		report, err := db.Bootstrap(context.Background(), *validator)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s%s\n", tenantPrefix(tenant), report)
+		return nil
+	})
+	if err != nil {
+		logging.Default().Fatal("failed bootstrapping MongoDB", logging.Fields{"error": err})
+	}
+}
+
+// runMigrate applies the pending migrations of the MongoDB datastore, or
+// with -dry-run prints how many documents each one would change
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report the pending migrations without applying them")
+	tenantID := flags.String("tenant", "", "only the database of this tenant")
+
+	mongoDB := connectMongoDB(flags, args)
+	defer mongoDB.Disconnect(context.TODO())
+
+	err := eachTenantDB(mongoDB, *tenantID, func(tenant string, db *models.DB) error {
+		report, err := db.Migrate(context.Background(), *dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s%s\n", tenantPrefix(tenant), report)
+		return nil
+	})
+	if err != nil {
+		logging.Default().Fatal("failed migrating MongoDB", logging.Fields{"error": err})
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bootstrap":
+			runBootstrap(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		}
+	}
+
+	cfg, err := config.Load(
+		flag.NewFlagSet(os.Args[0], flag.ExitOnError),
+		os.Args[1:],
+		os.LookupEnv,
 	)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logging.Default().Fatal("failed loading configuration", logging.Fields{"error": err})
+	}
 
-	var tlsConfig *tls.Config
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logger := logging.New(os.Stderr, level)
+	logging.SetDefault(logger)
+	// The standard library logs as well, e.g. the errors of http.Server
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.Error))
+	logger.Info("effective config", logging.Fields{"config": json.RawMessage(cfg.Redacted())})
 
-	if caFilePath := os.Getenv("DOCDB_CERT_PATH"); caFilePath != "" {
-		var err error
-		fmt.Fprint(b, "/?ssl=true&replicaSet=rs0")
-		fmt.Fprint(b, "&readPreference=secondaryPreferred&retryWrites=false")
-		tlsConfig, err = getCustomTLSConfig(caFilePath)
+	var (
+		audited *audit.Datastore
+		mongoDB *models.DB
+	)
+
+	switch cfg.Datastore {
+	case "mongo":
+		mongoDB, err = newMongoDB(cfg)
+		if err != nil {
+			logger.Fatal("failed connecting to MongoDB", logging.Fields{"error": err})
+		}
+		// Without the bootstrap the indexes are still created, since only the
+		// unique index on user_id keeps a user from having two documents
+		err := eachTenantDB(mongoDB, "", func(tenant string, db *models.DB) error {
+			if !cfg.Features.Bootstrap {
+				created, err := db.CreateIndexes(context.Background())
+				if err != nil {
+					return err
+				}
+				logger.Info("created MongoDB indexes", logging.Fields{
+					"tenant":  tenant,
+					"indexes": created,
+				})
+				return nil
+			}
+			report, err := db.Bootstrap(context.Background(), cfg.Features.Validator)
+			if err != nil {
+				return err
+			}
+			logger.Info("bootstrapped MongoDB", logging.Fields{
+				"tenant": tenant,
+				"report": report.String(),
+			})
+			return nil
+		})
 		if err != nil {
-			log.Fatalf("Failed getting TLS configuration: %v", err)
+			logger.Fatal("failed bootstrapping MongoDB", logging.Fields{"error": err})
 		}
+		audited = audit.NewDatastore(mongoDB)
+	case "memory":
+		logger.Warn("using in-memory datastore, preferences will not persist")
+		audited = audit.NewDatastore(models.NewMemDB())
 	}
 
-	db, err := models.NewDB(b.String(), tlsConfig)
+	tracer := newTracer(cfg.Tracing)
+	registry := metrics.NewRegistry()
+	audited.Instrument(registry)
+	var db models.Datastore = metrics.InstrumentDatastore(registry, audited)
 
+	authn, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		logging.Default().Fatal("failed configuring authentication", logging.Fields{"error": err})
+	}
+	userTenant, internalTenant, err := newTenantResolvers(cfg, authn)
 	if err != nil {
-		log.Panic(err)
+		logging.Default().Fatal("failed configuring tenancy", logging.Fields{"error": err})
+	}
+	authenticateUser := authenticate(authn)
+	withUserTenant := resolveTenant(userTenant)
+	user := func(f http.HandlerFunc) http.HandlerFunc {
+		return authenticateUser(withUserTenant(f))
+	}
+	withInternalTenant := resolveTenant(internalTenant)
+	var internal func(http.HandlerFunc) http.HandlerFunc
+	if cfg.Features.InternalAPI {
+		service, err := auth.LoadServiceToken(cfg.Auth.ServiceTokenFile)
+		if err != nil {
+			logging.Default().Fatal("failed configuring internal authentication", logging.Fields{"error": err})
+		}
+		authenticateInternal := authenticateService(service)
+		internal = func(f http.HandlerFunc) http.HandlerFunc {
+			return authenticateInternal(withInternalTenant(f))
+		}
+	} else {
+		logger.Warn("not serving the internal API, it is turned off")
 	}
 
-	env := &handlers.Env{db}
+	lifecycle := &handlers.Lifecycle{}
+	env := &handlers.Env{DB: db, Lifecycle: lifecycle}
 
 	httpMux := mux.NewRouter()
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs",
-		logging(env.PostPrefsHandler),
+	httpMux.NotFoundHandler = http.HandlerFunc(handlers.NotFoundHandler)
+	httpMux.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowedHandler)
+	httpMux.Use(metrics.NewHTTP(registry).Middleware)
+	httpMux.Handle("/metrics", registry).Methods("GET")
+	httpMux.HandleFunc("/healthz", env.HealthHandler).Methods("GET")
+	httpMux.HandleFunc("/readyz", env.ReadyHandler).Methods("GET")
+
+	// Only the API is traced, not the probes and metrics that are polled
+	api := httpMux.PathPrefix("/pest-control/v1").Subrouter()
+	api.Use(traceRequests(tracer))
+	api.Use(logRequests(logger))
+	api.HandleFunc(
+		"/prefs",
+		user(env.PostPrefsHandler),
+	).Methods("POST")
+	api.HandleFunc(
+		"/prefs/conversations",
+		user(env.PostPrefsConvHandler),
 	).Methods("POST")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs/conversations",
-		logging(env.PostPrefsConvHandler),
+	api.HandleFunc(
+		"/prefs",
+		user(env.PutPrefsHandler),
+	).Methods("PUT")
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}",
+		user(env.PutPrefsConvHandler),
+	).Methods("PUT")
+	api.HandleFunc(
+		"/prefs",
+		user(env.GetPrefsHandler),
+	).Methods("GET")
+	api.HandleFunc(
+		"/prefs/conversations",
+		user(env.ListPrefsConvHandler),
+	).Methods("GET")
+	api.HandleFunc(
+		"/prefs/history",
+		user(env.GetPrefsHistoryHandler),
+	).Methods("GET")
+	api.HandleFunc(
+		"/prefs/restore",
+		user(env.PostRestorePrefsHandler),
 	).Methods("POST")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs",
-		logging(env.GetPrefsHandler),
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}",
+		user(env.GetPrefsConvHandler),
 	).Methods("GET")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs/conversations/{conversation:[0-9]+}",
-		logging(env.GetPrefsConvHandler),
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}/effective",
+		user(env.GetEffectivePrefsHandler),
 	).Methods("GET")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs",
-		logging(env.DeletePrefsHandler),
+	api.HandleFunc(
+		"/prefs",
+		user(env.DeletePrefsHandler),
 	).Methods("DELETE")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs/conversations/{conversation:[0-9]+}",
-		logging(env.DeletePrefsConvHandler),
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}",
+		user(env.DeletePrefsConvHandler),
 	).Methods("DELETE")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs",
-		logging(env.PatchPrefsHandler),
+	api.HandleFunc(
+		"/prefs",
+		user(env.PatchPrefsHandler),
 	).Methods("PATCH")
-	httpMux.HandleFunc(
-		"/pest-control/v1/prefs/conversations/{conversation:[0-9]+}",
-		logging(env.PatchPrefsConvHandler),
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}",
+		user(env.PatchPrefsConvHandler),
 	).Methods("PATCH")
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}/mute",
+		user(env.PostMutePrefsConvHandler),
+	).Methods("POST")
+	api.HandleFunc(
+		"/prefs/conversations/{conversation:[0-9]+}/mute",
+		user(env.DeleteMutePrefsConvHandler),
+	).Methods("DELETE")
+	if internal != nil {
+		api.HandleFunc(
+			"/internal/recipients",
+			internal(env.PostRecipientsHandler),
+		).Methods("POST")
+		api.HandleFunc(
+			"/internal/digests",
+			internal(env.GetDueDigestsHandler),
+		).Methods("GET")
+	}
 
 	httpSrv := &http.Server{
-		Addr:         ":80",
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      httpMux,
+		Addr:         cfg.Server.ListenAddr,
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.Server.IdleTimeout),
+		Handler:      withDeadline(time.Duration(cfg.Server.RequestTimeout), httpMux),
 	}
 
-	log.Fatal(httpSrv.ListenAndServe())
+	err = serve(httpSrv, cfg.Server, lifecycle)
+	if err != nil {
+		logger.Error("server stopped", logging.Fields{"error": err})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if mongoDB != nil {
+		if err := mongoDB.Disconnect(ctx); err != nil {
+			logger.Error("failed disconnecting from MongoDB", logging.Fields{"error": err})
+		}
+	}
+	if err := tracer.Shutdown(ctx); err != nil {
+		logger.Error("failed exporting spans", logging.Fields{"error": err})
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	logger.Info("shut down")
 }
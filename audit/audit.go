@@ -0,0 +1,714 @@
+// Package audit records every change made to preferences through a
+// models.Datastore in its audit log, with who made it and the state of the
+// preferences before and after it
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pest-control/auth"
+	"pest-control/logging"
+	"pest-control/metrics"
+	"pest-control/models"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SystemActor is the actor of the changes made without an authenticated
+// user
+const SystemActor = "system"
+
+// maxRestoreAttempts bounds how often a restore is retried when the user's
+// preferences are changed between reading and writing them
+const maxRestoreAttempts = 3
+
+// historyPageSize is the number of audit entries read at once to find the
+// changes made since a restore point
+const historyPageSize = 100
+
+// Actor returns who a change made with ctx is made by
+func Actor(ctx context.Context) string {
+	if userID, ok := auth.UserID(ctx); ok {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	return SystemActor
+}
+
+// Datastore is a models.Datastore that records the changes made through the
+// Datastore that it decorates in its audit log. The states that are recorded
+// before and after a change are those of the Change that the write returns,
+// so they are those of the version of the preferences that it was made to.
+// A change that can't be recorded is logged and counted rather than failed,
+// since it has already been made.
+type Datastore struct {
+	db       models.AuditedDatastore
+	failures *metrics.Counter
+}
+
+// NewDatastore decorates db, recording its changes in its own audit log
+func NewDatastore(db models.AuditedDatastore) *Datastore {
+	return &Datastore{db: db}
+}
+
+// ForTenant returns the Datastore of a tenant, which records the changes in
+// the tenant's audit log, or ds itself if the decorated Datastore isn't
+// partitioned by tenant
+func (ds *Datastore) ForTenant(tenant string) models.Datastore {
+	tenants, ok := ds.db.(models.TenantDatastore)
+	if !ok {
+		return ds
+	}
+	db, ok := tenants.ForTenant(tenant).(models.AuditedDatastore)
+	if !ok {
+		return ds
+	}
+	return &Datastore{db: db, failures: ds.failures}
+}
+
+// Instrument counts the changes that can't be recorded in a metric
+// registered in reg
+func (ds *Datastore) Instrument(reg *metrics.Registry) {
+	ds.failures = reg.NewCounter(
+		"pestcontrol_audit_record_failures_total",
+		"Number of changes that were made but could not be recorded in the audit log.",
+		"action",
+	)
+}
+
+// CheckConnection checks the decorated Datastore, which always succeeds if
+// it has no health checks
+func (ds *Datastore) CheckConnection(ctx context.Context) error {
+	if db, ok := ds.db.(models.HealthDatastore); ok {
+		return db.CheckConnection(ctx)
+	}
+	return nil
+}
+
+// PendingMigrations returns the pending migrations of the decorated
+// Datastore, which are none if it has no health checks
+func (ds *Datastore) PendingMigrations(ctx context.Context) ([]models.Migration, error) {
+	if db, ok := ds.db.(models.HealthDatastore); ok {
+		return db.PendingMigrations(ctx)
+	}
+	return []models.Migration{}, nil
+}
+
+// History returns a page of a user's audit entries, newest first
+func (ds *Datastore) History(
+	ctx context.Context,
+	userID int,
+	query *models.HistoryQuery,
+) ([]*models.AuditEntry, error) {
+	return ds.db.History(ctx, userID, query)
+}
+
+// change is the state of a user's global preferences, or of their
+// preferences for a conversation, before and after a write
+type change struct {
+	conversationID *int
+	before, after  *models.AuditState
+}
+
+func conversationChange(conversationID int, before, after *models.AuditState) change {
+	return change{conversationID: &conversationID, before: before, after: after}
+}
+
+// changed reports whether c left the preferences other than they were
+func (c change) changed() bool {
+	return len(models.ChangedFields(c.before, c.after)) > 0 || (c.before == nil) != (c.after == nil)
+}
+
+// changed reports whether any of changes left the preferences other than
+// they were
+func changed(changes []change) bool {
+	for _, c := range changes {
+		if c.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// versions returns the versions of the preferences before and after a
+// write, which are 0 when they didn't exist
+func versions(write *models.Change) (int64, int64) {
+	var before, after int64
+	if write.Before != nil {
+		before = write.Before.Version
+	}
+	if write.After != nil {
+		after = write.After.Version
+	}
+	return before, after
+}
+
+// record records the changes of a write to a user's preferences, skipping
+// those that left the preferences as they were, and returns their entries.
+// A write that only changed the version of the preferences is recorded with
+// its first change, so that the versions of the entries follow each other.
+func (ds *Datastore) record(
+	ctx context.Context,
+	action models.AuditAction,
+	userID int,
+	write *models.Change,
+	changes []change,
+) []*models.AuditEntry {
+	// Times are kept to the millisecond, as MongoDB stores them
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	prevVersion, version := versions(write)
+	recorded := []change{}
+	for _, c := range changes {
+		if c.changed() {
+			recorded = append(recorded, c)
+		}
+	}
+	if len(recorded) == 0 && prevVersion != version && len(changes) > 0 {
+		recorded = changes[:1]
+	}
+
+	entries := []*models.AuditEntry{}
+	for _, c := range recorded {
+		entries = append(entries, &models.AuditEntry{
+			ID:             primitive.NewObjectID().Hex(),
+			UserID:         userID,
+			ConversationID: c.conversationID,
+			Action:         action,
+			Actor:          Actor(ctx),
+			RequestID:      logging.RequestID(ctx),
+			Time:           now,
+			Fields:         models.ChangedFields(c.before, c.after),
+			Before:         c.before,
+			After:          c.after,
+			PrevVersion:    prevVersion,
+			Version:        version,
+		})
+	}
+	if len(entries) == 0 {
+		return entries
+	}
+
+	if err := ds.db.RecordChanges(ctx, entries); err != nil {
+		logging.FromContext(ctx).Error("failed to record audit entries", logging.Fields{
+			"user_id": userID,
+			"action":  action,
+			"error":   err,
+		})
+		if ds.failures != nil {
+			ds.failures.Inc(string(action))
+		}
+	}
+	return entries
+}
+
+// globalChanges returns the change of the global preferences made by c
+func globalChanges(c *models.Change) []change {
+	return []change{{before: newSnapshot(c.Before).global, after: newSnapshot(c.After).global}}
+}
+
+// conversationChanges returns the change of the preferences for a
+// conversation made by c
+func conversationChanges(c *models.Change, conversationID int) []change {
+	return []change{conversationChange(
+		conversationID,
+		newSnapshot(c.Before).convs[conversationID],
+		newSnapshot(c.After).convs[conversationID],
+	)}
+}
+
+// allChanges returns the changes of the global preferences and of each
+// conversation made by c
+func allChanges(c *models.Change) []change {
+	return newSnapshot(c.Before).changes(newSnapshot(c.After))
+}
+
+// tryRewrite rewrites a user's preferences with RewritePrefs and returns the
+// Change that it made. write is passed the current preferences and returns
+// them as the rewrite leaves them, and they are left as they are if that
+// changes nothing. It reports whether the rewrite can be retried because the
+// preferences were changed concurrently.
+func (ds *Datastore) tryRewrite(
+	ctx context.Context,
+	userID int,
+	write func(*models.Preferences) (*models.Preferences, error),
+) (*models.Change, bool, error) {
+	var (
+		rewritten *models.Change
+		writeErr  error
+	)
+	err := ds.db.RewritePrefs(ctx, userID, func(current *models.Preferences) (*models.Preferences, error) {
+		prefs, err := write(current)
+		if err != nil {
+			writeErr = err
+			return nil, err
+		}
+		rewritten = &models.Change{Before: current, After: current}
+		if !changed(allChanges(&models.Change{Before: current, After: prefs})) {
+			return current, nil
+		}
+
+		rewritten.After = nil
+		if prefs != nil {
+			after := *prefs
+			after.Version = 1
+			if current != nil {
+				after.Version = current.Version + 1
+			}
+			rewritten.After = &after
+		}
+		return prefs, nil
+	})
+	return rewritten, err == models.ErrVersionMismatch && writeErr == nil, err
+}
+
+// snapshot is the state of all of a user's preferences
+type snapshot struct {
+	global *models.AuditState
+	convs  map[int]*models.AuditState
+}
+
+// missing is the snapshot of preferences that don't exist
+func missing() *snapshot {
+	return &snapshot{convs: map[int]*models.AuditState{}}
+}
+
+// newSnapshot returns the state of preferences that are about to be written,
+// which is missing if prefs is nil
+func newSnapshot(prefs *models.Preferences) *snapshot {
+	s := missing()
+	if prefs == nil {
+		return s
+	}
+	s.global = models.GlobalState(prefs.Global)
+	for _, conv := range prefs.Conversation {
+		if conv != nil {
+			s.convs[conv.ConversationID] = models.ConversationState(conv)
+		}
+	}
+	return s
+}
+
+// changes returns the change of the global preferences from s to after, and
+// of each conversation of either by conversation ID
+func (s *snapshot) changes(after *snapshot) []change {
+	ids := []int{}
+	for id := range s.convs {
+		ids = append(ids, id)
+	}
+	for id := range after.convs {
+		if _, ok := s.convs[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	changes := []change{{before: s.global, after: after.global}}
+	for _, id := range ids {
+		changes = append(changes, conversationChange(id, s.convs[id], after.convs[id]))
+	}
+	return changes
+}
+
+// undo returns the state of s before the changes of entries, which are
+// undone newest first
+func (s *snapshot) undo(entries []*models.AuditEntry) *snapshot {
+	undone := missing()
+	undone.global = s.global
+	for id, state := range s.convs {
+		undone.convs[id] = state
+	}
+
+	for _, e := range entries {
+		switch {
+		case e.ConversationID == nil:
+			undone.global = e.Before
+		case e.Before == nil:
+			delete(undone.convs, *e.ConversationID)
+		default:
+			undone.convs[*e.ConversationID] = e.Before
+		}
+	}
+	return undone
+}
+
+// preferences returns the preferences of a user in the state of s, which are
+// nil if they are missing
+func (s *snapshot) preferences(userID int) *models.Preferences {
+	if s.global == nil && len(s.convs) == 0 {
+		return nil
+	}
+
+	ids := []int{}
+	for id := range s.convs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	prefs := &models.Preferences{
+		UserID:       userID,
+		Global:       s.global.GlobalPrefs(),
+		Conversation: []*models.ConversationPrefs{},
+	}
+	for _, id := range ids {
+		prefs.Conversation = append(prefs.Conversation, s.convs[id].ConversationPrefs(id))
+	}
+	return prefs
+}
+
+// history returns the audit entries of the changes made to a user's
+// preferences after a restore point and of the newest ones made before it,
+// in the same millisecond, newest first, and the time of the point. The history is paged in the order
+// of the IDs of its entries, which the entries recorded by different replicas
+// within the same second can be out of time order in. Paging only stops at
+// the entries recorded in a second before the newest one made before the
+// point, and the entries are ordered by time.
+func (ds *Datastore) history(
+	ctx context.Context,
+	userID int,
+	point *models.RestorePoint,
+) ([]*models.AuditEntry, time.Time, error) {
+	found, at := point.EntryID == "", point.Time
+	// last is the second of the newest entry recorded in a second before the
+	// point, which is read to the end
+	var last time.Time
+	read := []*models.AuditEntry{}
+	query := &models.HistoryQuery{Limit: historyPageSize}
+	for done := false; !done; {
+		entries, err := ds.db.History(ctx, userID, query)
+		if err != nil {
+			return nil, at, err
+		}
+		for _, e := range entries {
+			// The entries recorded with the entry of the point share its time,
+			// and are undone with it
+			if e.ID == point.EntryID {
+				found, at = true, e.Time.Add(-time.Nanosecond)
+			}
+			if found && last.IsZero() && recordedBefore(e, at) {
+				last = recordedAt(e)
+			}
+			if !last.IsZero() && recordedBefore(e, last) {
+				done = true
+				break
+			}
+			read = append(read, e)
+		}
+		if len(entries) < query.Limit {
+			done = true
+		} else if !done {
+			query.Before = entries[len(entries)-1].ID
+		}
+	}
+	if !found {
+		return nil, at, models.ErrAuditEntryDNE
+	}
+
+	sort.SliceStable(read, func(i, j int) bool {
+		return read[i].Time.After(read[j].Time)
+	})
+	// The writes recorded in the millisecond of the newest entry up to at
+	// can't be told apart by time, so all of them are kept
+	history := []*models.AuditEntry{}
+	var newestBefore time.Time
+	for _, e := range read {
+		if !newestBefore.IsZero() && e.Time.Before(newestBefore) {
+			break
+		}
+		history = append(history, e)
+		if newestBefore.IsZero() && !e.Time.After(at) {
+			newestBefore = e.Time
+		}
+	}
+	return history, at, nil
+}
+
+// recordedAt returns the second that an audit entry was recorded in, from the
+// time in its ID
+func recordedAt(e *models.AuditEntry) time.Time {
+	id, err := primitive.ObjectIDFromHex(e.ID)
+	if err != nil {
+		return time.Time{}
+	}
+	return id.Timestamp()
+}
+
+// recordedBefore reports whether an audit entry was recorded in a second
+// before t, from the time in its ID. The entries after it in the history are
+// as well.
+func recordedBefore(e *models.AuditEntry, t time.Time) bool {
+	recorded := recordedAt(e)
+	return !recorded.IsZero() && recorded.Before(t.Truncate(time.Second))
+}
+
+// errNotRecorded is returned by chain when the newest change to the
+// preferences hasn't been recorded, which it may still be
+var errNotRecorded = errors.New("the newest change to the preferences is not recorded")
+
+// chain orders the audit entries of the changes made to a user's
+// preferences, newest first, by their versions from the current preferences,
+// since concurrent writes can be recorded out of time order. The entries of
+// a write share its versions and time. It fails with
+// models.ErrHistoryIncomplete if a change between the versions wasn't
+// recorded, or with errNotRecorded if that is the newest one. The entries
+// are left in time order if some were recorded before versions were.
+func chain(current *models.Preferences, entries []*models.AuditEntry) ([]*models.AuditEntry, error) {
+	writes := [][]*models.AuditEntry{}
+	for i, e := range entries {
+		if e.PrevVersion == 0 && e.Version == 0 {
+			return entries, nil
+		}
+		if i > 0 && sameWrite(entries[i-1], e) {
+			writes[len(writes)-1] = append(writes[len(writes)-1], e)
+			continue
+		}
+		writes = append(writes, []*models.AuditEntry{e})
+	}
+
+	var version int64
+	if current != nil {
+		version = current.Version
+	}
+	ordered := []*models.AuditEntry{}
+	for len(writes) > 0 {
+		// The newest write that left the version is the one it follows, as
+		// versions are used again once preferences are deleted
+		i := 0
+		for i < len(writes) && writes[i][0].Version != version {
+			i++
+		}
+		switch {
+		case i == len(writes) && len(ordered) == 0:
+			return nil, errNotRecorded
+		case i == len(writes):
+			return nil, models.ErrHistoryIncomplete
+		}
+		ordered = append(ordered, writes[i]...)
+		version = writes[i][0].PrevVersion
+		writes = append(writes[:i], writes[i+1:]...)
+	}
+	return ordered, nil
+}
+
+// sameWrite reports whether two audit entries were recorded by the same write
+func sameWrite(a, b *models.AuditEntry) bool {
+	return a.Time.Equal(b.Time) && a.PrevVersion == b.PrevVersion && a.Version == b.Version
+}
+
+// changesSince returns the audit entries of the changes made after a restore
+// point, keeping their order, and only those of its conversation if it has
+// one. The changes after the point of an entry are those up to its write,
+// since the times of entries don't tell apart the writes made within a
+// millisecond, and those after the point of a time are those made after at.
+func changesSince(entries []*models.AuditEntry, point *models.RestorePoint, at time.Time) []*models.AuditEntry {
+	since := []*models.AuditEntry{}
+	var pointWrite *models.AuditEntry
+	for _, e := range entries {
+		if pointWrite != nil && !sameWrite(pointWrite, e) {
+			break
+		}
+		if e.ID == point.EntryID {
+			pointWrite = e
+		}
+		if point.EntryID == "" && !e.Time.After(at) {
+			continue
+		}
+		if point.ConversationID == nil ||
+			(e.ConversationID != nil && *e.ConversationID == *point.ConversationID) {
+			since = append(since, e)
+		}
+	}
+	return since
+}
+
+// RestorePrefs rolls a user's preferences back to their state at a restore
+// point by undoing the changes recorded since, in a single write, and records
+// the restore as a change. Preferences without changes since the point are
+// left as they are. The history is read again when the preferences are
+// changed concurrently, so that the change is undone as well, and the restore
+// fails with models.ErrRestoreConflict if they keep being changed. It fails
+// with models.ErrHistoryIncomplete if the versions of the changes made since
+// the point show a change that wasn't recorded, which it couldn't undo.
+func (ds *Datastore) RestorePrefs(
+	ctx context.Context,
+	userID int,
+	point *models.RestorePoint,
+) ([]*models.AuditEntry, error) {
+	for attempt := 0; ; attempt++ {
+		history, at, err := ds.history(ctx, userID, point)
+		if err != nil {
+			return nil, err
+		}
+		change, retry, err := ds.tryRewrite(ctx, userID, func(current *models.Preferences) (*models.Preferences, error) {
+			ordered, err := chain(current, history)
+			if err != nil {
+				return nil, err
+			}
+			since := changesSince(ordered, point, at)
+			return newSnapshot(current).undo(since).preferences(userID), nil
+		})
+		// A change may be made but not yet recorded, so the history is read
+		// again before it is taken to be missing
+		if retry || err == errNotRecorded {
+			if attempt+1 < maxRestoreAttempts {
+				continue
+			}
+			if retry {
+				return nil, models.ErrRestoreConflict
+			}
+			return nil, models.ErrHistoryIncomplete
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ds.record(ctx, models.ActionRestore, userID, change, allChanges(change)), nil
+	}
+}
+
+func (ds *Datastore) GetPrefs(ctx context.Context, userID int) (*models.GlobalPrefs, error) {
+	return ds.db.GetPrefs(ctx, userID)
+}
+
+func (ds *Datastore) GetPrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+) (*models.ConversationPrefs, error) {
+	return ds.db.GetPrefsConv(ctx, userID, conversationID)
+}
+
+func (ds *Datastore) CreatePrefs(ctx context.Context, prefs *models.Preferences) error {
+	if err := ds.db.CreatePrefs(ctx, prefs); err != nil {
+		return err
+	}
+	change := &models.Change{After: prefs}
+	ds.record(ctx, models.ActionCreate, prefs.UserID, change, allChanges(change))
+	return nil
+}
+
+func (ds *Datastore) CreatePrefsConv(
+	ctx context.Context,
+	userID int,
+	convPrefs *models.ConversationPrefs,
+) error {
+	change, err := ds.db.CreatePrefsConvChange(ctx, userID, convPrefs)
+	if err != nil {
+		return err
+	}
+	ds.record(ctx, models.ActionCreate, userID, change, conversationChanges(change, convPrefs.ConversationID))
+	return nil
+}
+
+func (ds *Datastore) ReplacePrefs(ctx context.Context, prefs *models.Preferences) (bool, error) {
+	change, err := ds.db.ReplacePrefsChange(ctx, prefs)
+	if err != nil {
+		return false, err
+	}
+	action, created := models.ActionReplace, change.Before == nil
+	if created {
+		action = models.ActionCreate
+		prefs.ID = change.After.ID
+	}
+	ds.record(ctx, action, prefs.UserID, change, allChanges(change))
+	return created, nil
+}
+
+func (ds *Datastore) ReplacePrefsConv(
+	ctx context.Context,
+	userID int,
+	convPrefs *models.ConversationPrefs,
+) (bool, error) {
+	change, err := ds.db.ReplacePrefsConvChange(ctx, userID, convPrefs)
+	if err != nil {
+		return false, err
+	}
+	action, created := models.ActionReplace, change.CreatedConv(convPrefs.ConversationID)
+	if created {
+		action = models.ActionCreate
+	}
+	ds.record(ctx, action, userID, change, conversationChanges(change, convPrefs.ConversationID))
+	return created, nil
+}
+
+func (ds *Datastore) DeletePrefs(ctx context.Context, userID int, version int64) error {
+	change, err := ds.db.DeletePrefsChange(ctx, userID, version)
+	if err != nil {
+		return err
+	}
+	ds.record(ctx, models.ActionDelete, userID, change, allChanges(change))
+	return nil
+}
+
+func (ds *Datastore) DeletePrefsConv(ctx context.Context, userID, conversationID int, version int64) error {
+	change, err := ds.db.DeletePrefsConvChange(ctx, userID, conversationID, version)
+	if err != nil {
+		return err
+	}
+	ds.record(ctx, models.ActionDelete, userID, change, conversationChanges(change, conversationID))
+	return nil
+}
+
+func (ds *Datastore) PatchPrefs(
+	ctx context.Context,
+	userID int,
+	prefs *models.GlobalPrefs,
+	version int64,
+) (*models.GlobalPrefs, error) {
+	change, err := ds.db.PatchPrefsChange(ctx, userID, prefs, version)
+	if err != nil {
+		return nil, err
+	}
+	ds.record(ctx, models.ActionPatch, userID, change, globalChanges(change))
+	return change.GlobalPrefs(), nil
+}
+
+func (ds *Datastore) PatchPrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	prefs *models.ConversationPrefs,
+	version int64,
+) (*models.ConversationPrefs, error) {
+	change, err := ds.db.PatchPrefsConvChange(ctx, userID, conversationID, prefs, version)
+	if err != nil {
+		return nil, err
+	}
+	ds.record(ctx, models.ActionPatch, userID, change, conversationChanges(change, conversationID))
+	return change.ConversationPrefs(conversationID)
+}
+
+func (ds *Datastore) GetRecipients(
+	ctx context.Context,
+	conversationID int,
+	event models.Event,
+	userIDs []int,
+) (models.Recipients, error) {
+	return ds.db.GetRecipients(ctx, conversationID, event, userIDs)
+}
+
+func (ds *Datastore) ListPrefsConv(
+	ctx context.Context,
+	userID int,
+	query *models.ListConvQuery,
+) ([]*models.ConversationPrefs, error) {
+	return ds.db.ListPrefsConv(ctx, userID, query)
+}
+
+func (ds *Datastore) MutePrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	until *time.Time,
+) error {
+	change, err := ds.db.MutePrefsConvChange(ctx, userID, conversationID, until)
+	if err != nil {
+		return err
+	}
+	ds.record(ctx, models.ActionMute, userID, change, conversationChanges(change, conversationID))
+	return nil
+}
+
+func (ds *Datastore) GetDueDigests(ctx context.Context, t time.Time) ([]models.DueDigest, error) {
+	return ds.db.GetDueDigests(ctx, t)
+}
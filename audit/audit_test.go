@@ -0,0 +1,72 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"pest-control/audit"
+	"pest-control/auth"
+	"pest-control/metrics"
+	"pest-control/models"
+	"pest-control/models/storetest"
+)
+
+func TestDatastore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) models.Datastore {
+		return audit.NewDatastore(models.NewMemDB())
+	})
+}
+
+func TestDatastoreTenants(t *testing.T) {
+	storetest.RunTenants(t, func(t *testing.T) models.TenantDatastore {
+		return audit.NewDatastore(models.NewMemDB())
+	})
+}
+
+func TestHistory(t *testing.T) {
+	storetest.RunHistory(t, func(t *testing.T) models.AuditedDatastore {
+		return models.NewMemDB()
+	})
+}
+
+// failingLog is a MemDB that fails to record audit entries
+type failingLog struct {
+	*models.MemDB
+}
+
+func (failingLog) RecordChanges(context.Context, []*models.AuditEntry) error {
+	return errors.New("audit log unavailable")
+}
+
+func TestRecordFailures(t *testing.T) {
+	reg := metrics.NewRegistry()
+	db := audit.NewDatastore(failingLog{models.NewMemDB()})
+	db.Instrument(reg)
+
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	if err := db.CreatePrefs(context.Background(), prefs); err != nil {
+		t.Fatalf("CreatePrefs failed with the audit log, got %s", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := reg.Write(b); err != nil {
+		t.Fatalf("Write returned unexpected error: %s", err)
+	}
+	expected := `pestcontrol_audit_record_failures_total{action="create"} 1`
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("Failure was not counted, expected %q in:\n%s", expected, b.String())
+	}
+}
+
+func TestActor(t *testing.T) {
+	if actor := audit.Actor(context.Background()); actor != audit.SystemActor {
+		t.Errorf("Incorrect actor without a user, expected %s, got %s", audit.SystemActor, actor)
+	}
+	if actor := audit.Actor(auth.WithUserID(context.Background(), 42)); actor != "user:42" {
+		t.Errorf("Incorrect actor of a user, expected user:42, got %s", actor)
+	}
+}
@@ -0,0 +1,77 @@
+// Package auth identifies the user that a request is made on behalf of
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMissingToken  = errors.New("missing bearer token")
+	ErrMissingUserID = errors.New("missing user ID")
+	ErrInvalidUserID = errors.New("invalid user ID")
+)
+
+// Authenticator returns the ID of the user that made a request
+type Authenticator interface {
+	Authenticate(r *http.Request) (int, error)
+}
+
+// JWT authenticates requests with a bearer token in the Authorization header
+type JWT struct {
+	Verifier *Verifier
+}
+
+func (j *JWT) Authenticate(r *http.Request) (int, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return 0, err
+	}
+	return j.Verifier.Verify(token)
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", ErrMissingToken
+	}
+	return strings.TrimSpace(header[7:]), nil
+}
+
+// Header trusts the User-ID header set by an upstream gateway. It must only be
+// used when the service can't be reached without going through the gateway.
+type Header struct{}
+
+func (Header) Authenticate(r *http.Request) (int, error) {
+	val := r.Header.Get("User-ID")
+	if val == "" {
+		return 0, ErrMissingUserID
+	}
+	userID, err := strconv.Atoi(val)
+	if err != nil || userID <= 0 {
+		return 0, ErrInvalidUserID
+	}
+	return userID, nil
+}
+
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	tenantKey
+)
+
+// WithUserID returns a copy of ctx that carries an authenticated user ID
+func WithUserID(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// UserID returns the authenticated user ID carried by ctx. ok is false if
+// there is none.
+func UserID(ctx context.Context) (userID int, ok bool) {
+	userID, ok = ctx.Value(userIDKey).(int)
+	return userID, ok && userID > 0
+}
@@ -0,0 +1,362 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pest-control/auth"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2020, time.March, 2, 12, 0, 0, 0, time.UTC)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHMAC(t *testing.T, key []byte, alg string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT"}) +
+		"." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRSA(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "typ": "JWT"}) +
+		"." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestHMACVerifier(t *testing.T) {
+	key := []byte("secret")
+	valid := now.Add(time.Hour).Unix()
+
+	tests := []struct {
+		Name   string
+		Token  string
+		UserID int
+		Err    error
+	}{
+		{
+			Name:   "Successful verification",
+			Token:  signHMAC(t, key, "HS256", map[string]interface{}{"user_id": 1, "exp": valid}),
+			UserID: 1,
+		},
+		{
+			Name:   "Successful verification with string user ID",
+			Token:  signHMAC(t, key, "HS256", map[string]interface{}{"user_id": "2"}),
+			UserID: 2,
+		},
+		{
+			Name:  "Unsuccessful verification with wrong key",
+			Token: signHMAC(t, []byte("wrong"), "HS256", map[string]interface{}{"user_id": 1}),
+			Err:   auth.ErrInvalidSignature,
+		},
+		{
+			Name:  "Unsuccessful verification with mismatched algorithm",
+			Token: signHMAC(t, key, "HS512", map[string]interface{}{"user_id": 1}),
+			Err:   auth.ErrInvalidSignature,
+		},
+		{
+			Name:  "Unsuccessful verification with none algorithm",
+			Token: encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, map[string]interface{}{"user_id": 1}) + ".",
+			Err:   auth.ErrUnsupportedAlg,
+		},
+		{
+			Name:  "Unsuccessful verification with RSA algorithm",
+			Token: signHMAC(t, key, "RS256", map[string]interface{}{"user_id": 1}),
+			Err:   auth.ErrUnsupportedAlg,
+		},
+		{
+			Name:  "Unsuccessful verification with expired token",
+			Token: signHMAC(t, key, "HS256", map[string]interface{}{"user_id": 1, "exp": now.Unix()}),
+			Err:   auth.ErrTokenExpired,
+		},
+		{
+			Name:  "Unsuccessful verification with token that is not valid yet",
+			Token: signHMAC(t, key, "HS256", map[string]interface{}{"user_id": 1, "nbf": valid}),
+			Err:   auth.ErrTokenNotValidYet,
+		},
+		{
+			Name:  "Unsuccessful verification without user ID",
+			Token: signHMAC(t, key, "HS256", map[string]interface{}{"sub": "1"}),
+			Err:   auth.ErrMissingUserID,
+		},
+		{
+			Name:  "Unsuccessful verification with zero user ID",
+			Token: signHMAC(t, key, "HS256", map[string]interface{}{"user_id": 0}),
+			Err:   auth.ErrInvalidUserID,
+		},
+		{
+			Name:  "Unsuccessful verification with malformed token",
+			Token: "not.a-token",
+			Err:   auth.ErrMalformedToken,
+		},
+	}
+
+	verifier := auth.NewHMACVerifier(key)
+	verifier.Now = func() time.Time { return now }
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			userID, err := verifier.Verify(test.Token)
+			if err != test.Err {
+				t.Fatalf("Incorrect error, expected %v, got %v", test.Err, err)
+			}
+			if userID != test.UserID {
+				t.Errorf("Incorrect user ID, expected %d, got %d", test.UserID, userID)
+			}
+		})
+	}
+}
+
+func TestRSAVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := auth.LoadRSAVerifier(path)
+	if err != nil {
+		t.Fatalf("Unable to load RSA key: %v", err)
+	}
+
+	token := signRSA(t, key, map[string]interface{}{"user_id": 3})
+	if userID, err := verifier.Verify(token); err != nil || userID != 3 {
+		t.Errorf("Incorrect verification, expected user 3, got %d (%v)", userID, err)
+	}
+
+	// A token signed with the public key as an HMAC secret must be rejected
+	token = signHMAC(t, pemBytes, "HS256", map[string]interface{}{"user_id": 3})
+	if _, err := verifier.Verify(token); err != auth.ErrUnsupportedAlg {
+		t.Errorf("Incorrect error, expected %v, got %v", auth.ErrUnsupportedAlg, err)
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	key := []byte("secret")
+	jwt := &auth.JWT{Verifier: auth.NewHMACVerifier(key)}
+	token := signHMAC(t, key, "HS256", map[string]interface{}{"user_id": 1})
+
+	tests := []struct {
+		Name          string
+		Authenticator auth.Authenticator
+		Header        string
+		Value         string
+		UserID        int
+		Err           error
+	}{
+		{
+			Name:          "Successful JWT authentication",
+			Authenticator: jwt,
+			Header:        "Authorization",
+			Value:         "Bearer " + token,
+			UserID:        1,
+		},
+		{
+			Name:          "Unsuccessful JWT authentication without token",
+			Authenticator: jwt,
+			Header:        "User-ID",
+			Value:         "1",
+			Err:           auth.ErrMissingToken,
+		},
+		{
+			Name:          "Successful header authentication",
+			Authenticator: auth.Header{},
+			Header:        "User-ID",
+			Value:         "2",
+			UserID:        2,
+		},
+		{
+			Name:          "Unsuccessful header authentication without header",
+			Authenticator: auth.Header{},
+			Err:           auth.ErrMissingUserID,
+		},
+		{
+			Name:          "Unsuccessful header authentication with zero user ID",
+			Authenticator: auth.Header{},
+			Header:        "User-ID",
+			Value:         "0",
+			Err:           auth.ErrInvalidUserID,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("", "/pest-control/v1/prefs", nil)
+			if test.Header != "" {
+				r.Header.Set(test.Header, test.Value)
+			}
+
+			userID, err := test.Authenticator.Authenticate(r)
+			if err != test.Err {
+				t.Fatalf("Incorrect error, expected %v, got %v", test.Err, err)
+			}
+			if userID != test.UserID {
+				t.Errorf("Incorrect user ID, expected %d, got %d", test.UserID, userID)
+			}
+		})
+	}
+}
+
+func TestTenantResolvers(t *testing.T) {
+	key := []byte("secret")
+	claim := &auth.TenantClaim{Verifier: auth.NewHMACVerifier(key)}
+	sign := func(claims map[string]interface{}) string {
+		return "Bearer " + signHMAC(t, key, "HS256", claims)
+	}
+
+	tests := []struct {
+		Name     string
+		Resolver auth.TenantResolver
+		Header   string
+		Value    string
+		Tenant   string
+		Err      error
+	}{
+		{
+			Name:     "Successful claim resolution",
+			Resolver: claim,
+			Header:   "Authorization",
+			Value:    sign(map[string]interface{}{"user_id": 1, "tenant_id": "acme"}),
+			Tenant:   "acme",
+		},
+		{
+			Name:     "Successful claim resolution with a numeric tenant ID",
+			Resolver: claim,
+			Header:   "Authorization",
+			Value:    sign(map[string]interface{}{"user_id": 1, "tenant_id": 42}),
+			Tenant:   "42",
+		},
+		{
+			Name:     "Unsuccessful claim resolution without claim",
+			Resolver: claim,
+			Header:   "Authorization",
+			Value:    sign(map[string]interface{}{"user_id": 1}),
+			Err:      auth.ErrMissingTenant,
+		},
+		{
+			Name:     "Unsuccessful claim resolution with an invalid signature",
+			Resolver: claim,
+			Header:   "Authorization",
+			Value:    "Bearer " + signHMAC(t, []byte("other"), "HS256", map[string]interface{}{"tenant_id": "acme"}),
+			Err:      auth.ErrInvalidSignature,
+		},
+		{
+			Name:     "Successful header resolution",
+			Resolver: auth.TenantHeader{},
+			Header:   "Tenant-ID",
+			Value:    "staging",
+			Tenant:   "staging",
+		},
+		{
+			Name:     "Successful header resolution with a custom header",
+			Resolver: auth.TenantHeader{Name: "X-Tenant"},
+			Header:   "X-Tenant",
+			Value:    "customer_1",
+			Tenant:   "customer_1",
+		},
+		{
+			Name:     "Unsuccessful header resolution without header",
+			Resolver: auth.TenantHeader{},
+			Err:      auth.ErrMissingTenant,
+		},
+		{
+			Name:     "Unsuccessful header resolution with a database name",
+			Resolver: auth.TenantHeader{},
+			Header:   "Tenant-ID",
+			Value:    "../admin",
+			Err:      auth.ErrInvalidTenant,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("", "/pest-control/v1/prefs", nil)
+			if test.Header != "" {
+				r.Header.Set(test.Header, test.Value)
+			}
+
+			tenant, err := test.Resolver.Tenant(r)
+			if err != test.Err {
+				t.Fatalf("Incorrect error, expected %v, got %v", test.Err, err)
+			}
+			if tenant != test.Tenant {
+				t.Errorf("Incorrect tenant, expected %q, got %q", test.Tenant, tenant)
+			}
+		})
+	}
+}
+
+func TestServiceToken(t *testing.T) {
+	service := auth.NewServiceToken([]byte("secret"))
+
+	tests := []struct {
+		Name          string
+		Authorization string
+		Err           error
+	}{
+		{
+			Name:          "Successful service authentication",
+			Authorization: "Bearer secret",
+		},
+		{
+			Name:          "Unsuccessful service authentication with another token",
+			Authorization: "Bearer secrets",
+			Err:           auth.ErrInvalidServiceToken,
+		},
+		{
+			Name: "Unsuccessful service authentication without token",
+			Err:  auth.ErrMissingToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("", "/pest-control/v1/internal/digests", nil)
+			if test.Authorization != "" {
+				r.Header.Set("Authorization", test.Authorization)
+			}
+			if err := service.Verify(r); err != test.Err {
+				t.Errorf("Incorrect error, expected %v, got %v", test.Err, err)
+			}
+		})
+	}
+}
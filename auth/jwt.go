@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	// Register the hash functions used by the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// DefaultUserClaim is the claim that heimdall stores the user ID in
+const DefaultUserClaim = "user_id"
+
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrTokenExpired     = errors.New("token is expired")
+	ErrTokenNotValidYet = errors.New("token is not valid yet")
+)
+
+var hashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// Verifier verifies JWTs signed with either an HMAC secret or an RSA key.
+// Only the algorithms of the configured key are accepted, so a token can't
+// pick a weaker algorithm than the one it was issued with.
+type Verifier struct {
+	hmacKey   []byte
+	rsaKey    *rsa.PublicKey
+	UserClaim string
+	// Now returns the current time, it can be replaced in tests
+	Now func() time.Time
+}
+
+func NewHMACVerifier(key []byte) *Verifier {
+	return &Verifier{hmacKey: key, UserClaim: DefaultUserClaim, Now: time.Now}
+}
+
+func NewRSAVerifier(key *rsa.PublicKey) *Verifier {
+	return &Verifier{rsaKey: key, UserClaim: DefaultUserClaim, Now: time.Now}
+}
+
+// LoadHMACVerifier creates a Verifier from a file holding the HMAC secret.
+// Surrounding whitespace in the file is ignored.
+func LoadHMACVerifier(path string) (*Verifier, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("HMAC key file %s is empty", path)
+	}
+	return NewHMACVerifier(key), nil
+}
+
+// LoadRSAVerifier creates a Verifier from a PEM file holding an RSA public key
+// or a certificate
+func LoadRSAVerifier(path string) (*Verifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not an RSA public key", path)
+	}
+	return NewRSAVerifier(rsaKey), nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+func (v *Verifier) verifySignature(alg, signed string, sig []byte) error {
+	hash, ok := hashes[alg]
+	if !ok {
+		return ErrUnsupportedAlg
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && v.hmacKey != nil:
+		mac := hmac.New(hash.New, v.hmacKey)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrInvalidSignature
+		}
+	case strings.HasPrefix(alg, "RS") && v.rsaKey != nil:
+		h := hash.New()
+		h.Write([]byte(signed))
+		if rsa.VerifyPKCS1v15(v.rsaKey, hash, h.Sum(nil), sig) != nil {
+			return ErrInvalidSignature
+		}
+	default:
+		return ErrUnsupportedAlg
+	}
+	return nil
+}
+
+// numericClaim returns the value of a claim that is a number or a string
+// holding a number
+func numericClaim(claims map[string]interface{}, name string) (int64, bool, error) {
+	val, ok := claims[name]
+	if !ok {
+		return 0, false, nil
+	}
+
+	var str string
+	switch v := val.(type) {
+	case json.Number:
+		str = v.String()
+	case string:
+		str = v
+	default:
+		return 0, true, fmt.Errorf("claim %s is not a number", name)
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		// Time claims may have a fractional part
+		f, ferr := strconv.ParseFloat(str, 64)
+		if ferr != nil {
+			return 0, true, fmt.Errorf("claim %s is not a number", name)
+		}
+		n = int64(f)
+	}
+	return n, true, nil
+}
+
+// Verify checks the signature and the exp and nbf claims of a token and
+// returns the user ID in its user claim
+func (v *Verifier) Verify(token string) (int, error) {
+	claims, err := v.Claims(token)
+	if err != nil {
+		return 0, err
+	}
+
+	userID, ok, err := numericClaim(claims, v.UserClaim)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, ErrMissingUserID
+	}
+	if userID <= 0 || int64(int(userID)) != userID {
+		return 0, ErrInvalidUserID
+	}
+	return int(userID), nil
+}
+
+// Claims checks the signature and the exp and nbf claims of a token and
+// returns its claims. Numbers are decoded as json.Number.
+func (v *Verifier) Claims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := v.verifySignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := v.Now().Unix()
+	if exp, ok, err := numericClaim(claims, "exp"); err != nil {
+		return nil, err
+	} else if ok && now >= exp {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok, err := numericClaim(claims, "nbf"); err != nil {
+		return nil, err
+	} else if ok && now < nbf {
+		return nil, ErrTokenNotValidYet
+	}
+	return claims, nil
+}
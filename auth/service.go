@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+var ErrInvalidServiceToken = errors.New("invalid service token")
+
+// ServiceToken authenticates the internal requests of other services, which
+// send a token that they share with the service as their bearer token
+type ServiceToken struct {
+	token []byte
+}
+
+func NewServiceToken(token []byte) *ServiceToken {
+	return &ServiceToken{token: token}
+}
+
+// LoadServiceToken creates a ServiceToken from a file holding the token.
+// Surrounding whitespace in the file is ignored.
+func LoadServiceToken(path string) (*ServiceToken, error) {
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("service token file %s is empty", path)
+	}
+	return NewServiceToken(token), nil
+}
+
+// Verify checks that r carries the service token, in constant time so that
+// the token can't be guessed byte by byte
+func (s *ServiceToken) Verify(r *http.Request) error {
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+		return ErrInvalidServiceToken
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const (
+	// DefaultTenantHeader is the header that TenantHeader reads by default
+	DefaultTenantHeader = "Tenant-ID"
+	// DefaultTenantClaim is the claim that TenantClaim reads by default
+	DefaultTenantClaim = "tenant_id"
+)
+
+var (
+	ErrMissingTenant = errors.New("missing tenant ID")
+	ErrInvalidTenant = errors.New("invalid tenant ID")
+)
+
+// tenantPattern restricts tenant IDs to what can safely be part of a MongoDB
+// database name
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func validTenant(tenant string) (string, error) {
+	if tenant == "" {
+		return "", ErrMissingTenant
+	}
+	if !tenantPattern.MatchString(tenant) {
+		return "", ErrInvalidTenant
+	}
+	return tenant, nil
+}
+
+// TenantResolver returns the ID of the tenant that a request is made for
+type TenantResolver interface {
+	Tenant(r *http.Request) (string, error)
+}
+
+// TenantHeader reads the tenant ID from a header set by an upstream gateway
+type TenantHeader struct {
+	// Name is the name of the header, DefaultTenantHeader if empty
+	Name string
+}
+
+func (h TenantHeader) Tenant(r *http.Request) (string, error) {
+	name := h.Name
+	if name == "" {
+		name = DefaultTenantHeader
+	}
+	return validTenant(r.Header.Get(name))
+}
+
+// TenantClaim reads the tenant ID from a claim of the bearer token, which is
+// verified by Verifier
+type TenantClaim struct {
+	Verifier *Verifier
+	// Claim is the name of the claim, DefaultTenantClaim if empty
+	Claim string
+}
+
+func (c *TenantClaim) Tenant(r *http.Request) (string, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return "", err
+	}
+	claims, err := c.Verifier.Claims(token)
+	if err != nil {
+		return "", err
+	}
+
+	name := c.Claim
+	if name == "" {
+		name = DefaultTenantClaim
+	}
+	val, ok := claims[name]
+	if !ok {
+		return "", ErrMissingTenant
+	}
+	// Tenant IDs may also be issued as numbers
+	tenant, ok := val.(string)
+	if !ok {
+		tenant = fmt.Sprint(val)
+	}
+	return validTenant(tenant)
+}
+
+// WithTenant returns a copy of ctx that carries a tenant ID
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// Tenant returns the tenant ID carried by ctx. ok is false if there is none.
+func Tenant(ctx context.Context) (tenant string, ok bool) {
+	tenant, ok = ctx.Value(tenantKey).(string)
+	return tenant, ok && tenant != ""
+}
@@ -0,0 +1,539 @@
+// Package config loads the configuration of the server from an optional JSON
+// or YAML file, the environment and flags, in increasing order of precedence
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"pest-control/auth"
+	"pest-control/logging"
+	"pest-control/models"
+	"pest-control/tracing"
+)
+
+// FileEnv is the environment variable naming the configuration file when the
+// -config flag is not given
+const FileEnv = "PESTCONTROL_CONFIG"
+
+const redacted = "REDACTED"
+
+// Server configures the HTTP server
+type Server struct {
+	ListenAddr   string   `json:"listen_addr"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	// RequestTimeout is the deadline of the datastore operations of a
+	// request, it must be shorter than WriteTimeout
+	RequestTimeout Duration `json:"request_timeout"`
+	// ShutdownDelay is how long the readiness probe fails before the server
+	// stops accepting connections, so that load balancers stop sending it
+	// requests first
+	ShutdownDelay Duration `json:"shutdown_delay"`
+	// ShutdownTimeout is the grace period of in-flight requests on shutdown
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// TLSCertFile and TLSKeyFile serve HTTPS when both are set
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+}
+
+// Mongo configures the connection to MongoDB. URI is used as is when it is
+// set, otherwise it is built from Host, Port, User and Password.
+type Mongo struct {
+	URI      string `json:"uri"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// CAFile is the PEM file of the CA that signed the certificate of
+	// DocumentDB, which is then connected to with TLS
+	CAFile               string   `json:"ca_file"`
+	Database             string   `json:"database"`
+	Collection           string   `json:"collection"`
+	MigrationsCollection string   `json:"migrations_collection"`
+	AuditCollection      string   `json:"audit_collection"`
+	Timeout              Duration `json:"timeout"`
+}
+
+// Auth configures how requests are authenticated
+type Auth struct {
+	Mode        string `json:"mode"`
+	HMACKeyFile string `json:"jwt_hmac_key_file"`
+	RSAKeyFile  string `json:"jwt_rsa_key_file"`
+	UserClaim   string `json:"jwt_user_claim"`
+	// ServiceTokenFile holds the token that other services authenticate the
+	// internal API with, which it must be set to serve
+	ServiceTokenFile string `json:"service_token_file"`
+}
+
+// Tenancy configures how preferences are partitioned by tenant
+type Tenancy struct {
+	Mode string `json:"mode"`
+	// Source is header or claim, and defaults to the claim of the token in
+	// the jwt auth mode so that clients can't pick their tenant with a header
+	Source string `json:"source"`
+	Header string `json:"header"`
+	Claim  string `json:"claim"`
+}
+
+// Tracing configures where the spans of requests are exported
+type Tracing struct {
+	// Exporter is none, stdout or otlp
+	Exporter string `json:"exporter"`
+	// OTLPEndpoint is the traces endpoint of OTLP over HTTP of the collector
+	OTLPEndpoint string `json:"otlp_endpoint"`
+	// SampleRatio is the ratio of the traces started by the service that are
+	// sampled, traces continued from a caller are sampled if it sampled them
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Log configures the logs of the server
+type Log struct {
+	// Level is the least level of the records that are written, debug, info,
+	// warn or error. Preferences are only logged at debug.
+	Level string `json:"level"`
+}
+
+// Features toggles optional behaviour
+type Features struct {
+	// Bootstrap bootstraps MongoDB on startup. The indexes are created
+	// without it too.
+	Bootstrap bool `json:"bootstrap"`
+	// Validator installs the $jsonSchema validator when bootstrapping
+	Validator bool `json:"validator"`
+	// InternalAPI serves the internal API of other services, which needs a
+	// service token. It has to be turned off explicitly so that a missing
+	// token doesn't go unnoticed.
+	InternalAPI bool `json:"internal_api"`
+}
+
+type Config struct {
+	Datastore string   `json:"datastore"`
+	Server    Server   `json:"server"`
+	Mongo     Mongo    `json:"mongodb"`
+	Auth      Auth     `json:"auth"`
+	Tenancy   Tenancy  `json:"tenancy"`
+	Tracing   Tracing  `json:"tracing"`
+	Log       Log      `json:"log"`
+	Features  Features `json:"features"`
+}
+
+// Default returns the configuration that is used for anything that isn't set
+func Default() *Config {
+	db := models.DefaultDBConfig()
+	return &Config{
+		Datastore: "mongo",
+		Server: Server{
+			ListenAddr:      ":80",
+			ReadTimeout:     Duration(5 * time.Second),
+			WriteTimeout:    Duration(5 * time.Second),
+			IdleTimeout:     Duration(120 * time.Second),
+			RequestTimeout:  Duration(4 * time.Second),
+			ShutdownDelay:   Duration(5 * time.Second),
+			ShutdownTimeout: Duration(15 * time.Second),
+		},
+		Mongo: Mongo{
+			Port:                 "27017",
+			Database:             db.Database,
+			Collection:           db.Collection,
+			MigrationsCollection: db.MigrationsCollection,
+			AuditCollection:      db.AuditCollection,
+		},
+		Auth: Auth{
+			Mode:      "jwt",
+			UserClaim: auth.DefaultUserClaim,
+		},
+		Tenancy: Tenancy{
+			Mode:   "none",
+			Header: auth.DefaultTenantHeader,
+			Claim:  auth.DefaultTenantClaim,
+		},
+		Tracing: Tracing{
+			Exporter:     "none",
+			OTLPEndpoint: tracing.DefaultOTLPEndpoint,
+			SampleRatio:  1,
+		},
+		Log:      Log{Level: "info"},
+		Features: Features{Bootstrap: true, InternalAPI: true},
+	}
+}
+
+// setting is a value of Config that can be set by an environment variable
+// and a flag
+type setting struct {
+	Env   string
+	Flag  string
+	Usage string
+	Value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"PESTCONTROL_DATASTORE", "datastore", "datastore, mongo or memory", (*stringValue)(&c.Datastore)},
+		{"PESTCONTROL_LISTEN_ADDR", "listen-addr", "address that the server listens on", (*stringValue)(&c.Server.ListenAddr)},
+		{"PESTCONTROL_READ_TIMEOUT", "read-timeout", "timeout of reading requests", (*Duration)(&c.Server.ReadTimeout)},
+		{"PESTCONTROL_WRITE_TIMEOUT", "write-timeout", "timeout of writing responses", (*Duration)(&c.Server.WriteTimeout)},
+		{"PESTCONTROL_IDLE_TIMEOUT", "idle-timeout", "timeout of idle connections", (*Duration)(&c.Server.IdleTimeout)},
+		{"PESTCONTROL_REQUEST_TIMEOUT", "request-timeout", "deadline of the datastore operations of a request", (*Duration)(&c.Server.RequestTimeout)},
+		{"PESTCONTROL_SHUTDOWN_DELAY", "shutdown-delay", "how long the readiness probe fails before shutting down", (*Duration)(&c.Server.ShutdownDelay)},
+		{"PESTCONTROL_SHUTDOWN_TIMEOUT", "shutdown-timeout", "grace period of in-flight requests on shutdown", (*Duration)(&c.Server.ShutdownTimeout)},
+		{"PESTCONTROL_TLS_CERT_FILE", "tls-cert-file", "PEM file of the certificate to serve HTTPS with", (*stringValue)(&c.Server.TLSCertFile)},
+		{"PESTCONTROL_TLS_KEY_FILE", "tls-key-file", "PEM file of the key to serve HTTPS with", (*stringValue)(&c.Server.TLSKeyFile)},
+		{"MONGODB_URI", "mongodb-uri", "MongoDB connection string", (*stringValue)(&c.Mongo.URI)},
+		{"PESTCONTROL_DB_HOST", "db-host", "MongoDB host, unless a connection string is set", (*stringValue)(&c.Mongo.Host)},
+		{"PESTCONTROL_DB_PORT", "db-port", "MongoDB port", (*stringValue)(&c.Mongo.Port)},
+		{"PESTCONTROL_DB_USER", "db-user", "MongoDB user", (*stringValue)(&c.Mongo.User)},
+		{"PESTCONTROL_DB_PW", "db-password", "MongoDB password", (*stringValue)(&c.Mongo.Password)},
+		{"DOCDB_CERT_PATH", "db-ca-file", "PEM file of the CA of DocumentDB", (*stringValue)(&c.Mongo.CAFile)},
+		{"PESTCONTROL_DB_NAME", "db-name", "MongoDB database", (*stringValue)(&c.Mongo.Database)},
+		{"PESTCONTROL_DB_COLLECTION", "db-collection", "MongoDB collection of preferences", (*stringValue)(&c.Mongo.Collection)},
+		{"PESTCONTROL_DB_MIGRATIONS_COLLECTION", "db-migrations-collection", "MongoDB collection of applied migrations", (*stringValue)(&c.Mongo.MigrationsCollection)},
+		{"PESTCONTROL_DB_AUDIT_COLLECTION", "db-audit-collection", "MongoDB collection of the history of preferences", (*stringValue)(&c.Mongo.AuditCollection)},
+		{"PESTCONTROL_DB_TIMEOUT", "db-timeout", "timeout of each MongoDB operation, 0 for none", (*Duration)(&c.Mongo.Timeout)},
+		{"PESTCONTROL_AUTH", "auth", "auth mode, jwt or header", (*stringValue)(&c.Auth.Mode)},
+		{"PESTCONTROL_JWT_HMAC_KEY_FILE", "jwt-hmac-key-file", "file of the HMAC secret of JWTs", (*stringValue)(&c.Auth.HMACKeyFile)},
+		{"PESTCONTROL_JWT_RSA_KEY_FILE", "jwt-rsa-key-file", "PEM file of the RSA public key of JWTs", (*stringValue)(&c.Auth.RSAKeyFile)},
+		{"PESTCONTROL_JWT_USER_CLAIM", "jwt-user-claim", "JWT claim holding the user ID", (*stringValue)(&c.Auth.UserClaim)},
+		{"PESTCONTROL_SERVICE_TOKEN_FILE", "service-token-file", "file of the token of internal requests", (*stringValue)(&c.Auth.ServiceTokenFile)},
+		{"PESTCONTROL_TENANCY", "tenancy", "tenancy, none, database or field", (*stringValue)(&c.Tenancy.Mode)},
+		{"PESTCONTROL_TENANT_SOURCE", "tenant-source", "source of tenant IDs, header or claim (default claim in jwt auth mode)", (*stringValue)(&c.Tenancy.Source)},
+		{"PESTCONTROL_TENANT_HEADER", "tenant-header", "header holding the tenant ID", (*stringValue)(&c.Tenancy.Header)},
+		{"PESTCONTROL_JWT_TENANT_CLAIM", "jwt-tenant-claim", "JWT claim holding the tenant ID", (*stringValue)(&c.Tenancy.Claim)},
+		{"PESTCONTROL_TRACING", "tracing", "exporter of traces, none, stdout or otlp", (*stringValue)(&c.Tracing.Exporter)},
+		{"PESTCONTROL_OTLP_ENDPOINT", "otlp-endpoint", "OTLP over HTTP traces endpoint of the collector", (*stringValue)(&c.Tracing.OTLPEndpoint)},
+		{"PESTCONTROL_TRACE_SAMPLE_RATIO", "trace-sample-ratio", "ratio of new traces that are sampled", (*floatValue)(&c.Tracing.SampleRatio)},
+		{"PESTCONTROL_LOG_LEVEL", "log-level", "least level of logs, debug, info, warn or error", (*stringValue)(&c.Log.Level)},
+		{"PESTCONTROL_DB_BOOTSTRAP", "db-bootstrap", "bootstrap MongoDB on startup", (*boolValue)(&c.Features.Bootstrap)},
+		{"PESTCONTROL_DB_VALIDATOR", "db-validator", "install the $jsonSchema validator when bootstrapping", (*boolValue)(&c.Features.Validator)},
+		{"PESTCONTROL_INTERNAL_API", "internal-api", "serve the internal API, which needs a service token", (*boolValue)(&c.Features.InternalAPI)},
+	}
+}
+
+// Load returns the configuration of the JSON file named by the -config flag
+// or FileEnv, overridden by the environment variables found by lookupEnv and
+// then by the flags in args. The flags are registered on fs, which may hold
+// flags of its own. The configuration has to be validated by the caller,
+// since not every command needs all of it.
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	// Flags are parsed first to find the file, and are applied last
+	file := fs.String("config", "", "JSON or YAML configuration file ("+FileEnv+")")
+	flags := map[string]*recordedValue{}
+	for _, s := range Default().settings() {
+		_, isBool := s.Value.(*boolValue)
+		flags[s.Flag] = &recordedValue{isBool: isBool}
+		fs.Var(flags[s.Flag], s.Flag, fmt.Sprintf("%s (%s)", s.Usage, s.Env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *file == "" {
+		*file, _ = lookupEnv(FileEnv)
+	}
+	if *file != "" {
+		if err := c.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range c.settings() {
+		if val, ok := lookupEnv(s.Env); ok && val != "" {
+			if err := s.Value.Set(val); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", s.Env, err)
+			}
+		}
+	}
+	for _, s := range c.settings() {
+		if flag := flags[s.Flag]; flag.set {
+			if err := s.Value.Set(flag.value); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %s", s.Flag, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// loadFile loads a JSON file, or a YAML file if it has a .yaml or .yml
+// extension
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return fmt.Errorf("invalid configuration file %s: %s", path, err)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %s", path, err)
+	}
+	return nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that it is decoded like a
+// JSON file and unknown keys are rejected
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(doc))
+}
+
+// jsonValue converts the nested mappings that yaml.v2 decodes, whose keys
+// may be of any type, to mappings that can be encoded as JSON
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = jsonValue(val)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = jsonValue(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// problems collects the problems found in a configuration
+type problems []string
+
+func (p *problems) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*p = append(*p, fmt.Sprintf(format, args...))
+	}
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration: " + strings.Join(p, "; "))
+}
+
+// Validate checks that the configuration of the server is complete and
+// consistent, and reports every problem that it finds
+func (c *Config) Validate() error {
+	p := problems{}
+	p.check(c.Datastore == "mongo" || c.Datastore == "memory", "unknown datastore %q", c.Datastore)
+	c.validateServer(&p)
+	if c.Datastore == "mongo" {
+		c.validateMongo(&p)
+	}
+	c.validateTenancy(&p)
+	c.validateAuth(&p)
+	c.validateTracing(&p)
+	_, err := logging.ParseLevel(c.Log.Level)
+	p.check(err == nil, "unknown log level %q", c.Log.Level)
+	return p.err()
+}
+
+// ValidateMongo checks the configuration of MongoDB, for the commands that
+// only connect to it
+func (c *Config) ValidateMongo() error {
+	p := problems{}
+	c.validateMongo(&p)
+	_, err := models.ParseTenancy(c.Tenancy.Mode)
+	p.check(err == nil, "unknown tenancy %q", c.Tenancy.Mode)
+	return p.err()
+}
+
+func (c *Config) validateServer(p *problems) {
+	_, _, err := net.SplitHostPort(c.Server.ListenAddr)
+	p.check(err == nil, "invalid listen address %q", c.Server.ListenAddr)
+	p.check(c.Server.ReadTimeout > 0, "read timeout must be positive")
+	p.check(c.Server.WriteTimeout > 0, "write timeout must be positive")
+	p.check(c.Server.IdleTimeout > 0, "idle timeout must be positive")
+	p.check(
+		c.Server.RequestTimeout > 0 && c.Server.RequestTimeout < c.Server.WriteTimeout,
+		"request timeout must be positive and shorter than the write timeout",
+	)
+	p.check(c.Server.ShutdownDelay >= 0, "shutdown delay can't be negative")
+	p.check(
+		c.Server.ShutdownTimeout >= c.Server.RequestTimeout,
+		"shutdown timeout must be at least the request timeout",
+	)
+	p.check(
+		(c.Server.TLSCertFile == "") == (c.Server.TLSKeyFile == ""),
+		"TLS needs both a certificate and a key file",
+	)
+}
+
+func (c *Config) validateMongo(p *problems) {
+	if c.Mongo.URI != "" {
+		p.check(
+			strings.HasPrefix(c.Mongo.URI, "mongodb://") ||
+				strings.HasPrefix(c.Mongo.URI, "mongodb+srv://"),
+			"MongoDB connection string must start with mongodb:// or mongodb+srv://",
+		)
+		p.check(
+			c.Mongo.Host == "" && c.Mongo.User == "" && c.Mongo.Password == "",
+			"MongoDB host and credentials can't be set with a connection string",
+		)
+	} else {
+		p.check(c.Mongo.Host != "", "MongoDB connection string or host must be set")
+		p.check(c.Mongo.Port != "", "MongoDB port must be set")
+	}
+	p.check(c.Mongo.Timeout >= 0, "MongoDB timeout can't be negative")
+}
+
+func (c *Config) validateTenancy(p *problems) {
+	tenancy, err := models.ParseTenancy(c.Tenancy.Mode)
+	p.check(err == nil, "unknown tenancy %q", c.Tenancy.Mode)
+	if tenancy == models.NoTenancy {
+		return
+	}
+	switch c.TenantSource() {
+	case "header":
+		p.check(c.Tenancy.Header != "", "tenant header must be set")
+	case "claim":
+		p.check(c.Auth.Mode == "jwt", "tenant claims need the jwt auth mode")
+		p.check(c.Tenancy.Claim != "", "tenant claim must be set")
+	default:
+		p.check(false, "unknown tenant source %q", c.Tenancy.Source)
+	}
+}
+
+// TenantSource returns where the tenant IDs of requests are read from, the
+// configured source or, if it isn't set, the claim in the jwt auth mode and
+// the header otherwise
+func (c *Config) TenantSource() string {
+	switch {
+	case c.Tenancy.Source != "":
+		return c.Tenancy.Source
+	case c.Auth.Mode == "jwt":
+		return "claim"
+	default:
+		return "header"
+	}
+}
+
+func (c *Config) validateAuth(p *problems) {
+	switch c.Auth.Mode {
+	case "jwt":
+		p.check(
+			(c.Auth.HMACKeyFile == "") != (c.Auth.RSAKeyFile == ""),
+			"exactly one JWT key file must be set in jwt auth mode",
+		)
+		p.check(c.Auth.UserClaim != "", "JWT user claim must be set")
+	case "header":
+	default:
+		p.check(false, "unknown auth mode %q", c.Auth.Mode)
+	}
+	p.check(
+		!c.Features.InternalAPI || c.Auth.ServiceTokenFile != "",
+		"service token file must be set unless the internal API is turned off",
+	)
+}
+
+func (c *Config) validateTracing(p *problems) {
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		u, err := url.Parse(c.Tracing.OTLPEndpoint)
+		p.check(
+			err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"OTLP endpoint must be an http or https URL",
+		)
+	default:
+		p.check(false, "unknown trace exporter %q", c.Tracing.Exporter)
+	}
+	p.check(
+		c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1,
+		"trace sample ratio must be between 0 and 1",
+	)
+}
+
+// ConnectionURI returns the MongoDB connection string. DocumentDB is
+// connected to with TLS and without retryable writes, which it doesn't
+// support.
+func (m *Mongo) ConnectionURI() string {
+	if m.URI != "" {
+		return m.URI
+	}
+
+	b := new(strings.Builder)
+	fmt.Fprint(b, "mongodb://")
+	if m.User != "" {
+		fmt.Fprintf(b, "%s@", url.UserPassword(m.User, m.Password))
+	}
+	fmt.Fprintf(b, "%s:%s", m.Host, m.Port)
+	if m.CAFile != "" {
+		fmt.Fprint(b, "/?ssl=true&replicaSet=rs0")
+		fmt.Fprint(b, "&readPreference=secondaryPreferred&retryWrites=false")
+	}
+	return b.String()
+}
+
+// DBConfig returns the configuration of models.DB
+func (c *Config) DBConfig() *models.DBConfig {
+	// The tenancy has been validated
+	tenancy, _ := models.ParseTenancy(c.Tenancy.Mode)
+	return &models.DBConfig{
+		Database:             c.Mongo.Database,
+		Collection:           c.Mongo.Collection,
+		MigrationsCollection: c.Mongo.MigrationsCollection,
+		AuditCollection:      c.Mongo.AuditCollection,
+		Tenancy:              tenancy,
+		Timeout:              time.Duration(c.Mongo.Timeout),
+	}
+}
+
+// Redacted returns the configuration as JSON with its secrets replaced, so
+// that it can be logged
+func (c *Config) Redacted() string {
+	r := *c
+	if r.Mongo.Password != "" {
+		r.Mongo.Password = redacted
+	}
+	r.Mongo.URI = redactURI(r.Mongo.URI)
+
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return redacted
+	}
+	return string(data)
+}
+
+func redactURI(uri string) string {
+	if uri == "" {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
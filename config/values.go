@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string such as "5s" in
+// JSON, environment variables and flags
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+type stringValue string
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string {
+	return strconv.FormatBool(bool(*v))
+}
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type floatValue float64
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+// recordedValue is a flag that records its value, so that it can be applied
+// to the configuration after the file and the environment
+type recordedValue struct {
+	isBool bool
+	set    bool
+	value  string
+}
+
+func (v *recordedValue) String() string {
+	return v.value
+}
+
+func (v *recordedValue) Set(s string) error {
+	v.set = true
+	v.value = s
+	return nil
+}
+
+func (v *recordedValue) IsBoolFlag() bool {
+	return v.isBool
+}
@@ -4,38 +4,94 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"pest-control/auth"
+	"pest-control/logging"
 	"pest-control/models"
+	"pest-control/tracing"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type Env struct {
 	DB models.Datastore
+	// Lifecycle is the lifecycle of the server, which is always running if
+	// it is nil
+	Lifecycle *Lifecycle
+}
+
+// store returns the Datastore of the tenant that a request is made for, or
+// env.DB if there is no tenant or env.DB is not partitioned by tenant
+func (env *Env) store(r *http.Request) models.Datastore {
+	tenant, ok := auth.Tenant(r.Context())
+	if !ok {
+		return env.DB
+	}
+	if tenants, ok := env.DB.(models.TenantDatastore); ok {
+		return tenants.ForTenant(tenant)
+	}
+	return env.DB
 }
 
 const (
 	ApplicationJSON        = "application/json"
 	InternalServerErrorStr = "Internal Server Error"
+	ServiceUnavailableStr  = "Service Unavailable"
+	GatewayTimeoutStr      = "Gateway Timeout"
 )
 
-func parseReqBody(w http.ResponseWriter, body io.ReadCloser, bodyObj interface{}) error {
-	bodyBytes, err := ioutil.ReadAll(body)
+// logDatastoreError logs the error of a Datastore operation for a request.
+// Preferences that don't exist, already exist or are at another version are
+// the client's problem, and a datastore that is unreachable is not a bug of
+// the service.
+func logDatastoreError(r *http.Request, msg string, err error, fields ...logging.Fields) {
+	level := logging.Error
+	switch {
+	case err == models.ErrPrefsDNE || err == models.ErrPrefsConvDNE ||
+		err == models.ErrAuditEntryDNE ||
+		err == models.ErrPrefsExists || err == models.ErrPrefsConvExists ||
+		err == models.ErrVersionMismatch || err == models.ErrRestoreConflict ||
+		err == models.ErrHistoryIncomplete:
+		level = logging.Info
+	case models.IsTimeout(err) || models.IsUnavailable(err):
+		level = logging.Warn
+	}
+	fields = append(fields, logging.Fields{"error": err})
+	logging.FromContext(r.Context()).Log(level, msg, fields...)
+}
+
+// writeBodyError responds to a request whose body can't be decoded, or is
+// decoded but has invalid fields
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Info("failed to parse request body", logging.Fields{"error": err})
+	if models.ErrorCode(err) == models.CodeValidationFailed {
+		writeError(w, r, err)
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, CodeInvalidBody, "failed to parse request body: "+err.Error())
+}
+
+func parseReqBody(w http.ResponseWriter, r *http.Request, bodyObj interface{}) (err error) {
+	_, span := tracing.Start(r.Context(), "parseReqBody")
+	defer func() {
+		span.RecordError(err)
+		span.Finish()
+	}()
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		errMsg := "failed to read request body: " + err.Error()
-		log.Println(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		logging.FromContext(r.Context()).Info(errMsg)
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidBody, errMsg)
 		return err
 	}
 
 	if err := json.Unmarshal(bodyBytes, bodyObj); err != nil {
-		errMsg := "failed to parse request body: " + err.Error()
-		log.Println(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return err
 	}
 
@@ -49,9 +105,7 @@ func parseReqBody(w http.ResponseWriter, body io.ReadCloser, bodyObj interface{}
 		// This needs to be done since there is no way to initialize the
 		// conversations array with all the fields set to true.
 		if err := json.Unmarshal(bodyBytes, prefs); err != nil {
-			errMsg := "failed to parse request body: " + err.Error()
-			log.Println(errMsg)
-			http.Error(w, errMsg, http.StatusBadRequest)
+			writeBodyError(w, r, err)
 			return err
 		}
 	}
@@ -81,38 +135,72 @@ func parseStringToInt(strings ...string) ([]int, error) {
 	return vals, nil
 }
 
+// requireUserID gets the authenticated user of a request, responding with 401
+// if there is none
+func requireUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, ok := auth.UserID(r.Context())
+	if !ok {
+		logging.FromContext(r.Context()).Warn("request has no authenticated user")
+		writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "request has no authenticated user")
+	}
+	return userID, ok
+}
+
+// formatETag returns the entity tag of a version of a user's preferences
+func formatETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseIfMatch returns the version of a user's preferences that the If-Match
+// header of a request requires, or models.AnyVersion if it is missing or "*".
+// Weak entity tags never match.
+func parseIfMatch(r *http.Request) (int64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return models.AnyVersion, nil
+	}
+
+	tag, err := strconv.Unquote(ifMatch)
+	if err != nil || !strings.HasPrefix(ifMatch, `"`) {
+		return 0, fmt.Errorf("invalid entity tag %s", ifMatch)
+	}
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("unknown entity tag %s", ifMatch)
+	}
+	return version, nil
+}
+
+// clearMutes drops the mutes of the conversations of a request body, which
+// are only set through MutePrefsConvHandler so that they are validated
+func clearMutes(convs []*models.ConversationPrefs) {
+	for _, conv := range convs {
+		if conv != nil {
+			conv.MutedUntil = nil
+		}
+	}
+}
+
 // PostPrefsHandler creates new preferences for a user
 func (env *Env) PostPrefsHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	reqBody := models.NewPreferences()
-	if err := parseReqBody(w, r.Body, reqBody); err != nil {
+	if err := parseReqBody(w, r, reqBody); err != nil {
 		return
 	}
 
-	vals, err := parseStringToInt(r.Header.Get("User-ID"))
-	if err != nil {
-		errMsg := "Invalid user ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+	userID, ok := requireUserID(w, r)
+	if !ok {
 		return
 	}
 
-	reqBody.UserID = vals[0]
+	reqBody.UserID = userID
+	clearMutes(reqBody.Conversation)
 
-	if err = env.DB.CreatePrefs(reqBody); err != nil {
-		log.Printf(
-			"failed to create prefs (%+v): %s",
-			*reqBody,
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsExists {
-			errMsg = err.Error()
-			responseCode = http.StatusConflict
-		}
-		http.Error(w, errMsg, responseCode)
+	if err := env.store(r).CreatePrefs(r.Context(), reqBody); err != nil {
+		logDatastoreError(r, "failed to create prefs", err, logging.Fields{"body": reqBody})
+		writeError(w, r, err)
 		return
 	}
 
@@ -129,34 +217,20 @@ func (env *Env) PostPrefsConvHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	reqBody := models.NewConversationPrefs()
-	if err := parseReqBody(w, r.Body, reqBody); err != nil {
+	if err := parseReqBody(w, r, reqBody); err != nil {
 		return
 	}
 
-	vals, err := parseStringToInt(r.Header.Get("User-ID"))
-	if err != nil {
-		errMsg := "Invalid user ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+	userID, ok := requireUserID(w, r)
+	if !ok {
 		return
 	}
 
-	if err := env.DB.CreatePrefsConv(vals[0], reqBody); err != nil {
-		log.Printf(
-			"failed to create conversation prefs (%+v): %s",
-			*reqBody,
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
-		} else if err == models.ErrPrefsConvExists {
-			errMsg = err.Error()
-			responseCode = http.StatusConflict
-		}
-		http.Error(w, errMsg, responseCode)
+	reqBody.MutedUntil = nil
+
+	if err := env.store(r).CreatePrefsConv(r.Context(), userID, reqBody); err != nil {
+		logDatastoreError(r, "failed to create conversation prefs", err, logging.Fields{"body": reqBody})
+		writeError(w, r, err)
 		return
 	}
 
@@ -169,32 +243,105 @@ func (env *Env) PostPrefsConvHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(reqBody)
 }
 
+// PutPrefsHandler creates a user's preferences, or replaces them if they exist
+func (env *Env) PutPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	reqBody := models.NewPreferences()
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	reqBody.UserID = userID
+	clearMutes(reqBody.Conversation)
+
+	created, err := env.store(r).ReplacePrefs(r.Context(), reqBody)
+	if err != nil {
+		logDatastoreError(r, "failed to replace prefs", err, logging.Fields{"body": reqBody})
+		writeError(w, r, err)
+		return
+	}
+
+	reqBody.UserID = 0
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	if created {
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(reqBody)
+}
+
+// PutPrefsConvHandler creates a user's preferences for a conversation, or
+// replaces them if they exist. The mute of the conversation is kept.
+func (env *Env) PutPrefsConvHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	reqBody := models.NewConversationPrefs()
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
+	if err != nil {
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
+		return
+	}
+
+	if reqBody.ConversationID != 0 && reqBody.ConversationID != vals[0] {
+		invalid := &models.ValidationError{}
+		invalid.Add("conversation_id", "conversation ID does not match the path", strconv.Itoa(vals[0]))
+		logging.FromContext(r.Context()).Info("invalid request body", logging.Fields{"error": invalid})
+		writeError(w, r, invalid)
+		return
+	}
+	reqBody.ConversationID = vals[0]
+	reqBody.MutedUntil = nil
+
+	created, err := env.store(r).ReplacePrefsConv(r.Context(), userID, reqBody)
+	if err != nil {
+		logDatastoreError(r, "failed to replace conversation prefs", err, logging.Fields{"body": reqBody})
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	if created {
+		w.Header().Set("Location", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(reqBody)
+}
+
 // GetPrefsHandler gets a user's global preferences
 func (env *Env) GetPrefsHandler(w http.ResponseWriter, r *http.Request) {
-	vals, err := parseStringToInt(r.Header.Get("User-ID"))
-	if err != nil {
-		errMsg := "Invalid user ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+	userID, ok := requireUserID(w, r)
+	if !ok {
 		return
 	}
 
-	prefs, err := env.DB.GetPrefs(vals[0])
+	prefs, err := env.store(r).GetPrefs(r.Context(), userID)
 	if err != nil {
-		log.Printf(
-			"unable to get preferences for user: %s",
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
-		}
-		http.Error(w, errMsg, responseCode)
+		logDatastoreError(r, "unable to get preferences for user", err)
+		writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", formatETag(prefs.Version))
 	w.Header().Set("Content-Type", ApplicationJSON)
 	json.NewEncoder(w).Encode(prefs)
 }
@@ -203,56 +350,48 @@ func (env *Env) GetPrefsHandler(w http.ResponseWriter, r *http.Request) {
 func (env *Env) GetPrefsConvHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	vals, err := parseStringToInt(r.Header.Get("User-ID"), vars["conversation"])
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
 	if err != nil {
-		errMsg := "Invalid user ID or conversation ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
 		return
 	}
 
-	prefs, err := env.DB.GetPrefsConv(vals[0], vals[1])
+	prefs, err := env.store(r).GetPrefsConv(r.Context(), userID, vals[0])
 	if err != nil {
-		log.Printf(
-			"unable to get conversation preferences for user: %s",
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsConvDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
-		}
-		http.Error(w, errMsg, responseCode)
+		logDatastoreError(r, "unable to get conversation preferences for user", err)
+		writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", formatETag(prefs.Version))
 	w.Header().Set("Content-Type", ApplicationJSON)
 	json.NewEncoder(w).Encode(prefs)
 }
 
 // DeletePrefsHandler deletes a user's preferences
 func (env *Env) DeletePrefsHandler(w http.ResponseWriter, r *http.Request) {
-	vals, err := parseStringToInt(r.Header.Get("User-ID"))
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := parseIfMatch(r)
 	if err != nil {
-		errMsg := "Invalid user ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+		logging.FromContext(r.Context()).Info("invalid If-Match header", logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
 		return
 	}
 
-	if err = env.DB.DeletePrefs(vals[0]); err != nil {
-		log.Printf(
-			"unable to delete preferences for user: %s",
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
-		}
-		http.Error(w, errMsg, responseCode)
+	if err := env.store(r).DeletePrefs(r.Context(), userID, version); err != nil {
+		logDatastoreError(r, "unable to delete preferences for user", err)
+		writeError(w, r, err)
 		return
 	}
 
@@ -263,26 +402,29 @@ func (env *Env) DeletePrefsHandler(w http.ResponseWriter, r *http.Request) {
 func (env *Env) DeletePrefsConvHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	vals, err := parseStringToInt(r.Header.Get("User-ID"), vars["conversation"])
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
 	if err != nil {
-		errMsg := "Invalid user ID or conversation ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
 		return
 	}
 
-	if err = env.DB.DeletePrefsConv(vals[0], vals[1]); err != nil {
-		log.Printf(
-			"unable to delete preferences for user: %s",
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsConvDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
-		}
-		http.Error(w, errMsg, responseCode)
+	version, err := parseIfMatch(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid If-Match header", logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
+		return
+	}
+
+	if err := env.store(r).DeletePrefsConv(r.Context(), userID, vals[0], version); err != nil {
+		logDatastoreError(r, "unable to delete preferences for user", err)
+		writeError(w, r, err)
 		return
 	}
 
@@ -294,35 +436,32 @@ func (env *Env) PatchPrefsHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	reqBody := &models.GlobalPrefs{}
-	if err := parseReqBody(w, r.Body, reqBody); err != nil {
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
 		return
 	}
 
-	vals, err := parseStringToInt(r.Header.Get("User-ID"))
+	version, err := parseIfMatch(r)
 	if err != nil {
-		errMsg := "Invalid user ID or conversation ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+		logging.FromContext(r.Context()).Info("invalid If-Match header", logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
 		return
 	}
 
-	if err := env.DB.PatchPrefs(vals[0], reqBody); err != nil {
-		log.Printf(
-			"unable to update preferences for user: %s",
-			err.Error(),
-		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
-		}
-		http.Error(w, errMsg, responseCode)
+	prefs, err := env.store(r).PatchPrefs(r.Context(), userID, reqBody, version)
+	if err != nil {
+		logDatastoreError(r, "unable to update preferences for user", err)
+		writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", formatETag(prefs.Version))
 	w.Header().Set("Content-Type", ApplicationJSON)
-	json.NewEncoder(w).Encode(reqBody)
+	json.NewEncoder(w).Encode(prefs)
 }
 
 // PatchPrefsConvHandler updates a user's preferences for a specific conversation
@@ -332,33 +471,364 @@ func (env *Env) PatchPrefsConvHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	reqBody := &models.ConversationPrefs{}
-	if err := parseReqBody(w, r.Body, reqBody); err != nil {
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
+	if err != nil {
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
+		return
+	}
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid If-Match header", logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error())
 		return
 	}
 
-	vals, err := parseStringToInt(r.Header.Get("User-ID"), vars["conversation"])
+	prefs, err := env.store(r).PatchPrefsConv(r.Context(), userID, vals[0], reqBody, version)
 	if err != nil {
-		errMsg := "Invalid user ID or conversation ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+		logDatastoreError(r, "unable to update preferences for user", err)
+		writeError(w, r, err)
 		return
 	}
 
-	if err := env.DB.PatchPrefsConv(vals[0], vals[1], reqBody); err != nil {
-		log.Printf(
-			"unable to update preferences for user: %s",
-			err.Error(),
+	w.Header().Set("ETag", formatETag(prefs.Version))
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// GetEffectivePrefsHandler gets the preferences that apply to a user for a
+// conversation after falling back to their global and default preferences,
+// and whether the user is in quiet hours now or at the time in the "at" query
+// parameter
+func (env *Env) GetEffectivePrefsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
+	if err != nil {
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
+		return
+	}
+
+	at := time.Now()
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		if at, err = time.Parse(time.RFC3339, atStr); err != nil {
+			invalid := &models.ValidationError{}
+			invalid.Add("at", "invalid time, expected RFC 3339 format")
+			logging.FromContext(r.Context()).Info("invalid query", logging.Fields{"error": err})
+			writeError(w, r, invalid)
+			return
+		}
+	}
+
+	prefs, err := models.GetEffectivePrefs(r.Context(), env.store(r), userID, vals[0], at)
+	if err != nil {
+		logDatastoreError(r, "unable to get effective preferences for user", err)
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// MaxRecipientUsers is the maximum number of users in a recipients request
+const MaxRecipientUsers = 1000
+
+type RecipientsReq struct {
+	ConversationID int          `json:"conversation_id"`
+	Event          models.Event `json:"event"`
+	UserIDs        []int        `json:"user_ids"`
+}
+
+// PostRecipientsHandler groups users by the Option they chose for an event in
+// a conversation. It is meant for internal services, not for users.
+func (env *Env) PostRecipientsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	reqBody := &RecipientsReq{}
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	invalid := &models.ValidationError{}
+	if !reqBody.Event.Valid() {
+		events := []string{}
+		for _, event := range models.Events() {
+			events = append(events, string(event))
+		}
+		invalid.Add("event", fmt.Sprintf("invalid event %q", reqBody.Event), events...)
+	}
+	if len(reqBody.UserIDs) > MaxRecipientUsers {
+		invalid.Add("user_ids", fmt.Sprintf("too many user IDs, maximum is %d", MaxRecipientUsers))
+	}
+	if err := invalid.Err(); err != nil {
+		logging.FromContext(r.Context()).Info("invalid request body", logging.Fields{"error": err})
+		writeError(w, r, err)
+		return
+	}
+
+	recipients, err := env.store(r).GetRecipients(
+		r.Context(),
+		reqBody.ConversationID,
+		reqBody.Event,
+		reqBody.UserIDs,
+	)
+	if err != nil {
+		logDatastoreError(r, "unable to get recipients", err)
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(recipients)
+}
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+type ListPrefsConvRes struct {
+	Conversations []*models.ConversationPrefs `json:"conversations"`
+	NextCursor    string                      `json:"next_cursor,omitempty"`
+}
+
+// parseLimit parses the limit of a page, which is DefaultListLimit if it is
+// empty
+func parseLimit(limit string, invalid *models.ValidationError) int {
+	if limit == "" {
+		return DefaultListLimit
+	}
+	val, err := strconv.Atoi(limit)
+	if err != nil || val < 1 || val > MaxListLimit {
+		invalid.Add(
+			"limit",
+			fmt.Sprintf("limit must be between 1 and %d", MaxListLimit),
+			fmt.Sprintf("1-%d", MaxListLimit),
 		)
-		errMsg := InternalServerErrorStr
-		responseCode := http.StatusInternalServerError
-		if err == models.ErrPrefsConvDNE {
-			errMsg = err.Error()
-			responseCode = http.StatusNotFound
+	}
+	return val
+}
+
+func parseListConvQuery(r *http.Request) (*models.ListConvQuery, error) {
+	params := r.URL.Query()
+	query := &models.ListConvQuery{}
+	invalid := &models.ValidationError{}
+
+	query.Limit = parseLimit(params.Get("limit"), invalid)
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		val, err := strconv.Atoi(cursor)
+		if err != nil {
+			invalid.Add("cursor", "invalid cursor")
+		}
+		query.After = &val
+	}
+
+	switch order := params.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		invalid.Add("order", fmt.Sprintf("invalid order %q", order), "asc", "desc")
+	}
+
+	query.Filter.TextEntered = models.ParseOption(params.Get("text_entered"))
+	query.Filter.TextModified = models.ParseOption(params.Get("text_modified"))
+	query.Filter.Tag = models.ParseOption(params.Get("tag"))
+	query.Filter.Role = models.ParseOption(params.Get("role"))
+	invalid.AddOptions(
+		[]string{"text_entered", "text_modified", "tag", "role"},
+		query.Filter.TextEntered,
+		query.Filter.TextModified,
+		query.Filter.Tag,
+		query.Filter.Role,
+	)
+
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// ListPrefsConvHandler lists a page of a user's conversation preferences
+func (env *Env) ListPrefsConvHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseListConvQuery(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid query", logging.Fields{"error": err})
+		writeError(w, r, err)
+		return
+	}
+
+	// Ask for one more than the limit to find out if there is another page
+	limit := query.Limit
+	query.Limit++
+
+	convs, err := env.store(r).ListPrefsConv(r.Context(), userID, query)
+	if err != nil {
+		logDatastoreError(r, "unable to list conversation preferences for user", err)
+		writeError(w, r, err)
+		return
+	}
+
+	resBody := &ListPrefsConvRes{Conversations: convs}
+	if len(convs) > limit {
+		resBody.Conversations = convs[:limit]
+		resBody.NextCursor = strconv.Itoa(convs[limit-1].ConversationID)
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(resBody)
+}
+
+type MuteReq struct {
+	Until    *time.Time `json:"until,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+}
+
+// PostMutePrefsConvHandler mutes a user's conversation until a time or for a
+// duration
+func (env *Env) PostMutePrefsConvHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+
+	reqBody := &MuteReq{}
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
+	if err != nil {
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
+		return
+	}
+
+	now := time.Now()
+	until := reqBody.Until
+	if (until == nil) == (reqBody.Duration == "") {
+		invalid := &models.ValidationError{}
+		invalid.Add("until", "exactly one of until or duration must be set")
+		invalid.Add("duration", "exactly one of until or duration must be set")
+		logging.FromContext(r.Context()).Info("invalid request body", logging.Fields{"error": invalid})
+		writeError(w, r, invalid)
+		return
+	} else if until == nil {
+		duration, err := time.ParseDuration(reqBody.Duration)
+		if err != nil {
+			invalid := &models.ValidationError{}
+			invalid.Add("duration", "invalid duration, expected e.g. 90m or 8h")
+			logging.FromContext(r.Context()).Info("invalid request body", logging.Fields{"error": err})
+			writeError(w, r, invalid)
+			return
+		}
+		mutedUntil := now.Add(duration)
+		until = &mutedUntil
+	}
+
+	if !until.After(now) {
+		invalid := &models.ValidationError{}
+		invalid.Add("until", "mute must end in the future")
+		logging.FromContext(r.Context()).Info("invalid request body", logging.Fields{"error": invalid})
+		writeError(w, r, invalid)
+		return
+	}
+
+	if err := env.store(r).MutePrefsConv(r.Context(), userID, vals[0], until); err != nil {
+		logDatastoreError(r, "unable to mute conversation for user", err)
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(&models.ConversationPrefs{
+		ConversationID: vals[0],
+		MutedUntil:     until,
+	})
+}
+
+// DeleteMutePrefsConvHandler unmutes a user's conversation
+func (env *Env) DeleteMutePrefsConvHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vals, err := parseStringToInt(vars["conversation"])
+	if err != nil {
+		errMsg := "Invalid conversation ID"
+		logging.FromContext(r.Context()).Info(errMsg, logging.Fields{"error": err})
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidConversationID, errMsg)
+		return
+	}
+
+	if err := env.store(r).MutePrefsConv(r.Context(), userID, vals[0], nil); err != nil {
+		logDatastoreError(r, "unable to unmute conversation for user", err)
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type DueDigestsRes struct {
+	Digests []models.DueDigest `json:"digests"`
+}
+
+// GetDueDigestsHandler lists the digests that are due now or at the time in
+// the "at" query parameter. It is meant for internal services, not for users.
+func (env *Env) GetDueDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, atStr); err != nil {
+			invalid := &models.ValidationError{}
+			invalid.Add("at", "invalid time, expected RFC 3339 format")
+			logging.FromContext(r.Context()).Info("invalid query", logging.Fields{"error": err})
+			writeError(w, r, invalid)
+			return
 		}
-		http.Error(w, errMsg, responseCode)
+	}
+
+	digests, err := env.store(r).GetDueDigests(r.Context(), at)
+	if err != nil {
+		logDatastoreError(r, "unable to get due digests", err)
+		writeError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", ApplicationJSON)
-	json.NewEncoder(w).Encode(reqBody)
+	json.NewEncoder(w).Encode(&DueDigestsRes{digests})
 }
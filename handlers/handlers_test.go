@@ -2,15 +2,69 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"pest-control/audit"
+	"pest-control/auth"
 	"pest-control/models"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
+// forEachStore runs test against a MemDB, and against MongoDB if
+// PESTCONTROL_TEST_DB_URI is set. Like the models tests it drops the database
+// that it uses, so it must never be pointed at one holding real preferences.
+func forEachStore(t *testing.T, test func(*testing.T, models.Datastore)) {
+	t.Run("MemDB", func(t *testing.T) {
+		test(t, models.NewMemDB())
+	})
+	t.Run("DB", func(t *testing.T) {
+		uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+		if uri == "" {
+			t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+		}
+
+		config := &models.DBConfig{Database: "pest-control-handlers-test"}
+		db, err := models.NewDB(uri, nil, config)
+		if err != nil {
+			t.Fatalf("Failed to connect to MongoDB: %s", err)
+		}
+		defer db.Disconnect(context.TODO())
+		if err := db.Database(config.Database).Drop(context.TODO()); err != nil {
+			t.Fatalf("Failed to drop database: %s", err)
+		}
+		if _, err := db.CreateIndexes(context.TODO()); err != nil {
+			t.Fatalf("Failed to create indexes: %s", err)
+		}
+		test(t, db)
+	})
+}
+
+func withUser(r *http.Request, userID int) *http.Request {
+	return r.WithContext(auth.WithUserID(r.Context(), userID))
+}
+
+// problemOf decodes the problem of an error response
+func problemOf(t *testing.T, w *httptest.ResponseRecorder) *Problem {
+	t.Helper()
+	if contentType := w.Header().Get("Content-Type"); contentType != ApplicationProblemJSON {
+		t.Errorf("Response has incorrect content type, expected %s, got %s", ApplicationProblemJSON, contentType)
+	}
+	p := &Problem{}
+	if err := json.Unmarshal(w.Body.Bytes(), p); err != nil {
+		t.Fatalf("Response has invalid problem %s: %s", w.Body.String(), err)
+	}
+	return p
+}
+
 func TestPostPrefsHandler(t *testing.T) {
 	tests := []struct {
 		Name       string
@@ -38,8 +92,8 @@ func TestPostPrefsHandler(t *testing.T) {
 			},
 			ResBody: models.Preferences{
 				Global: &models.GlobalPrefs{
-					models.None,
-					&models.GeneralPrefs{
+					Invitation: models.None,
+					GeneralPrefs: &models.GeneralPrefs{
 						Role:         models.All,
 						Tag:          models.All,
 						TextEntered:  models.Email,
@@ -47,8 +101,8 @@ func TestPostPrefsHandler(t *testing.T) {
 					},
 				},
 				Conversation: []*models.ConversationPrefs{{
-					0,
-					&models.GeneralPrefs{
+					ConversationID: 0,
+					GeneralPrefs: &models.GeneralPrefs{
 						Role:         models.All,
 						Tag:          models.Browser,
 						TextEntered:  models.All,
@@ -71,6 +125,7 @@ func TestPostPrefsHandler(t *testing.T) {
 			test.ResBody.ID = "blah"
 			rBody, _ := json.Marshal(test.ReqBody)
 			r := httptest.NewRequest("POST", "/pest-control/v1/prefs", bytes.NewReader(rBody))
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
 			mDB := &models.MockDB{
@@ -116,8 +171,8 @@ func TestPostPrefsConvHandler(t *testing.T) {
 				"tag": models.None,
 			},
 			ResBody: models.ConversationPrefs{
-				0,
-				&models.GeneralPrefs{
+				ConversationID: 0,
+				GeneralPrefs: &models.GeneralPrefs{
 					Role:         models.All,
 					Tag:          models.None,
 					TextEntered:  models.All,
@@ -132,6 +187,23 @@ func TestPostPrefsConvHandler(t *testing.T) {
 				"text_modified": 10,
 			},
 		},
+		{
+			Name:       "Unsuccessful conversation preference creation with invalid quiet hours",
+			StatusCode: http.StatusBadRequest,
+			ReqBody: map[string]interface{}{
+				"quiet_hours": map[string]interface{}{
+					"timezone": "Mars/Olympus_Mons",
+					"ranges":   []map[string]string{{"start": "22:00", "end": "07:00"}},
+				},
+			},
+		},
+		{
+			Name:       "Unsuccessful conversation preference creation with unregistered channel",
+			StatusCode: http.StatusBadRequest,
+			ReqBody: map[string]interface{}{
+				"text_modified": []string{"email", "carrier_pigeon"},
+			},
+		},
 		{
 			Name:       "Unsuccessful conversation preference creation with existing conversation",
 			StatusCode: http.StatusConflict,
@@ -146,6 +218,7 @@ func TestPostPrefsConvHandler(t *testing.T) {
 		t.Run(test.Name, func(t *testing.T) {
 			rBody, _ := json.Marshal(test.ReqBody)
 			r := httptest.NewRequest("POST", "/pest-control/v1/prefs", bytes.NewReader(rBody))
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
 			mDB := &models.MockDB{CreateErr: test.Error}
@@ -158,6 +231,9 @@ func TestPostPrefsConvHandler(t *testing.T) {
 			}
 
 			if w.Code == http.StatusOK {
+				if etag := w.Header().Get("ETag"); etag != `"2"` {
+					t.Errorf("Response has incorrect ETag, expected %s, got %s", `"2"`, etag)
+				}
 				resBody := models.ConversationPrefs{}
 				_ = json.NewDecoder(w.Body).Decode(&resBody)
 				if !reflect.DeepEqual(test.ResBody, resBody) {
@@ -179,8 +255,8 @@ func TestGetPrefsHandler(t *testing.T) {
 			Name:       "Successful preference retrieval",
 			StatusCode: http.StatusOK,
 			ResBody: models.GlobalPrefs{
-				models.All,
-				&models.GeneralPrefs{
+				Invitation: models.All,
+				GeneralPrefs: &models.GeneralPrefs{
 					TextModified: models.All,
 					TextEntered:  models.All,
 				},
@@ -191,11 +267,27 @@ func TestGetPrefsHandler(t *testing.T) {
 			StatusCode: http.StatusNotFound,
 			Error:      models.ErrPrefsDNE,
 		},
+		{
+			Name:       "Unsuccessful preference retrieval with datastore timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Error:      context.DeadlineExceeded,
+		},
+		{
+			Name:       "Unsuccessful preference retrieval with unreachable datastore",
+			StatusCode: http.StatusServiceUnavailable,
+			Error:      errors.New("server selection error: server selection timeout"),
+		},
+		{
+			Name:       "Unsuccessful preference retrieval with datastore failure",
+			StatusCode: http.StatusInternalServerError,
+			Error:      errors.New("write failed"),
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			r := httptest.NewRequest("", "/pest-control/v1/prefs", nil)
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
 			env := &Env{DB: &models.MockDB{
@@ -225,7 +317,7 @@ func TestGetPrefsHandler(t *testing.T) {
 					)
 				}
 			} else if w.Code == http.StatusNotFound &&
-				strings.TrimRight(w.Body.String(), "\n") != test.Error.Error() {
+				problemOf(t, w).Code != models.ErrorCode(test.Error) {
 				t.Errorf(
 					"Response is incorrect, expected %s, got %s",
 					test.Error.Error(),
@@ -247,8 +339,8 @@ func TestGetPrefsConvHandler(t *testing.T) {
 			Name:       "Successful preference retrieval with user query",
 			StatusCode: http.StatusOK,
 			ResBody: models.ConversationPrefs{
-				0,
-				&models.GeneralPrefs{
+				ConversationID: 0,
+				GeneralPrefs: &models.GeneralPrefs{
 					TextModified: models.All,
 					TextEntered:  models.None,
 				},
@@ -264,6 +356,7 @@ func TestGetPrefsConvHandler(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			r := httptest.NewRequest("", "/pest-control/v1/prefs/conversations/1", nil)
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
 			env := &Env{DB: &models.MockDB{
@@ -299,7 +392,7 @@ func TestGetPrefsConvHandler(t *testing.T) {
 					)
 				}
 			} else if w.Code == http.StatusNotFound &&
-				strings.TrimRight(w.Body.String(), "\n") != test.Error.Error() {
+				problemOf(t, w).Code != models.ErrorCode(test.Error) {
 				t.Errorf(
 					"Response is incorrect, expected %s, got %s",
 					test.Error.Error(),
@@ -330,6 +423,7 @@ func TestDeletePrefsHandler(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			r := httptest.NewRequest("DELETE", "/pest-control/v1/prefs", nil)
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
 			env := &Env{DB: &models.MockDB{DeleteErr: test.Error}}
@@ -340,7 +434,7 @@ func TestDeletePrefsHandler(t *testing.T) {
 			}
 
 			if w.Code > http.StatusNoContent &&
-				strings.TrimRight(w.Body.String(), "\n") != test.Error.Error() {
+				problemOf(t, w).Code != models.ErrorCode(test.Error) {
 				t.Errorf(
 					"Response has incorrect body, expected %s, got %s",
 					test.Error.Error(),
@@ -371,6 +465,7 @@ func TestDeletePrefsConvHandler(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			r := httptest.NewRequest("DELETE", "/pest-control/v1/prefs/conversations/1", nil)
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
 			env := &Env{DB: &models.MockDB{DeleteErr: test.Error}}
@@ -381,7 +476,7 @@ func TestDeletePrefsConvHandler(t *testing.T) {
 			}
 
 			if w.Code > http.StatusNoContent &&
-				strings.TrimRight(w.Body.String(), "\n") != test.Error.Error() {
+				problemOf(t, w).Code != models.ErrorCode(test.Error) {
 				t.Errorf(
 					"Response has incorrect body, expected %s, got %s",
 					test.Error.Error(),
@@ -413,9 +508,12 @@ func TestPatchPrefsHandler(t *testing.T) {
 				"tag": models.Email,
 			},
 			ResBody: models.GlobalPrefs{
-				models.Option(""),
-				&models.GeneralPrefs{
-					Tag: models.Email,
+				Invitation: models.All,
+				GeneralPrefs: &models.GeneralPrefs{
+					TextEntered:  models.All,
+					TextModified: models.All,
+					Tag:          models.Email,
+					Role:         models.All,
 				},
 			},
 		},
@@ -440,9 +538,16 @@ func TestPatchPrefsHandler(t *testing.T) {
 		t.Run(test.Name, func(t *testing.T) {
 			rBody, _ := json.Marshal(test.ReqBody)
 			r := httptest.NewRequest("PATCH", "/pest-control/v1/prefs", bytes.NewReader(rBody))
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
-			mDB := &models.MockDB{PatchErr: test.Error}
+			// The response has the preferences that the patch left
+			stored := test.ResBody
+			stored.Version = 2
+			mDB := &models.MockDB{
+				Prefs:    &models.Preferences{Global: &stored},
+				PatchErr: test.Error,
+			}
 
 			env := &Env{DB: mDB}
 			env.PatchPrefsHandler(w, r)
@@ -452,13 +557,16 @@ func TestPatchPrefsHandler(t *testing.T) {
 			}
 
 			if w.Code == http.StatusOK {
+				if etag := w.Header().Get("ETag"); etag != `"2"` {
+					t.Errorf("Response has incorrect ETag, expected %s, got %s", `"2"`, etag)
+				}
 				resBody := models.GlobalPrefs{}
 				_ = json.NewDecoder(w.Body).Decode(&resBody)
 				if !reflect.DeepEqual(test.ResBody, resBody) {
 					t.Errorf("Response has incorrect body, expected %+v, got %+v", test.ResBody, resBody)
 				}
 			} else if w.Code == http.StatusNotFound &&
-				strings.TrimRight(w.Body.String(), "\n") != test.Error.Error() {
+				problemOf(t, w).Code != models.ErrorCode(test.Error) {
 				t.Errorf(
 					"Response has incorrect body, expected %s, got %s",
 					test.Error.Error(),
@@ -487,12 +595,15 @@ func TestPatchPrefsConvHandler(t *testing.T) {
 			Name:       "Successful custom preference update",
 			StatusCode: http.StatusOK,
 			ReqBody: map[string]interface{}{
-				"tag": models.All,
+				"tag": models.None,
 			},
 			ResBody: models.ConversationPrefs{
-				0,
-				&models.GeneralPrefs{
-					Tag: models.All,
+				ConversationID: 1,
+				GeneralPrefs: &models.GeneralPrefs{
+					TextEntered:  models.All,
+					TextModified: models.All,
+					Tag:          models.None,
+					Role:         models.All,
 				},
 			},
 		},
@@ -517,9 +628,16 @@ func TestPatchPrefsConvHandler(t *testing.T) {
 		t.Run(test.Name, func(t *testing.T) {
 			rBody, _ := json.Marshal(test.ReqBody)
 			r := httptest.NewRequest("PATCH", "/pest-control/v1/prefs/conversations/1", bytes.NewReader(rBody))
+			r = withUser(r, 1)
 			w := httptest.NewRecorder()
 
-			mDB := &models.MockDB{PatchErr: test.Error}
+			// The response has the preferences that the patch left
+			stored := test.ResBody
+			stored.Version = 2
+			mDB := &models.MockDB{
+				Prefs:    &models.Preferences{Conversation: []*models.ConversationPrefs{&stored}},
+				PatchErr: test.Error,
+			}
 
 			env := &Env{DB: mDB}
 			env.PatchPrefsConvHandler(w, r)
@@ -535,7 +653,7 @@ func TestPatchPrefsConvHandler(t *testing.T) {
 					t.Errorf("Response has incorrect body, expected %+v, got %+v", test.ResBody, resBody)
 				}
 			} else if w.Code == http.StatusNotFound &&
-				strings.TrimRight(w.Body.String(), "\n") != test.Error.Error() {
+				problemOf(t, w).Code != models.ErrorCode(test.Error) {
 				t.Errorf(
 					"Response has incorrect body, expected %s, got %s",
 					test.Error.Error(),
@@ -545,3 +663,1362 @@ func TestPatchPrefsConvHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestGetEffectivePrefsHandler(t *testing.T) {
+	quietHours := &models.QuietHours{
+		Timezone: "UTC",
+		Ranges:   []models.QuietRange{{Start: "22:00", End: "07:00"}},
+	}
+	noQuietHours := &models.QuietHours{Timezone: "UTC", Ranges: []models.QuietRange{}}
+	global := models.NewGlobalPrefs()
+	global.Tag = models.Email
+	global.Role = models.None
+	global.QuietHours = quietHours
+	conv := &models.ConversationPrefs{
+		ConversationID: 1,
+		GeneralPrefs: &models.GeneralPrefs{
+			Role:       models.Browser,
+			QuietHours: noQuietHours,
+		},
+	}
+
+	tests := []struct {
+		Name           string
+		StatusCode     int
+		UserID         int
+		ConversationID string
+		Query          string
+		ResBody        models.EffectivePrefs
+	}{
+		{
+			Name:           "Successful resolution from conversation and global preferences",
+			StatusCode:     http.StatusOK,
+			UserID:         1,
+			ConversationID: "1",
+			Query:          "?at=2020-03-02T23:00:00Z",
+			ResBody: models.EffectivePrefs{
+				ConversationID: 1,
+				TextEntered:    models.EffectiveOption{Value: models.All, Source: models.SourceGlobal},
+				TextModified:   models.EffectiveOption{Value: models.All, Source: models.SourceGlobal},
+				Tag:            models.EffectiveOption{Value: models.Email, Source: models.SourceGlobal},
+				Role:           models.EffectiveOption{Value: models.Browser, Source: models.SourceConversation},
+				QuietHours:     models.EffectiveQuietHours{Value: noQuietHours, Source: models.SourceConversation},
+				Digest:         models.EffectiveDigest{Value: models.NewDigest(), Source: models.SourceDefault},
+			},
+		},
+		{
+			Name:           "Successful resolution from global preferences with non-existent conversation",
+			StatusCode:     http.StatusOK,
+			UserID:         1,
+			ConversationID: "2",
+			Query:          "?at=2020-03-02T23:00:00Z",
+			ResBody: models.EffectivePrefs{
+				ConversationID: 2,
+				TextEntered:    models.EffectiveOption{Value: models.All, Source: models.SourceGlobal},
+				TextModified:   models.EffectiveOption{Value: models.All, Source: models.SourceGlobal},
+				Tag:            models.EffectiveOption{Value: models.Email, Source: models.SourceGlobal},
+				Role:           models.EffectiveOption{Value: models.None, Source: models.SourceGlobal},
+				QuietHours:     models.EffectiveQuietHours{Value: quietHours, Source: models.SourceGlobal},
+				Digest:         models.EffectiveDigest{Value: models.NewDigest(), Source: models.SourceDefault},
+				InQuietHours:   true,
+			},
+		},
+		{
+			Name:           "Successful resolution outside of quiet hours",
+			StatusCode:     http.StatusOK,
+			UserID:         1,
+			ConversationID: "2",
+			Query:          "?at=2020-03-02T12:00:00Z",
+			ResBody: models.EffectivePrefs{
+				ConversationID: 2,
+				TextEntered:    models.EffectiveOption{Value: models.All, Source: models.SourceGlobal},
+				TextModified:   models.EffectiveOption{Value: models.All, Source: models.SourceGlobal},
+				Tag:            models.EffectiveOption{Value: models.Email, Source: models.SourceGlobal},
+				Role:           models.EffectiveOption{Value: models.None, Source: models.SourceGlobal},
+				QuietHours:     models.EffectiveQuietHours{Value: quietHours, Source: models.SourceGlobal},
+				Digest:         models.EffectiveDigest{Value: models.NewDigest(), Source: models.SourceDefault},
+			},
+		},
+		{
+			Name:           "Successful resolution from defaults with non-existent user",
+			StatusCode:     http.StatusOK,
+			UserID:         2,
+			ConversationID: "1",
+			ResBody: models.EffectivePrefs{
+				ConversationID: 1,
+				TextEntered:    models.EffectiveOption{Value: models.All, Source: models.SourceDefault},
+				TextModified:   models.EffectiveOption{Value: models.All, Source: models.SourceDefault},
+				Tag:            models.EffectiveOption{Value: models.All, Source: models.SourceDefault},
+				Role:           models.EffectiveOption{Value: models.All, Source: models.SourceDefault},
+				QuietHours:     models.EffectiveQuietHours{Source: models.SourceDefault},
+				Digest:         models.EffectiveDigest{Value: models.NewDigest(), Source: models.SourceDefault},
+			},
+		},
+		{
+			Name:           "Unsuccessful resolution without authenticated user",
+			StatusCode:     http.StatusUnauthorized,
+			ConversationID: "1",
+		},
+		{
+			Name:           "Unsuccessful resolution with invalid time",
+			StatusCode:     http.StatusBadRequest,
+			UserID:         1,
+			ConversationID: "1",
+			Query:          "?at=yesterday",
+		},
+	}
+
+	db := models.NewMemDB()
+	_ = db.CreatePrefs(context.TODO(), &models.Preferences{
+		UserID:       1,
+		Global:       global,
+		Conversation: []*models.ConversationPrefs{conv},
+	})
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("", "/pest-control/v1/prefs/conversations/"+test.ConversationID+"/effective"+test.Query, nil)
+			r = withUser(r, test.UserID)
+			r = mux.SetURLVars(r, map[string]string{"conversation": test.ConversationID})
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: db}
+			env.GetEffectivePrefsHandler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+
+			if w.Code == http.StatusOK {
+				resBody := models.EffectivePrefs{}
+				_ = json.NewDecoder(w.Body).Decode(&resBody)
+				if !reflect.DeepEqual(test.ResBody, resBody) {
+					t.Errorf("Response has incorrect body, expected %+v, got %+v", test.ResBody, resBody)
+				}
+			}
+		})
+	}
+}
+
+func TestPostRecipientsHandler(t *testing.T) {
+	tests := []struct {
+		Name       string
+		StatusCode int
+		ReqBody    map[string]interface{}
+		ResBody    models.Recipients
+	}{
+		{
+			Name:       "Successful recipient lookup",
+			StatusCode: http.StatusOK,
+			ReqBody: map[string]interface{}{
+				"conversation_id": 1,
+				"event":           models.EventTag,
+				"user_ids":        []int{1, 2, 3, 2},
+			},
+			ResBody: models.Recipients{
+				models.ChannelEmail:   {2, 3},
+				models.ChannelBrowser: {3},
+			},
+		},
+		{
+			Name:       "Successful recipient lookup for invitation",
+			StatusCode: http.StatusOK,
+			ReqBody: map[string]interface{}{
+				"conversation_id": 1,
+				"event":           models.EventInvitation,
+				"user_ids":        []int{1, 2, 3},
+			},
+			ResBody: models.Recipients{
+				models.ChannelEmail:   {2, 3},
+				models.ChannelBrowser: {1, 2, 3},
+			},
+		},
+		{
+			Name:       "Unsuccessful recipient lookup with invalid event",
+			StatusCode: http.StatusBadRequest,
+			ReqBody: map[string]interface{}{
+				"conversation_id": 1,
+				"event":           "something",
+				"user_ids":        []int{1},
+			},
+		},
+		{
+			Name:       "Unsuccessful recipient lookup with too many users",
+			StatusCode: http.StatusBadRequest,
+			ReqBody: map[string]interface{}{
+				"conversation_id": 1,
+				"event":           models.EventTag,
+				"user_ids":        make([]int, MaxRecipientUsers+1),
+			},
+		},
+	}
+
+	db := models.NewMemDB()
+	user1 := models.NewPreferences()
+	user1.UserID = 1
+	user1.Global.Invitation = models.Browser
+	user1.Conversation = []*models.ConversationPrefs{{
+		ConversationID: 1,
+		GeneralPrefs:   &models.GeneralPrefs{Tag: models.None},
+	}}
+	user2 := models.NewPreferences()
+	user2.UserID = 2
+	user2.Global.Tag = models.Email
+	_ = db.CreatePrefs(context.TODO(), user1)
+	_ = db.CreatePrefs(context.TODO(), user2)
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rBody, _ := json.Marshal(test.ReqBody)
+			r := httptest.NewRequest("POST", "/pest-control/v1/internal/recipients", bytes.NewReader(rBody))
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: db}
+			env.PostRecipientsHandler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+
+			if w.Code == http.StatusOK {
+				resBody := models.Recipients{}
+				_ = json.NewDecoder(w.Body).Decode(&resBody)
+				if !reflect.DeepEqual(test.ResBody, resBody) {
+					t.Errorf("Response has incorrect body, expected %+v, got %+v", test.ResBody, resBody)
+				}
+			}
+		})
+	}
+}
+
+func TestListPrefsConvHandler(t *testing.T) {
+	tests := []struct {
+		Name       string
+		StatusCode int
+		UserID     int
+		Query      string
+		ConvIDs    []int
+		NextCursor string
+	}{
+		{
+			Name:       "Successful listing of first page",
+			StatusCode: http.StatusOK,
+			UserID:     1,
+			Query:      "?limit=2",
+			ConvIDs:    []int{1, 2},
+			NextCursor: "2",
+		},
+		{
+			Name:       "Successful listing of last page",
+			StatusCode: http.StatusOK,
+			UserID:     1,
+			Query:      "?limit=2&cursor=2",
+			ConvIDs:    []int{3, 4},
+		},
+		{
+			Name:       "Successful listing in descending order",
+			StatusCode: http.StatusOK,
+			UserID:     1,
+			Query:      "?limit=3&order=desc",
+			ConvIDs:    []int{4, 3, 2},
+			NextCursor: "2",
+		},
+		{
+			Name:       "Successful listing with filter",
+			StatusCode: http.StatusOK,
+			UserID:     1,
+			Query:      "?tag=none",
+			ConvIDs:    []int{2, 4},
+		},
+		{
+			Name:       "Successful listing with legacy filter",
+			StatusCode: http.StatusOK,
+			UserID:     1,
+			Query:      "?tag=all",
+			ConvIDs:    []int{1, 3},
+		},
+		{
+			Name:       "Successful listing with unsorted filter",
+			StatusCode: http.StatusOK,
+			UserID:     1,
+			Query:      "?tag=email,browser",
+			ConvIDs:    []int{1, 3},
+		},
+		{
+			Name:       "Successful listing for user without conversations",
+			StatusCode: http.StatusOK,
+			UserID:     2,
+			ConvIDs:    []int{},
+		},
+		{
+			Name:       "Unsuccessful listing with invalid filter",
+			StatusCode: http.StatusBadRequest,
+			UserID:     1,
+			Query:      "?tag=something",
+		},
+		{
+			Name:       "Unsuccessful listing with invalid limit",
+			StatusCode: http.StatusBadRequest,
+			UserID:     1,
+			Query:      "?limit=0",
+		},
+		{
+			Name:       "Unsuccessful listing for non-existent user",
+			StatusCode: http.StatusNotFound,
+			UserID:     3,
+		},
+	}
+
+	forEachStore(t, func(t *testing.T, db models.Datastore) {
+		user1 := models.NewPreferences()
+		user1.UserID = 1
+		for _, convID := range []int{3, 1, 4, 2} {
+			conv := models.NewConversationPrefs()
+			conv.ConversationID = convID
+			if convID%2 == 0 {
+				conv.Tag = models.None
+			}
+			user1.Conversation = append(user1.Conversation, conv)
+		}
+		user2 := models.NewPreferences()
+		user2.UserID = 2
+		_ = db.CreatePrefs(context.TODO(), user1)
+		_ = db.CreatePrefs(context.TODO(), user2)
+
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				r := httptest.NewRequest("", "/pest-control/v1/prefs/conversations"+test.Query, nil)
+				r = withUser(r, test.UserID)
+				w := httptest.NewRecorder()
+
+				env := &Env{DB: db}
+				env.ListPrefsConvHandler(w, r)
+
+				if w.Code != test.StatusCode {
+					t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+				}
+
+				if w.Code == http.StatusOK {
+					resBody := ListPrefsConvRes{}
+					_ = json.NewDecoder(w.Body).Decode(&resBody)
+					convIDs := []int{}
+					for _, conv := range resBody.Conversations {
+						convIDs = append(convIDs, conv.ConversationID)
+					}
+					if !reflect.DeepEqual(test.ConvIDs, convIDs) {
+						t.Errorf("Response has incorrect conversations, expected %v, got %v", test.ConvIDs, convIDs)
+					}
+					if test.NextCursor != resBody.NextCursor {
+						t.Errorf("Response has incorrect cursor, expected %q, got %q", test.NextCursor, resBody.NextCursor)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestMutePrefsConvHandlers(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Method         string
+		StatusCode     int
+		ConversationID string
+		ReqBody        map[string]interface{}
+		Muted          bool
+	}{
+		{
+			Name:           "Successful mute for a duration",
+			Method:         "POST",
+			StatusCode:     http.StatusOK,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"duration": "8h"},
+			Muted:          true,
+		},
+		{
+			Name:           "Successful unmute",
+			Method:         "DELETE",
+			StatusCode:     http.StatusNoContent,
+			ConversationID: "1",
+		},
+		{
+			Name:           "Successful mute until a time",
+			Method:         "POST",
+			StatusCode:     http.StatusOK,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"until": time.Now().Add(time.Hour)},
+			Muted:          true,
+		},
+		{
+			Name:           "Unsuccessful mute in the past",
+			Method:         "POST",
+			StatusCode:     http.StatusBadRequest,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"until": time.Now().Add(-time.Hour)},
+			Muted:          true,
+		},
+		{
+			Name:           "Unsuccessful mute with until and duration",
+			Method:         "POST",
+			StatusCode:     http.StatusBadRequest,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"until": time.Now().Add(time.Hour), "duration": "1h"},
+			Muted:          true,
+		},
+		{
+			Name:           "Unsuccessful mute with invalid duration",
+			Method:         "POST",
+			StatusCode:     http.StatusBadRequest,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"duration": "forever"},
+			Muted:          true,
+		},
+		{
+			Name:           "Unsuccessful mute of non-existent conversation",
+			Method:         "POST",
+			StatusCode:     http.StatusNotFound,
+			ConversationID: "2",
+			ReqBody:        map[string]interface{}{"duration": "1h"},
+			Muted:          true,
+		},
+		{
+			Name:           "Unsuccessful unmute of non-existent conversation",
+			Method:         "DELETE",
+			StatusCode:     http.StatusNotFound,
+			ConversationID: "2",
+			Muted:          true,
+		},
+	}
+
+	db := models.NewMemDB()
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	conv := models.NewConversationPrefs()
+	conv.ConversationID = 1
+	prefs.Conversation = append(prefs.Conversation, conv)
+	_ = db.CreatePrefs(context.TODO(), prefs)
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rBody, _ := json.Marshal(test.ReqBody)
+			r := httptest.NewRequest(test.Method, "/pest-control/v1/prefs/conversations/"+test.ConversationID+"/mute", bytes.NewReader(rBody))
+			r = withUser(r, 1)
+			r = mux.SetURLVars(r, map[string]string{"conversation": test.ConversationID})
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: db}
+			if test.Method == "POST" {
+				env.PostMutePrefsConvHandler(w, r)
+			} else {
+				env.DeleteMutePrefsConvHandler(w, r)
+			}
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+
+			effective, _ := models.GetEffectivePrefs(context.TODO(), db, 1, 1, time.Now())
+			if muted := effective.Tag.Source == models.SourceMuted; muted != test.Muted {
+				t.Errorf("Conversation has incorrect mute, expected %t, got %t", test.Muted, muted)
+			}
+		})
+	}
+}
+
+func TestGetDueDigestsHandler(t *testing.T) {
+	tests := []struct {
+		Name       string
+		StatusCode int
+		Query      string
+		ResBody    DueDigestsRes
+	}{
+		{
+			Name:       "Successful listing of daily and hourly digests",
+			StatusCode: http.StatusOK,
+			Query:      "?at=2020-03-02T08:15:00Z",
+			ResBody: DueDigestsRes{[]models.DueDigest{
+				{UserID: 1, Frequency: models.Daily},
+				{UserID: 1, ConversationID: 1, Frequency: models.Hourly},
+			}},
+		},
+		{
+			Name:       "Successful listing of hourly digests",
+			StatusCode: http.StatusOK,
+			Query:      "?at=2020-03-02T09:15:00Z",
+			ResBody: DueDigestsRes{[]models.DueDigest{
+				{UserID: 1, ConversationID: 1, Frequency: models.Hourly},
+			}},
+		},
+		{
+			Name:       "Unsuccessful listing with invalid time",
+			StatusCode: http.StatusBadRequest,
+			Query:      "?at=tomorrow",
+		},
+	}
+
+	db := models.NewMemDB()
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	prefs.Global.Digest = &models.Digest{Frequency: models.Daily, Hour: 8}
+	conv := models.NewConversationPrefs()
+	conv.ConversationID = 1
+	conv.Digest = &models.Digest{Frequency: models.Hourly}
+	prefs.Conversation = append(prefs.Conversation, conv)
+	_ = db.CreatePrefs(context.TODO(), prefs)
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("", "/pest-control/v1/internal/digests"+test.Query, nil)
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: db}
+			env.GetDueDigestsHandler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+
+			if w.Code == http.StatusOK {
+				resBody := DueDigestsRes{}
+				_ = json.NewDecoder(w.Body).Decode(&resBody)
+				if !reflect.DeepEqual(test.ResBody, resBody) {
+					t.Errorf("Response has incorrect body, expected %+v, got %+v", test.ResBody, resBody)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefsVersionHandlers(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Method         string
+		ConversationID string
+		IfMatch        string
+		ReqBody        interface{}
+		StatusCode     int
+		ETag           string
+	}{
+		{
+			Name:       "Successful preference retrieval with entity tag",
+			Method:     "GET",
+			StatusCode: http.StatusOK,
+			ETag:       `"1"`,
+		},
+		{
+			Name:       "Successful preference update with matching entity tag",
+			Method:     "PATCH",
+			IfMatch:    `"1"`,
+			ReqBody:    map[string]interface{}{"tag": models.Email},
+			StatusCode: http.StatusOK,
+			ETag:       `"2"`,
+		},
+		{
+			Name:       "Unsuccessful preference update with stale entity tag",
+			Method:     "PATCH",
+			IfMatch:    `"1"`,
+			ReqBody:    map[string]interface{}{"tag": models.Browser},
+			StatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			Name:           "Successful conversation preference retrieval with entity tag",
+			Method:         "GET",
+			ConversationID: "1",
+			StatusCode:     http.StatusOK,
+			ETag:           `"2"`,
+		},
+		{
+			Name:           "Unsuccessful conversation preference deletion with weak entity tag",
+			Method:         "DELETE",
+			ConversationID: "1",
+			IfMatch:        `W/"2"`,
+			StatusCode:     http.StatusPreconditionFailed,
+		},
+		{
+			Name:           "Successful conversation preference update without entity tag",
+			Method:         "PATCH",
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"role": models.None},
+			StatusCode:     http.StatusOK,
+			ETag:           `"3"`,
+		},
+		{
+			Name:           "Unsuccessful conversation preference deletion with stale entity tag",
+			Method:         "DELETE",
+			ConversationID: "1",
+			IfMatch:        `"2"`,
+			StatusCode:     http.StatusPreconditionFailed,
+		},
+		{
+			Name:           "Successful conversation preference deletion with matching entity tag",
+			Method:         "DELETE",
+			ConversationID: "1",
+			IfMatch:        `"3"`,
+			StatusCode:     http.StatusNoContent,
+		},
+		{
+			Name:       "Successful preference deletion with any entity tag",
+			Method:     "DELETE",
+			IfMatch:    "*",
+			StatusCode: http.StatusNoContent,
+		},
+	}
+
+	db := models.NewMemDB()
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	conv := models.NewConversationPrefs()
+	conv.ConversationID = 1
+	prefs.Conversation = append(prefs.Conversation, conv)
+	_ = db.CreatePrefs(context.TODO(), prefs)
+
+	env := &Env{DB: db}
+	handlers := map[string][2]http.HandlerFunc{
+		"GET":    {env.GetPrefsHandler, env.GetPrefsConvHandler},
+		"PATCH":  {env.PatchPrefsHandler, env.PatchPrefsConvHandler},
+		"DELETE": {env.DeletePrefsHandler, env.DeletePrefsConvHandler},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rBody, _ := json.Marshal(test.ReqBody)
+			path := "/pest-control/v1/prefs"
+			handler := handlers[test.Method][0]
+			if test.ConversationID != "" {
+				path += "/conversations/" + test.ConversationID
+				handler = handlers[test.Method][1]
+			}
+			r := httptest.NewRequest(test.Method, path, bytes.NewReader(rBody))
+			r = withUser(r, 1)
+			r = mux.SetURLVars(r, map[string]string{"conversation": test.ConversationID})
+			if test.IfMatch != "" {
+				r.Header.Set("If-Match", test.IfMatch)
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+			if etag := w.Header().Get("ETag"); etag != test.ETag {
+				t.Errorf("Response has incorrect ETag, expected %s, got %s", test.ETag, etag)
+			}
+		})
+	}
+}
+
+func TestPutPrefsHandlers(t *testing.T) {
+	tests := []struct {
+		Name           string
+		UserID         int
+		ConversationID string
+		ReqBody        interface{}
+		StatusCode     int
+		Location       string
+	}{
+		{
+			Name:       "Successful preference creation",
+			UserID:     1,
+			ReqBody:    map[string]interface{}{"global": map[string]interface{}{"tag": models.Email}},
+			StatusCode: http.StatusCreated,
+			Location:   "/pest-control/v1/prefs",
+		},
+		{
+			Name:       "Successful preference replacement",
+			UserID:     1,
+			ReqBody:    map[string]interface{}{"global": map[string]interface{}{"tag": models.Browser}},
+			StatusCode: http.StatusOK,
+		},
+		{
+			Name:       "Unsuccessful preference replacement with bad request",
+			UserID:     1,
+			ReqBody:    map[string]interface{}{"global": map[string]interface{}{"tag": "pigeon"}},
+			StatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:   "Unsuccessful preference replacement with duplicated conversation",
+			UserID: 1,
+			ReqBody: map[string]interface{}{"conversation": []map[string]interface{}{
+				{"conversation_id": 1},
+				{"conversation_id": 1, "role": models.Email},
+			}},
+			StatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:           "Successful conversation preference creation",
+			UserID:         1,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"role": models.None},
+			StatusCode:     http.StatusCreated,
+			Location:       "/pest-control/v1/prefs/conversations/1",
+		},
+		{
+			Name:           "Successful conversation preference replacement",
+			UserID:         1,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"conversation_id": 1, "role": models.Email},
+			StatusCode:     http.StatusOK,
+		},
+		{
+			Name:           "Unsuccessful conversation preference replacement with mismatched conversation ID",
+			UserID:         1,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{"conversation_id": 2},
+			StatusCode:     http.StatusBadRequest,
+		},
+		{
+			Name:           "Unsuccessful conversation preference replacement with non-existent user",
+			UserID:         2,
+			ConversationID: "1",
+			ReqBody:        map[string]interface{}{},
+			StatusCode:     http.StatusNotFound,
+		},
+	}
+
+	env := &Env{DB: models.NewMemDB()}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rBody, _ := json.Marshal(test.ReqBody)
+			path := "/pest-control/v1/prefs"
+			handler := env.PutPrefsHandler
+			if test.ConversationID != "" {
+				path += "/conversations/" + test.ConversationID
+				handler = env.PutPrefsConvHandler
+			}
+			r := httptest.NewRequest("PUT", path, bytes.NewReader(rBody))
+			r = withUser(r, test.UserID)
+			r = mux.SetURLVars(r, map[string]string{"conversation": test.ConversationID})
+			w := httptest.NewRecorder()
+
+			handler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+			if location := w.Header().Get("Location"); location != test.Location {
+				t.Errorf("Response has incorrect location, expected %q, got %q", test.Location, location)
+			}
+		})
+	}
+
+	global, _ := env.DB.GetPrefs(context.TODO(), 1)
+	if global.Tag != models.Browser {
+		t.Errorf("Preferences were not replaced, expected tag %v, got %v", models.Browser, global.Tag)
+	}
+	conv, _ := env.DB.GetPrefsConv(context.TODO(), 1, 1)
+	if conv.Role != models.Email {
+		t.Errorf("Conversation preferences were not replaced, expected role %v, got %v", models.Email, conv.Role)
+	}
+}
+
+func TestPrefsHandlersIgnoreMutes(t *testing.T) {
+	// A mute that hasn't ended yet, since ended ones aren't read
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	conv := map[string]interface{}{"conversation_id": 1, "muted_until": until}
+	tests := []struct {
+		Name    string
+		Method  string
+		Path    string
+		ReqBody interface{}
+		Handler func(*Env) http.HandlerFunc
+	}{
+		{
+			Name:    "Preference creation",
+			Method:  "POST",
+			Path:    "/pest-control/v1/prefs",
+			ReqBody: map[string]interface{}{"conversation": []interface{}{conv}},
+			Handler: func(env *Env) http.HandlerFunc { return env.PostPrefsHandler },
+		},
+		{
+			Name:    "Preference replacement",
+			Method:  "PUT",
+			Path:    "/pest-control/v1/prefs",
+			ReqBody: map[string]interface{}{"conversation": []interface{}{conv}},
+			Handler: func(env *Env) http.HandlerFunc { return env.PutPrefsHandler },
+		},
+		{
+			Name:    "Conversation preference creation",
+			Method:  "POST",
+			Path:    "/pest-control/v1/prefs/conversations",
+			ReqBody: conv,
+			Handler: func(env *Env) http.HandlerFunc { return env.PostPrefsConvHandler },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			env := &Env{DB: models.NewMemDB()}
+			if test.Path == "/pest-control/v1/prefs/conversations" {
+				prefs := models.NewPreferences()
+				prefs.UserID = 1
+				_ = env.DB.CreatePrefs(context.TODO(), prefs)
+			}
+
+			rBody, _ := json.Marshal(test.ReqBody)
+			r := httptest.NewRequest(test.Method, test.Path, bytes.NewReader(rBody))
+			r = withUser(r, 1)
+			w := httptest.NewRecorder()
+
+			test.Handler(env)(w, r)
+
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Response has incorrect status code, expected status code %d, got %d", http.StatusCreated, w.Code)
+			}
+			if strings.Contains(w.Body.String(), "muted_until") {
+				t.Errorf("Response has a mute: %s", w.Body.String())
+			}
+			stored, err := env.DB.ListPrefsConv(context.TODO(), 1, &models.ListConvQuery{})
+			if err != nil || len(stored) != 1 || stored[0].MutedUntil != nil {
+				t.Errorf("Mute of the request body was stored, got %+v, %v", stored, err)
+			}
+		})
+	}
+}
+
+func TestTenantHandlers(t *testing.T) {
+	env := &Env{DB: models.NewMemDB()}
+	withTenant := func(r *http.Request, tenant string) *http.Request {
+		if tenant == "" {
+			return r
+		}
+		return r.WithContext(auth.WithTenant(r.Context(), tenant))
+	}
+
+	body, err := json.Marshal(models.NewPreferences())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/pest-control/v1/prefs", bytes.NewReader(body))
+	r = withTenant(withUser(r, 1), "a")
+	w := httptest.NewRecorder()
+	env.PostPrefsHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Incorrect status code creating preferences, expected %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	tests := []struct {
+		Name       string
+		Tenant     string
+		StatusCode int
+	}{
+		{
+			Name:       "Successful preference retrieval by the same tenant",
+			Tenant:     "a",
+			StatusCode: http.StatusOK,
+		},
+		{
+			Name:       "Unsuccessful preference retrieval by another tenant",
+			Tenant:     "b",
+			StatusCode: http.StatusNotFound,
+		},
+		{
+			Name:       "Unsuccessful preference retrieval without tenant",
+			StatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/pest-control/v1/prefs", nil)
+			r = withTenant(withUser(r, 1), test.Tenant)
+			w := httptest.NewRecorder()
+			env.GetPrefsHandler(w, r)
+			if w.Code != test.StatusCode {
+				t.Errorf("Incorrect status code, expected %d, got %d", test.StatusCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestGetPrefsHistoryHandler(t *testing.T) {
+	db := audit.NewDatastore(models.NewMemDB())
+	ctx := auth.WithUserID(context.Background(), 1)
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	conv := models.NewConversationPrefs()
+	conv.ConversationID = 10
+	prefs.Conversation = []*models.ConversationPrefs{conv}
+	_ = db.CreatePrefs(ctx, prefs)
+	for _, tag := range []models.Option{models.Email, models.None} {
+		patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: tag}}
+		_, _ = db.PatchPrefs(ctx, 1, patch, models.AnyVersion)
+	}
+	_, _ = db.PatchPrefs(ctx, 1, &models.GlobalPrefs{Invitation: models.Browser}, models.AnyVersion)
+
+	tests := []struct {
+		Name       string
+		DB         models.Datastore
+		StatusCode int
+		Query      string
+		Actions    []models.AuditAction
+		NextCursor bool
+	}{
+		{
+			Name:       "Successful history",
+			DB:         db,
+			StatusCode: http.StatusOK,
+			Actions: []models.AuditAction{
+				models.ActionPatch,
+				models.ActionPatch,
+				models.ActionPatch,
+				models.ActionCreate,
+				models.ActionCreate,
+			},
+		},
+		{
+			Name:       "Successful first page",
+			DB:         db,
+			StatusCode: http.StatusOK,
+			Query:      "?limit=2",
+			Actions:    []models.AuditAction{models.ActionPatch, models.ActionPatch},
+			NextCursor: true,
+		},
+		{
+			Name:       "Successful history of a field",
+			DB:         db,
+			StatusCode: http.StatusOK,
+			Query:      "?field=invitation",
+			Actions:    []models.AuditAction{models.ActionPatch, models.ActionCreate},
+		},
+		{
+			Name:       "Successful history of a conversation",
+			DB:         db,
+			StatusCode: http.StatusOK,
+			Query:      "?conversation_id=10",
+			Actions:    []models.AuditAction{models.ActionCreate},
+		},
+		{
+			Name:       "Unsuccessful history of an unknown field",
+			DB:         db,
+			StatusCode: http.StatusBadRequest,
+			Query:      "?field=colour",
+		},
+		{
+			Name:       "Unsuccessful history of a datastore without history",
+			DB:         &models.MockDB{},
+			StatusCode: http.StatusNotImplemented,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/pest-control/v1/prefs/history"+test.Query, nil)
+			r = withUser(r, 1)
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: test.DB}
+			env.GetPrefsHistoryHandler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			resBody := PrefsHistoryRes{}
+			_ = json.NewDecoder(w.Body).Decode(&resBody)
+			actions := []models.AuditAction{}
+			for _, e := range resBody.Entries {
+				actions = append(actions, e.Action)
+			}
+			if !reflect.DeepEqual(test.Actions, actions) {
+				t.Errorf("Response has incorrect entries, expected %v, got %v", test.Actions, actions)
+			}
+			if test.NextCursor != (resBody.NextCursor != "") {
+				t.Errorf("Response has incorrect cursor %q", resBody.NextCursor)
+			}
+		})
+	}
+}
+
+func TestPostRestorePrefsHandler(t *testing.T) {
+	// newDB returns a datastore where a user's global and conversation
+	// preferences were patched after they were created at the time returned,
+	// and the history of the user oldest first
+	newDB := func() (*audit.Datastore, time.Time, []*models.AuditEntry) {
+		db := audit.NewDatastore(models.NewMemDB())
+		ctx := auth.WithUserID(context.Background(), 1)
+		prefs := models.NewPreferences()
+		prefs.UserID = 1
+		conv := models.NewConversationPrefs()
+		conv.ConversationID = 10
+		prefs.Conversation = []*models.ConversationPrefs{conv}
+		_ = db.CreatePrefs(ctx, prefs)
+		created := time.Now()
+		// Audit entry times are kept to the millisecond
+		time.Sleep(time.Millisecond)
+		patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Email}}
+		_, _ = db.PatchPrefs(ctx, 1, patch, models.AnyVersion)
+		convPatch := &models.ConversationPrefs{GeneralPrefs: &models.GeneralPrefs{Role: models.None}}
+		_, _ = db.PatchPrefsConv(ctx, 1, 10, convPatch, models.AnyVersion)
+
+		history, _ := db.History(ctx, 1, &models.HistoryQuery{})
+		for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+			history[i], history[j] = history[j], history[i]
+		}
+		return db, created, history
+	}
+	conversationID := 10
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		Name       string
+		NoHistory  bool
+		Req        func(created time.Time, history []*models.AuditEntry) *RestoreReq
+		StatusCode int
+		Fields     [][]string
+		Tag        models.Option
+		Role       models.Option
+	}{
+		{
+			Name: "Successful restore to a time",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{At: &created}
+			},
+			StatusCode: http.StatusOK,
+			Fields:     [][]string{{"tag"}, {"role"}},
+			Tag:        models.All,
+			Role:       models.All,
+		},
+		{
+			Name: "Successful restore of a conversation to a time",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{ConversationID: &conversationID, At: &created}
+			},
+			StatusCode: http.StatusOK,
+			Fields:     [][]string{{"role"}},
+			Tag:        models.Email,
+			Role:       models.All,
+		},
+		{
+			Name: "Successful restore before an entry",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{EntryID: history[3].ID}
+			},
+			StatusCode: http.StatusOK,
+			Fields:     [][]string{{"role"}},
+			Tag:        models.Email,
+			Role:       models.All,
+		},
+		{
+			Name: "Successful restore before the preferences were created",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{EntryID: history[0].ID}
+			},
+			StatusCode: http.StatusOK,
+			Fields: [][]string{
+				{"invitation", "text_entered", "text_modified", "tag", "role"},
+				{"text_entered", "text_modified", "tag", "role"},
+			},
+		},
+		{
+			Name: "Unsuccessful restore before an unknown entry",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{EntryID: "5f1d7e2c9b1e8a3d4c2b1a09"}
+			},
+			StatusCode: http.StatusNotFound,
+		},
+		{
+			Name: "Unsuccessful restore without a restore point",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{}
+			},
+			StatusCode: http.StatusBadRequest,
+		},
+		{
+			Name: "Unsuccessful restore to a time and before an entry",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{At: &created, EntryID: history[0].ID}
+			},
+			StatusCode: http.StatusBadRequest,
+		},
+		{
+			Name: "Unsuccessful restore to the future",
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{At: &future}
+			},
+			StatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:      "Unsuccessful restore of a datastore without history",
+			NoHistory: true,
+			Req: func(created time.Time, history []*models.AuditEntry) *RestoreReq {
+				return &RestoreReq{At: &created}
+			},
+			StatusCode: http.StatusNotImplemented,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			db, created, history := newDB()
+			reqBody, _ := json.Marshal(test.Req(created, history))
+			r := httptest.NewRequest("POST", "/pest-control/v1/prefs/restore", bytes.NewBuffer(reqBody))
+			r = withUser(r, 1)
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: db}
+			if test.NoHistory {
+				env.DB = &models.MockDB{}
+			}
+			env.PostRestorePrefsHandler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			resBody := PrefsHistoryRes{}
+			_ = json.NewDecoder(w.Body).Decode(&resBody)
+			fields := [][]string{}
+			for _, e := range resBody.Entries {
+				if e.Action != models.ActionRestore {
+					t.Errorf("Response has entry of incorrect action %s", e.Action)
+				}
+				fields = append(fields, e.Fields)
+			}
+			if !reflect.DeepEqual(test.Fields, fields) {
+				t.Errorf("Response has incorrect entries, expected fields %v, got %v", test.Fields, fields)
+			}
+
+			global, err := db.GetPrefs(r.Context(), 1)
+			if test.Tag == "" {
+				if err != models.ErrPrefsDNE {
+					t.Errorf("Restored preferences exist, expected %v, got %v", models.ErrPrefsDNE, err)
+				}
+				return
+			}
+			conv, _ := db.GetPrefsConv(r.Context(), 1, 10)
+			if err != nil || global.Tag != test.Tag || conv.Role != test.Role {
+				t.Errorf("Preferences were restored incorrectly, got %+v and %+v", global, conv)
+			}
+		})
+	}
+}
+
+func TestProblems(t *testing.T) {
+	env := &Env{DB: models.NewMemDB()}
+
+	tests := []struct {
+		Name          string
+		Handler       http.HandlerFunc
+		Path          string
+		ReqBody       string
+		StatusCode    int
+		Code          string
+		InvalidFields []string
+	}{
+		{
+			Name:    "Invalid fields of preferences",
+			Handler: env.PostPrefsHandler,
+			Path:    "/pest-control/v1/prefs",
+			ReqBody: `{
+				"global": {"tag": "email,pigeon", "digest": {"frequency": "monthly", "hour": 25}},
+				"conversation": [{"conversation_id": 1, "role": 7, "quiet_hours": {"timezone": "UTC", "ranges": [{"start": "25:00", "end": "08:00"}]}}]
+			}`,
+			StatusCode: http.StatusBadRequest,
+			Code:       models.CodeValidationFailed,
+			InvalidFields: []string{
+				"global.tag",
+				"global.digest.frequency",
+				"global.digest.hour",
+				"conversation[0].role",
+				"conversation[0].quiet_hours.ranges[0].start",
+			},
+		},
+		{
+			Name:       "Malformed body",
+			Handler:    env.PostPrefsHandler,
+			Path:       "/pest-control/v1/prefs",
+			ReqBody:    `{"global": `,
+			StatusCode: http.StatusBadRequest,
+			Code:       CodeInvalidBody,
+		},
+		{
+			Name:          "Invalid fields of query",
+			Handler:       env.ListPrefsConvHandler,
+			Path:          "/pest-control/v1/prefs/conversations?limit=0&order=up&role=pigeon",
+			StatusCode:    http.StatusBadRequest,
+			Code:          models.CodeValidationFailed,
+			InvalidFields: []string{"limit", "order", "role"},
+		},
+		{
+			Name:       "Non-existent preferences",
+			Handler:    env.GetPrefsHandler,
+			Path:       "/pest-control/v1/prefs",
+			StatusCode: http.StatusNotFound,
+			Code:       "prefs_not_found",
+		},
+		{
+			Name:       "Unknown route",
+			Handler:    NotFoundHandler,
+			Path:       "/pest-control/v1/pests",
+			StatusCode: http.StatusNotFound,
+			Code:       CodeNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", test.Path, bytes.NewBufferString(test.ReqBody))
+			r = withUser(r, 1)
+			w := httptest.NewRecorder()
+			test.Handler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf("Response has incorrect status code, expected status code %d, got %d", test.StatusCode, w.Code)
+			}
+			p := problemOf(t, w)
+			if p.Code != test.Code || p.Status != test.StatusCode {
+				t.Errorf("Problem has incorrect code, expected %s, got %+v", test.Code, p)
+			}
+			if p.Type != "urn:pest-control:problem:"+test.Code {
+				t.Errorf("Problem has incorrect type %s", p.Type)
+			}
+			fields := []string{}
+			for _, f := range p.InvalidFields {
+				fields = append(fields, f.Field)
+				if f.Reason == "" {
+					t.Errorf("Invalid field %s has no reason", f.Field)
+				}
+			}
+			if len(test.InvalidFields) > 0 && !reflect.DeepEqual(test.InvalidFields, fields) {
+				t.Errorf("Problem has incorrect invalid fields, expected %v, got %v", test.InvalidFields, fields)
+			}
+		})
+	}
+}
+
+// unreachableDB is a Datastore whose health checks hang until they run out
+// of time, like a MongoDB that doesn't answer
+type unreachableDB struct {
+	*models.MockDB
+}
+
+func (db unreachableDB) CheckConnection(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (db unreachableDB) PendingMigrations(ctx context.Context) ([]models.Migration, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestHealthHandler(t *testing.T) {
+	r := httptest.NewRequest("", "/healthz", nil)
+	w := httptest.NewRecorder()
+
+	env := &Env{DB: &models.MockDB{PingErr: errors.New("server selection error")}}
+	env.HealthHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Response has incorrect status code, expected %d, got %d", http.StatusOK, w.Code)
+	}
+	resBody := Health{}
+	_ = json.NewDecoder(w.Body).Decode(&resBody)
+	if resBody.Status != "ok" {
+		t.Errorf("Response has incorrect status, expected ok, got %s", resBody.Status)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		Name         string
+		StatusCode   int
+		DB           models.Datastore
+		ShuttingDown bool
+		Failing      []string
+	}{
+		{
+			Name:       "Ready",
+			StatusCode: http.StatusOK,
+			DB:         &models.MockDB{},
+		},
+		{
+			Name:       "Ready with in-memory datastore",
+			StatusCode: http.StatusOK,
+			DB:         models.NewMemDB(),
+		},
+		{
+			Name:         "Not ready while shutting down",
+			StatusCode:   http.StatusServiceUnavailable,
+			DB:           &models.MockDB{},
+			ShuttingDown: true,
+			Failing:      []string{"shutdown"},
+		},
+		{
+			Name:       "Not ready with unavailable datastore",
+			StatusCode: http.StatusServiceUnavailable,
+			DB: &models.MockDB{
+				PingErr:       errors.New("server selection error"),
+				MigrationsErr: errors.New("server selection error"),
+			},
+			Failing: []string{"datastore", "migrations"},
+		},
+		{
+			Name:       "Not ready with datastore that times out",
+			StatusCode: http.StatusServiceUnavailable,
+			DB:         unreachableDB{&models.MockDB{}},
+			Failing:    []string{"datastore", "migrations"},
+		},
+		{
+			Name:       "Not ready with pending migrations",
+			StatusCode: http.StatusServiceUnavailable,
+			DB: &models.MockDB{
+				Pending: []models.Migration{{ID: 2, Description: "test"}},
+			},
+			Failing: []string{"migrations"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			r := httptest.NewRequest("", "/readyz", nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			env := &Env{DB: test.DB, Lifecycle: &Lifecycle{}}
+			if test.ShuttingDown {
+				env.Lifecycle.ShutDown()
+			}
+			env.ReadyHandler(w, r)
+
+			if w.Code != test.StatusCode {
+				t.Errorf(
+					"Response has incorrect status code, expected %d, got %d",
+					test.StatusCode,
+					w.Code,
+				)
+			}
+
+			resBody := Health{}
+			_ = json.NewDecoder(w.Body).Decode(&resBody)
+			failing := []string{}
+			for _, name := range []string{"shutdown", "datastore", "migrations"} {
+				check, ok := resBody.Checks[name]
+				if !ok {
+					t.Errorf("Response is missing check %s", name)
+				}
+				if check.Status != "ok" {
+					failing = append(failing, name)
+				}
+			}
+			if len(test.Failing) == 0 {
+				test.Failing = []string{}
+			}
+			if !reflect.DeepEqual(test.Failing, failing) {
+				t.Errorf(
+					"Response has incorrect failing checks, expected %v, got %+v",
+					test.Failing,
+					resBody,
+				)
+			}
+		})
+	}
+}
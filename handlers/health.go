@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pest-control/logging"
+	"pest-control/models"
+	"sync/atomic"
+	"time"
+)
+
+// readyTimeout bounds the checks of the readiness probe, so that it answers
+// before the load balancer gives up on it
+const readyTimeout = 2 * time.Second
+
+const (
+	statusOK      = "ok"
+	statusFailing = "failing"
+)
+
+// Lifecycle tracks whether the server is shutting down. The zero value is a
+// server that is running.
+type Lifecycle struct {
+	shuttingDown int32
+}
+
+// ShutDown marks the server as shutting down, which fails the readiness probe
+// so that no new requests are sent to it
+func (l *Lifecycle) ShutDown() {
+	atomic.StoreInt32(&l.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether ShutDown has been called. A nil Lifecycle is
+// never shutting down.
+func (l *Lifecycle) ShuttingDown() bool {
+	return l != nil && atomic.LoadInt32(&l.shuttingDown) == 1
+}
+
+// Check is the outcome of one check of a health probe
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health is the response body of the health probes
+type Health struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+func (h *Health) check(name string, err error) {
+	if err == nil {
+		h.Checks[name] = Check{Status: statusOK}
+		return
+	}
+	h.Status = statusFailing
+	h.Checks[name] = Check{Status: statusFailing, Error: err.Error()}
+}
+
+func writeHealth(w http.ResponseWriter, h *Health) {
+	w.Header().Set("Content-Type", ApplicationJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	if h.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// HealthHandler is the liveness probe, which succeeds while the process is
+// able to serve requests at all
+func (env *Env) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, &Health{Status: statusOK})
+}
+
+// ReadyHandler is the readiness probe, which fails while the server is
+// shutting down, the datastore can't be reached within readyTimeout, or
+// migrations are pending
+func (env *Env) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	health := &Health{Status: statusOK, Checks: map[string]Check{}}
+
+	var err error
+	if env.Lifecycle.ShuttingDown() {
+		err = fmt.Errorf("server is shutting down")
+	}
+	health.check("shutdown", err)
+
+	if db, ok := env.DB.(models.HealthDatastore); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		health.check("datastore", db.CheckConnection(ctx))
+
+		pending, err := db.PendingMigrations(ctx)
+		if err == nil && len(pending) > 0 {
+			err = fmt.Errorf(
+				"%d migrations are pending, starting with %d",
+				len(pending),
+				pending[0].ID,
+			)
+		}
+		health.check("migrations", err)
+	}
+
+	if health.Status != statusOK {
+		logging.FromContext(r.Context()).Warn("readiness probe failing", logging.Fields{
+			"checks": health.Checks,
+		})
+	}
+	writeHealth(w, health)
+}
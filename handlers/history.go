@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pest-control/logging"
+	"pest-control/models"
+	"strconv"
+	"time"
+)
+
+type PrefsHistoryRes struct {
+	Entries    []*models.AuditEntry `json:"entries"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+func parseHistoryQuery(r *http.Request) (*models.HistoryQuery, error) {
+	params := r.URL.Query()
+	invalid := &models.ValidationError{}
+	query := &models.HistoryQuery{
+		Limit:  parseLimit(params.Get("limit"), invalid),
+		Before: params.Get("cursor"),
+	}
+
+	if conversation := params.Get("conversation_id"); conversation != "" {
+		val, err := strconv.Atoi(conversation)
+		if err != nil {
+			invalid.Add("conversation_id", "invalid conversation ID")
+		}
+		query.ConversationID = &val
+	}
+
+	if field := params.Get("field"); field != "" {
+		fields := models.AuditFields()
+		valid := false
+		for _, f := range fields {
+			valid = valid || f == field
+		}
+		if !valid {
+			invalid.Add("field", fmt.Sprintf("invalid field %q", field), fields...)
+		}
+		query.Field = field
+	}
+
+	if err := invalid.Err(); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// GetPrefsHistoryHandler lists a page of the changes made to a user's
+// preferences, newest first
+func (env *Env) GetPrefsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseHistoryQuery(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Info("invalid query", logging.Fields{"error": err})
+		writeError(w, r, err)
+		return
+	}
+
+	store, ok := env.store(r).(models.HistoryDatastore)
+	if !ok {
+		writeError(w, r, models.ErrHistoryUnavailable)
+		return
+	}
+
+	// Ask for one more than the limit to find out if there is another page
+	limit := query.Limit
+	query.Limit++
+
+	entries, err := store.History(r.Context(), userID, query)
+	if err != nil {
+		logDatastoreError(r, "unable to get history of preferences for user", err)
+		writeError(w, r, err)
+		return
+	}
+
+	resBody := &PrefsHistoryRes{Entries: entries}
+	if len(entries) > limit {
+		resBody.Entries = entries[:limit]
+		resBody.NextCursor = entries[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(resBody)
+}
+
+type RestoreReq struct {
+	ConversationID *int       `json:"conversation_id,omitempty"`
+	At             *time.Time `json:"at,omitempty"`
+	EntryID        string     `json:"entry_id,omitempty"`
+}
+
+// PostRestorePrefsHandler rolls a user's preferences, or their preferences
+// for a conversation, back to their state at a time or before the write of
+// an audit entry, and lists the entries that record the restore
+func (env *Env) PostRestorePrefsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	reqBody := &RestoreReq{}
+	if err := parseReqBody(w, r, reqBody); err != nil {
+		return
+	}
+
+	userID, ok := requireUserID(w, r)
+	if !ok {
+		return
+	}
+
+	point := &models.RestorePoint{ConversationID: reqBody.ConversationID, EntryID: reqBody.EntryID}
+	invalid := &models.ValidationError{}
+	if (reqBody.At == nil) == (reqBody.EntryID == "") {
+		invalid.Add("at", "exactly one of at or entry_id must be set")
+		invalid.Add("entry_id", "exactly one of at or entry_id must be set")
+	} else if reqBody.At != nil {
+		if reqBody.At.After(time.Now()) {
+			invalid.Add("at", "restore point must not be in the future")
+		}
+		point.Time = *reqBody.At
+	}
+	if err := invalid.Err(); err != nil {
+		logging.FromContext(r.Context()).Info("invalid request body", logging.Fields{"error": err})
+		writeError(w, r, err)
+		return
+	}
+
+	store, ok := env.store(r).(models.RestoreDatastore)
+	if !ok {
+		writeError(w, r, models.ErrHistoryUnavailable)
+		return
+	}
+
+	entries, err := store.RestorePrefs(r.Context(), userID, point)
+	if err != nil {
+		logDatastoreError(r, "unable to restore preferences for user", err, logging.Fields{"body": reqBody})
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(&PrefsHistoryRes{Entries: entries})
+}
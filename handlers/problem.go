@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pest-control/logging"
+	"pest-control/models"
+)
+
+// ApplicationProblemJSON is the media type of the error responses of the
+// API, see RFC 7807
+const ApplicationProblemJSON = "application/problem+json"
+
+// problemTypePrefix makes the type URI of a problem from its code
+const problemTypePrefix = "urn:pest-control:problem:"
+
+// The codes of the problems that are not errors of models, whose codes are
+// those of models.ErrorCode
+const (
+	CodeInvalidBody           = "invalid_body"
+	CodeInvalidConversationID = "invalid_conversation_id"
+	CodePreconditionFailed    = "precondition_failed"
+	CodeUnauthorized          = "unauthorized"
+	CodeInvalidTenant         = "invalid_tenant"
+	CodeNotFound              = "not_found"
+	CodeMethodNotAllowed      = "method_not_allowed"
+	CodeDatastoreTimeout      = "datastore_timeout"
+	CodeDatastoreUnavailable  = "datastore_unavailable"
+	CodeInternal              = "internal_error"
+)
+
+// Problem is the body of an error response. Code identifies the problem and
+// is stable, so that clients can localise their messages from it, while
+// Title and Detail are for humans.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// InvalidFields are the invalid fields of the request, with the values
+	// that they allow
+	InvalidFields []models.FieldError `json:"invalid_fields,omitempty"`
+	// RequestID is the ID of the request in the logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewProblem returns the problem of a response with status
+func NewProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   problemTypePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// WriteProblem responds to r with p
+func WriteProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	p.Instance = r.URL.Path
+	p.RequestID = logging.RequestID(r.Context())
+	w.Header().Set("Content-Type", ApplicationProblemJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem responds to r with the problem of status, code and detail
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	WriteProblem(w, r, NewProblem(status, code, detail))
+}
+
+// errorStatus is the status code of the responses to the errors of models
+var errorStatus = map[error]int{
+	models.ErrPrefsExists:        http.StatusConflict,
+	models.ErrPrefsConvExists:    http.StatusConflict,
+	models.ErrPrefsDNE:           http.StatusNotFound,
+	models.ErrPrefsConvDNE:       http.StatusNotFound,
+	models.ErrAuditEntryDNE:      http.StatusNotFound,
+	models.ErrRestoreConflict:    http.StatusConflict,
+	models.ErrHistoryIncomplete:  http.StatusConflict,
+	models.ErrVersionMismatch:    http.StatusPreconditionFailed,
+	models.ErrInvalidEvent:       http.StatusBadRequest,
+	models.ErrInvalidChannel:     http.StatusBadRequest,
+	models.ErrHistoryUnavailable: http.StatusNotImplemented,
+}
+
+// errorProblem returns the problem of an error of a Datastore or of the
+// validation of a request. A datastore that timed out or couldn't be reached
+// is not an internal error of the service.
+func errorProblem(err error) *Problem {
+	var invalid *models.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		p := NewProblem(http.StatusBadRequest, models.CodeValidationFailed, err.Error())
+		p.InvalidFields = invalid.Fields
+		return p
+	case models.IsTimeout(err):
+		return NewProblem(http.StatusGatewayTimeout, CodeDatastoreTimeout, GatewayTimeoutStr)
+	case models.IsUnavailable(err):
+		return NewProblem(http.StatusServiceUnavailable, CodeDatastoreUnavailable, ServiceUnavailableStr)
+	}
+	if status, ok := errorStatus[err]; ok {
+		return NewProblem(status, models.ErrorCode(err), err.Error())
+	}
+	return NewProblem(http.StatusInternalServerError, CodeInternal, InternalServerErrorStr)
+}
+
+// writeError responds to r with the problem of err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	WriteProblem(w, r, errorProblem(err))
+}
+
+// NotFoundHandler responds with the problem of a path that has no route
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, CodeNotFound, "no route matches the path")
+}
+
+// MethodNotAllowedHandler responds with the problem of a method that the
+// route of the path doesn't handle
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "the route doesn't handle the method")
+}
@@ -0,0 +1,264 @@
+// Package logging writes leveled, structured logs as JSON lines, carries the
+// logger of a request and its ID in the request context, and redacts the
+// contents of preferences unless debug logs are enabled
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseLevel returns the level named s, which is debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for _, l := range []Level{Debug, Info, Warn, Error} {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Fields are the structured values of a log record, by name
+type Fields map[string]interface{}
+
+// RedactedValue replaces the values of sensitive fields
+const RedactedValue = "REDACTED"
+
+// sensitiveFields hold the contents of preferences, or of the requests and
+// queries that carry them, which are only written when debug logs are
+// enabled. IDs are not sensitive.
+var sensitiveFields = map[string]bool{
+	"body":         true,
+	"conversation": true,
+	"filter":       true,
+	"global":       true,
+	"prefs":        true,
+	"update":       true,
+}
+
+// output is where the loggers derived from one another write to
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	now   func() time.Time
+}
+
+// Logger writes the records of at least its level as JSON lines, holding
+// the time, level, message and fields of the record and of the logger
+type Logger struct {
+	out *output
+
+	mu     sync.Mutex
+	fields Fields
+}
+
+// New returns a Logger that writes the records of at least level to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		out:    &output{w: w, level: level, now: time.Now},
+		fields: Fields{},
+	}
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = New(os.Stderr, Info)
+)
+
+// Default returns the logger of code without a request, which writes info
+// records to stderr unless SetDefault replaced it
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the logger that Default returns
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+// Level returns the least level of the records that l writes
+func (l *Logger) Level() Level {
+	return l.out.level
+}
+
+// Enabled reports whether l writes records of level
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// With returns a logger that adds fields to the records of l
+func (l *Logger) With(fields Fields) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	child := &Logger{out: l.out, fields: make(Fields, len(l.fields)+len(fields))}
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		child.fields[k] = v
+	}
+	return child
+}
+
+// set adds a field to the records of l, and of the loggers derived from it
+// afterwards
+func (l *Logger) set(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fields[key] = value
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) { l.log(Debug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Fields)  { l.log(Info, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Fields)  { l.log(Warn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Fields) { l.log(Error, msg, fields) }
+
+// Fatal writes an error record and exits
+func (l *Logger) Fatal(msg string, fields ...Fields) {
+	l.log(Error, msg, fields)
+	os.Exit(1)
+}
+
+// Log writes a record of level, for callers that choose it at run time
+func (l *Logger) Log(level Level, msg string, fields ...Fields) {
+	l.log(level, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Fields) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	l.mu.Lock()
+	merged := make(Fields, len(l.fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	l.mu.Unlock()
+	for _, f := range fields {
+		for k, v := range f {
+			merged[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// The time, level and message come first, then the fields by name
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, `{"time":%s,"level":%s,"msg":%s`,
+		encode(l.out.now().UTC().Format(time.RFC3339Nano)),
+		encode(level.String()),
+		encode(msg),
+	)
+	for _, k := range keys {
+		v := merged[k]
+		if sensitiveFields[k] && !l.Enabled(Debug) {
+			v = RedactedValue
+		}
+		fmt.Fprintf(b, ",%s:%s", encode(k), encode(v))
+	}
+	b.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+// encode returns the JSON of v. Errors are written as their message, and
+// values that can't be encoded as their fmt representation.
+func encode(v interface{}) []byte {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case time.Duration:
+		v = value.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	return b
+}
+
+// Writer returns a writer that logs each line written to it as a record of
+// level, for the standard library's log package and other code that only
+// knows io.Writer
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		w.logger.log(w.level, line, nil)
+	}
+	return len(b), nil
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx holding l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// SetField adds a field to the logger held by ctx, so that every record of
+// the request that is yet to be written carries it, including those of the
+// middleware that wrap the one that learnt it, such as the user of the
+// request. It does nothing without a logger in ctx.
+func SetField(ctx context.Context, key string, value interface{}) {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		l.set(key, value)
+	}
+}
+
+// FromContext returns the logger held by ctx, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
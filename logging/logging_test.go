@@ -0,0 +1,205 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"pest-control/logging"
+	"strings"
+	"testing"
+)
+
+// records decodes the JSON lines written by a logger
+func records(t *testing.T, b *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	decoded := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Logged invalid JSON %s: %s", line, err)
+		}
+		decoded = append(decoded, record)
+	}
+	return decoded
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "info", "WARN", "Error"} {
+		level, err := logging.ParseLevel(name)
+		if err != nil {
+			t.Fatalf("ParseLevel returned unexpected error: %s", err)
+		}
+		if level.String() != strings.ToLower(name) {
+			t.Errorf("Incorrect level, expected %s, got %s", name, level)
+		}
+	}
+	if _, err := logging.ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel accepted an unknown level")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := logging.New(b, logging.Info).With(logging.Fields{"request_id": "abc"})
+
+	logger.Debug("not written")
+	logger.Info("handled request", logging.Fields{"status": 200, "route": "/prefs"})
+	logger.Error("failed", logging.Fields{"error": errors.New("timed out")})
+
+	written := records(t, b)
+	if len(written) != 2 {
+		t.Fatalf("Incorrect number of records, expected 2, got %d", len(written))
+	}
+	expected := map[string]interface{}{
+		"level":      "info",
+		"msg":        "handled request",
+		"request_id": "abc",
+		"status":     float64(200),
+		"route":      "/prefs",
+	}
+	for key, value := range expected {
+		if written[0][key] != value {
+			t.Errorf("Incorrect %s, expected %v, got %v", key, value, written[0][key])
+		}
+	}
+	if _, ok := written[0]["time"]; !ok {
+		t.Errorf("Record has no time")
+	}
+	if written[1]["level"] != "error" || written[1]["error"] != "timed out" {
+		t.Errorf("Incorrect error record %v", written[1])
+	}
+	if !strings.HasPrefix(b.String(), `{"time":`) {
+		t.Errorf("Record doesn't start with its time: %s", b.String())
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	prefs := map[string]interface{}{"enabled": false}
+
+	tests := []struct {
+		Name     string
+		Level    logging.Level
+		Redacted bool
+	}{
+		{
+			Name:     "Info",
+			Level:    logging.Info,
+			Redacted: true,
+		},
+		{
+			Name:  "Debug",
+			Level: logging.Debug,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			logger := logging.New(b, test.Level)
+			logger.Error("failed to insert preferences", logging.Fields{
+				"prefs":   prefs,
+				"filter":  []int{1},
+				"user_id": 1,
+			})
+
+			written := records(t, b)[0]
+			if written["user_id"] != float64(1) {
+				t.Errorf("User ID was redacted")
+			}
+			for _, key := range []string{"prefs", "filter"} {
+				if (written[key] == logging.RedactedValue) != test.Redacted {
+					t.Errorf("Incorrect redaction of %s, got %v", key, written[key])
+				}
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := logging.New(b, logging.Info).With(logging.Fields{"request_id": "abc"})
+	ctx := logging.NewContext(context.Background(), logger)
+	ctx = logging.WithRequestID(ctx, "abc")
+
+	logging.SetField(ctx, "user_id", 7)
+	logging.FromContext(ctx).Info("got preferences")
+	logger.Info("handled request")
+
+	for _, written := range records(t, b) {
+		if written["user_id"] != float64(7) || written["request_id"] != "abc" {
+			t.Errorf("Record doesn't carry the fields of the request: %v", written)
+		}
+	}
+	if logging.RequestID(ctx) != "abc" {
+		t.Errorf("Incorrect request ID %q", logging.RequestID(ctx))
+	}
+
+	// Without a logger in the context, the default logger is used and the
+	// fields of requests don't leak into it
+	logging.SetField(context.Background(), "user_id", 7)
+	if logging.FromContext(context.Background()) != logging.Default() {
+		t.Errorf("Context without a logger didn't return the default logger")
+	}
+	if logging.RequestID(context.Background()) != "" {
+		t.Errorf("Context without a request has a request ID")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	b := new(bytes.Buffer)
+	stdlog := log.New(logging.New(b, logging.Info).Writer(logging.Error), "", 0)
+	stdlog.Print("http: TLS handshake error")
+
+	written := records(t, b)
+	if len(written) != 1 || written[0]["level"] != "error" ||
+		written[0]["msg"] != "http: TLS handshake error" {
+		t.Errorf("Incorrect records %v", written)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		Name  string
+		ID    string
+		Valid bool
+	}{
+		{
+			Name:  "UUID",
+			ID:    "f47ac10b-58cc-4372-a567-0e02b2c3d479",
+			Valid: true,
+		},
+		{
+			Name:  "Generated",
+			ID:    logging.NewRequestID(),
+			Valid: true,
+		},
+		{
+			Name: "Empty",
+		},
+		{
+			Name: "Too long",
+			ID:   strings.Repeat("a", 129),
+		},
+		{
+			Name: "Spaces",
+			ID:   "a b",
+		},
+		{
+			Name: "Quotes",
+			ID:   `a"b`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if logging.ValidRequestID(test.ID) != test.Valid {
+				t.Errorf("Incorrect validity of %q, expected %t", test.ID, test.Valid)
+			}
+		})
+	}
+}
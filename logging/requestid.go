@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RequestIDHeader is the header that carries the ID of a request from the
+// caller, and back to it in the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID that is propagated
+const maxRequestIDLength = 128
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// ValidRequestID reports whether id can be propagated from a caller: it is
+// at most 128 letters, digits, and the punctuation of UUIDs and trace IDs
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx holding the ID of its request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request of ctx, or "" if it has none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
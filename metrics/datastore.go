@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"context"
+	"pest-control/models"
+	"time"
+)
+
+// datastoreMetrics are shared by a Datastore and the Datastores of its
+// tenants
+type datastoreMetrics struct {
+	duration *Histogram
+	errors   *Counter
+}
+
+// Datastore is a models.Datastore that records the latency and errors of
+// each method of the Datastore that it decorates. Errors are labelled by
+// kind, so that preferences that don't exist can be told apart from failures.
+type Datastore struct {
+	db      models.Datastore
+	metrics *datastoreMetrics
+}
+
+// InstrumentDatastore decorates db with metrics registered in reg
+func InstrumentDatastore(reg *Registry, db models.Datastore) *Datastore {
+	return &Datastore{
+		db: db,
+		metrics: &datastoreMetrics{
+			duration: reg.NewHistogram(
+				"pestcontrol_datastore_operation_duration_seconds",
+				"Latency of Datastore operations.",
+				DefaultBuckets,
+				"method",
+			),
+			errors: reg.NewCounter(
+				"pestcontrol_datastore_errors_total",
+				"Number of Datastore operations that returned an error, by kind.",
+				"method",
+				"error",
+			),
+		},
+	}
+}
+
+// ErrorKind is the label of a Datastore error. Errors that are part of the
+// normal operation of the service, such as preferences that don't exist, are
+// labelled by what they mean and anything else is a failure.
+func ErrorKind(err error) string {
+	switch {
+	case err == models.ErrPrefsDNE || err == models.ErrPrefsConvDNE || err == models.ErrAuditEntryDNE:
+		return "not_found"
+	case err == models.ErrPrefsExists || err == models.ErrPrefsConvExists:
+		return "exists"
+	case err == models.ErrRestoreConflict || err == models.ErrHistoryIncomplete:
+		return "conflict"
+	case err == models.ErrVersionMismatch:
+		return "version_mismatch"
+	case models.IsTimeout(err):
+		return "timeout"
+	case models.IsUnavailable(err):
+		return "unavailable"
+	}
+	return "failure"
+}
+
+func (ds *Datastore) observe(method string, start time.Time, err error) {
+	ds.metrics.duration.Observe(time.Since(start).Seconds(), method)
+	if err != nil {
+		ds.metrics.errors.Inc(method, ErrorKind(err))
+	}
+}
+
+// ForTenant returns the instrumented Datastore of a tenant, or ds itself if
+// the decorated Datastore isn't partitioned by tenant
+func (ds *Datastore) ForTenant(tenant string) models.Datastore {
+	tenants, ok := ds.db.(models.TenantDatastore)
+	if !ok {
+		return ds
+	}
+	return &Datastore{db: tenants.ForTenant(tenant), metrics: ds.metrics}
+}
+
+// CheckConnection checks the decorated Datastore, which always succeeds if
+// it has no health checks. The health checks aren't recorded, so that the
+// probes don't skew the latency of the datastore.
+func (ds *Datastore) CheckConnection(ctx context.Context) error {
+	if db, ok := ds.db.(models.HealthDatastore); ok {
+		return db.CheckConnection(ctx)
+	}
+	return nil
+}
+
+// PendingMigrations returns the pending migrations of the decorated
+// Datastore, which are none if it has no health checks
+func (ds *Datastore) PendingMigrations(ctx context.Context) ([]models.Migration, error) {
+	if db, ok := ds.db.(models.HealthDatastore); ok {
+		return db.PendingMigrations(ctx)
+	}
+	return []models.Migration{}, nil
+}
+
+func (ds *Datastore) GetPrefs(ctx context.Context, userID int) (*models.GlobalPrefs, error) {
+	start := time.Now()
+	prefs, err := ds.db.GetPrefs(ctx, userID)
+	ds.observe("GetPrefs", start, err)
+	return prefs, err
+}
+
+func (ds *Datastore) GetPrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+) (*models.ConversationPrefs, error) {
+	start := time.Now()
+	prefs, err := ds.db.GetPrefsConv(ctx, userID, conversationID)
+	ds.observe("GetPrefsConv", start, err)
+	return prefs, err
+}
+
+func (ds *Datastore) CreatePrefs(ctx context.Context, prefs *models.Preferences) error {
+	start := time.Now()
+	err := ds.db.CreatePrefs(ctx, prefs)
+	ds.observe("CreatePrefs", start, err)
+	return err
+}
+
+func (ds *Datastore) CreatePrefsConv(
+	ctx context.Context,
+	userID int,
+	convPrefs *models.ConversationPrefs,
+) error {
+	start := time.Now()
+	err := ds.db.CreatePrefsConv(ctx, userID, convPrefs)
+	ds.observe("CreatePrefsConv", start, err)
+	return err
+}
+
+func (ds *Datastore) ReplacePrefs(ctx context.Context, prefs *models.Preferences) (bool, error) {
+	start := time.Now()
+	created, err := ds.db.ReplacePrefs(ctx, prefs)
+	ds.observe("ReplacePrefs", start, err)
+	return created, err
+}
+
+func (ds *Datastore) ReplacePrefsConv(
+	ctx context.Context,
+	userID int,
+	convPrefs *models.ConversationPrefs,
+) (bool, error) {
+	start := time.Now()
+	created, err := ds.db.ReplacePrefsConv(ctx, userID, convPrefs)
+	ds.observe("ReplacePrefsConv", start, err)
+	return created, err
+}
+
+func (ds *Datastore) DeletePrefs(ctx context.Context, userID int, version int64) error {
+	start := time.Now()
+	err := ds.db.DeletePrefs(ctx, userID, version)
+	ds.observe("DeletePrefs", start, err)
+	return err
+}
+
+func (ds *Datastore) DeletePrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	version int64,
+) error {
+	start := time.Now()
+	err := ds.db.DeletePrefsConv(ctx, userID, conversationID, version)
+	ds.observe("DeletePrefsConv", start, err)
+	return err
+}
+
+func (ds *Datastore) PatchPrefs(
+	ctx context.Context,
+	userID int,
+	prefs *models.GlobalPrefs,
+	version int64,
+) (*models.GlobalPrefs, error) {
+	start := time.Now()
+	patched, err := ds.db.PatchPrefs(ctx, userID, prefs, version)
+	ds.observe("PatchPrefs", start, err)
+	return patched, err
+}
+
+func (ds *Datastore) PatchPrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	prefs *models.ConversationPrefs,
+	version int64,
+) (*models.ConversationPrefs, error) {
+	start := time.Now()
+	patched, err := ds.db.PatchPrefsConv(ctx, userID, conversationID, prefs, version)
+	ds.observe("PatchPrefsConv", start, err)
+	return patched, err
+}
+
+func (ds *Datastore) GetRecipients(
+	ctx context.Context,
+	conversationID int,
+	event models.Event,
+	userIDs []int,
+) (models.Recipients, error) {
+	start := time.Now()
+	recipients, err := ds.db.GetRecipients(ctx, conversationID, event, userIDs)
+	ds.observe("GetRecipients", start, err)
+	return recipients, err
+}
+
+func (ds *Datastore) ListPrefsConv(
+	ctx context.Context,
+	userID int,
+	query *models.ListConvQuery,
+) ([]*models.ConversationPrefs, error) {
+	start := time.Now()
+	prefs, err := ds.db.ListPrefsConv(ctx, userID, query)
+	ds.observe("ListPrefsConv", start, err)
+	return prefs, err
+}
+
+func (ds *Datastore) MutePrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	until *time.Time,
+) error {
+	start := time.Now()
+	err := ds.db.MutePrefsConv(ctx, userID, conversationID, until)
+	ds.observe("MutePrefsConv", start, err)
+	return err
+}
+
+func (ds *Datastore) GetDueDigests(ctx context.Context, t time.Time) ([]models.DueDigest, error) {
+	start := time.Now()
+	digests, err := ds.db.GetDueDigests(ctx, t)
+	ds.observe("GetDueDigests", start, err)
+	return digests, err
+}
+
+// History returns the history of the decorated Datastore, which fails with
+// models.ErrHistoryUnavailable if it doesn't record it
+func (ds *Datastore) History(
+	ctx context.Context,
+	userID int,
+	query *models.HistoryQuery,
+) ([]*models.AuditEntry, error) {
+	db, ok := ds.db.(models.HistoryDatastore)
+	if !ok {
+		return nil, models.ErrHistoryUnavailable
+	}
+	start := time.Now()
+	entries, err := db.History(ctx, userID, query)
+	ds.observe("History", start, err)
+	return entries, err
+}
+
+// RestorePrefs restores preferences with the decorated Datastore, which
+// fails with models.ErrHistoryUnavailable if it doesn't record their history
+func (ds *Datastore) RestorePrefs(
+	ctx context.Context,
+	userID int,
+	point *models.RestorePoint,
+) ([]*models.AuditEntry, error) {
+	db, ok := ds.db.(models.RestoreDatastore)
+	if !ok {
+		return nil, models.ErrHistoryUnavailable
+	}
+	start := time.Now()
+	entries, err := db.RestorePrefs(ctx, userID, point)
+	ds.observe("RestorePrefs", start, err)
+	return entries, err
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HTTP records the count and latency of requests by method, route template
+// and status code
+type HTTP struct {
+	requests *Counter
+	duration *Histogram
+}
+
+func NewHTTP(reg *Registry) *HTTP {
+	labels := []string{"method", "route", "status"}
+	return &HTTP{
+		requests: reg.NewCounter(
+			"pestcontrol_http_requests_total",
+			"Number of HTTP requests handled.",
+			labels...,
+		),
+		duration: reg.NewHistogram(
+			"pestcontrol_http_request_duration_seconds",
+			"Latency of HTTP requests.",
+			DefaultBuckets,
+			labels...,
+		),
+	}
+}
+
+// StatusWriter is an http.ResponseWriter that records the status code of
+// the response
+type StatusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// RouteTemplate returns the path template of the route that r matched, e.g.
+// /pest-control/v1/prefs/conversations/{conversation:[0-9]+}
+func RouteTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// Middleware is a mux.MiddlewareFunc that records the requests of the route
+// that they matched. Routes are labelled by their template rather than the
+// path, so that each conversation doesn't get a series of its own.
+func (m *HTTP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := RouteTemplate(r)
+		start := time.Now()
+		sw := &StatusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.Status == 0 {
+			sw.Status = http.StatusOK
+		}
+
+		status := strconv.Itoa(sw.Status)
+		m.requests.Inc(r.Method, route, status)
+		m.duration.Observe(time.Since(start).Seconds(), r.Method, route, status)
+	})
+}
@@ -0,0 +1,264 @@
+// Package metrics records counters and histograms and exposes them in the
+// Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"pest-control/logging"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of latency histograms in seconds, the
+// same as the Prometheus client's
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ContentType is the content type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and serves them on /metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+// Write writes every metric in the Prometheus text format
+func (reg *Registry) Write(w io.Writer) error {
+	reg.mu.Lock()
+	metrics := append([]metric{}, reg.metrics...)
+	reg.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := reg.Write(w); err != nil {
+		logging.FromContext(r.Context()).Warn("unable to write metrics", logging.Fields{"error": err})
+	}
+}
+
+// family is what counters and histograms have in common: a name, a help
+// text, and a series for each combination of label values
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string][]string{},
+	}
+}
+
+// key returns the key of the series of values, and records the values of a
+// new series. It must be called with f.mu held.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf(
+			"metric %s has labels %v, got values %v",
+			f.name,
+			f.labels,
+			values,
+		))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := f.series[key]; !ok {
+		f.series[key] = append([]string{}, values...)
+	}
+	return key
+}
+
+// sortedKeys returns the keys of the series in order, so that the output is
+// stable. It must be called with f.mu held.
+func (f *family) sortedKeys() []string {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// formatLabels formats the labels of a series with extra appended, e.g.
+// {route="/prefs",le="0.5"}
+func (f *family) formatLabels(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, label := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a count that only goes up, with a series for each combination
+// of label values
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+// NewCounter registers a counter with the given labels
+func (reg *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		family: newFamily(name, help, "counter", labels),
+		values: map[string]float64{},
+	}
+	reg.register(c)
+	return c
+}
+
+// Inc adds 1 to the series of the label values, given in the order of the
+// labels of c
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series of the label values
+func (c *Counter) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(values)] += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w)
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(c.series[key]), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations in buckets, with a series for each
+// combination of label values
+type Histogram struct {
+	family
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// counts are the cumulative counts of the buckets
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets,
+// in increasing order, and the given labels
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	reg.register(h)
+	return h
+}
+
+// Observe records v in the series of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(values)
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, key := range h.sortedKeys() {
+		values, hv := h.series[key], h.values[key]
+		for i, bound := range h.buckets {
+			labels := h.formatLabels(values, "le", formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(values, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(values), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(values), hv.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,145 @@
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pest-control/metrics"
+	"pest-control/models"
+	"pest-control/models/storetest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := metrics.NewRegistry()
+	counter := reg.NewCounter("test_total", "Number of\ntests.", "name")
+	histogram := reg.NewHistogram("test_seconds", "Latency of tests.", []float64{0.1, 1}, "name")
+
+	counter.Inc("b")
+	counter.Add(2, `a "quoted"\name`)
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(5, "a")
+
+	expected := `# HELP test_total Number of\ntests.
+# TYPE test_total counter
+test_total{name="a \"quoted\"\\name"} 2
+test_total{name="b"} 1
+# HELP test_seconds Latency of tests.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="a",le="0.1"} 1
+test_seconds_bucket{name="a",le="1"} 2
+test_seconds_bucket{name="a",le="+Inf"} 3
+test_seconds_sum{name="a"} 5.55
+test_seconds_count{name="a"} 3
+`
+	b := new(bytes.Buffer)
+	if err := reg.Write(b); err != nil {
+		t.Fatalf("Write returned unexpected error: %s", err)
+	}
+	if b.String() != expected {
+		t.Errorf("Incorrect exposition, expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	reg := metrics.NewRegistry()
+	router := mux.NewRouter()
+	router.Use(metrics.NewHTTP(reg).Middleware)
+	router.HandleFunc("/prefs/conversations/{conversation:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["conversation"] == "2" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("{}"))
+	})
+	router.Handle("/metrics", reg)
+
+	for _, path := range []string{"/prefs/conversations/1", "/prefs/conversations/2", "/prefs/conversations/3"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Header().Get("Content-Type") != metrics.ContentType {
+		t.Errorf("Response has incorrect content type %s", w.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`pestcontrol_http_requests_total{method="GET",route="/prefs/conversations/{conversation:[0-9]+}",status="200"} 2`,
+		`pestcontrol_http_requests_total{method="GET",route="/prefs/conversations/{conversation:[0-9]+}",status="404"} 1`,
+		`pestcontrol_http_request_duration_seconds_count{method="GET",route="/prefs/conversations/{conversation:[0-9]+}",status="200"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("Metrics are missing %s, got:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestDatastore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) models.Datastore {
+		return metrics.InstrumentDatastore(metrics.NewRegistry(), models.NewMemDB())
+	})
+}
+
+func TestDatastoreTenants(t *testing.T) {
+	storetest.RunTenants(t, func(t *testing.T) models.TenantDatastore {
+		return metrics.InstrumentDatastore(metrics.NewRegistry(), models.NewMemDB())
+	})
+}
+
+func TestDatastoreErrors(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Error error
+		Kind  string
+	}{
+		{
+			Name:  "Preferences that don't exist",
+			Error: models.ErrPrefsDNE,
+			Kind:  "not_found",
+		},
+		{
+			Name:  "Modified preferences",
+			Error: models.ErrVersionMismatch,
+			Kind:  "version_mismatch",
+		},
+		{
+			Name:  "Timeout",
+			Error: context.DeadlineExceeded,
+			Kind:  "timeout",
+		},
+		{
+			Name:  "Failure",
+			Error: errors.New("connection reset"),
+			Kind:  "failure",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			reg := metrics.NewRegistry()
+			db := metrics.InstrumentDatastore(reg, &models.MockDB{
+				Prefs:  models.NewPreferences(),
+				GetErr: test.Error,
+			})
+			db.GetPrefs(context.Background(), 1)
+			db.GetPrefs(context.Background(), 1)
+
+			b := new(bytes.Buffer)
+			reg.Write(b)
+			for _, line := range []string{
+				`pestcontrol_datastore_operation_duration_seconds_count{method="GetPrefs"} 2`,
+				`pestcontrol_datastore_errors_total{method="GetPrefs",error="` + test.Kind + `"} 2`,
+			} {
+				if !strings.Contains(b.String(), line+"\n") {
+					t.Errorf("Metrics are missing %s, got:\n%s", line, b.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package models
+
+import (
+	"context"
+	"pest-control/logging"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditAction is the kind of change that an AuditEntry records
+type AuditAction string
+
+const (
+	ActionCreate  AuditAction = "create"
+	ActionReplace AuditAction = "replace"
+	ActionPatch   AuditAction = "patch"
+	ActionDelete  AuditAction = "delete"
+	ActionMute    AuditAction = "mute"
+	ActionRestore AuditAction = "restore"
+)
+
+// AuditState is the state of a user's global preferences, or of their
+// preferences for a conversation, before or after a change
+type AuditState struct {
+	Invitation    Option `json:"invitation,omitempty" bson:"invitation,omitempty"`
+	*GeneralPrefs `bson:"inline"`
+	MutedUntil    *time.Time `json:"muted_until,omitempty" bson:"muted_until,omitempty"`
+}
+
+// GlobalState returns the state of global preferences. Preferences without
+// global preferences have an empty state, only missing preferences have none.
+func GlobalState(g *GlobalPrefs) *AuditState {
+	state := &AuditState{}
+	if g != nil {
+		state.Invitation = g.Invitation
+		state.GeneralPrefs = copyGeneralPrefs(g.GeneralPrefs)
+	}
+	return state
+}
+
+// ConversationState returns the state of preferences for a conversation, or
+// nil if they don't exist
+func ConversationState(c *ConversationPrefs) *AuditState {
+	if c == nil {
+		return nil
+	}
+	state := &AuditState{GeneralPrefs: copyGeneralPrefs(c.GeneralPrefs)}
+	if c.MutedUntil != nil {
+		mutedUntil := *c.MutedUntil
+		state.MutedUntil = &mutedUntil
+	}
+	return state
+}
+
+func copyAuditState(s *AuditState) *AuditState {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.GeneralPrefs = copyGeneralPrefs(s.GeneralPrefs)
+	if s.MutedUntil != nil {
+		mutedUntil := *s.MutedUntil
+		c.MutedUntil = &mutedUntil
+	}
+	return &c
+}
+
+// auditFields are the names of the fields of an AuditState
+var auditFields = []string{
+	"invitation",
+	"text_entered",
+	"text_modified",
+	"tag",
+	"role",
+	"quiet_hours",
+	"digest",
+	"muted_until",
+}
+
+// AuditFields returns the names of the fields that audit entries record the
+// changes of
+func AuditFields() []string {
+	return append([]string{}, auditFields...)
+}
+
+// values returns the value of each of the auditFields of s, which are all
+// empty if s is nil
+func (s *AuditState) values() []interface{} {
+	state, general := &AuditState{}, &GeneralPrefs{}
+	if s != nil {
+		state = s
+	}
+	if state.GeneralPrefs != nil {
+		general = state.GeneralPrefs
+	}
+	var mutedUntil interface{}
+	if state.MutedUntil != nil {
+		mutedUntil = state.MutedUntil.UTC().Truncate(time.Millisecond)
+	}
+	return []interface{}{
+		state.Invitation,
+		general.TextEntered,
+		general.TextModified,
+		general.Tag,
+		general.Role,
+		general.QuietHours,
+		general.Digest,
+		mutedUntil,
+	}
+}
+
+// ChangedFields returns the names of the fields that differ between two
+// states, in the order of AuditFields. A missing state has no fields set.
+func ChangedFields(before, after *AuditState) []string {
+	changed := []string{}
+	beforeValues, afterValues := before.values(), after.values()
+	for i, field := range auditFields {
+		if !reflect.DeepEqual(beforeValues[i], afterValues[i]) {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// AuditEntry records a change to a user's global preferences, or to their
+// preferences for a conversation. A write that changes both, such as
+// DeletePrefs, is recorded as an entry for each.
+type AuditEntry struct {
+	// ID orders the entries of a user by the time they were recorded
+	ID     string `json:"id" bson:"_id"`
+	UserID int    `json:"user_id" bson:"user_id"`
+	// ConversationID is nil for an entry of the global preferences
+	ConversationID *int        `json:"conversation_id,omitempty" bson:"conversation_id,omitempty"`
+	Action         AuditAction `json:"action" bson:"action"`
+	// Actor is who made the change, such as user:42
+	Actor     string    `json:"actor" bson:"actor"`
+	RequestID string    `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Time      time.Time `json:"time" bson:"time"`
+	// Fields are the names of the fields that differ between Before and
+	// After, which are nil when the preferences didn't exist
+	Fields []string    `json:"fields" bson:"fields"`
+	Before *AuditState `json:"before" bson:"before"`
+	After  *AuditState `json:"after" bson:"after"`
+	// PrevVersion and Version are the versions of the preferences before and
+	// after the write, which are 0 when they didn't exist. Entries recorded
+	// before versions were have both set to 0.
+	PrevVersion int64 `json:"prev_version" bson:"prev_version"`
+	Version     int64 `json:"version" bson:"version"`
+	// TenantID keeps the entries of tenants apart with TenantField tenancy
+	TenantID string `json:"-" bson:"tenant_id,omitempty"`
+}
+
+func copyAuditEntry(e *AuditEntry) *AuditEntry {
+	c := *e
+	if e.ConversationID != nil {
+		conversationID := *e.ConversationID
+		c.ConversationID = &conversationID
+	}
+	c.Fields = append([]string{}, e.Fields...)
+	c.Before = copyAuditState(e.Before)
+	c.After = copyAuditState(e.After)
+	return &c
+}
+
+// HistoryQuery selects a page of a user's audit entries, newest first
+type HistoryQuery struct {
+	// Before is the ID of the entry that the page starts before, if any
+	Before string
+	// Limit is the maximum number of entries returned
+	Limit int
+	// ConversationID only selects the entries of a conversation if it is set
+	ConversationID *int
+	// Field only selects the entries that changed the field if it is set
+	Field string
+}
+
+func (q *HistoryQuery) matches(e *AuditEntry) bool {
+	if q.Before != "" && e.ID >= q.Before {
+		return false
+	}
+	if q.ConversationID != nil &&
+		(e.ConversationID == nil || *e.ConversationID != *q.ConversationID) {
+		return false
+	}
+	if q.Field == "" {
+		return true
+	}
+	for _, field := range e.Fields {
+		if field == q.Field {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLog stores the audit entries of the changes made to preferences
+type AuditLog interface {
+	RecordChanges(context.Context, []*AuditEntry) error
+	History(context.Context, int, *HistoryQuery) ([]*AuditEntry, error)
+}
+
+// AuditedDatastore is a Datastore that keeps an AuditLog next to the
+// preferences that it stores. Its writes return the Change that they made to
+// be recorded, and it can rewrite all of a user's preferences at once to
+// restore them.
+type AuditedDatastore interface {
+	Datastore
+	AuditLog
+	ChangeDatastore
+	RewritePrefs(context.Context, int, func(*Preferences) (*Preferences, error)) error
+}
+
+// HistoryDatastore is a Datastore that can return the history of the
+// preferences that it stores
+type HistoryDatastore interface {
+	Datastore
+	History(context.Context, int, *HistoryQuery) ([]*AuditEntry, error)
+}
+
+// ErrHistoryUnavailable is returned for the history of a Datastore that
+// doesn't record it
+var ErrHistoryUnavailable error = &Error{
+	Code:    "history_unavailable",
+	Message: "the history of preferences is not recorded",
+}
+
+func (mdb *MemDB) RecordChanges(ctx context.Context, entries []*AuditEntry) error {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	for _, e := range entries {
+		mdb.audit = append(mdb.audit, copyAuditEntry(e))
+	}
+	return nil
+}
+
+func (mdb *MemDB) History(ctx context.Context, userID int, query *HistoryQuery) ([]*AuditEntry, error) {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	entries := []*AuditEntry{}
+	for i := len(mdb.audit) - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(entries) == query.Limit {
+			break
+		}
+		if e := mdb.audit[i]; e.UserID == userID && query.matches(e) {
+			entries = append(entries, copyAuditEntry(e))
+		}
+	}
+	return entries, nil
+}
+
+func (db *DB) auditCollection() *mongo.Collection {
+	return db.database().Collection(db.config.AuditCollection)
+}
+
+// auditIndexes returns the index that serves the history of a user, newest
+// first. With TenantField tenancy it is prefixed with tenant_id.
+func (db *DB) auditIndexes() []mongo.IndexModel {
+	if db.config.Tenancy == TenantField {
+		return []mongo.IndexModel{{
+			Keys:    bson.D{{"tenant_id", 1}, {"user_id", 1}, {"_id", -1}},
+			Options: options.Index().SetName("tenant_id_user_id_history"),
+		}}
+	}
+	return []mongo.IndexModel{{
+		Keys:    bson.D{{"user_id", 1}, {"_id", -1}},
+		Options: options.Index().SetName("user_id_history"),
+	}}
+}
+
+// RecordChanges inserts audit entries into the audit collection
+func (db *DB) RecordChanges(ctx context.Context, entries []*AuditEntry) error {
+	ctx, end := db.start(ctx, "RecordChanges")
+	defer end()
+
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		if db.config.Tenancy == TenantField {
+			e.TenantID = db.tenant
+		}
+		docs[i] = e
+	}
+	if _, err := db.auditCollection().InsertMany(ctx, docs); err != nil {
+		logging.FromContext(ctx).Error("failed to insert audit entries into MongoDB collection", logging.Fields{
+			"error": err,
+		})
+		return err
+	}
+	return nil
+}
+
+// History returns a page of a user's audit entries, newest first
+func (db *DB) History(ctx context.Context, userID int, query *HistoryQuery) ([]*AuditEntry, error) {
+	ctx, end := db.start(ctx, "History")
+	defer end()
+
+	filter := db.scope(bson.D{{"user_id", userID}})
+	if query.Before != "" {
+		filter = append(filter, bson.E{"_id", bson.D{{"$lt", query.Before}}})
+	}
+	if query.ConversationID != nil {
+		filter = append(filter, bson.E{"conversation_id", *query.ConversationID})
+	}
+	if query.Field != "" {
+		filter = append(filter, bson.E{"fields", query.Field})
+	}
+	opts := options.Find().SetSort(bson.D{{"_id", -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+
+	cursor, err := db.auditCollection().Find(ctx, filter, opts)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to find audit entries in MongoDB collection", logging.Fields{
+			"filter": filter,
+			"error":  err,
+		})
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := []*AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		logging.FromContext(ctx).Error("failed to decode audit entries", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+	return entries, nil
+}
@@ -5,26 +5,42 @@ import (
 	"crypto/tls"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
 )
 
 type Datastore interface {
-	GetPrefs(int) (*GlobalPrefs, error)
-	GetPrefsConv(int, int) (*ConversationPrefs, error)
-	CreatePrefs(*Preferences) error
-	CreatePrefsConv(int, *ConversationPrefs) error
-	DeletePrefs(int) error
-	DeletePrefsConv(int, int) error
-	PatchPrefs(int, *GlobalPrefs) error
-	PatchPrefsConv(int, int, *ConversationPrefs) error
+	GetPrefs(context.Context, int) (*GlobalPrefs, error)
+	GetPrefsConv(context.Context, int, int) (*ConversationPrefs, error)
+	CreatePrefs(context.Context, *Preferences) error
+	CreatePrefsConv(context.Context, int, *ConversationPrefs) error
+	ReplacePrefs(context.Context, *Preferences) (bool, error)
+	ReplacePrefsConv(context.Context, int, *ConversationPrefs) (bool, error)
+	DeletePrefs(context.Context, int, int64) error
+	DeletePrefsConv(context.Context, int, int, int64) error
+	PatchPrefs(context.Context, int, *GlobalPrefs, int64) (*GlobalPrefs, error)
+	PatchPrefsConv(context.Context, int, int, *ConversationPrefs, int64) (*ConversationPrefs, error)
+	GetRecipients(context.Context, int, Event, []int) (Recipients, error)
+	ListPrefsConv(context.Context, int, *ListConvQuery) ([]*ConversationPrefs, error)
+	MutePrefsConv(context.Context, int, int, *time.Time) error
+	GetDueDigests(context.Context, time.Time) ([]DueDigest, error)
 }
 
 type DB struct {
 	*mongo.Client
+	config DBConfig
+	// tenant is the tenant whose preferences DB reads and writes, or empty
+	// for the preferences of every tenant
+	tenant string
+	// bootstrapped is shared by db and the DBs of its tenants
+	bootstrapped *tenantBootstraps
 }
 
-func NewDB(dataSourceName string, tlsConfig *tls.Config) (*DB, error) {
+// NewDB connects to MongoDB. A nil config stores preferences with the
+// DefaultDBConfig.
+func NewDB(dataSourceName string, tlsConfig *tls.Config, config *DBConfig) (*DB, error) {
 	// Set client options
 	clientOptions := options.Client().ApplyURI(dataSourceName)
+	clientOptions.SetMonitor(commandMonitor())
 	if tlsConfig != nil {
 		clientOptions.SetTLSConfig(tlsConfig)
 	}
@@ -37,5 +53,12 @@ func NewDB(dataSourceName string, tlsConfig *tls.Config) (*DB, error) {
 	if err = client.Ping(context.TODO(), nil); err != nil {
 		return nil, err
 	}
-	return &DB{client}, nil
+	if config == nil {
+		config = &DBConfig{}
+	}
+	return &DB{
+		Client:       client,
+		config:       config.withDefaults(),
+		bootstrapped: &tenantBootstraps{},
+	}, nil
 }
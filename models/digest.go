@@ -0,0 +1,201 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"pest-control/logging"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DigestFrequency is how often a user's email notifications are batched
+type DigestFrequency string
+
+const (
+	Immediate DigestFrequency = "immediate"
+	Hourly    DigestFrequency = "hourly"
+	Daily     DigestFrequency = "daily"
+	Weekly    DigestFrequency = "weekly"
+)
+
+// Digest is a schedule for batching email notifications
+type Digest struct {
+	Frequency DigestFrequency `json:"frequency" bson:"frequency"`
+	// Hour is the hour of the day that daily and weekly digests are sent at
+	Hour int `json:"hour" bson:"hour"`
+	// Day is the day of the week that weekly digests are sent on, e.g. "mon"
+	Day string `json:"day,omitempty" bson:"day,omitempty"`
+	// Timezone is the IANA time zone of Hour and Day, UTC if empty
+	Timezone string `json:"timezone,omitempty" bson:"timezone,omitempty"`
+}
+
+// DueDigest is a digest that is due to be sent. ConversationID is 0 for the
+// user's global digest.
+type DueDigest struct {
+	UserID         int             `json:"user_id"`
+	ConversationID int             `json:"conversation_id,omitempty"`
+	Frequency      DigestFrequency `json:"frequency"`
+}
+
+func (f DigestFrequency) Valid() bool {
+	switch f {
+	case Immediate, Hourly, Daily, Weekly:
+		return true
+	}
+	return false
+}
+
+func NewDigest() *Digest {
+	return &Digest{Frequency: Immediate}
+}
+
+// Validate returns a ValidationError listing every invalid field of the
+// digest, or nil
+func (d *Digest) Validate() error {
+	invalid := &ValidationError{}
+	if !d.Frequency.Valid() {
+		invalid.Add(
+			"frequency",
+			fmt.Sprintf("invalid frequency %q", d.Frequency),
+			string(Immediate), string(Hourly), string(Daily), string(Weekly),
+		)
+	}
+	if d.Hour < 0 || d.Hour > 23 {
+		invalid.Add("hour", fmt.Sprintf("invalid hour %d", d.Hour), "0-23")
+	}
+	if _, ok := weekdays[d.Day]; d.Frequency == Weekly && !ok {
+		invalid.Add("day", fmt.Sprintf("invalid day %q", d.Day), weekdayNames...)
+	}
+	if _, err := time.LoadLocation(d.Timezone); err != nil {
+		invalid.Add("timezone", fmt.Sprintf("invalid timezone %q", d.Timezone))
+	}
+	return invalid.Err()
+}
+
+// Due reports whether the digest should be sent in the hour of time t
+func (d *Digest) Due(t time.Time) bool {
+	if d == nil {
+		return false
+	}
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		return false
+	}
+	local := t.In(loc)
+
+	switch d.Frequency {
+	case Hourly:
+		return true
+	case Daily:
+		return local.Hour() == d.Hour
+	case Weekly:
+		return local.Hour() == d.Hour && local.Weekday() == weekdays[d.Day]
+	}
+	return false
+}
+
+func copyDigest(d *Digest) *Digest {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	return &c
+}
+
+// dueDigests returns the digests of a user's preferences that are due at
+// time t. Conversations that are muted are skipped.
+func dueDigests(prefs *Preferences, t time.Time) []DueDigest {
+	due := []DueDigest{}
+	if prefs.Global != nil && prefs.Global.GeneralPrefs != nil &&
+		prefs.Global.Digest.Due(t) {
+		due = append(due, DueDigest{
+			UserID:    prefs.UserID,
+			Frequency: prefs.Global.Digest.Frequency,
+		})
+	}
+	for _, conv := range prefs.Conversation {
+		if conv == nil || conv.GeneralPrefs == nil || conv.Muted(t) {
+			continue
+		}
+		if conv.Digest.Due(t) {
+			due = append(due, DueDigest{
+				UserID:         prefs.UserID,
+				ConversationID: conv.ConversationID,
+				Frequency:      conv.Digest.Frequency,
+			})
+		}
+	}
+	return due
+}
+
+func sortDueDigests(due []DueDigest) {
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].UserID != due[j].UserID {
+			return due[i].UserID < due[j].UserID
+		}
+		return due[i].ConversationID < due[j].ConversationID
+	})
+}
+
+func (mdb *MemDB) GetDueDigests(ctx context.Context, t time.Time) ([]DueDigest, error) {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	due := []DueDigest{}
+	for _, prefs := range mdb.prefs {
+		due = append(due, dueDigests(prefs, t)...)
+	}
+	sortDueDigests(due)
+	return due, nil
+}
+
+// GetDueDigests lists the digests that are due to be sent in the hour of time
+// t. Only preferences with a batched digest are read, the schedules are then
+// evaluated in their own time zones.
+func (db *DB) GetDueDigests(ctx context.Context, t time.Time) ([]DueDigest, error) {
+	ctx, end := db.start(ctx, "GetDueDigests")
+	defer end()
+
+	batched := bson.D{{"$in", bson.A{Hourly, Daily, Weekly}}}
+	filter := db.scope(bson.D{{"$or", bson.A{
+		bson.D{{"global.digest.frequency", batched}},
+		bson.D{{"conversation.digest.frequency", batched}},
+	}}})
+	opts := options.Find().SetProjection(bson.D{
+		{"user_id", 1},
+		{"global.digest", 1},
+		{"conversation.conversation_id", 1},
+		{"conversation.digest", 1},
+		{"conversation.muted_until", 1},
+	})
+
+	collection := db.prefsCollection()
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to find digests in MongoDB collection", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	due := []DueDigest{}
+	for cursor.Next(ctx) {
+		prefs := &Preferences{}
+		if err := cursor.Decode(prefs); err != nil {
+			logging.FromContext(ctx).Error("failed to decode digests", logging.Fields{"error": err})
+			return nil, err
+		}
+		due = append(due, dueDigests(prefs, t)...)
+	}
+	if err := cursor.Err(); err != nil {
+		logging.FromContext(ctx).Error("failed to iterate digests", logging.Fields{"error": err})
+		return nil, err
+	}
+
+	sortDueDigests(due)
+	return due, nil
+}
@@ -0,0 +1,55 @@
+package models_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"pest-control/models"
+)
+
+func TestDigestDue(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Digest *models.Digest
+		Time   string
+		Due    bool
+	}{
+		{"Immediate", models.NewDigest(), "2020-03-02T08:00:00Z", false},
+		{"Hourly", &models.Digest{Frequency: models.Hourly}, "2020-03-02T08:30:00Z", true},
+		{"Daily at hour", &models.Digest{Frequency: models.Daily, Hour: 8}, "2020-03-02T08:59:00Z", true},
+		{"Daily at other hour", &models.Digest{Frequency: models.Daily, Hour: 8}, "2020-03-02T09:00:00Z", false},
+		{"Daily in time zone", &models.Digest{Frequency: models.Daily, Hour: 8, Timezone: "America/Toronto"}, "2020-03-02T13:00:00Z", true},
+		{"Weekly on day", &models.Digest{Frequency: models.Weekly, Hour: 8, Day: "mon"}, "2020-03-02T08:00:00Z", true},
+		{"Weekly on other day", &models.Digest{Frequency: models.Weekly, Hour: 8, Day: "tue"}, "2020-03-02T08:00:00Z", false},
+	}
+
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.Time)
+		if due := test.Digest.Due(at); due != test.Due {
+			t.Errorf("%s: incorrect result at %s, expected %t, got %t", test.Name, test.Time, test.Due, due)
+		}
+	}
+}
+
+func TestDigestValidation(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Data  string
+		Valid bool
+	}{
+		{"Daily digest", `{"digest":{"frequency":"daily","hour":20}}`, true},
+		{"Weekly digest", `{"digest":{"frequency":"weekly","hour":20,"day":"fri","timezone":"Europe/Paris"}}`, true},
+		{"Invalid frequency", `{"digest":{"frequency":"monthly"}}`, false},
+		{"Invalid hour", `{"digest":{"frequency":"daily","hour":24}}`, false},
+		{"Weekly digest without day", `{"digest":{"frequency":"weekly","hour":8}}`, false},
+		{"Invalid timezone", `{"digest":{"frequency":"daily","timezone":"Nowhere"}}`, false},
+	}
+
+	for _, test := range tests {
+		err := json.Unmarshal([]byte(test.Data), &models.ConversationPrefs{})
+		if (err == nil) != test.Valid {
+			t.Errorf("%s: incorrect validation, expected valid %t, got error %v", test.Name, test.Valid, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Source is the layer of preferences that an effective value was taken from
+type Source string
+
+const (
+	SourceConversation Source = "conversation"
+	SourceGlobal       Source = "global"
+	SourceDefault      Source = "default"
+	// SourceMuted is used for every Option of a muted conversation
+	SourceMuted Source = "mute"
+)
+
+type EffectiveOption struct {
+	Value  Option `json:"value"`
+	Source Source `json:"source"`
+}
+
+type EffectiveQuietHours struct {
+	Value  *QuietHours `json:"value"`
+	Source Source      `json:"source"`
+}
+
+type EffectiveDigest struct {
+	Value  *Digest `json:"value"`
+	Source Source  `json:"source"`
+}
+
+// EffectivePrefs are the preferences that apply to a user in a conversation
+// once conversation, global and default preferences have been merged
+type EffectivePrefs struct {
+	ConversationID int                 `json:"conversation_id"`
+	TextEntered    EffectiveOption     `json:"text_entered"`
+	TextModified   EffectiveOption     `json:"text_modified"`
+	Tag            EffectiveOption     `json:"tag"`
+	Role           EffectiveOption     `json:"role"`
+	QuietHours     EffectiveQuietHours `json:"quiet_hours"`
+	Digest         EffectiveDigest     `json:"digest"`
+	MutedUntil     *time.Time          `json:"muted_until,omitempty"`
+	// InQuietHours is only set by GetEffectivePrefs
+	InQuietHours bool `json:"in_quiet_hours"`
+}
+
+func resolveOption(conv, global, def Option) EffectiveOption {
+	if conv != "" {
+		return EffectiveOption{conv, SourceConversation}
+	}
+	if global != "" {
+		return EffectiveOption{global, SourceGlobal}
+	}
+	return EffectiveOption{def, SourceDefault}
+}
+
+// ResolvePrefs resolves each GeneralPrefs field at time t by falling back
+// from the conversation preferences to the global preferences and then to the
+// defaults of NewGlobalPrefs. Either set of preferences may be nil. Every
+// Option of a conversation that is muted at time t is None.
+func ResolvePrefs(
+	conversationID int,
+	global *GlobalPrefs,
+	conv *ConversationPrefs,
+	t time.Time,
+) *EffectivePrefs {
+	if conv.Muted(t) {
+		muted := EffectiveOption{None, SourceMuted}
+		return &EffectivePrefs{
+			ConversationID: conversationID,
+			TextEntered:    muted,
+			TextModified:   muted,
+			Tag:            muted,
+			Role:           muted,
+			QuietHours:     EffectiveQuietHours{nil, SourceMuted},
+			Digest:         EffectiveDigest{nil, SourceMuted},
+			MutedUntil:     conv.MutedUntil,
+		}
+	}
+
+	defaults := NewGlobalPrefs().GeneralPrefs
+	globalGeneral, convGeneral := &GeneralPrefs{}, &GeneralPrefs{}
+	if global != nil && global.GeneralPrefs != nil {
+		globalGeneral = global.GeneralPrefs
+	}
+	if conv != nil && conv.GeneralPrefs != nil {
+		convGeneral = conv.GeneralPrefs
+	}
+
+	return &EffectivePrefs{
+		ConversationID: conversationID,
+		TextEntered: resolveOption(
+			convGeneral.TextEntered,
+			globalGeneral.TextEntered,
+			defaults.TextEntered,
+		),
+		TextModified: resolveOption(
+			convGeneral.TextModified,
+			globalGeneral.TextModified,
+			defaults.TextModified,
+		),
+		Tag: resolveOption(convGeneral.Tag, globalGeneral.Tag, defaults.Tag),
+		Role: resolveOption(
+			convGeneral.Role,
+			globalGeneral.Role,
+			defaults.Role,
+		),
+		QuietHours: resolveQuietHours(
+			convGeneral.QuietHours,
+			globalGeneral.QuietHours,
+		),
+		Digest: resolveDigest(convGeneral.Digest, globalGeneral.Digest),
+	}
+}
+
+func resolveDigest(conv, global *Digest) EffectiveDigest {
+	if conv != nil {
+		return EffectiveDigest{conv, SourceConversation}
+	}
+	if global != nil {
+		return EffectiveDigest{global, SourceGlobal}
+	}
+	return EffectiveDigest{NewDigest(), SourceDefault}
+}
+
+func resolveQuietHours(conv, global *QuietHours) EffectiveQuietHours {
+	if conv != nil {
+		return EffectiveQuietHours{conv, SourceConversation}
+	}
+	if global != nil {
+		return EffectiveQuietHours{global, SourceGlobal}
+	}
+	return EffectiveQuietHours{nil, SourceDefault}
+}
+
+// GetEffectivePrefs gets the effective preferences of a user for a
+// conversation at time t. Missing user or conversation preferences are not an
+// error, the next layer is used instead.
+func GetEffectivePrefs(
+	ctx context.Context,
+	db Datastore,
+	userID,
+	conversationID int,
+	t time.Time,
+) (*EffectivePrefs, error) {
+	global, err := db.GetPrefs(ctx, userID)
+	if err == ErrPrefsDNE {
+		return ResolvePrefs(conversationID, nil, nil, t), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	conv, err := db.GetPrefsConv(ctx, userID, conversationID)
+	if err != nil && err != ErrPrefsConvDNE && err != ErrPrefsDNE {
+		return nil, err
+	}
+
+	prefs := ResolvePrefs(conversationID, global, conv, t)
+	if prefs.InQuietHours, err = prefs.QuietHours.Value.Active(t); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error is an error of models with a stable Code, which clients can rely on
+// to tell errors apart while their messages change
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// CodeValidationFailed is the code of a ValidationError
+const CodeValidationFailed = "validation_failed"
+
+// ErrorCode returns the stable code of err, or "" if it is not an error of
+// models
+func ErrorCode(err error) string {
+	var modelsErr *Error
+	if errors.As(err, &modelsErr) {
+		return modelsErr.Code
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return CodeValidationFailed
+	}
+	return ""
+}
+
+// FieldError is an invalid field and the values that it allows
+type FieldError struct {
+	// Field is the path of the field in the document, e.g.
+	// global.digest.hour or conversation[0].role
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	// Allowed are the values that the field allows, or their range such as
+	// "0-23". It is empty when they can't be listed, e.g. for time zones.
+	Allowed []string `json:"allowed,omitempty"`
+}
+
+// ValidationError lists every invalid field of a document
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		names[i] = f.Field
+	}
+	return fmt.Sprintf("invalid value for %v", names)
+}
+
+// Add records that field is invalid for reason
+func (e *ValidationError) Add(field, reason string, allowed ...string) {
+	e.Fields = append(e.Fields, FieldError{field, reason, allowed})
+}
+
+// merge adds the invalid fields of err, which are relative to the field at
+// prefix, and reports whether err was a ValidationError. A field without a
+// name is the one at prefix.
+func (e *ValidationError) merge(prefix string, err error) bool {
+	var nested *ValidationError
+	if !errors.As(err, &nested) {
+		return false
+	}
+	for _, f := range nested.Fields {
+		if f.Field == "" {
+			f.Field = strings.TrimSuffix(prefix, ".")
+		} else {
+			f.Field = prefix + f.Field
+		}
+		e.Fields = append(e.Fields, f)
+	}
+	return true
+}
+
+// Err returns e if it has invalid fields, and nil otherwise
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
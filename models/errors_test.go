@@ -0,0 +1,87 @@
+package models_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"pest-control/models"
+)
+
+func TestValidationError(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Data   string
+		Fields map[string][]string
+	}{
+		{
+			Name: "Invalid options",
+			Data: `{"global": {"tag": ["email", "pigeon"], "role": 3}}`,
+			Fields: map[string][]string{
+				"global.tag":  {"browser", "email"},
+				"global.role": {"browser", "email"},
+			},
+		},
+		{
+			Name: "Invalid digest and quiet hours",
+			Data: `{"conversation": [
+				{"conversation_id": 1},
+				{"conversation_id": 2, "digest": {"frequency": "monthly"}, "quiet_hours": {"timezone": "Mars/Olympus"}}
+			]}`,
+			Fields: map[string][]string{
+				"conversation[1].digest.frequency":     {"immediate", "hourly", "daily", "weekly"},
+				"conversation[1].quiet_hours.timezone": nil,
+			},
+		},
+		{
+			Name: "Duplicated conversation",
+			Data: `{"conversation": [
+				{"conversation_id": 1},
+				{"conversation_id": 2},
+				{"conversation_id": 1, "role": "none"}
+			]}`,
+			Fields: map[string][]string{"conversation[2].conversation_id": nil},
+		},
+		{
+			Name: "Valid preferences",
+			Data: `{"global": {"tag": ["email"]}, "conversation": [{"conversation_id": 1, "role": "none"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := json.Unmarshal([]byte(test.Data), models.NewPreferences())
+			if len(test.Fields) == 0 {
+				if err != nil {
+					t.Fatalf("Unexpected error while decoding: %s", err)
+				}
+				return
+			}
+
+			var invalid *models.ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("Expected a validation error, got %v", err)
+			}
+			if models.ErrorCode(err) != models.CodeValidationFailed {
+				t.Errorf("Incorrect code %q", models.ErrorCode(err))
+			}
+			fields := map[string][]string{}
+			for _, f := range invalid.Fields {
+				fields[f.Field] = f.Allowed
+			}
+			if !reflect.DeepEqual(test.Fields, fields) {
+				t.Errorf("Incorrect invalid fields, expected %v, got %v", test.Fields, fields)
+			}
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	if code := models.ErrorCode(models.ErrPrefsDNE); code != "prefs_not_found" {
+		t.Errorf("Incorrect code of ErrPrefsDNE %q", code)
+	}
+	if code := models.ErrorCode(errors.New("write failed")); code != "" {
+		t.Errorf("Error of another package has code %q", code)
+	}
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// HealthDatastore is a Datastore that can check whether it is able to serve
+// requests
+type HealthDatastore interface {
+	Datastore
+	// CheckConnection checks that the datastore can be reached
+	CheckConnection(context.Context) error
+	// PendingMigrations returns the migrations that have not been applied
+	PendingMigrations(context.Context) ([]Migration, error)
+}
+
+// CheckConnection pings the primary, which every write goes to
+func (db *DB) CheckConnection(ctx context.Context) error {
+	ctx, end := db.start(ctx, "CheckConnection")
+	defer end()
+	return db.Ping(ctx, readpref.Primary())
+}
+
+// CheckConnection always succeeds, since MemDB is in memory
+func (mdb *MemDB) CheckConnection(ctx context.Context) error {
+	return nil
+}
+
+// PendingMigrations is always empty, since MemDB only stores the current
+// format
+func (mdb *MemDB) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	return []Migration{}, nil
+}
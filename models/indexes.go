@@ -0,0 +1,151 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"pest-control/logging"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// duplicateKeyCode is the code of the error returned by MongoDB for a write
+// that violates a unique index
+const duplicateKeyCode = 11000
+
+// namespaceNotFoundCode is the code of the error returned by MongoDB for a
+// command on a collection that does not exist
+const namespaceNotFoundCode = 26
+
+// indexes returns the indexes that DB needs. The unique index on user_id is
+// what keeps CreatePrefs and ReplacePrefs from creating two documents for a
+// user, and the multikey index on conversation.conversation_id serves the
+// lookups of a user's conversation. With TenantField tenancy both are
+// prefixed with tenant_id, so a user ID can be used by every tenant.
+func (db *DB) indexes() []mongo.IndexModel {
+	if db.config.Tenancy == TenantField {
+		return []mongo.IndexModel{
+			{
+				Keys:    bson.D{{"tenant_id", 1}, {"user_id", 1}},
+				Options: options.Index().SetName("tenant_id_user_id").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{"tenant_id", 1}, {"conversation.conversation_id", 1}},
+				Options: options.Index().SetName("tenant_id_conversation.conversation_id"),
+			},
+		}
+	}
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{"user_id", 1}},
+			Options: options.Index().SetName("user_id").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{"conversation.conversation_id", 1}},
+			Options: options.Index().SetName("conversation.conversation_id"),
+		},
+	}
+}
+
+type indexSpec struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"`
+	Unique bool   `bson:"unique"`
+}
+
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// Key directions may be stored as any numeric type
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateIndexes creates the indexes that are missing from the prefs and audit
+// collections and returns their names. An existing index on the same keys but
+// with other options is reported as an error rather than replaced, since
+// dropping it would have to be done with care on a live collection.
+func (db *DB) CreateIndexes(ctx context.Context) ([]string, error) {
+	created, err := createIndexes(ctx, db.prefsCollection(), db.indexes())
+	if err != nil {
+		return created, err
+	}
+	audit, err := createIndexes(ctx, db.auditCollection(), db.auditIndexes())
+	if err == nil {
+		db.markIndexed()
+	}
+	return append(created, audit...), err
+}
+
+// createIndexes creates the indexes that are missing from collection
+func createIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) ([]string, error) {
+	existing := []indexSpec{}
+	cursor, err := collection.Indexes().List(ctx)
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == namespaceNotFoundCode {
+		// The collection is created with the first index
+	} else if err != nil {
+		logging.FromContext(ctx).Error("failed to list indexes of MongoDB collection", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	} else if err := cursor.All(ctx, &existing); err != nil {
+		logging.FromContext(ctx).Error("failed to decode indexes", logging.Fields{"error": err})
+		return nil, err
+	}
+
+	created := []string{}
+	for _, index := range indexes {
+		keys := index.Keys.(bson.D)
+		unique := index.Options.Unique != nil && *index.Options.Unique
+
+		found := false
+		for _, spec := range existing {
+			if !sameKeys(keys, spec.Key) {
+				continue
+			}
+			if spec.Unique != unique {
+				return created, fmt.Errorf(
+					"index %s exists with unique set to %t",
+					spec.Name,
+					spec.Unique,
+				)
+			}
+			found = true
+			break
+		}
+		if found {
+			continue
+		}
+
+		name, err := collection.Indexes().CreateOne(ctx, index)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to create index", logging.Fields{
+				"index": *index.Options.Name,
+				"error": err,
+			})
+			return created, err
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+func isDuplicateKeyError(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, writeErr := range e.WriteErrors {
+			if writeErr.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == duplicateKeyCode
+	}
+	return false
+}
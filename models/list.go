@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"pest-control/logging"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ListConvQuery selects a page of a user's conversation preferences
+type ListConvQuery struct {
+	// After is the conversation ID that the page starts after, if any
+	After *int
+	// Limit is the maximum number of conversation preferences returned
+	Limit      int
+	Descending bool
+	// Filter holds the Option values that conversation preferences must have,
+	// empty fields match anything
+	Filter GeneralPrefs
+}
+
+func (q *ListConvQuery) matches(conv *ConversationPrefs) bool {
+	if q.After != nil {
+		if q.Descending && conv.ConversationID >= *q.After {
+			return false
+		} else if !q.Descending && conv.ConversationID <= *q.After {
+			return false
+		}
+	}
+
+	general := conv.GeneralPrefs
+	if general == nil {
+		general = &GeneralPrefs{}
+	}
+	for _, event := range []Event{EventTextEntered, EventTextModified, EventTag, EventRole} {
+		if option := q.Filter.option(event); option != "" && general.option(event) != option {
+			return false
+		}
+	}
+	return true
+}
+
+func (mdb *MemDB) ListPrefsConv(ctx context.Context, userID int, query *ListConvQuery) ([]*ConversationPrefs, error) {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	prefs, ok := mdb.prefs[userID]
+	if !ok {
+		return nil, ErrPrefsDNE
+	}
+
+	now := time.Now()
+	convs := []*ConversationPrefs{}
+	for _, conv := range prefs.Conversation {
+		if query.matches(conv) {
+			conv = copyConversationPrefs(conv)
+			conv.expireMute(now)
+			convs = append(convs, conv)
+		}
+	}
+
+	sort.Slice(convs, func(i, j int) bool {
+		if query.Descending {
+			return convs[i].ConversationID > convs[j].ConversationID
+		}
+		return convs[i].ConversationID < convs[j].ConversationID
+	})
+	if query.Limit > 0 && len(convs) > query.Limit {
+		convs = convs[:query.Limit]
+	}
+	return convs, nil
+}
+
+// optionFilter matches an array of channels that is equal to the Option as
+// a set
+func optionFilter(option Option) bson.D {
+	chans := option.Channels()
+	if len(chans) == 0 {
+		return bson.D{{"$size", 0}}
+	}
+	return bson.D{{"$size", len(chans)}, {"$all", chans}}
+}
+
+// ListPrefsConv lists a page of a user's conversation preferences sorted by
+// conversation ID
+func (db *DB) ListPrefsConv(ctx context.Context, userID int, query *ListConvQuery) ([]*ConversationPrefs, error) {
+	ctx, end := db.start(ctx, "ListPrefsConv")
+	defer end()
+
+	match := bson.D{}
+	sortOrder := 1
+	if query.Descending {
+		sortOrder = -1
+	}
+	if query.After != nil {
+		op := "$gt"
+		if query.Descending {
+			op = "$lt"
+		}
+		match = append(match, bson.E{"conversation_id", bson.D{{op, *query.After}}})
+	}
+	for _, event := range []Event{EventTextEntered, EventTextModified, EventTag, EventRole} {
+		if option := query.Filter.option(event); option != "" {
+			match = append(match, bson.E{string(event), optionFilter(option)})
+		}
+	}
+
+	pipeline := bson.A{
+		bson.D{{"$match", db.scope(bson.D{{"user_id", userID}})}},
+		bson.D{{"$unwind", "$conversation"}},
+		bson.D{{"$replaceRoot", bson.D{{"newRoot", "$conversation"}}}},
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"conversation_id", sortOrder}}}},
+	}
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{"$limit", query.Limit}})
+	}
+
+	collection := db.prefsCollection()
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to list conversation preferences from MongoDB collection", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	convs := []*ConversationPrefs{}
+	if err := cursor.All(ctx, &convs); err != nil {
+		logging.FromContext(ctx).Error("failed to decode conversation preferences", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, conv := range convs {
+		conv.expireMute(now)
+	}
+
+	// An empty page may also mean that the user has no preferences at all
+	if len(convs) == 0 {
+		count, err := collection.CountDocuments(
+			ctx,
+			db.scope(bson.D{{"user_id", userID}}),
+		)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to count preferences in MongoDB collection", logging.Fields{
+				"error": err,
+			})
+			return nil, err
+		} else if count == 0 {
+			return nil, ErrPrefsDNE
+		}
+	}
+
+	return convs, nil
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemDB is an in-memory Datastore that mirrors the semantics of DB. It is
+// safe for concurrent use and is intended for local development and tests.
+type MemDB struct {
+	mu    sync.RWMutex
+	prefs map[int]*Preferences
+	// audit holds the audit entries of every user in the order they were
+	// recorded
+	audit []*AuditEntry
+
+	tenantsMu sync.Mutex
+	tenants   map[string]*MemDB
+}
+
+func NewMemDB() *MemDB {
+	return &MemDB{prefs: map[int]*Preferences{}}
+}
+
+func copyGeneralPrefs(g *GeneralPrefs) *GeneralPrefs {
+	if g == nil {
+		return nil
+	}
+	c := *g
+	c.QuietHours = copyQuietHours(g.QuietHours)
+	c.Digest = copyDigest(g.Digest)
+	return &c
+}
+
+func copyGlobalPrefs(g *GlobalPrefs) *GlobalPrefs {
+	if g == nil {
+		return nil
+	}
+	return &GlobalPrefs{
+		Invitation:   g.Invitation,
+		GeneralPrefs: copyGeneralPrefs(g.GeneralPrefs),
+		Version:      g.Version,
+	}
+}
+
+func copyConversationPrefs(c *ConversationPrefs) *ConversationPrefs {
+	if c == nil {
+		return nil
+	}
+	copied := &ConversationPrefs{
+		ConversationID: c.ConversationID,
+		GeneralPrefs:   copyGeneralPrefs(c.GeneralPrefs),
+		Version:        c.Version,
+	}
+	if c.MutedUntil != nil {
+		mutedUntil := *c.MutedUntil
+		copied.MutedUntil = &mutedUntil
+	}
+	return copied
+}
+
+func copyPreferences(p *Preferences) *Preferences {
+	c := &Preferences{
+		ID:      p.ID,
+		UserID:  p.UserID,
+		Global:  copyGlobalPrefs(p.Global),
+		Version: p.Version,
+	}
+	if p.Conversation != nil {
+		c.Conversation = make([]*ConversationPrefs, len(p.Conversation))
+		for i, conv := range p.Conversation {
+			c.Conversation[i] = copyConversationPrefs(conv)
+		}
+	}
+	return c
+}
+
+// patchGeneralPrefs overwrites the fields of dst with the non-empty fields of
+// src, which is the same behaviour as the $set built by createUpdateBSON.
+func patchGeneralPrefs(dst **GeneralPrefs, src *GeneralPrefs) {
+	if src == nil {
+		return
+	}
+	if *dst == nil {
+		*dst = &GeneralPrefs{}
+	}
+	if src.TextEntered != "" {
+		(*dst).TextEntered = src.TextEntered
+	}
+	if src.TextModified != "" {
+		(*dst).TextModified = src.TextModified
+	}
+	if src.Tag != "" {
+		(*dst).Tag = src.Tag
+	}
+	if src.Role != "" {
+		(*dst).Role = src.Role
+	}
+	if src.QuietHours != nil {
+		(*dst).QuietHours = copyQuietHours(src.QuietHours)
+	}
+	if src.Digest != nil {
+		(*dst).Digest = copyDigest(src.Digest)
+	}
+}
+
+// set reports whether any field of g would be written by patchGeneralPrefs,
+// like an update built by createUpdateBSON an empty patch is not a write
+func (g *GeneralPrefs) set() bool {
+	return g != nil && (g.TextEntered != "" || g.TextModified != "" ||
+		g.Tag != "" || g.Role != "" || g.QuietHours != nil || g.Digest != nil)
+}
+
+func (p *Preferences) checkVersion(version int64) error {
+	if version != AnyVersion && version != p.Version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+func (p *Preferences) findConv(conversationID int) int {
+	for i, conv := range p.Conversation {
+		if conv != nil && conv.ConversationID == conversationID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (mdb *MemDB) GetPrefs(ctx context.Context, userID int) (*GlobalPrefs, error) {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	prefs, ok := mdb.prefs[userID]
+	if !ok {
+		return nil, ErrPrefsDNE
+	}
+	global := copyGlobalPrefs(prefs.Global)
+	if global != nil {
+		global.Version = prefs.Version
+	}
+	return global, nil
+}
+
+func (mdb *MemDB) GetPrefsConv(ctx context.Context, userID, conversationID int) (*ConversationPrefs, error) {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	prefs, ok := mdb.prefs[userID]
+	if !ok {
+		return nil, ErrPrefsDNE
+	}
+	return prefs.storedConv(conversationID)
+}
+
+func (mdb *MemDB) CreatePrefs(ctx context.Context, prefs *Preferences) error {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if _, ok := mdb.prefs[prefs.UserID]; ok {
+		return ErrPrefsExists
+	}
+
+	prefs.ID = primitive.NewObjectID().Hex()
+	prefs.Version = 1
+	mdb.prefs[prefs.UserID] = copyPreferences(prefs)
+	return nil
+}
+
+// current returns a copy of a user's preferences without the mutes that have
+// ended, or nil if they don't exist. mdb.mu must be held.
+func (mdb *MemDB) current(userID int) *Preferences {
+	prefs, ok := mdb.prefs[userID]
+	if !ok {
+		return nil
+	}
+	current := copyPreferences(prefs)
+	current.expireMutes(time.Now())
+	return current
+}
+
+// store stores prefs as a user's preferences, or deletes them if it is nil,
+// and returns the Change from current. Preferences that are current are left
+// as they are. mdb.mu must be held for writing.
+func (mdb *MemDB) store(userID int, current, prefs *Preferences) *Change {
+	switch {
+	case prefs == current:
+		return &Change{Before: current, After: current}
+	case prefs == nil:
+		delete(mdb.prefs, userID)
+		return &Change{Before: current}
+	}
+
+	stored := copyPreferences(prefs)
+	stored.UserID = userID
+	if current != nil {
+		stored.ID = current.ID
+		stored.Version = current.Version + 1
+	} else {
+		stored.ID = primitive.NewObjectID().Hex()
+		stored.Version = 1
+	}
+	mdb.prefs[userID] = stored
+	return &Change{Before: current, After: copyPreferences(stored)}
+}
+
+// write makes a write to a user's preferences and returns its Change. write
+// is passed their current preferences, or nil if they don't exist, and
+// returns them as the write leaves them.
+func (mdb *MemDB) write(userID int, write func(*Preferences) (*Preferences, error)) (*Change, error) {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	current := mdb.current(userID)
+	prefs, err := write(current)
+	if err != nil {
+		return nil, err
+	}
+	return mdb.store(userID, current, prefs), nil
+}
+
+func (mdb *MemDB) CreatePrefsConv(ctx context.Context, userID int, convPrefs *ConversationPrefs) error {
+	_, err := mdb.CreatePrefsConvChange(ctx, userID, convPrefs)
+	return err
+}
+
+func (mdb *MemDB) CreatePrefsConvChange(
+	ctx context.Context,
+	userID int,
+	convPrefs *ConversationPrefs,
+) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return createdPrefsConv(current, convPrefs)
+	})
+}
+
+func (mdb *MemDB) DeletePrefs(ctx context.Context, userID int, version int64) error {
+	_, err := mdb.DeletePrefsChange(ctx, userID, version)
+	return err
+}
+
+func (mdb *MemDB) DeletePrefsChange(ctx context.Context, userID int, version int64) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return deletedPrefs(current, version)
+	})
+}
+
+func (mdb *MemDB) DeletePrefsConv(ctx context.Context, userID, conversationID int, version int64) error {
+	_, err := mdb.DeletePrefsConvChange(ctx, userID, conversationID, version)
+	return err
+}
+
+func (mdb *MemDB) DeletePrefsConvChange(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	version int64,
+) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return deletedPrefsConv(current, conversationID, version)
+	})
+}
+
+func (mdb *MemDB) PatchPrefs(ctx context.Context, userID int, patch *GlobalPrefs, version int64) (*GlobalPrefs, error) {
+	change, err := mdb.PatchPrefsChange(ctx, userID, patch, version)
+	if err != nil {
+		return nil, err
+	}
+	return change.GlobalPrefs(), nil
+}
+
+func (mdb *MemDB) PatchPrefsChange(
+	ctx context.Context,
+	userID int,
+	patch *GlobalPrefs,
+	version int64,
+) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return patchedPrefs(current, patch, version)
+	})
+}
+
+func (mdb *MemDB) PatchPrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	patch *ConversationPrefs,
+	version int64,
+) (*ConversationPrefs, error) {
+	change, err := mdb.PatchPrefsConvChange(ctx, userID, conversationID, patch, version)
+	if err != nil {
+		return nil, err
+	}
+	return change.ConversationPrefs(conversationID)
+}
+
+func (mdb *MemDB) PatchPrefsConvChange(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	patch *ConversationPrefs,
+	version int64,
+) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return patchedPrefsConv(current, conversationID, patch, version)
+	})
+}
@@ -0,0 +1,26 @@
+package models_test
+
+import (
+	"testing"
+
+	"pest-control/models"
+	"pest-control/models/storetest"
+)
+
+func TestMemDB(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) models.Datastore {
+		return models.NewMemDB()
+	})
+}
+
+func TestMemDBTenants(t *testing.T) {
+	storetest.RunTenants(t, func(t *testing.T) models.TenantDatastore {
+		return models.NewMemDB()
+	})
+}
+
+func TestMemDBAuditLog(t *testing.T) {
+	storetest.RunAuditLog(t, func(t *testing.T) models.AuditedDatastore {
+		return models.NewMemDB()
+	})
+}
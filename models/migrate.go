@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"pest-control/logging"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// optionFields are the paths of every Option in a preferences document
+var optionFields = []string{
+	"global.invitation",
+	"global.text_entered",
+	"global.text_modified",
+	"global.tag",
+	"global.role",
+	"conversation.text_entered",
+	"conversation.text_modified",
+	"conversation.tag",
+	"conversation.role",
+}
+
+// legacyOptionsFilter matches the preferences that have an Option stored as
+// a legacy string
+func legacyOptionsFilter() bson.D {
+	legacy := bson.A{}
+	for _, field := range optionFields {
+		legacy = append(legacy, bson.D{{field, bson.D{{"$type", "string"}}}})
+	}
+	return bson.D{{"$or", legacy}}
+}
+
+func (db *DB) countLegacyOptions(ctx context.Context) (int64, error) {
+	collection := db.prefsCollection()
+	return collection.CountDocuments(ctx, legacyOptionsFilter())
+}
+
+// migrateOptionSets rewrites the legacy Option strings of stored preferences
+// as arrays of channels. It is safe to run more than once and returns the
+// number of documents that were changed.
+func (db *DB) migrateOptionSets(ctx context.Context) (int64, error) {
+	filter := legacyOptionsFilter()
+
+	collection := db.prefsCollection()
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to find legacy preferences in MongoDB collection", logging.Fields{
+			"error": err,
+		})
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var migrated int64
+	for cursor.Next(ctx) {
+		changed, err := db.migrateLegacyPrefs(ctx, cursor.Current)
+		if err != nil {
+			return migrated, err
+		}
+		if changed {
+			migrated++
+		}
+	}
+
+	return migrated, cursor.Err()
+}
+
+// migrateLegacyPrefs rewrites the legacy Options of a preferences document.
+// The write only applies to the version of the document that was read, so
+// that concurrent writes aren't lost, and is retried with the document read
+// again if it was changed in the meantime. It returns false if another write
+// left no legacy Options in the document.
+func (db *DB) migrateLegacyPrefs(ctx context.Context, doc bson.Raw) (bool, error) {
+	collection := db.prefsCollection()
+	id := doc.Lookup("_id")
+	for attempt := 0; ; attempt++ {
+		// Decoding converts the legacy strings and encoding writes them back
+		// as arrays
+		prefs := &Preferences{}
+		if err := bson.Unmarshal(doc, prefs); err != nil {
+			logging.FromContext(ctx).Error("failed to decode legacy preferences", logging.Fields{
+				"error": err,
+			})
+			return false, err
+		}
+
+		filter := bson.D{{"_id", id}}
+		if prefs.Version == 0 {
+			filter = append(filter, bson.E{"version", bson.D{{"$exists", false}}})
+		} else {
+			filter = append(filter, bson.E{"version", prefs.Version})
+		}
+		update := bson.D{
+			{"$set", bson.D{
+				{"global", prefs.Global},
+				{"conversation", prefs.Conversation},
+			}},
+			{"$inc", bson.D{{"version", 1}}},
+		}
+		updateResult, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to migrate preferences for user", logging.Fields{
+				"user_id": prefs.UserID,
+				"error":   err,
+			})
+			return false, err
+		}
+		if updateResult.MatchedCount > 0 {
+			return true, nil
+		}
+		if attempt+1 == maxReplaceAttempts {
+			logging.FromContext(ctx).Error("preferences for user kept changing during migration", logging.Fields{
+				"user_id": prefs.UserID,
+			})
+			return false, ErrVersionMismatch
+		}
+
+		// The document was changed since it was read, so it is migrated
+		// again from its new version if it still has legacy Options
+		filter = append(bson.D{{"_id", id}}, legacyOptionsFilter()...)
+		doc, err = collection.FindOne(ctx, filter).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		} else if err != nil {
+			logging.FromContext(ctx).Error("failed to find legacy preferences in MongoDB collection", logging.Fields{
+				"user_id": prefs.UserID,
+				"error":   err,
+			})
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"pest-control/logging"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is a change to the stored preferences documents. Migrations are
+// applied in the order of their IDs and each one is applied once. Apply must
+// be safe to run again if it fails partway, since it is then retried.
+type Migration struct {
+	ID          int
+	Description string
+	// Count returns the number of documents that Apply would change
+	Count func(db *DB, ctx context.Context) (int64, error)
+	// Apply changes the documents and returns the number that it changed
+	Apply func(db *DB, ctx context.Context) (int64, error)
+}
+
+// migrations are every migration, in the order that they are applied. A
+// migration must never be removed or renumbered once it has been released.
+var migrations = []Migration{
+	{
+		ID:          1,
+		Description: "store Options as arrays of channels",
+		Count:       (*DB).countLegacyOptions,
+		Apply:       (*DB).migrateOptionSets,
+	},
+}
+
+const (
+	// migrationLockID is the ID of the document in the migrations collection
+	// that is held by the replica applying migrations
+	migrationLockID = "lock"
+	// migrationLockTTL is how long a lock is held without being renewed
+	// before another replica can take it over
+	migrationLockTTL = 10 * time.Minute
+	// migrationLockWait is how long to wait for another replica to release
+	// the lock
+	migrationLockWait = 2 * time.Minute
+	// migrationLockPoll is how often the lock is polled while waiting
+	migrationLockPoll = time.Second
+	// migrationLockRenew is how often the lock is renewed while migrations
+	// are applied
+	migrationLockRenew = migrationLockTTL / 5
+)
+
+var ErrMigrationLocked error = &Error{
+	Code:    "migrations_locked",
+	Message: "migrations are locked by another replica",
+}
+
+// MigrationStep is the outcome of a migration in a MigrationReport
+type MigrationStep struct {
+	ID          int
+	Description string
+	// Documents is the number of documents that were changed, or that would
+	// be changed in a dry run
+	Documents int64
+}
+
+// MigrationReport describes the migrations run by Migrate
+type MigrationReport struct {
+	DryRun bool
+	Steps  []MigrationStep
+}
+
+func (r *MigrationReport) String() string {
+	if len(r.Steps) == 0 {
+		return "no pending migrations"
+	}
+
+	verb := "applied"
+	if r.DryRun {
+		verb = "would apply"
+	}
+	steps := make([]string, len(r.Steps))
+	for i, step := range r.Steps {
+		steps[i] = fmt.Sprintf(
+			"%d (%s, %d documents)",
+			step.ID,
+			step.Description,
+			step.Documents,
+		)
+	}
+	return fmt.Sprintf("%s migrations %s", verb, strings.Join(steps, ", "))
+}
+
+type appliedMigration struct {
+	ID          int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+	Documents   int64     `bson:"documents"`
+}
+
+func (db *DB) migrationsCollection() *mongo.Collection {
+	return db.database().Collection(db.config.MigrationsCollection)
+}
+
+// PendingMigrations returns the migrations that have not been applied, in
+// the order that they would be applied. With TenantDatabase tenancy, the DB
+// of every tenant also returns those that are pending in any tenant's
+// database, so that the readiness probe covers the databases of tenants.
+func (db *DB) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	pending, err := db.pendingMigrations(ctx)
+	if err != nil || db.config.Tenancy != TenantDatabase || db.tenant != "" {
+		return pending, err
+	}
+
+	tenants, err := db.Tenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := map[int]bool{}
+	for _, m := range pending {
+		found[m.ID] = true
+	}
+	for _, tenant := range tenants {
+		tenantPending, err := db.TenantDB(tenant).pendingMigrations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range tenantPending {
+			found[m.ID] = true
+		}
+	}
+
+	pending = []Migration{}
+	for _, m := range migrations {
+		if found[m.ID] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// pendingMigrations returns the migrations that have not been applied to the
+// database of db
+func (db *DB) pendingMigrations(ctx context.Context) ([]Migration, error) {
+	filter := bson.D{{"_id", bson.D{{"$type", "number"}}}}
+	cursor, err := db.migrationsCollection().Find(ctx, filter)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to find applied migrations", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+	applied := []appliedMigration{}
+	if err := cursor.All(ctx, &applied); err != nil {
+		logging.FromContext(ctx).Error("failed to decode applied migrations", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+
+	done := map[int]bool{}
+	for _, m := range applied {
+		done[m.ID] = true
+	}
+	pending := []Migration{}
+	for _, m := range migrations {
+		if !done[m.ID] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// lockMigrations takes the migration lock for owner, or renews it if owner
+// already holds it. A lock that has expired is taken over.
+func (db *DB) lockMigrations(ctx context.Context, owner string) error {
+	now := time.Now()
+	filter := bson.D{
+		{"_id", migrationLockID},
+		{"$or", bson.A{
+			bson.D{{"owner", owner}},
+			bson.D{{"expires_at", bson.D{{"$lt", now}}}},
+		}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"owner", owner},
+		{"expires_at", now.Add(migrationLockTTL)},
+	}}}
+	opts := options.Update().SetUpsert(true)
+
+	// When the lock is held, the filter doesn't match and the upsert fails
+	// on the _id of the existing lock
+	_, err := db.migrationsCollection().UpdateOne(ctx, filter, update, opts)
+	if isDuplicateKeyError(err) {
+		return ErrMigrationLocked
+	}
+	return err
+}
+
+// unlockMigrations releases the migration lock of owner. It isn't given the
+// context of Migrate, so that the lock is released when that is canceled.
+func (db *DB) unlockMigrations(owner string) {
+	filter := bson.D{{"_id", migrationLockID}, {"owner", owner}}
+	if _, err := db.migrationsCollection().DeleteOne(context.Background(), filter); err != nil {
+		logging.Default().Error("failed to release migration lock", logging.Fields{"error": err})
+	}
+}
+
+// keepLockMigrations renews the migration lock of owner on a ticker until
+// the returned function is called, so that it can't expire during a long
+// migration. The returned context is canceled if the lock is lost.
+func (db *DB) keepLockMigrations(ctx context.Context, owner string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(migrationLockRenew)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := db.lockMigrations(ctx, owner); err != nil && ctx.Err() == nil {
+				logging.FromContext(ctx).Error("failed to renew migration lock", logging.Fields{
+					"error": err,
+				})
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitLockMigrations takes the migration lock for owner, waiting for another
+// replica to release it
+func (db *DB) waitLockMigrations(ctx context.Context, owner string) error {
+	deadline := time.Now().Add(migrationLockWait)
+	for {
+		err := db.lockMigrations(ctx, owner)
+		if err != ErrMigrationLocked || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationLockPoll):
+		}
+	}
+}
+
+// Migrate applies the pending migrations in order and records them in the
+// migrations collection. Only one replica applies migrations at a time, the
+// others wait for it and then find nothing left to apply. With dryRun, the
+// number of documents that each pending migration would change is reported
+// and nothing is changed.
+func (db *DB) Migrate(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, Steps: []MigrationStep{}}
+
+	if dryRun {
+		pending, err := db.pendingMigrations(ctx)
+		if err != nil {
+			return report, err
+		}
+		for _, m := range pending {
+			count, err := m.Count(db, ctx)
+			if err != nil {
+				logging.FromContext(ctx).Error("failed to count documents of migration", logging.Fields{
+					"migration": m.ID,
+					"error":     err,
+				})
+				return report, err
+			}
+			report.Steps = append(report.Steps, MigrationStep{m.ID, m.Description, count})
+		}
+		return report, nil
+	}
+
+	owner := primitive.NewObjectID().Hex()
+	if err := db.waitLockMigrations(ctx, owner); err != nil {
+		logging.FromContext(ctx).Error("failed to lock migrations", logging.Fields{"error": err})
+		return report, err
+	}
+	defer db.unlockMigrations(owner)
+	ctx, release := db.keepLockMigrations(ctx, owner)
+	defer release()
+
+	// Read the pending migrations while holding the lock, since the replica
+	// that held it before may have applied them
+	pending, err := db.pendingMigrations(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for _, m := range pending {
+		changed, err := m.Apply(db, ctx)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to apply migration", logging.Fields{
+				"migration": m.ID,
+				"error":     err,
+			})
+			return report, err
+		}
+
+		record := &appliedMigration{
+			ID:          m.ID,
+			Description: m.Description,
+			AppliedAt:   time.Now(),
+			Documents:   changed,
+		}
+		if _, err := db.migrationsCollection().InsertOne(ctx, record); err != nil {
+			logging.FromContext(ctx).Error("failed to record migration", logging.Fields{
+				"migration": m.ID,
+				"error":     err,
+			})
+			return report, err
+		}
+		report.Steps = append(report.Steps, MigrationStep{m.ID, m.Description, changed})
+	}
+	return report, nil
+}
@@ -1,46 +1,122 @@
 package models
 
+import (
+	"context"
+	"time"
+)
+
 type MockDB struct {
-	Prefs     *Preferences
-	GetErr    error
-	CreateErr error
-	DeleteErr error
-	PatchErr  error
+	Prefs      *Preferences
+	Recipients Recipients
+	Digests    []DueDigest
+	GetErr     error
+	CreateErr  error
+	DeleteErr  error
+	PatchErr   error
+	// PingErr and MigrationsErr fail the health checks, and Pending are the
+	// pending migrations
+	PingErr       error
+	MigrationsErr error
+	Pending       []Migration
 }
 
-func (mdb *MockDB) GetPrefs(userID int) (*GlobalPrefs, error) {
+func (mdb *MockDB) GetPrefs(ctx context.Context, userID int) (*GlobalPrefs, error) {
 	return mdb.Prefs.Global, mdb.GetErr
 }
 
-func (mdb *MockDB) GetPrefsConv(userID, conversationID int) (*ConversationPrefs, error) {
+func (mdb *MockDB) GetPrefsConv(ctx context.Context, userID, conversationID int) (*ConversationPrefs, error) {
 	return mdb.Prefs.Conversation[0], mdb.GetErr
 }
 
-func (mdb *MockDB) CreatePrefs(prefs *Preferences) error {
+func (mdb *MockDB) CreatePrefs(ctx context.Context, prefs *Preferences) error {
 	prefs.ID = mdb.Prefs.ID
 	return mdb.CreateErr
 }
 
-func (mdb *MockDB) CreatePrefsConv(userID int, convPrefs *ConversationPrefs) error {
+func (mdb *MockDB) CreatePrefsConv(ctx context.Context, userID int, convPrefs *ConversationPrefs) error {
 	return mdb.CreateErr
 }
 
-func (mdb *MockDB) DeletePrefs(userID int) error {
+func (mdb *MockDB) ReplacePrefs(ctx context.Context, prefs *Preferences) (bool, error) {
+	prefs.ID = mdb.Prefs.ID
+	return mdb.CreateErr == nil, mdb.CreateErr
+}
+
+func (mdb *MockDB) ReplacePrefsConv(
+	ctx context.Context,
+	userID int,
+	convPrefs *ConversationPrefs,
+) (bool, error) {
+	return mdb.CreateErr == nil, mdb.CreateErr
+}
+
+func (mdb *MockDB) DeletePrefs(ctx context.Context, userID int, version int64) error {
 	return mdb.DeleteErr
 }
 
-func (mdb *MockDB) DeletePrefsConv(userID, conversationID int) error {
+func (mdb *MockDB) DeletePrefsConv(ctx context.Context, userID, conversationID int, version int64) error {
 	return mdb.DeleteErr
 }
 
-func (mdb *MockDB) PatchPrefs(userID int, prefs *GlobalPrefs) error {
-	return mdb.PatchErr
+// PatchPrefs returns the global preferences of Prefs as those left by the
+// patch
+func (mdb *MockDB) PatchPrefs(ctx context.Context, userID int, prefs *GlobalPrefs, version int64) (*GlobalPrefs, error) {
+	if mdb.PatchErr != nil {
+		return nil, mdb.PatchErr
+	}
+	return mdb.Prefs.Global, nil
 }
 
 func (mdb *MockDB) PatchPrefsConv(
+	ctx context.Context,
 	userID,
 	conversationID int,
 	prefs *ConversationPrefs,
+	version int64,
+) (*ConversationPrefs, error) {
+	if mdb.PatchErr != nil {
+		return nil, mdb.PatchErr
+	}
+	return mdb.Prefs.Conversation[0], nil
+}
+
+func (mdb *MockDB) GetRecipients(
+	ctx context.Context,
+	conversationID int,
+	event Event,
+	userIDs []int,
+) (Recipients, error) {
+	return mdb.Recipients, mdb.GetErr
+}
+
+func (mdb *MockDB) ListPrefsConv(
+	ctx context.Context,
+	userID int,
+	query *ListConvQuery,
+) ([]*ConversationPrefs, error) {
+	return mdb.Prefs.Conversation, mdb.GetErr
+}
+
+func (mdb *MockDB) MutePrefsConv(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	until *time.Time,
 ) error {
 	return mdb.PatchErr
 }
+
+func (mdb *MockDB) GetDueDigests(ctx context.Context, t time.Time) ([]DueDigest, error) {
+	return mdb.Digests, mdb.GetErr
+}
+
+func (mdb *MockDB) CheckConnection(ctx context.Context) error {
+	return mdb.PingErr
+}
+
+func (mdb *MockDB) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	if mdb.MigrationsErr != nil {
+		return nil, mdb.MigrationsErr
+	}
+	return mdb.Pending, nil
+}
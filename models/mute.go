@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Muted reports whether the conversation is muted at time t
+func (c *ConversationPrefs) Muted(t time.Time) bool {
+	return c != nil && c.MutedUntil != nil && c.MutedUntil.After(t)
+}
+
+// expireMute drops the mute deadline if it has passed at time t, so that
+// expired mutes never have to be removed from the store
+func (c *ConversationPrefs) expireMute(t time.Time) {
+	if c != nil && !c.Muted(t) {
+		c.MutedUntil = nil
+	}
+}
+
+func (mdb *MemDB) MutePrefsConv(ctx context.Context, userID, conversationID int, until *time.Time) error {
+	_, err := mdb.MutePrefsConvChange(ctx, userID, conversationID, until)
+	return err
+}
+
+func (mdb *MemDB) MutePrefsConvChange(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	until *time.Time,
+) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return mutedPrefsConv(current, conversationID, until)
+	})
+}
+
+// MutePrefsConv mutes a user's conversation until the given time, or unmutes
+// it if the time is nil. The conversation preferences are left untouched.
+func (db *DB) MutePrefsConv(ctx context.Context, userID, conversationID int, until *time.Time) error {
+	_, err := db.MutePrefsConvChange(ctx, userID, conversationID, until)
+	return err
+}
+
+// MutePrefsConvChange makes the write of MutePrefsConv and returns its Change
+func (db *DB) MutePrefsConvChange(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	until *time.Time,
+) (*Change, error) {
+	ctx, end := db.start(ctx, "MutePrefsConv")
+	defer end()
+
+	filter := db.scope(bson.D{
+		{"user_id", userID},
+		{"conversation.conversation_id", conversationID},
+	})
+	update := bson.D{
+		{"$unset", bson.D{{"conversation.$.muted_until", ""}}},
+		{"$inc", bson.D{{"version", 1}}},
+	}
+	if until != nil {
+		update = bson.D{
+			{"$set", bson.D{{"conversation.$.muted_until", *until}}},
+			{"$inc", bson.D{{"version", 1}}},
+		}
+	}
+
+	before, err := db.updatePrefs(ctx, filter, update, convProjection(conversationID))
+	if err == mongo.ErrNoDocuments {
+		if _, err := db.GetPrefs(ctx, userID); err != nil {
+			return nil, err
+		}
+		return nil, ErrPrefsConvDNE
+	} else if err != nil {
+		return nil, err
+	}
+	after, err := mutedPrefsConv(before, conversationID, until)
+	if err != nil {
+		return nil, err
+	}
+	return updated(before, after), nil
+}
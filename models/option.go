@@ -0,0 +1,258 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Channel is a medium that notifications can be sent through
+type Channel string
+
+// Option is the set of channels that a user wants to be notified through for
+// an event. It is kept in a canonical form, the sorted channel names joined
+// by commas, so that Options can be compared and used as map keys. The empty
+// Option means that the preference is not set and None means that the set is
+// empty. In JSON and BSON an Option is an array of channels, but the legacy
+// strings "none", "email", "browser" and "all" are still accepted.
+type Option string
+
+const (
+	ChannelEmail   Channel = "email"
+	ChannelBrowser Channel = "browser"
+)
+
+const (
+	None    Option = "none"
+	Email   Option = Option(ChannelEmail)
+	Browser Option = Option(ChannelBrowser)
+	// All is the legacy "all" value, which only covered email and browser
+	All Option = Option(ChannelBrowser + "," + ChannelEmail)
+)
+
+var ErrInvalidChannel error = &Error{Code: "invalid_channel", Message: "invalid channel"}
+
+var (
+	channelsMu sync.RWMutex
+	channels   = map[Channel]bool{
+		ChannelEmail:   true,
+		ChannelBrowser: true,
+	}
+)
+
+// RegisterChannel makes a channel valid in Options. It panics if the channel
+// name is reserved, contains a comma or is already registered.
+func RegisterChannel(c Channel) {
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+
+	switch {
+	case c == "" || strings.Contains(string(c), ","):
+		panic(fmt.Sprintf("models: invalid channel name %q", c))
+	case Option(c) == None || c == "all":
+		panic(fmt.Sprintf("models: reserved channel name %q", c))
+	case channels[c]:
+		panic(fmt.Sprintf("models: channel %q registered twice", c))
+	}
+	channels[c] = true
+}
+
+// Channels returns the sorted registered channels
+func Channels() []Channel {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+
+	registered := make([]Channel, 0, len(channels))
+	for c := range channels {
+		registered = append(registered, c)
+	}
+	sort.Slice(registered, func(i, j int) bool { return registered[i] < registered[j] })
+	return registered
+}
+
+// channelNames returns the names of the registered channels, which are the
+// values that Options allow
+func channelNames() []string {
+	chans := Channels()
+	names := make([]string, len(chans))
+	for i, c := range chans {
+		names[i] = string(c)
+	}
+	return names
+}
+
+func (c Channel) Registered() bool {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+	return channels[c]
+}
+
+// NewOption returns the Option for a set of channels
+func NewOption(chans ...Channel) Option {
+	set := map[Channel]bool{}
+	names := []string{}
+	for _, c := range chans {
+		if !set[c] {
+			set[c] = true
+			names = append(names, string(c))
+		}
+	}
+	if len(names) == 0 {
+		return None
+	}
+	sort.Strings(names)
+	return Option(strings.Join(names, ","))
+}
+
+// ParseOption parses a legacy Option string or a comma separated list of
+// channels
+func ParseOption(s string) Option {
+	switch s {
+	case "":
+		return ""
+	case string(None):
+		return None
+	case "all":
+		return All
+	}
+
+	chans := []Channel{}
+	for _, name := range strings.Split(s, ",") {
+		chans = append(chans, Channel(strings.TrimSpace(name)))
+	}
+	return NewOption(chans...)
+}
+
+// Channels returns the channels of the Option, which is nil if the Option is
+// not set or is None
+func (o Option) Channels() []Channel {
+	if o == "" || o == None {
+		return nil
+	}
+	chans := []Channel{}
+	for _, name := range strings.Split(string(o), ",") {
+		chans = append(chans, Channel(name))
+	}
+	return chans
+}
+
+func (o Option) Has(c Channel) bool {
+	for _, channel := range o.Channels() {
+		if channel == c {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldError describes why the Option of a field is invalid
+func (o Option) fieldError(field string) FieldError {
+	reason := fmt.Sprintf("invalid option %q", o)
+	for _, c := range o.Channels() {
+		if !c.Registered() {
+			reason = fmt.Sprintf("unknown channel %q", c)
+			break
+		}
+	}
+	return FieldError{Field: field, Reason: reason, Allowed: channelNames()}
+}
+
+// invalidOption is the error of an Option that can't be decoded, which the
+// preferences holding it name the field of
+func invalidOption(reason string) error {
+	return &ValidationError{[]FieldError{{Reason: reason, Allowed: channelNames()}}}
+}
+
+// Valid reports whether the Option is set and only has registered channels
+func (o Option) Valid() bool {
+	if o == "" {
+		return false
+	}
+	for _, c := range o.Channels() {
+		if !c.Registered() {
+			return false
+		}
+	}
+	return true
+}
+
+func (o Option) MarshalJSON() ([]byte, error) {
+	chans := o.Channels()
+	if chans == nil {
+		chans = []Channel{}
+	}
+	return json.Marshal(chans)
+}
+
+// UnmarshalJSON decodes an array of channels or a legacy Option string. The
+// channels are not validated here so that the preferences can report every
+// invalid field at once, but names with a comma are rejected since they would
+// be split into several channels in the canonical form.
+func (o *Option) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	switch val := raw.(type) {
+	case nil:
+		*o = ""
+	case string:
+		*o = ParseOption(val)
+	case []interface{}:
+		chans := []Channel{}
+		for _, elem := range val {
+			name, ok := elem.(string)
+			if !ok {
+				return invalidOption(fmt.Sprintf("invalid channel %v", elem))
+			}
+			if strings.Contains(name, ",") {
+				return invalidOption(fmt.Sprintf("invalid channel %q", name))
+			}
+			chans = append(chans, Channel(name))
+		}
+		*o = NewOption(chans...)
+	default:
+		return invalidOption(fmt.Sprintf("invalid option %s", data))
+	}
+	return nil
+}
+
+func (o Option) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	chans := o.Channels()
+	if chans == nil {
+		chans = []Channel{}
+	}
+	return bson.MarshalValue(chans)
+}
+
+// UnmarshalBSONValue decodes an array of channels or, for documents that
+// have not been migrated yet, a legacy Option string
+func (o *Option) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.Null, bsontype.Undefined:
+		*o = ""
+	case bsontype.String:
+		*o = ParseOption(raw.StringValue())
+	case bsontype.Array:
+		chans := []Channel{}
+		if err := raw.Unmarshal(&chans); err != nil {
+			return err
+		}
+		for _, c := range chans {
+			if strings.Contains(string(c), ",") {
+				return fmt.Errorf("invalid channel %q in an Option", c)
+			}
+		}
+		*o = NewOption(chans...)
+	default:
+		return fmt.Errorf("cannot decode %v into an Option", t)
+	}
+	return nil
+}
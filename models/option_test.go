@@ -0,0 +1,93 @@
+package models_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"pest-control/models"
+)
+
+func TestOptionUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Data   string
+		Option models.Option
+		Valid  bool
+	}{
+		{"Legacy none", `"none"`, models.None, true},
+		{"Legacy email", `"email"`, models.Email, true},
+		{"Legacy browser", `"browser"`, models.Browser, true},
+		{"Legacy all", `"all"`, models.All, true},
+		{"Empty set", `[]`, models.None, true},
+		{"Set of channels", `["email","browser","email"]`, models.All, true},
+		{"Unregistered channel", `["email","push"]`, models.NewOption("email", "push"), false},
+		{"Unset", `null`, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var option models.Option
+			if err := json.Unmarshal([]byte(test.Data), &option); err != nil {
+				t.Fatalf("Unexpected error while decoding %s: %s", test.Data, err)
+			}
+			if option != test.Option {
+				t.Errorf("Decoded incorrect option, expected %q, got %q", test.Option, option)
+			}
+			if option.Valid() != test.Valid {
+				t.Errorf("Option has incorrect validity, expected %t, got %t", test.Valid, option.Valid())
+			}
+		})
+	}
+
+	for _, data := range []string{`10`, `["email,browser"]`} {
+		var option models.Option
+		if err := json.Unmarshal([]byte(data), &option); err == nil {
+			t.Errorf("Expected error while decoding %s, got %q", data, option)
+		}
+	}
+}
+
+func TestOptionMarshal(t *testing.T) {
+	prefs := &models.ConversationPrefs{
+		ConversationID: 1,
+		GeneralPrefs: &models.GeneralPrefs{
+			TextEntered: models.None,
+			Tag:         models.All,
+		},
+	}
+
+	data, _ := json.Marshal(prefs)
+	expectedJSON := `{"conversation_id":1,"text_entered":[],"tag":["browser","email"]}`
+	if string(data) != expectedJSON {
+		t.Errorf("Incorrect JSON, expected %s, got %s", expectedJSON, data)
+	}
+
+	data, err := bson.Marshal(prefs)
+	if err != nil {
+		t.Fatalf("Unexpected error while encoding BSON: %s", err)
+	}
+	decoded := &models.ConversationPrefs{}
+	if err := bson.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unexpected error while decoding BSON: %s", err)
+	}
+	if !reflect.DeepEqual(prefs, decoded) {
+		t.Errorf("Incorrect BSON round trip, expected %+v, got %+v", prefs, decoded)
+	}
+
+	// Documents that have not been migrated still hold legacy strings
+	data, _ = bson.Marshal(bson.D{{"conversation_id", 1}, {"text_entered", "none"}, {"tag", "all"}})
+	decoded = &models.ConversationPrefs{}
+	if err := bson.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unexpected error while decoding legacy BSON: %s", err)
+	}
+	if !reflect.DeepEqual(prefs, decoded) {
+		t.Errorf("Incorrect legacy BSON decoding, expected %+v, got %+v", prefs, decoded)
+	}
+
+	data, _ = bson.Marshal(bson.D{{"conversation_id", 1}, {"tag", bson.A{"email,browser"}}})
+	if err := bson.Unmarshal(data, &models.ConversationPrefs{}); err == nil {
+		t.Errorf("Expected error while decoding a channel with a comma")
+	}
+}
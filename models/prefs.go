@@ -5,7 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"pest-control/logging"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -13,23 +14,32 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type Option string
-
 type GeneralPrefs struct {
-	TextEntered  Option `json:"text_entered,omitempty" bson:"text_entered,omitempty"`
-	TextModified Option `json:"text_modified,omitempty" bson:"text_modified,omitempty"`
-	Tag          Option `json:"tag,omitempty" bson:"tag,omitempty"`
-	Role         Option `json:"role,omitempty" bson:"role,omitempty"`
+	TextEntered  Option      `json:"text_entered,omitempty" bson:"text_entered,omitempty"`
+	TextModified Option      `json:"text_modified,omitempty" bson:"text_modified,omitempty"`
+	Tag          Option      `json:"tag,omitempty" bson:"tag,omitempty"`
+	Role         Option      `json:"role,omitempty" bson:"role,omitempty"`
+	QuietHours   *QuietHours `json:"quiet_hours,omitempty" bson:"quiet_hours,omitempty"`
+	Digest       *Digest     `json:"digest,omitempty" bson:"digest,omitempty"`
 }
 
 type GlobalPrefs struct {
 	Invitation    Option `json:"invitation,omitempty" bson:"invitation,omitempty"`
 	*GeneralPrefs `bson:"inline"`
+	// Version is the version of the user's preferences that these were read
+	// at, it is not stored with them
+	Version int64 `json:"-" bson:"-"`
 }
 
 type ConversationPrefs struct {
 	ConversationID int `json:"conversation_id,omitempty" bson:"conversation_id,omitempty"`
 	*GeneralPrefs  `bson:"inline"`
+	// MutedUntil is the time until which the conversation is muted, it is
+	// dropped when read after that time
+	MutedUntil *time.Time `json:"muted_until,omitempty" bson:"muted_until,omitempty"`
+	// Version is the version of the user's preferences that these were read
+	// at, it is not stored with them
+	Version int64 `json:"-" bson:"-"`
 }
 
 type Preferences struct {
@@ -37,26 +47,44 @@ type Preferences struct {
 	UserID       int                  `json:"user_id,omitempty" bson:"user_id"`
 	Global       *GlobalPrefs         `json:"global,omitempty" bson:"global"`
 	Conversation []*ConversationPrefs `json:"conversation,omitempty" bson:"conversation"`
+	// Version is incremented by every write to the preferences. Preferences
+	// written before it was added are at version 0.
+	Version int64 `json:"-" bson:"version,omitempty"`
+	// TenantID keeps the preferences of tenants apart with TenantField tenancy
+	TenantID string `json:"-" bson:"tenant_id,omitempty"`
 }
 
-const (
-	None    Option = "none"
-	Email   Option = "email"
-	Browser Option = "browser"
-	All     Option = "all"
-)
+// AnyVersion can be passed to the conditional writes of a Datastore to skip
+// the version check
+const AnyVersion int64 = -1
 
 var (
-	ErrPrefsExists     = errors.New("user preferences already exists")
-	ErrPrefsConvExists = errors.New("user preferences for conversation already exists")
-	ErrPrefsDNE        = errors.New("user preferences does not exist")
-	ErrPrefsConvDNE    = errors.New("user preferences for conversation does not exist")
+	ErrPrefsExists error = &Error{
+		Code:    "prefs_exists",
+		Message: "user preferences already exists",
+	}
+	ErrPrefsConvExists error = &Error{
+		Code:    "conversation_prefs_exists",
+		Message: "user preferences for conversation already exists",
+	}
+	ErrPrefsDNE error = &Error{
+		Code:    "prefs_not_found",
+		Message: "user preferences does not exist",
+	}
+	ErrPrefsConvDNE error = &Error{
+		Code:    "conversation_prefs_not_found",
+		Message: "user preferences for conversation does not exist",
+	}
+	ErrVersionMismatch error = &Error{
+		Code:    "version_mismatch",
+		Message: "user preferences have been modified",
+	}
 )
 
 func NewGlobalPrefs() *GlobalPrefs {
 	return &GlobalPrefs{
-		All,
-		&GeneralPrefs{
+		Invitation: All,
+		GeneralPrefs: &GeneralPrefs{
 			TextEntered:  All,
 			TextModified: All,
 			Tag:          All,
@@ -67,8 +95,8 @@ func NewGlobalPrefs() *GlobalPrefs {
 
 func NewConversationPrefs() *ConversationPrefs {
 	return &ConversationPrefs{
-		0,
-		&GeneralPrefs{
+		ConversationID: 0,
+		GeneralPrefs: &GeneralPrefs{
 			TextEntered:  All,
 			TextModified: All,
 			Tag:          All,
@@ -92,59 +120,80 @@ func (g *GlobalPrefs) String() string {
 	return fmt.Sprintf("%+v", *g)
 }
 
-func (g *GlobalPrefs) UnmarshalJSON(data []byte) error {
-	type Aux GlobalPrefs
-	var s *Aux = (*Aux)(g)
-	if err := json.Unmarshal(data, s); err != nil {
-		return err
+// AddOptions records the fields that are set to an invalid Option, with the
+// channels that they allow
+func (e *ValidationError) AddOptions(fields []string, options ...Option) {
+	for i, option := range options {
+		if option != "" && !option.Valid() {
+			e.Fields = append(e.Fields, option.fieldError(fields[i]))
+		}
 	}
+}
 
-	if s == nil || s.GeneralPrefs == nil {
-		return nil
+// decodePrefs decodes data into v, recording the fields of the Options that
+// can't be decoded in invalid. The decoding of a document stops at the first
+// error, which doesn't know its field, so the Options are decoded one by one
+// to find them all, and the rest of the document is decoded without them.
+func decodePrefs(data []byte, v interface{}, fields []string, invalid *ValidationError) error {
+	err := json.Unmarshal(data, v)
+	var unnamed *ValidationError
+	if !errors.As(err, &unnamed) {
+		return err
 	}
-
-	invalidVal := []string{}
-
-	switch s.Invitation {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "invitation")
+	raw := map[string]json.RawMessage{}
+	if json.Unmarshal(data, &raw) != nil {
+		return err
 	}
 
-	switch s.Role {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "role")
+	for _, field := range fields {
+		if value, ok := raw[field]; ok {
+			var option Option
+			if invalid.merge(field, option.UnmarshalJSON(value)) {
+				delete(raw, field)
+			}
+		}
 	}
-
-	switch s.Tag {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "tag")
+	rest, err := json.Marshal(raw)
+	if err != nil {
+		return err
 	}
+	return json.Unmarshal(rest, v)
+}
 
-	switch s.TextEntered {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "text_entered")
+// validate records the invalid fields of the quiet hours and digest
+func (g *GeneralPrefs) validate(invalid *ValidationError) {
+	if g.QuietHours != nil {
+		invalid.merge("quiet_hours.", g.QuietHours.Validate())
 	}
-
-	switch s.TextModified {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "text_modified")
+	if g.Digest != nil {
+		invalid.merge("digest.", g.Digest.Validate())
 	}
+}
+
+func (g *GlobalPrefs) UnmarshalJSON(data []byte) error {
+	fields := []string{"invitation", "role", "tag", "text_entered", "text_modified"}
 
-	if len(invalidVal) > 0 {
-		return errors.New(fmt.Sprintf("invalid value for %v", invalidVal))
+	type Aux GlobalPrefs
+	var s *Aux = (*Aux)(g)
+	invalid := &ValidationError{}
+	if err := decodePrefs(data, s, fields, invalid); err != nil {
+		return err
 	}
 
-	return nil
+	if s == nil || s.GeneralPrefs == nil {
+		return invalid.Err()
+	}
+
+	invalid.AddOptions(
+		fields,
+		s.Invitation,
+		s.Role,
+		s.Tag,
+		s.TextEntered,
+		s.TextModified,
+	)
+	s.GeneralPrefs.validate(invalid)
+	return invalid.Err()
 }
 
 func (c *ConversationPrefs) String() string {
@@ -152,58 +201,151 @@ func (c *ConversationPrefs) String() string {
 }
 
 func (c *ConversationPrefs) UnmarshalJSON(data []byte) error {
+	fields := []string{"role", "tag", "text_entered", "text_modified"}
+
 	type Aux ConversationPrefs
 	var s *Aux = (*Aux)(c)
-	if err := json.Unmarshal(data, s); err != nil {
+	invalid := &ValidationError{}
+	if err := decodePrefs(data, s, fields, invalid); err != nil {
 		return err
 	}
 
 	if s == nil || s.GeneralPrefs == nil {
-		return nil
-	}
-
-	invalidVal := []string{}
+		return invalid.Err()
+	}
+
+	invalid.AddOptions(
+		fields,
+		s.Role,
+		s.Tag,
+		s.TextEntered,
+		s.TextModified,
+	)
+	s.GeneralPrefs.validate(invalid)
+	return invalid.Err()
+}
 
-	switch s.Role {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "role")
+// UnmarshalJSON decodes the global preferences and those of each
+// conversation on their own, so that the invalid fields of all of them are
+// reported, named by their path in the document. Conversation preferences
+// that are already in the slice are decoded into, as json.Unmarshal does.
+// Conversation IDs that are repeated are invalid.
+func (p *Preferences) UnmarshalJSON(data []byte) error {
+	type Aux Preferences
+	aux := struct {
+		*Aux
+		Global       json.RawMessage `json:"global"`
+		Conversation json.RawMessage `json:"conversation"`
+	}{Aux: (*Aux)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
 	}
 
-	switch s.Tag {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "tag")
+	invalid := &ValidationError{}
+	if isNull(aux.Global) {
+		if aux.Global != nil {
+			p.Global = nil
+		}
+	} else {
+		if p.Global == nil {
+			p.Global = &GlobalPrefs{}
+		}
+		if err := json.Unmarshal(aux.Global, p.Global); !invalid.merge("global.", err) && err != nil {
+			return err
+		}
 	}
 
-	switch s.TextEntered {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "text_entered")
+	if isNull(aux.Conversation) {
+		if aux.Conversation != nil {
+			p.Conversation = nil
+		}
+		return invalid.Err()
 	}
+	convs := []json.RawMessage{}
+	if err := json.Unmarshal(aux.Conversation, &convs); err != nil {
+		return err
+	}
+	decoded := make([]*ConversationPrefs, len(convs))
+	seen := map[int]int{}
+	for i, conv := range convs {
+		if isNull(conv) {
+			continue
+		}
+		decoded[i] = &ConversationPrefs{}
+		if i < len(p.Conversation) && p.Conversation[i] != nil {
+			decoded[i] = p.Conversation[i]
+		}
+		err := json.Unmarshal(conv, decoded[i])
+		if !invalid.merge(fmt.Sprintf("conversation[%d].", i), err) && err != nil {
+			return err
+		}
+		// A user has one entry per conversation, which the datastores only
+		// guard when a single conversation is created
+		id := decoded[i].ConversationID
+		if first, ok := seen[id]; ok {
+			invalid.Add(
+				fmt.Sprintf("conversation[%d].conversation_id", i),
+				fmt.Sprintf("conversation ID is duplicated, first in conversation[%d]", first),
+			)
+		} else {
+			seen[id] = i
+		}
+	}
+	p.Conversation = decoded
+	return invalid.Err()
+}
+
+// isNull reports whether a JSON value is missing or null
+func isNull(data json.RawMessage) bool {
+	return data == nil || string(data) == "null"
+}
 
-	switch s.TextModified {
-	case All, Email, Browser, None, "":
-		break
-	default:
-		invalidVal = append(invalidVal, "text_modified")
+// globalProjection projects the global preferences of a user and the
+// version that they are at
+var globalProjection = bson.D{{"global", 1}, {"version", 1}}
+
+// convProjection projects a user's preferences for a conversation and the
+// version that they are at
+func convProjection(conversationID int) bson.D {
+	return bson.D{
+		{
+			"conversation",
+			bson.D{{"$elemMatch", bson.D{{"conversation_id", conversationID}}}},
+		},
+		{"version", 1},
 	}
+}
 
-	if len(invalidVal) > 0 {
-		return errors.New(fmt.Sprintf("invalid value for %v", invalidVal))
+// storedGlobal returns the global preferences of p at its version, which are
+// empty if it has none
+func (p *Preferences) storedGlobal() *GlobalPrefs {
+	global := copyGlobalPrefs(p.Global)
+	if global == nil {
+		global = &GlobalPrefs{}
 	}
+	global.Version = p.Version
+	return global
+}
 
-	return nil
+// storedConv returns the preferences of p for a conversation at its version,
+// without a mute that has ended
+func (p *Preferences) storedConv(conversationID int) (*ConversationPrefs, error) {
+	i := p.findConv(conversationID)
+	if i < 0 {
+		return nil, ErrPrefsConvDNE
+	}
+	conv := copyConversationPrefs(p.Conversation[i])
+	conv.expireMute(time.Now())
+	conv.Version = p.Version
+	return conv, nil
 }
 
-func (db *DB) GetPrefs(userID int) (*GlobalPrefs, error) {
-	filter := bson.D{{"user_id", userID}}
-	opts := options.FindOne().SetProjection(bson.D{{"global", 1}})
-	collection := db.Database("pest-control").Collection("prefs")
-	singleResult := collection.FindOne(context.TODO(), filter, opts)
+// findPrefs reads the projection of a user's preferences
+func (db *DB) findPrefs(ctx context.Context, userID int, projection bson.D) (*Preferences, error) {
+	filter := db.scope(bson.D{{"user_id", userID}})
+	opts := options.FindOne().SetProjection(projection)
+	collection := db.prefsCollection()
+	singleResult := collection.FindOne(ctx, filter, opts)
 	if singleResult.Err() != nil {
 		if singleResult.Err() == mongo.ErrNoDocuments {
 			return nil, ErrPrefsDNE
@@ -213,59 +355,66 @@ func (db *DB) GetPrefs(userID int) (*GlobalPrefs, error) {
 
 	prefs := &Preferences{}
 	if err := singleResult.Decode(prefs); err != nil {
-		log.Printf("failed to decode retrieved data (%+v): %s", singleResult, err.Error())
+		logging.FromContext(ctx).Error("failed to decode retrieved data", logging.Fields{
+			"error": err,
+		})
 		return nil, err
 	}
-	return prefs.Global, nil
+	return prefs, nil
 }
 
-func (db *DB) GetPrefsConv(userID, conversationID int) (*ConversationPrefs, error) {
-	filter := bson.D{{"user_id", userID}}
-	opts := options.FindOne().SetProjection(bson.D{{
-		"conversation",
-		bson.D{{"$elemMatch", bson.D{{"conversation_id", conversationID}}}},
-	}})
-	collection := db.Database("pest-control").Collection("prefs")
-	singleResult := collection.FindOne(context.TODO(), filter, opts)
-	if singleResult.Err() != nil {
-		if singleResult.Err() == mongo.ErrNoDocuments {
-			return nil, ErrPrefsDNE
-		}
-		return nil, singleResult.Err()
-	}
+func (db *DB) GetPrefs(ctx context.Context, userID int) (*GlobalPrefs, error) {
+	ctx, end := db.start(ctx, "GetPrefs")
+	defer end()
 
-	prefs := &Preferences{}
-	if err := singleResult.Decode(prefs); err != nil {
-		log.Printf("failed to decode retrieved data (%+v): %s", singleResult, err.Error())
+	prefs, err := db.findPrefs(ctx, userID, globalProjection)
+	if err != nil {
 		return nil, err
 	}
+	if prefs.Global != nil {
+		prefs.Global.Version = prefs.Version
+	}
+	return prefs.Global, nil
+}
 
-	if len(prefs.Conversation) == 0 {
-		return nil, ErrPrefsConvDNE
+func (db *DB) GetPrefsConv(ctx context.Context, userID, conversationID int) (*ConversationPrefs, error) {
+	ctx, end := db.start(ctx, "GetPrefsConv")
+	defer end()
+
+	prefs, err := db.findPrefs(ctx, userID, convProjection(conversationID))
+	if err != nil {
+		return nil, err
 	}
-	return prefs.Conversation[0], nil
+	return prefs.storedConv(conversationID)
 }
 
-func (db *DB) CreatePrefs(prefs *Preferences) error {
-	if _, err := db.GetPrefs(prefs.UserID); err != nil && err != ErrPrefsDNE {
-		log.Printf(
-			"failed to get preferences from MongoDB collection: %s",
-			err.Error(),
-		)
+// CreatePrefs creates a user's preferences. The unique index on user_id
+// created by CreateIndexes, which a new tenant's database is bootstrapped
+// with first, makes concurrent creates for a user fail with ErrPrefsExists.
+func (db *DB) CreatePrefs(ctx context.Context, prefs *Preferences) error {
+	ctx, end := db.start(ctx, "CreatePrefs")
+	defer end()
+
+	if err := db.ensureBootstrapped(ctx); err != nil {
 		return err
-	} else if err == nil {
-		log.Printf("preferences for user (%d) already exists", prefs.UserID)
-		return ErrPrefsExists
 	}
 
-	collection := db.Database("pest-control").Collection("prefs")
-	insertResult, err := collection.InsertOne(context.TODO(), prefs)
-	if err != nil {
-		log.Printf(
-			"failed to insert preferences (%+v) into MongoDB collection: %s",
-			prefs,
-			err.Error(),
-		)
+	prefs.Version = 1
+	if db.config.Tenancy == TenantField {
+		prefs.TenantID = db.tenant
+	}
+	collection := db.prefsCollection()
+	insertResult, err := collection.InsertOne(ctx, prefs)
+	if isDuplicateKeyError(err) {
+		logging.FromContext(ctx).Info("preferences for user already exist", logging.Fields{
+			"user_id": prefs.UserID,
+		})
+		return ErrPrefsExists
+	} else if err != nil {
+		logging.FromContext(ctx).Error("failed to insert preferences into MongoDB collection", logging.Fields{
+			"prefs": prefs,
+			"error": err,
+		})
 		return err
 	}
 
@@ -274,102 +423,189 @@ func (db *DB) CreatePrefs(prefs *Preferences) error {
 	return nil
 }
 
-func (db *DB) CreatePrefsConv(userID int, convPrefs *ConversationPrefs) error {
-	if _, err := db.GetPrefsConv(userID, convPrefs.ConversationID); err != nil && err != ErrPrefsConvDNE {
-		log.Printf(
-			"failed to get preferences from MongoDB collection: %s",
-			err.Error(),
-		)
-		return err
-	} else if err == nil {
-		log.Printf(
-			"conversation (%d) preferences for user (%d) already exists",
-			convPrefs.ConversationID,
-			userID,
-		)
-		return ErrPrefsConvExists
-	}
-
-	filter := bson.D{{"user_id", userID}}
-	update := bson.D{{"$push", bson.D{{Key: "conversation", Value: convPrefs}}}}
-	collection := db.Database("pest-control").Collection("prefs")
-	updateResult, err := collection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		log.Printf(
-			"failed to insert conversation preferences (%+v) into MongoDB collection: %s",
-			convPrefs,
-			err.Error(),
-		)
-		return err
+// CreatePrefsConv adds a user's preferences for a conversation. The push only
+// matches preferences without the conversation, so concurrent creates can't
+// add it twice.
+func (db *DB) CreatePrefsConv(ctx context.Context, userID int, convPrefs *ConversationPrefs) error {
+	_, err := db.CreatePrefsConvChange(ctx, userID, convPrefs)
+	return err
+}
+
+// CreatePrefsConvChange makes the write of CreatePrefsConv and returns its
+// Change
+func (db *DB) CreatePrefsConvChange(
+	ctx context.Context,
+	userID int,
+	convPrefs *ConversationPrefs,
+) (*Change, error) {
+	ctx, end := db.start(ctx, "CreatePrefsConv")
+	defer end()
+
+	filter := db.scope(bson.D{
+		{"user_id", userID},
+		{"conversation.conversation_id", bson.D{{"$ne", convPrefs.ConversationID}}},
+	})
+	update := bson.D{
+		{"$push", bson.D{{Key: "conversation", Value: convPrefs}}},
+		{"$inc", bson.D{{"version", 1}}},
+	}
+	before, err := db.updatePrefs(ctx, filter, update, convProjection(convPrefs.ConversationID))
+	if err == mongo.ErrNoDocuments {
+		if _, err := db.GetPrefs(ctx, userID); err != nil {
+			return nil, err
+		}
+		logging.FromContext(ctx).Info("conversation preferences for user already exist", logging.Fields{
+			"user_id":         userID,
+			"conversation_id": convPrefs.ConversationID,
+		})
+		return nil, ErrPrefsConvExists
+	} else if err != nil {
+		return nil, err
 	}
 
-	if updateResult.ModifiedCount == 0 {
-		return ErrPrefsDNE
+	after, err := createdPrefsConv(before, convPrefs)
+	if err != nil {
+		return nil, err
 	}
+	return updated(before, after), nil
+}
 
-	return nil
+// versionFilter returns a filter on the user_id of preferences, and on their
+// version unless it is AnyVersion
+func (db *DB) versionFilter(userID int, version int64) bson.D {
+	filter := db.scope(bson.D{{"user_id", userID}})
+	if version == 0 {
+		filter = append(filter, bson.E{"version", bson.D{{"$exists", false}}})
+	} else if version != AnyVersion {
+		filter = append(filter, bson.E{"version", version})
+	}
+	return filter
 }
 
-func (db *DB) DeletePrefs(userID int) error {
-	filter := bson.D{{"user_id", userID}}
-	collection := db.Database("pest-control").Collection("prefs")
-	deleteResult, err := collection.DeleteOne(context.TODO(), filter)
-	if err != nil {
-		log.Printf(
-			"failed to delete preferences (%+v) from MongoDB collection: %s",
-			filter,
-			err.Error(),
-		)
-		return err
+// checkVersion finds out whether a user's preferences, or their preferences
+// for a conversation if conversationID is not nil, are missing or at another
+// version, and returns their current version. It is used after a conditional
+// write that did not match.
+func (db *DB) checkVersion(ctx context.Context, userID int, conversationID *int, version int64) (int64, error) {
+	var current int64
+	if conversationID == nil {
+		prefs, err := db.GetPrefs(ctx, userID)
+		if err != nil {
+			return 0, err
+		} else if prefs != nil {
+			current = prefs.Version
+		}
+	} else {
+		prefs, err := db.GetPrefsConv(ctx, userID, *conversationID)
+		if err != nil {
+			return 0, err
+		}
+		current = prefs.Version
+	}
+
+	if version != AnyVersion && version != current {
+		return current, ErrVersionMismatch
 	}
+	return current, nil
+}
+
+// DeletePrefs deletes a user's preferences if they are at the given version
+func (db *DB) DeletePrefs(ctx context.Context, userID int, version int64) error {
+	_, err := db.DeletePrefsChange(ctx, userID, version)
+	return err
+}
+
+// DeletePrefsChange makes the write of DeletePrefs and returns its Change
+func (db *DB) DeletePrefsChange(ctx context.Context, userID int, version int64) (*Change, error) {
+	ctx, end := db.start(ctx, "DeletePrefs")
+	defer end()
 
+	filter := db.versionFilter(userID, version)
+	before := &Preferences{}
+	err := db.prefsCollection().FindOneAndDelete(ctx, filter).Decode(before)
 	// No preferences were deleted which means that the user did not have any
-	// preferences to begin with
-	if deleteResult.DeletedCount == 0 {
-		return ErrPrefsDNE
+	// preferences to begin with, or that they have been modified
+	if err == mongo.ErrNoDocuments {
+		if _, err := db.checkVersion(ctx, userID, nil, version); err != nil {
+			return nil, err
+		}
+		return nil, ErrVersionMismatch
+	} else if err != nil {
+		logging.FromContext(ctx).Error("failed to delete preferences from MongoDB collection", logging.Fields{
+			"filter": filter,
+			"error":  err,
+		})
+		return nil, err
 	}
-	return nil
+	before.expireMutes(time.Now())
+	return &Change{Before: before}, nil
 }
 
-func (db *DB) DeletePrefsConv(userID, conversationID int) error {
-	filter := bson.D{{"user_id", userID}}
-	update := bson.D{{
-		"$pull",
-		bson.D{{
-			Key:   "conversation",
-			Value: bson.D{{Key: "conversation_id", Value: conversationID}},
-		}},
-	}}
+// DeletePrefsConv deletes a user's preferences for a conversation if the
+// user's preferences are at the given version
+func (db *DB) DeletePrefsConv(ctx context.Context, userID, conversationID int, version int64) error {
+	_, err := db.DeletePrefsConvChange(ctx, userID, conversationID, version)
+	return err
+}
 
-	collection := db.Database("pest-control").Collection("prefs")
-	updateResult, err := collection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		log.Printf(
-			"failed to delete preferences (%+v) from MongoDB collection: %s",
-			filter,
-			err.Error(),
-		)
-		return err
+// DeletePrefsConvChange makes the write of DeletePrefsConv and returns its
+// Change
+func (db *DB) DeletePrefsConvChange(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	version int64,
+) (*Change, error) {
+	ctx, end := db.start(ctx, "DeletePrefsConv")
+	defer end()
+
+	filter := append(
+		db.versionFilter(userID, version),
+		bson.E{"conversation.conversation_id", conversationID},
+	)
+	update := bson.D{
+		{
+			"$pull",
+			bson.D{{
+				Key:   "conversation",
+				Value: bson.D{{Key: "conversation_id", Value: conversationID}},
+			}},
+		},
+		{"$inc", bson.D{{"version", 1}}},
 	}
 
+	before, err := db.updatePrefs(ctx, filter, update, convProjection(conversationID))
 	// No preferences were deleted which means that the user did not have any
-	// preferences to begin with
-	if updateResult.ModifiedCount == 0 {
-		return ErrPrefsConvDNE
+	// preferences to begin with, or that they have been modified
+	if err == mongo.ErrNoDocuments {
+		_, err := db.checkVersion(ctx, userID, &conversationID, version)
+		if err == ErrPrefsDNE || err == ErrPrefsConvDNE {
+			return nil, ErrPrefsConvDNE
+		} else if err != nil {
+			return nil, err
+		}
+		return nil, ErrVersionMismatch
+	} else if err != nil {
+		return nil, err
 	}
-	return nil
+
+	after, err := deletedPrefsConv(before, conversationID, AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return updated(before, after), nil
 }
 
 func createUpdateBSON(prefs interface{}, prefix string) ([]byte, error) {
 	bytes, err := bson.Marshal(prefs)
 	if err != nil {
-		log.Printf("failed to marshal prefs to bson: %s", err.Error())
+		logging.Default().Error("failed to marshal prefs to bson", logging.Fields{"error": err})
 		return nil, err
 	}
 
-	prefsMap := map[string]string{}
+	prefsMap := bson.M{}
 	if err = bson.Unmarshal(bytes, &prefsMap); err != nil {
-		log.Printf("failed to unmarshal bson to map: %s", err.Error())
+		logging.Default().Error("failed to unmarshal bson to map", logging.Fields{"error": err})
 		return nil, err
 	}
 
@@ -378,93 +614,181 @@ func createUpdateBSON(prefs interface{}, prefix string) ([]byte, error) {
 		return nil, nil
 	}
 
-	newPrefsMap := map[string]string{}
+	newPrefsMap := bson.M{}
 
 	for key, value := range prefsMap {
 		newPrefsMap[prefix+key] = value
 	}
 
-	update := bson.D{{"$set", newPrefsMap}}
+	update := bson.D{
+		{"$set", newPrefsMap},
+		{"$inc", bson.D{{"version", 1}}},
+	}
 	updateBytes, err := bson.Marshal(update)
 	if err != nil {
-		log.Printf("failed to marshal update to bson: %s", err.Error())
+		logging.Default().Error("failed to marshal update to bson", logging.Fields{"error": err})
 		return nil, err
 	}
 
 	return updateBytes, nil
 }
 
-func (db *DB) PatchPrefs(userID int, prefs *GlobalPrefs) error {
-	if _, err := db.GetPrefs(userID); err != nil {
-		log.Printf(
-			"failed to get preferences from MongoDB collection: %s",
-			err.Error(),
-		)
-		if err == mongo.ErrNoDocuments {
-			return ErrPrefsDNE
+// updatePrefs applies an update to the preferences matched by filter, and
+// returns the projection of the preferences that it found, without the mutes
+// that had ended. It returns mongo.ErrNoDocuments if the filter didn't match.
+func (db *DB) updatePrefs(
+	ctx context.Context,
+	filter bson.D,
+	update interface{},
+	projection bson.D,
+) (*Preferences, error) {
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.Before).
+		SetProjection(projection)
+	before := &Preferences{}
+	err := db.prefsCollection().FindOneAndUpdate(ctx, filter, update, opts).Decode(before)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logging.FromContext(ctx).Error("failed to update preferences in MongoDB collection", logging.Fields{
+				"filter": filter,
+				"error":  err,
+			})
 		}
-		return err
+		return nil, err
 	}
+	before.expireMutes(time.Now())
+	return before, nil
+}
+
+// PatchPrefs updates a user's global preferences if they are at the given
+// version, and returns the global preferences that it left
+func (db *DB) PatchPrefs(ctx context.Context, userID int, prefs *GlobalPrefs, version int64) (*GlobalPrefs, error) {
+	change, err := db.PatchPrefsChange(ctx, userID, prefs, version)
+	if err != nil {
+		return nil, err
+	}
+	return change.GlobalPrefs(), nil
+}
+
+// PatchPrefsChange makes the write of PatchPrefs and returns its Change. An
+// empty patch is not a write, and its Change leaves the preferences as they
+// are.
+func (db *DB) PatchPrefsChange(
+	ctx context.Context,
+	userID int,
+	prefs *GlobalPrefs,
+	version int64,
+) (*Change, error) {
+	ctx, end := db.start(ctx, "PatchPrefs")
+	defer end()
 
-	filter := bson.D{{"user_id", userID}}
 	update, err := createUpdateBSON(prefs, "global.")
 	if err != nil {
-		log.Printf("failed to create bson for update object: %s", err.Error())
-		return err
+		logging.FromContext(ctx).Error("failed to create bson for update object", logging.Fields{
+			"error": err,
+		})
+		return nil, err
 	} else if update == nil {
-		return nil
+		current, err := db.findPrefs(ctx, userID, globalProjection)
+		if err != nil {
+			return nil, err
+		}
+		if err := current.checkVersion(version); err != nil {
+			return nil, err
+		}
+		return &Change{Before: current, After: current}, nil
 	}
 
-	collection := db.Database("pest-control").Collection("prefs")
-	if _, err := collection.UpdateOne(context.TODO(), filter, update); err != nil {
-		log.Printf(
-			"failed to update preferences (%+v) in MongoDB collection: %s",
-			filter,
-			err.Error(),
-		)
-		return err
+	filter := db.versionFilter(userID, version)
+	before, err := db.updatePrefs(ctx, filter, update, globalProjection)
+	if err == mongo.ErrNoDocuments {
+		if _, err := db.checkVersion(ctx, userID, nil, version); err != nil {
+			return nil, err
+		}
+		return nil, ErrVersionMismatch
+	} else if err != nil {
+		return nil, err
 	}
 
-	return nil
+	after, err := patchedPrefs(before, prefs, AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return updated(before, after), nil
 }
 
+// PatchPrefsConv updates a user's preferences for a conversation if the
+// user's preferences are at the given version, and returns the preferences
+// for the conversation that it left
 func (db *DB) PatchPrefsConv(
+	ctx context.Context,
 	userID,
 	conversationID int,
 	prefs *ConversationPrefs,
-) error {
-	if _, err := db.GetPrefsConv(userID, conversationID); err != nil {
-		log.Printf(
-			"failed to get preferences from MongoDB collection: %s",
-			err.Error(),
-		)
-		if err == mongo.ErrNoDocuments {
-			return ErrPrefsConvDNE
-		}
-		return err
+	version int64,
+) (*ConversationPrefs, error) {
+	change, err := db.PatchPrefsConvChange(ctx, userID, conversationID, prefs, version)
+	if err != nil {
+		return nil, err
 	}
+	return change.ConversationPrefs(conversationID)
+}
 
-	filter := bson.D{
-		{"user_id", userID},
-		{"conversation.conversation_id", conversationID},
-	}
-	update, err := createUpdateBSON(prefs, "conversation.$.")
+// PatchPrefsConvChange makes the write of PatchPrefsConv and returns its
+// Change. An empty patch is not a write, and its Change leaves the
+// preferences as they are.
+func (db *DB) PatchPrefsConvChange(
+	ctx context.Context,
+	userID,
+	conversationID int,
+	prefs *ConversationPrefs,
+	version int64,
+) (*Change, error) {
+	ctx, end := db.start(ctx, "PatchPrefsConv")
+	defer end()
+
+	// The conversation ID of a conversation's preferences can't be changed
+	// and it can only be muted through MutePrefsConv
+	patch := *prefs
+	patch.ConversationID = 0
+	patch.MutedUntil = nil
+	update, err := createUpdateBSON(&patch, "conversation.$.")
 	if err != nil {
-		log.Printf("failed to create bson for update object: %s", err.Error())
-		return err
+		logging.FromContext(ctx).Error("failed to create bson for update object", logging.Fields{
+			"error": err,
+		})
+		return nil, err
 	} else if update == nil {
-		return nil
+		current, err := db.findPrefs(ctx, userID, convProjection(conversationID))
+		if err != nil {
+			return nil, err
+		}
+		if current.findConv(conversationID) < 0 {
+			return nil, ErrPrefsConvDNE
+		}
+		if err := current.checkVersion(version); err != nil {
+			return nil, err
+		}
+		return &Change{Before: current, After: current}, nil
 	}
 
-	collection := db.Database("pest-control").Collection("prefs")
-	if _, err := collection.UpdateOne(context.TODO(), filter, update); err != nil {
-		log.Printf(
-			"failed to update preferences (%+v) in MongoDB collection: %s",
-			filter,
-			err.Error(),
-		)
-		return err
+	filter := append(
+		db.versionFilter(userID, version),
+		bson.E{"conversation.conversation_id", conversationID},
+	)
+	before, err := db.updatePrefs(ctx, filter, update, convProjection(conversationID))
+	if err == mongo.ErrNoDocuments {
+		if _, err := db.checkVersion(ctx, userID, &conversationID, version); err != nil {
+			return nil, err
+		}
+		return nil, ErrVersionMismatch
+	} else if err != nil {
+		return nil, err
 	}
 
-	return nil
+	after, err := patchedPrefsConv(before, conversationID, &patch, AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return updated(before, after), nil
 }
@@ -0,0 +1,341 @@
+package models_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"pest-control/models"
+	"pest-control/models/storetest"
+)
+
+// TestDB runs the conformance suite against MongoDB. It is skipped unless
+// PESTCONTROL_TEST_DB_URI is set, and it drops the pest-control database, so
+// it must never be pointed at a database holding real preferences.
+func TestDB(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	db, err := models.NewDB(uri, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+
+	storetest.Run(t, func(t *testing.T) models.Datastore {
+		if err := db.Database("pest-control").Drop(context.TODO()); err != nil {
+			t.Fatalf("Failed to drop database: %s", err)
+		}
+		if _, err := db.CreateIndexes(context.TODO()); err != nil {
+			t.Fatalf("Failed to create indexes: %s", err)
+		}
+		return db
+	})
+}
+
+// TestDBAuditLog runs the audit log suite against MongoDB. Like TestDB it
+// drops the pest-control database.
+func TestDBAuditLog(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	db, err := models.NewDB(uri, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+
+	storetest.RunAuditLog(t, func(t *testing.T) models.AuditedDatastore {
+		if err := db.Database("pest-control").Drop(context.TODO()); err != nil {
+			t.Fatalf("Failed to drop database: %s", err)
+		}
+		if _, err := db.CreateIndexes(context.TODO()); err != nil {
+			t.Fatalf("Failed to create indexes: %s", err)
+		}
+		return db
+	})
+}
+
+// TestDBHistory runs the history suite against MongoDB. Like TestDB it drops
+// the pest-control database.
+func TestDBHistory(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	db, err := models.NewDB(uri, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+
+	storetest.RunHistory(t, func(t *testing.T) models.AuditedDatastore {
+		if err := db.Database("pest-control").Drop(context.TODO()); err != nil {
+			t.Fatalf("Failed to drop database: %s", err)
+		}
+		if _, err := db.CreateIndexes(context.TODO()); err != nil {
+			t.Fatalf("Failed to create indexes: %s", err)
+		}
+		return db
+	})
+}
+
+// TestDBTenants runs the tenant suite against MongoDB with each tenancy. Like
+// TestDB it drops the databases that it uses.
+func TestDBTenants(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	for _, tenancy := range []models.Tenancy{models.TenantDatabase, models.TenantField} {
+		t.Run(string(tenancy), func(t *testing.T) {
+			config := &models.DBConfig{Database: "pest-control-test", Tenancy: tenancy}
+			db, err := models.NewDB(uri, nil, config)
+			if err != nil {
+				t.Fatalf("Failed to connect to MongoDB: %s", err)
+			}
+			defer db.Disconnect(context.TODO())
+
+			storetest.RunTenants(t, func(t *testing.T) models.TenantDatastore {
+				for _, tenant := range []string{"", "a", "b"} {
+					name := "pest-control-test"
+					if tenant != "" {
+						name += "-" + tenant
+					}
+					if err := db.Database(name).Drop(context.TODO()); err != nil {
+						t.Fatalf("Failed to drop database: %s", err)
+					}
+				}
+				for _, tenant := range []string{"", "a", "b"} {
+					if _, err := db.TenantDB(tenant).CreateIndexes(context.TODO()); err != nil {
+						t.Fatalf("Failed to create indexes: %s", err)
+					}
+				}
+				return db
+			})
+		})
+	}
+}
+
+// TestDBNewTenant checks that the database of a tenant that wasn't
+// bootstrapped is bootstrapped before its first preferences are created
+func TestDBNewTenant(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	config := &models.DBConfig{Database: "pest-control-test", Tenancy: models.TenantDatabase}
+	db, err := models.NewDB(uri, nil, config)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+	if err := db.Database("pest-control-test-new").Drop(context.TODO()); err != nil {
+		t.Fatalf("Failed to drop database: %s", err)
+	}
+
+	tenant := db.ForTenant("new")
+	for i, expected := range []error{nil, models.ErrPrefsExists} {
+		prefs := models.NewPreferences()
+		prefs.UserID = 1
+		if err := tenant.CreatePrefs(context.TODO(), prefs); err != expected {
+			t.Errorf("CreatePrefs %d returned incorrect error, expected %v, got %v", i, expected, err)
+		}
+	}
+
+	pending, err := db.TenantDB("new").PendingMigrations(context.TODO())
+	if err != nil || len(pending) != 0 {
+		t.Errorf("New tenant has pending migrations %v, %v", pending, err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	db, err := models.NewDB(uri, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+
+	if err := db.Database("pest-control").Drop(context.TODO()); err != nil {
+		t.Fatalf("Failed to drop database: %s", err)
+	}
+
+	report, err := db.Bootstrap(context.TODO(), true)
+	if err != nil {
+		t.Fatalf("Bootstrap returned unexpected error: %s", err)
+	}
+	if len(report.CreatedIndexes) != 2 || !report.InstalledSchema {
+		t.Errorf("Bootstrap of an empty database made incorrect changes: %s", report)
+	}
+
+	report, err = db.Bootstrap(context.TODO(), true)
+	if err != nil {
+		t.Fatalf("Bootstrap returned unexpected error: %s", err)
+	}
+	if len(report.CreatedIndexes) != 0 || report.InstalledSchema {
+		t.Errorf("Bootstrap of a bootstrapped database made changes: %s", report)
+	}
+
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	if err := db.CreatePrefs(context.TODO(), prefs); err != nil {
+		t.Errorf("CreatePrefs was rejected by the validator: %s", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	db, err := models.NewDB(uri, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+
+	database := db.Database("pest-control")
+	if err := database.Drop(context.TODO()); err != nil {
+		t.Fatalf("Failed to drop database: %s", err)
+	}
+	legacy := bson.D{
+		{"user_id", 1},
+		{"global", bson.D{{"text_entered", "all"}}},
+	}
+	if _, err := database.Collection("prefs").InsertOne(context.TODO(), legacy); err != nil {
+		t.Fatalf("Failed to insert legacy preferences: %s", err)
+	}
+
+	report, err := db.Migrate(context.TODO(), true)
+	if err != nil {
+		t.Fatalf("Migrate dry run returned unexpected error: %s", err)
+	}
+	if len(report.Steps) != 1 || report.Steps[0].Documents != 1 {
+		t.Errorf("Migrate dry run reported incorrect steps: %s", report)
+	}
+
+	// Only one of the concurrent runs applies each migration
+	reports := make(chan *models.MigrationReport, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(reports); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report, err := db.Migrate(context.TODO(), false)
+			if err != nil {
+				t.Errorf("Migrate returned unexpected error: %s", err)
+			}
+			reports <- report
+		}()
+	}
+	wg.Wait()
+	close(reports)
+
+	applied := map[int]int64{}
+	for report := range reports {
+		for _, step := range report.Steps {
+			if _, ok := applied[step.ID]; ok {
+				t.Errorf("Migration %d was applied more than once", step.ID)
+			}
+			applied[step.ID] = step.Documents
+		}
+	}
+	if applied[1] != 1 {
+		t.Errorf("Migration 1 changed %d documents, expected 1", applied[1])
+	}
+
+	pending, err := db.PendingMigrations(context.TODO())
+	if err != nil {
+		t.Fatalf("PendingMigrations returned unexpected error: %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Migrations are pending after Migrate: %+v", pending)
+	}
+
+	prefs, err := db.GetPrefs(context.TODO(), 1)
+	if err != nil {
+		t.Fatalf("GetPrefs returned unexpected error: %s", err)
+	}
+	if prefs.TextEntered != models.All {
+		t.Errorf("Legacy Option was migrated to %v", prefs.TextEntered)
+	}
+	if prefs.Version != 1 {
+		t.Errorf("Migration did not increment the version, got %d", prefs.Version)
+	}
+}
+
+// TestDBRecipientsLegacyOptions checks that the recipients of documents that
+// haven't been migrated yet are those that MemDB resolves from them
+func TestDBRecipientsLegacyOptions(t *testing.T) {
+	uri := os.Getenv("PESTCONTROL_TEST_DB_URI")
+	if uri == "" {
+		t.Skip("PESTCONTROL_TEST_DB_URI is not set")
+	}
+
+	db, err := models.NewDB(uri, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %s", err)
+	}
+	defer db.Disconnect(context.TODO())
+
+	database := db.Database("pest-control")
+	if err := database.Drop(context.TODO()); err != nil {
+		t.Fatalf("Failed to drop database: %s", err)
+	}
+	legacy := []bson.D{
+		{
+			{"user_id", 1},
+			{"global", bson.D{{"text_entered", "all"}, {"tag", "browser"}}},
+			{"conversation", bson.A{bson.D{{"conversation_id", 10}, {"tag", "none"}, {"role", "email"}}}},
+		},
+		{
+			{"user_id", 2},
+			{"global", bson.D{{"text_entered", "none"}, {"role", "all"}}},
+		},
+	}
+	mem := models.NewMemDB()
+	for _, doc := range legacy {
+		if _, err := database.Collection("prefs").InsertOne(context.TODO(), doc); err != nil {
+			t.Fatalf("Failed to insert legacy preferences: %s", err)
+		}
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatalf("Failed to encode legacy preferences: %s", err)
+		}
+		prefs := &models.Preferences{}
+		if err := bson.Unmarshal(data, prefs); err != nil {
+			t.Fatalf("Failed to decode legacy preferences: %s", err)
+		}
+		if err := mem.CreatePrefs(context.TODO(), prefs); err != nil {
+			t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+		}
+	}
+
+	for _, event := range models.Events() {
+		expected, err := mem.GetRecipients(context.TODO(), 10, event, []int{1, 2, 3})
+		if err != nil {
+			t.Fatalf("GetRecipients of MemDB returned unexpected error: %s", err)
+		}
+		recipients, err := db.GetRecipients(context.TODO(), 10, event, []int{1, 2, 3})
+		if err != nil || !reflect.DeepEqual(expected, recipients) {
+			t.Errorf("GetRecipients of %s returned incorrect recipients, expected %v, got %v, %v",
+				event, expected, recipients, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QuietHours is a weekly schedule during which a user does not want to be
+// notified. A schedule without ranges is never quiet, which lets a
+// conversation turn off the global quiet hours.
+type QuietHours struct {
+	// Timezone is an IANA time zone name, e.g. "America/Toronto"
+	Timezone string       `json:"timezone" bson:"timezone"`
+	Ranges   []QuietRange `json:"ranges" bson:"ranges"`
+}
+
+// QuietRange is a daily range of quiet time. Start and End are "HH:MM"
+// times, and a range whose End is before its Start ends on the next day.
+type QuietRange struct {
+	// Days are the days that the range starts on, e.g. "mon", or every day
+	// if empty
+	Days  []string `json:"days,omitempty" bson:"days,omitempty"`
+	Start string   `json:"start" bson:"start"`
+	End   string   `json:"end" bson:"end"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// weekdayNames are the keys of weekdays from Sunday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// clockRange is the range of "HH:MM" times
+const clockRange = "00:00-23:59"
+
+// parseClock returns the minutes since midnight of an "HH:MM" time
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate returns a ValidationError listing every invalid field of the
+// range, or nil
+func (r *QuietRange) Validate() error {
+	invalid := &ValidationError{}
+	for _, day := range r.Days {
+		if _, ok := weekdays[day]; !ok {
+			invalid.Add("days", fmt.Sprintf("invalid day %q", day), weekdayNames...)
+			break
+		}
+	}
+	start, err := parseClock(r.Start)
+	if err != nil {
+		invalid.Add("start", err.Error(), clockRange)
+	}
+	end, endErr := parseClock(r.End)
+	if endErr != nil {
+		invalid.Add("end", endErr.Error(), clockRange)
+	}
+	if err == nil && endErr == nil && start == end {
+		invalid.Add("end", "start and end times must differ")
+	}
+	return invalid.Err()
+}
+
+// Validate returns a ValidationError listing every invalid field of the
+// quiet hours and of their ranges, or nil
+func (q *QuietHours) Validate() error {
+	invalid := &ValidationError{}
+	if _, err := time.LoadLocation(q.Timezone); err != nil || q.Timezone == "" {
+		invalid.Add("timezone", fmt.Sprintf("invalid timezone %q", q.Timezone))
+	}
+	for i := range q.Ranges {
+		invalid.merge(fmt.Sprintf("ranges[%d].", i), q.Ranges[i].Validate())
+	}
+	return invalid.Err()
+}
+
+func (r *QuietRange) startsOn(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, d := range r.Days {
+		if weekdays[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether t is within the quiet hours
+func (q *QuietHours) Active(t time.Time) (bool, error) {
+	if q == nil {
+		return false, nil
+	}
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return false, err
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	for i := range q.Ranges {
+		r := &q.Ranges[i]
+		start, err := parseClock(r.Start)
+		if err != nil {
+			return false, err
+		}
+		end, err := parseClock(r.End)
+		if err != nil {
+			return false, err
+		}
+
+		if start < end {
+			if r.startsOn(today) && now >= start && now < end {
+				return true, nil
+			}
+		} else if (r.startsOn(today) && now >= start) ||
+			(r.startsOn(yesterday) && now < end) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func copyQuietHours(q *QuietHours) *QuietHours {
+	if q == nil {
+		return nil
+	}
+	c := &QuietHours{Timezone: q.Timezone}
+	if q.Ranges != nil {
+		c.Ranges = make([]QuietRange, len(q.Ranges))
+		for i, r := range q.Ranges {
+			c.Ranges[i] = QuietRange{
+				Start: r.Start,
+				End:   r.End,
+			}
+			if r.Days != nil {
+				c.Ranges[i].Days = append([]string{}, r.Days...)
+			}
+		}
+	}
+	return c
+}
+
+// InQuietHours reports whether a user is in quiet hours for a conversation at
+// time t. The conversation's quiet hours take precedence over the global ones.
+func InQuietHours(
+	ctx context.Context,
+	db Datastore,
+	userID,
+	conversationID int,
+	t time.Time,
+) (bool, error) {
+	prefs, err := GetEffectivePrefs(ctx, db, userID, conversationID, t)
+	if err != nil {
+		return false, err
+	}
+	return prefs.InQuietHours, nil
+}
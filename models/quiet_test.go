@@ -0,0 +1,77 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"pest-control/models"
+)
+
+func TestQuietHoursActive(t *testing.T) {
+	quietHours := &models.QuietHours{
+		Timezone: "America/Toronto",
+		Ranges: []models.QuietRange{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "07:00"},
+			{Days: []string{"sat", "sun"}, Start: "12:00", End: "14:00"},
+		},
+	}
+	if err := quietHours.Validate(); err != nil {
+		t.Fatalf("Quiet hours are unexpectedly invalid: %s", err)
+	}
+
+	tests := []struct {
+		Name   string
+		Time   string
+		Active bool
+	}{
+		{"Weekday night", "2020-03-02T23:30:00-05:00", true},
+		{"Weekday early morning", "2020-03-03T06:59:00-05:00", true},
+		{"Weekday end of range", "2020-03-03T07:00:00-05:00", false},
+		{"Weekday afternoon", "2020-03-03T12:30:00-05:00", false},
+		{"Saturday morning after Friday night", "2020-03-07T06:00:00-05:00", true},
+		{"Monday morning after Sunday", "2020-03-02T06:00:00-05:00", false},
+		{"Weekend afternoon", "2020-03-07T13:00:00-05:00", true},
+		{"Weekend afternoon in UTC", "2020-03-07T18:00:00Z", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			at, _ := time.Parse(time.RFC3339, test.Time)
+			active, err := quietHours.Active(at)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if active != test.Active {
+				t.Errorf("Incorrect result at %s, expected %t, got %t", test.Time, test.Active, active)
+			}
+		})
+	}
+}
+
+func TestQuietHoursValidate(t *testing.T) {
+	tests := []struct {
+		Name       string
+		QuietHours models.QuietHours
+	}{
+		{"Invalid timezone", models.QuietHours{Timezone: "Nowhere"}},
+		{"Missing timezone", models.QuietHours{}},
+		{"Invalid day", models.QuietHours{
+			Timezone: "UTC",
+			Ranges:   []models.QuietRange{{Days: []string{"someday"}, Start: "01:00", End: "02:00"}},
+		}},
+		{"Invalid time", models.QuietHours{
+			Timezone: "UTC",
+			Ranges:   []models.QuietRange{{Start: "25:00", End: "02:00"}},
+		}},
+		{"Empty range", models.QuietHours{
+			Timezone: "UTC",
+			Ranges:   []models.QuietRange{{Start: "02:00", End: "02:00"}},
+		}},
+	}
+
+	for _, test := range tests {
+		if err := test.QuietHours.Validate(); err == nil {
+			t.Errorf("%s: expected an error", test.Name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package models
+
+import (
+	"context"
+	"pest-control/logging"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Event is a kind of event that users can be notified about
+type Event string
+
+// Recipients maps each channel to the IDs of the users that want to be
+// notified through it
+type Recipients map[Channel][]int
+
+const (
+	EventInvitation   Event = "invitation"
+	EventTextEntered  Event = "text_entered"
+	EventTextModified Event = "text_modified"
+	EventTag          Event = "tag"
+	EventRole         Event = "role"
+)
+
+var ErrInvalidEvent error = &Error{Code: "invalid_event", Message: "invalid event"}
+
+// Events returns every kind of event
+func Events() []Event {
+	return []Event{EventInvitation, EventTextEntered, EventTextModified, EventTag, EventRole}
+}
+
+func (e Event) Valid() bool {
+	switch e {
+	case EventInvitation, EventTextEntered, EventTextModified, EventTag, EventRole:
+		return true
+	}
+	return false
+}
+
+func (g *GeneralPrefs) option(event Event) Option {
+	if g == nil {
+		return ""
+	}
+	switch event {
+	case EventTextEntered:
+		return g.TextEntered
+	case EventTextModified:
+		return g.TextModified
+	case EventTag:
+		return g.Tag
+	case EventRole:
+		return g.Role
+	}
+	return ""
+}
+
+// resolveEvent resolves the Option a user chose for an event in a
+// conversation at time t, in the same way as ResolvePrefs. Invitations only
+// have a global preference and are not muted.
+func resolveEvent(
+	global *GlobalPrefs,
+	conv *ConversationPrefs,
+	event Event,
+	t time.Time,
+) Option {
+	if event != EventInvitation && conv.Muted(t) {
+		return None
+	}
+	if event != EventInvitation && conv != nil {
+		if option := conv.GeneralPrefs.option(event); option != "" {
+			return option
+		}
+	}
+
+	defaults := NewGlobalPrefs()
+	if event == EventInvitation {
+		if global != nil && global.Invitation != "" {
+			return global.Invitation
+		}
+		return defaults.Invitation
+	}
+
+	if global != nil {
+		if option := global.GeneralPrefs.option(event); option != "" {
+			return option
+		}
+	}
+	return defaults.GeneralPrefs.option(event)
+}
+
+// uniqueUserIDs returns the sorted, de-duplicated user IDs
+func uniqueUserIDs(userIDs []int) []int {
+	seen := map[int]bool{}
+	unique := []int{}
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			unique = append(unique, userID)
+		}
+	}
+	sort.Ints(unique)
+	return unique
+}
+
+func (mdb *MemDB) GetRecipients(ctx context.Context, conversationID int, event Event, userIDs []int) (Recipients, error) {
+	if !event.Valid() {
+		return nil, ErrInvalidEvent
+	}
+
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	now := time.Now()
+	recipients := Recipients{}
+	for _, userID := range uniqueUserIDs(userIDs) {
+		var (
+			global *GlobalPrefs
+			conv   *ConversationPrefs
+		)
+		if prefs, ok := mdb.prefs[userID]; ok {
+			global = prefs.Global
+			if i := prefs.findConv(conversationID); i >= 0 {
+				conv = prefs.Conversation[i]
+			}
+		}
+		for _, c := range resolveEvent(global, conv, event, now).Channels() {
+			recipients[c] = append(recipients[c], userID)
+		}
+	}
+	return recipients, nil
+}
+
+// channelsExpr returns the channels of an Option expression as an array. An
+// Option stored as a legacy string, in a document that hasn't been migrated
+// yet, is converted as ParseOption does.
+func channelsExpr(option interface{}) bson.D {
+	return bson.D{{"$let", bson.D{
+		{"vars", bson.D{{"option", option}}},
+		{"in", bson.D{{"$switch", bson.D{
+			{"branches", bson.A{
+				bson.D{
+					{"case", bson.D{{"$ne", bson.A{bson.D{{"$type", "$$option"}}, "string"}}}},
+					{"then", "$$option"},
+				},
+				bson.D{
+					{"case", bson.D{{"$eq", bson.A{"$$option", string(None)}}}},
+					{"then", bson.A{}},
+				},
+				bson.D{
+					{"case", bson.D{{"$eq", bson.A{"$$option", "all"}}}},
+					{"then", All.Channels()},
+				},
+			}},
+			{"default", bson.D{{"$split", bson.A{"$$option", ","}}}},
+		}}}},
+	}}}
+}
+
+// GetRecipients groups the given users by the channels of the Option they
+// resolve to for an event in a conversation. Users without preferences get
+// the defaults.
+func (db *DB) GetRecipients(ctx context.Context, conversationID int, event Event, userIDs []int) (Recipients, error) {
+	ctx, end := db.start(ctx, "GetRecipients")
+	defer end()
+
+	if !event.Valid() {
+		return nil, ErrInvalidEvent
+	}
+	userIDs = uniqueUserIDs(userIDs)
+
+	now := time.Now()
+	defaultOption := resolveEvent(nil, nil, event, now)
+	option := bson.D{{"$ifNull", bson.A{"$global." + string(event), defaultOption}}}
+	if event != EventInvitation {
+		conv := bson.D{{"$arrayElemAt", bson.A{
+			bson.D{{"$filter", bson.D{
+				{"input", "$conversation"},
+				{"as", "conv"},
+				{"cond", bson.D{{"$eq", bson.A{"$$conv.conversation_id", conversationID}}}},
+			}}},
+			0,
+		}}}
+		option = bson.D{{"$let", bson.D{
+			{"vars", bson.D{{"conv", conv}}},
+			{"in", bson.D{{"$cond", bson.A{
+				bson.D{{"$gt", bson.A{"$$conv.muted_until", now}}},
+				None,
+				bson.D{{"$ifNull", bson.A{"$$conv." + string(event), option}}},
+			}}}},
+		}}}
+	}
+
+	pipeline := bson.A{
+		bson.D{{"$match", db.scope(bson.D{{"user_id", bson.D{{"$in", userIDs}}}})}},
+		bson.D{{"$project", bson.D{{"user_id", 1}, {"option", channelsExpr(option)}}}},
+		// Users that chose None are kept with a null channel so that they
+		// are not mistaken for users without preferences
+		bson.D{{"$unwind", bson.D{
+			{"path", "$option"},
+			{"preserveNullAndEmptyArrays", true},
+		}}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$option"},
+			{"user_ids", bson.D{{"$push", "$user_id"}}},
+		}}},
+	}
+
+	collection := db.prefsCollection()
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to aggregate recipients from MongoDB collection", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	recipients := Recipients{}
+	found := map[int]bool{}
+	for cursor.Next(ctx) {
+		group := struct {
+			Channel *Channel `bson:"_id"`
+			UserIDs []int    `bson:"user_ids"`
+		}{}
+		if err := cursor.Decode(&group); err != nil {
+			logging.FromContext(ctx).Error("failed to decode recipients", logging.Fields{
+				"error": err,
+			})
+			return nil, err
+		}
+		for _, userID := range group.UserIDs {
+			found[userID] = true
+		}
+		if group.Channel != nil {
+			c := *group.Channel
+			recipients[c] = append(recipients[c], group.UserIDs...)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		logging.FromContext(ctx).Error("failed to iterate recipients", logging.Fields{"error": err})
+		return nil, err
+	}
+
+	for _, userID := range userIDs {
+		if !found[userID] {
+			for _, c := range defaultOption.Channels() {
+				recipients[c] = append(recipients[c], userID)
+			}
+		}
+	}
+	for _, ids := range recipients {
+		sort.Ints(ids)
+	}
+
+	return recipients, nil
+}
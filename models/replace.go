@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"pest-control/logging"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// generalPrefsFields are the BSON names of the fields of GeneralPrefs
+var generalPrefsFields = []string{
+	"text_entered",
+	"text_modified",
+	"tag",
+	"role",
+	"quiet_hours",
+	"digest",
+}
+
+// maxReplaceAttempts bounds how often ReplacePrefsConv retries when the
+// conversation is created or deleted concurrently
+const maxReplaceAttempts = 3
+
+func (mdb *MemDB) ReplacePrefs(ctx context.Context, prefs *Preferences) (bool, error) {
+	change, err := mdb.ReplacePrefsChange(ctx, prefs)
+	if err != nil {
+		return false, err
+	}
+	return replaced(prefs, change), nil
+}
+
+func (mdb *MemDB) ReplacePrefsChange(ctx context.Context, prefs *Preferences) (*Change, error) {
+	return mdb.write(prefs.UserID, func(current *Preferences) (*Preferences, error) {
+		return copyPreferences(prefs), nil
+	})
+}
+
+func (mdb *MemDB) ReplacePrefsConv(ctx context.Context, userID int, convPrefs *ConversationPrefs) (bool, error) {
+	change, err := mdb.ReplacePrefsConvChange(ctx, userID, convPrefs)
+	if err != nil {
+		return false, err
+	}
+	return change.CreatedConv(convPrefs.ConversationID), nil
+}
+
+func (mdb *MemDB) ReplacePrefsConvChange(
+	ctx context.Context,
+	userID int,
+	convPrefs *ConversationPrefs,
+) (*Change, error) {
+	return mdb.write(userID, func(current *Preferences) (*Preferences, error) {
+		return replacedPrefsConv(current, convPrefs)
+	})
+}
+
+// replaced sets the ID of the preferences that a ReplacePrefs created, and
+// reports whether it did
+func replaced(prefs *Preferences, change *Change) bool {
+	if change.Before != nil {
+		return false
+	}
+	prefs.ID = change.After.ID
+	return true
+}
+
+// ReplacePrefs creates a user's preferences or replaces them if they exist,
+// and reports whether they were created
+func (db *DB) ReplacePrefs(ctx context.Context, prefs *Preferences) (bool, error) {
+	change, err := db.ReplacePrefsChange(ctx, prefs)
+	if err != nil {
+		return false, err
+	}
+	return replaced(prefs, change), nil
+}
+
+// ReplacePrefsChange makes the write of ReplacePrefs and returns its Change
+func (db *DB) ReplacePrefsChange(ctx context.Context, prefs *Preferences) (*Change, error) {
+	ctx, end := db.start(ctx, "ReplacePrefs")
+	defer end()
+
+	if err := db.ensureBootstrapped(ctx); err != nil {
+		return nil, err
+	}
+
+	conversation := prefs.Conversation
+	if conversation == nil {
+		conversation = []*ConversationPrefs{}
+	}
+
+	id := primitive.NewObjectID()
+	filter := db.scope(bson.D{{"user_id", prefs.UserID}})
+	update := bson.D{
+		{"$set", bson.D{{"global", prefs.Global}, {"conversation", conversation}}},
+		{"$inc", bson.D{{"version", 1}}},
+		{"$setOnInsert", bson.D{{"_id", id}}},
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before)
+	collection := db.prefsCollection()
+	before := &Preferences{}
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(before)
+	// Concurrent upserts for a new user can all try to insert, the ones that
+	// lose against the unique index on user_id are retried as updates
+	if isDuplicateKeyError(err) {
+		before = &Preferences{}
+		err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(before)
+	}
+
+	after := copyPreferences(prefs)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		after.ID = id.Hex()
+		after.Version = 1
+		return &Change{After: after}, nil
+	case err != nil:
+		logging.FromContext(ctx).Error("failed to replace preferences in MongoDB collection", logging.Fields{
+			"prefs": prefs,
+			"error": err,
+		})
+		return nil, err
+	}
+	before.expireMutes(time.Now())
+	after.ID = before.ID
+	return updated(before, after), nil
+}
+
+// replaceConvUpdate sets every field of the GeneralPrefs of the conversation
+// matched by a filter, and unsets the fields that convPrefs leaves empty. The
+// mute of the conversation is kept.
+func replaceConvUpdate(convPrefs *ConversationPrefs) (bson.D, error) {
+	general := convPrefs.GeneralPrefs
+	if general == nil {
+		general = &GeneralPrefs{}
+	}
+	bytes, err := bson.Marshal(general)
+	if err != nil {
+		return nil, err
+	}
+	fields := bson.M{}
+	if err := bson.Unmarshal(bytes, &fields); err != nil {
+		return nil, err
+	}
+
+	set, unset := bson.D{}, bson.D{}
+	for _, field := range generalPrefsFields {
+		if value, ok := fields[field]; ok {
+			set = append(set, bson.E{"conversation.$." + field, value})
+		} else {
+			unset = append(unset, bson.E{"conversation.$." + field, ""})
+		}
+	}
+
+	update := bson.D{{"$inc", bson.D{{"version", 1}}}}
+	if len(set) > 0 {
+		update = append(update, bson.E{"$set", set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+	return update, nil
+}
+
+// ReplacePrefsConv creates a user's preferences for a conversation or
+// replaces them if they exist, and reports whether they were created
+func (db *DB) ReplacePrefsConv(ctx context.Context, userID int, convPrefs *ConversationPrefs) (bool, error) {
+	change, err := db.ReplacePrefsConvChange(ctx, userID, convPrefs)
+	if err != nil {
+		return false, err
+	}
+	return change.CreatedConv(convPrefs.ConversationID), nil
+}
+
+// ReplacePrefsConvChange makes the write of ReplacePrefsConv and returns its
+// Change
+func (db *DB) ReplacePrefsConvChange(
+	ctx context.Context,
+	userID int,
+	convPrefs *ConversationPrefs,
+) (*Change, error) {
+	ctx, end := db.start(ctx, "ReplacePrefsConv")
+	defer end()
+
+	update, err := replaceConvUpdate(convPrefs)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to create bson for update object", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+
+	filter := db.scope(bson.D{
+		{"user_id", userID},
+		{"conversation.conversation_id", convPrefs.ConversationID},
+	})
+	projection := convProjection(convPrefs.ConversationID)
+
+	for attempt := 0; ; attempt++ {
+		before, err := db.updatePrefs(ctx, filter, update, projection)
+		if err == nil {
+			after, err := replacedPrefsConv(before, convPrefs)
+			if err != nil {
+				return nil, err
+			}
+			return updated(before, after), nil
+		} else if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+
+		// The conversation doesn't exist, but it can be created before the
+		// push below in which case it is replaced on the next attempt
+		created := *convPrefs
+		created.MutedUntil = nil
+		change, err := db.CreatePrefsConvChange(ctx, userID, &created)
+		if err != ErrPrefsConvExists || attempt+1 == maxReplaceAttempts {
+			return change, err
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"pest-control/logging"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RestorePoint is the point in the history of a user's preferences that
+// they are restored to
+type RestorePoint struct {
+	// ConversationID only restores the preferences for a conversation if it
+	// is set, otherwise all of the user's preferences are restored
+	ConversationID *int
+	// Time restores the state left by the changes made at or before it
+	Time time.Time
+	// EntryID restores the state before the write that recorded the entry,
+	// and is used instead of Time if it is set
+	EntryID string
+}
+
+// RestoreDatastore is a Datastore that can roll preferences back to their
+// state at a point in their history, and returns the audit entries that
+// record the restore
+type RestoreDatastore interface {
+	Datastore
+	RestorePrefs(context.Context, int, *RestorePoint) ([]*AuditEntry, error)
+}
+
+var (
+	// ErrAuditEntryDNE is returned for a restore point of an audit entry
+	// that isn't in the user's history
+	ErrAuditEntryDNE error = &Error{
+		Code:    "audit_entry_not_found",
+		Message: "audit entry does not exist",
+	}
+	// ErrRestoreConflict is returned for a restore that kept being overtaken
+	// by concurrent changes to the user's preferences
+	ErrRestoreConflict error = &Error{
+		Code:    "restore_conflict",
+		Message: "user preferences were modified concurrently, the restore was not made",
+	}
+	// ErrHistoryIncomplete is returned for a restore across changes to the
+	// user's preferences that weren't recorded in their history
+	ErrHistoryIncomplete error = &Error{
+		Code:    "history_incomplete",
+		Message: "user preferences were modified without being recorded, the restore was not made",
+	}
+)
+
+// GlobalPrefs returns the global preferences of state s, which are nil if
+// it is missing or has no fields set
+func (s *AuditState) GlobalPrefs() *GlobalPrefs {
+	if s == nil || (s.Invitation == "" && s.GeneralPrefs == nil) {
+		return nil
+	}
+	return &GlobalPrefs{
+		Invitation:   s.Invitation,
+		GeneralPrefs: copyGeneralPrefs(s.GeneralPrefs),
+	}
+}
+
+// ConversationPrefs returns the preferences for a conversation of state s,
+// which are nil if it is missing
+func (s *AuditState) ConversationPrefs(conversationID int) *ConversationPrefs {
+	if s == nil {
+		return nil
+	}
+	conv := &ConversationPrefs{
+		ConversationID: conversationID,
+		GeneralPrefs:   copyGeneralPrefs(s.GeneralPrefs),
+	}
+	if s.MutedUntil != nil {
+		mutedUntil := *s.MutedUntil
+		conv.MutedUntil = &mutedUntil
+	}
+	return conv
+}
+
+// expireMutes drops the mutes of p that have ended, as GetPrefsConv does
+func (p *Preferences) expireMutes(now time.Time) {
+	for _, conv := range p.Conversation {
+		if conv != nil {
+			conv.expireMute(now)
+		}
+	}
+}
+
+// RewritePrefs replaces all of a user's preferences with those returned by
+// rewrite, or deletes them if it returns nil. rewrite is passed the current
+// preferences, or nil if they don't exist, and returns them to leave them as
+// they are. Like DB, the write only applies to the version of the
+// preferences that were passed to rewrite, and fails with ErrVersionMismatch
+// if they were changed in the meantime.
+func (mdb *MemDB) RewritePrefs(
+	ctx context.Context,
+	userID int,
+	rewrite func(*Preferences) (*Preferences, error),
+) error {
+	mdb.mu.RLock()
+	current := mdb.current(userID)
+	mdb.mu.RUnlock()
+
+	prefs, err := rewrite(current)
+	if err != nil {
+		return err
+	}
+	if prefs == current {
+		return nil
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	latest, ok := mdb.prefs[userID]
+	if ok != (current != nil) || (ok && latest.Version != current.Version) {
+		return ErrVersionMismatch
+	}
+	change := mdb.store(userID, current, prefs)
+	if current == nil {
+		prefs.ID = change.After.ID
+	}
+	return nil
+}
+
+// RewritePrefs replaces all of a user's preferences with those returned by
+// rewrite, or deletes them if it returns nil. rewrite is passed the current
+// preferences, or nil if they don't exist, and returns them to leave them as
+// they are. The write only applies to the version of the preferences that
+// were passed to rewrite, and fails with ErrVersionMismatch if they were
+// changed in the meantime.
+func (db *DB) RewritePrefs(
+	ctx context.Context,
+	userID int,
+	rewrite func(*Preferences) (*Preferences, error),
+) error {
+	ctx, end := db.start(ctx, "RewritePrefs")
+	defer end()
+
+	current := &Preferences{}
+	collection := db.prefsCollection()
+	err := collection.FindOne(ctx, db.scope(bson.D{{"user_id", userID}})).Decode(current)
+	if err == mongo.ErrNoDocuments {
+		current = nil
+	} else if err != nil {
+		logging.FromContext(ctx).Error("failed to find preferences in MongoDB collection", logging.Fields{
+			"user_id": userID,
+			"error":   err,
+		})
+		return err
+	} else {
+		current.expireMutes(time.Now())
+	}
+
+	prefs, err := rewrite(current)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case prefs == current:
+		return nil
+	case current == nil:
+		prefs.UserID = userID
+		if err := db.CreatePrefs(ctx, prefs); err != ErrPrefsExists {
+			return err
+		}
+		return ErrVersionMismatch
+	case prefs == nil:
+		if err := db.DeletePrefs(ctx, userID, current.Version); err != ErrPrefsDNE {
+			return err
+		}
+		return ErrVersionMismatch
+	}
+
+	conversation := prefs.Conversation
+	if conversation == nil {
+		conversation = []*ConversationPrefs{}
+	}
+	filter := db.versionFilter(userID, current.Version)
+	update := bson.D{
+		{"$set", bson.D{{"global", prefs.Global}, {"conversation", conversation}}},
+		{"$inc", bson.D{{"version", 1}}},
+	}
+	updateResult, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to rewrite preferences in MongoDB collection", logging.Fields{
+			"prefs": prefs,
+			"error": err,
+		})
+		return err
+	}
+	if updateResult.MatchedCount == 0 {
+		return ErrVersionMismatch
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Change is a write to a user's preferences, with their state before and
+// after it at the versions that it found and left them at. Before is nil if
+// the preferences didn't exist and After is nil if the write deleted them.
+// They hold at least the part of the preferences that the write touched,
+// which is all that DB reads of them: the global preferences of a write to
+// those, the preferences for the conversation of a write to a conversation,
+// and all of them otherwise.
+type Change struct {
+	Before *Preferences
+	After  *Preferences
+}
+
+// ChangeDatastore makes the writes of a Datastore and returns their Change
+type ChangeDatastore interface {
+	CreatePrefsConvChange(context.Context, int, *ConversationPrefs) (*Change, error)
+	ReplacePrefsChange(context.Context, *Preferences) (*Change, error)
+	ReplacePrefsConvChange(context.Context, int, *ConversationPrefs) (*Change, error)
+	DeletePrefsChange(context.Context, int, int64) (*Change, error)
+	DeletePrefsConvChange(context.Context, int, int, int64) (*Change, error)
+	PatchPrefsChange(context.Context, int, *GlobalPrefs, int64) (*Change, error)
+	PatchPrefsConvChange(context.Context, int, int, *ConversationPrefs, int64) (*Change, error)
+	MutePrefsConvChange(context.Context, int, int, *time.Time) (*Change, error)
+}
+
+// GlobalPrefs returns the global preferences that c left, at the version
+// that it left them at
+func (c *Change) GlobalPrefs() *GlobalPrefs {
+	return c.After.storedGlobal()
+}
+
+// ConversationPrefs returns the preferences for a conversation that c left,
+// at the version that it left them at
+func (c *Change) ConversationPrefs(conversationID int) (*ConversationPrefs, error) {
+	return c.After.storedConv(conversationID)
+}
+
+// CreatedConv reports whether c created the preferences for a conversation
+func (c *Change) CreatedConv(conversationID int) bool {
+	return c.After != nil && c.After.findConv(conversationID) >= 0 &&
+		(c.Before == nil || c.Before.findConv(conversationID) < 0)
+}
+
+// updated returns the Change of an update to the preferences before, which
+// left them as after at the next version
+func updated(before, after *Preferences) *Change {
+	c := &Change{Before: before, After: copyPreferences(after)}
+	c.After.Version = before.Version + 1
+	return c
+}
+
+// The functions below return a user's preferences as a write of the same
+// name leaves them, which MemDB stores and DB returns in the Change of its
+// update. They are passed the current preferences, or nil if they don't
+// exist, return them as they are if the write changes nothing and fail with
+// the errors of the write.
+
+// patchedPrefs returns the preferences left by PatchPrefs
+func patchedPrefs(current *Preferences, patch *GlobalPrefs, version int64) (*Preferences, error) {
+	if current == nil {
+		return nil, ErrPrefsDNE
+	}
+	if err := current.checkVersion(version); err != nil {
+		return nil, err
+	}
+	if patch == nil || (patch.Invitation == "" && !patch.GeneralPrefs.set()) {
+		return current, nil
+	}
+
+	patched := copyPreferences(current)
+	if patched.Global == nil {
+		patched.Global = &GlobalPrefs{}
+	}
+	if patch.Invitation != "" {
+		patched.Global.Invitation = patch.Invitation
+	}
+	patchGeneralPrefs(&patched.Global.GeneralPrefs, patch.GeneralPrefs)
+	return patched, nil
+}
+
+// patchedPrefsConv returns the preferences left by PatchPrefsConv
+func patchedPrefsConv(
+	current *Preferences,
+	conversationID int,
+	patch *ConversationPrefs,
+	version int64,
+) (*Preferences, error) {
+	if current == nil {
+		return nil, ErrPrefsDNE
+	}
+	i := current.findConv(conversationID)
+	if i < 0 {
+		return nil, ErrPrefsConvDNE
+	}
+	if err := current.checkVersion(version); err != nil {
+		return nil, err
+	}
+	if patch == nil || !patch.GeneralPrefs.set() {
+		return current, nil
+	}
+
+	patched := copyPreferences(current)
+	patchGeneralPrefs(&patched.Conversation[i].GeneralPrefs, patch.GeneralPrefs)
+	return patched, nil
+}
+
+// createdPrefsConv returns the preferences left by CreatePrefsConv
+func createdPrefsConv(current *Preferences, convPrefs *ConversationPrefs) (*Preferences, error) {
+	if current == nil {
+		return nil, ErrPrefsDNE
+	}
+	if current.findConv(convPrefs.ConversationID) >= 0 {
+		return nil, ErrPrefsConvExists
+	}
+
+	created := copyPreferences(current)
+	created.Conversation = append(created.Conversation, copyConversationPrefs(convPrefs))
+	return created, nil
+}
+
+// replacedPrefsConv returns the preferences left by ReplacePrefsConv
+func replacedPrefsConv(current *Preferences, convPrefs *ConversationPrefs) (*Preferences, error) {
+	if current == nil {
+		return nil, ErrPrefsDNE
+	}
+
+	replaced := copyPreferences(current)
+	if i := replaced.findConv(convPrefs.ConversationID); i >= 0 {
+		replaced.Conversation[i].GeneralPrefs = copyGeneralPrefs(convPrefs.GeneralPrefs)
+		return replaced, nil
+	}
+	conv := copyConversationPrefs(convPrefs)
+	conv.MutedUntil = nil
+	replaced.Conversation = append(replaced.Conversation, conv)
+	return replaced, nil
+}
+
+// mutedPrefsConv returns the preferences left by MutePrefsConv
+func mutedPrefsConv(current *Preferences, conversationID int, until *time.Time) (*Preferences, error) {
+	if current == nil {
+		return nil, ErrPrefsDNE
+	}
+	i := current.findConv(conversationID)
+	if i < 0 {
+		return nil, ErrPrefsConvDNE
+	}
+
+	muted := copyPreferences(current)
+	if until == nil {
+		muted.Conversation[i].MutedUntil = nil
+	} else {
+		mutedUntil := *until
+		muted.Conversation[i].MutedUntil = &mutedUntil
+	}
+	return muted, nil
+}
+
+// deletedPrefs returns the preferences left by DeletePrefs, which are nil
+func deletedPrefs(current *Preferences, version int64) (*Preferences, error) {
+	if current == nil {
+		return nil, ErrPrefsDNE
+	}
+	if err := current.checkVersion(version); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// deletedPrefsConv returns the preferences left by DeletePrefsConv
+func deletedPrefsConv(current *Preferences, conversationID int, version int64) (*Preferences, error) {
+	// Like the $pull in DB, a missing user is reported as a missing
+	// conversation since nothing was modified
+	if current == nil {
+		return nil, ErrPrefsConvDNE
+	}
+	i := current.findConv(conversationID)
+	if i < 0 {
+		return nil, ErrPrefsConvDNE
+	}
+	if err := current.checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	deleted := copyPreferences(current)
+	deleted.Conversation = append(deleted.Conversation[:i], deleted.Conversation[i+1:]...)
+	return deleted, nil
+}
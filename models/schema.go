@@ -0,0 +1,192 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"pest-control/logging"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// optionSchema matches an Option stored as a set of registered channels
+func optionSchema() bson.D {
+	channels := bson.A{}
+	for _, c := range Channels() {
+		channels = append(channels, string(c))
+	}
+	return bson.D{
+		{"bsonType", "array"},
+		{"uniqueItems", true},
+		{"items", bson.D{{"enum", channels}}},
+	}
+}
+
+func generalPrefsProperties() bson.D {
+	return bson.D{
+		{"text_entered", optionSchema()},
+		{"text_modified", optionSchema()},
+		{"tag", optionSchema()},
+		{"role", optionSchema()},
+		{"quiet_hours", bson.D{
+			{"bsonType", "object"},
+			{"required", bson.A{"timezone", "ranges"}},
+			{"properties", bson.D{
+				{"timezone", bson.D{{"bsonType", "string"}}},
+				{"ranges", bson.D{{"bsonType", bson.A{"array", "null"}}}},
+			}},
+		}},
+		{"digest", bson.D{
+			{"bsonType", "object"},
+			{"required", bson.A{"frequency"}},
+			{"properties", bson.D{
+				{"frequency", bson.D{{"enum", bson.A{Immediate, Hourly, Daily, Weekly}}}},
+				{"hour", bson.D{
+					{"bsonType", bson.A{"int", "long"}},
+					{"minimum", 0},
+					{"maximum", 23},
+				}},
+			}},
+		}},
+	}
+}
+
+// prefsSchema returns the $jsonSchema validator of the prefs collection. It
+// mirrors the types of Preferences and the values of Option, so it has to be
+// installed again when a channel is registered.
+func prefsSchema() bson.D {
+	globalProperties := append(
+		bson.D{{"invitation", optionSchema()}},
+		generalPrefsProperties()...,
+	)
+	convProperties := append(
+		bson.D{
+			{"conversation_id", bson.D{{"bsonType", bson.A{"int", "long"}}}},
+			{"muted_until", bson.D{{"bsonType", "date"}}},
+		},
+		generalPrefsProperties()...,
+	)
+
+	return bson.D{{"$jsonSchema", bson.D{
+		{"bsonType", "object"},
+		{"required", bson.A{"user_id"}},
+		{"properties", bson.D{
+			{"user_id", bson.D{{"bsonType", bson.A{"int", "long"}}}},
+			{"version", bson.D{{"bsonType", bson.A{"int", "long"}}}},
+			{"global", bson.D{
+				{"bsonType", bson.A{"object", "null"}},
+				{"properties", globalProperties},
+			}},
+			{"conversation", bson.D{
+				{"bsonType", bson.A{"array", "null"}},
+				{"items", bson.D{
+					{"bsonType", "object"},
+					{"properties", convProperties},
+				}},
+			}},
+		}},
+	}}}
+}
+
+// InstallValidator installs the $jsonSchema validator of the prefs collection
+// unless it is already installed, and reports whether it was changed. The
+// validation level is moderate, so documents that don't match the schema yet
+// can still be updated until they are migrated.
+func (db *DB) InstallValidator(ctx context.Context) (bool, error) {
+	database := db.database()
+	schema := prefsSchema()
+
+	cursor, err := database.ListCollections(
+		ctx,
+		bson.D{{"name", db.config.Collection}},
+	)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to list MongoDB collections", logging.Fields{
+			"error": err,
+		})
+		return false, err
+	}
+	collections := []struct {
+		Options struct {
+			Validator bson.Raw `bson:"validator"`
+		} `bson:"options"`
+	}{}
+	if err := cursor.All(ctx, &collections); err != nil {
+		logging.FromContext(ctx).Error("failed to decode collections", logging.Fields{"error": err})
+		return false, err
+	}
+
+	expected, err := bson.Marshal(schema)
+	if err != nil {
+		return false, err
+	}
+	if len(collections) > 0 && bytes.Equal(collections[0].Options.Validator, expected) {
+		return false, nil
+	}
+
+	cmd := bson.D{{"collMod", db.config.Collection}}
+	if len(collections) == 0 {
+		cmd = bson.D{{"create", db.config.Collection}}
+	}
+	cmd = append(
+		cmd,
+		bson.E{"validator", schema},
+		bson.E{"validationLevel", "moderate"},
+		bson.E{"validationAction", "error"},
+	)
+	if err := database.RunCommand(ctx, cmd).Err(); err != nil {
+		logging.FromContext(ctx).Error("failed to install validator", logging.Fields{"error": err})
+		return false, err
+	}
+	return true, nil
+}
+
+// BootstrapReport describes the changes made by Bootstrap
+type BootstrapReport struct {
+	CreatedIndexes  []string
+	Migrations      *MigrationReport
+	InstalledSchema bool
+	SchemaRequested bool
+}
+
+func (r *BootstrapReport) String() string {
+	b := new(strings.Builder)
+	if len(r.CreatedIndexes) > 0 {
+		fmt.Fprintf(b, "created indexes %s", strings.Join(r.CreatedIndexes, ", "))
+	} else {
+		fmt.Fprint(b, "indexes up to date")
+	}
+	if r.Migrations != nil {
+		fmt.Fprintf(b, "; %s", r.Migrations)
+	}
+	switch {
+	case !r.SchemaRequested:
+	case r.InstalledSchema:
+		fmt.Fprint(b, "; installed schema validator")
+	default:
+		fmt.Fprint(b, "; schema validator up to date")
+	}
+	return b.String()
+}
+
+// Bootstrap prepares the prefs collection for DB. It creates the missing
+// indexes, applies the pending migrations and, if validator is true, installs
+// the schema validator. It is safe to run more than once and concurrently.
+func (db *DB) Bootstrap(ctx context.Context, validator bool) (*BootstrapReport, error) {
+	report := &BootstrapReport{SchemaRequested: validator}
+
+	var err error
+	if report.CreatedIndexes, err = db.CreateIndexes(ctx); err != nil {
+		return report, err
+	}
+	if report.Migrations, err = db.Migrate(ctx, false); err != nil {
+		return report, err
+	}
+	if validator {
+		if report.InstalledSchema, err = db.InstallValidator(ctx); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
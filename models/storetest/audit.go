@@ -0,0 +1,370 @@
+package storetest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"pest-control/models"
+)
+
+// AuditFactory returns a new, empty AuditedDatastore
+type AuditFactory func(t *testing.T) models.AuditedDatastore
+
+// RunAuditLog verifies that the audit log of the AuditedDatastore returned
+// by newStore returns the entries that it recorded, newest first, by page
+// and filtered by conversation and field, and that it rewrites preferences.
+func RunAuditLog(t *testing.T, newStore AuditFactory) {
+	db := newStore(t)
+	conversationID := 10
+	mutedUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	newEntry := func(userID int, conversationID *int, fields ...string) *models.AuditEntry {
+		return &models.AuditEntry{
+			ID:             primitive.NewObjectID().Hex(),
+			UserID:         userID,
+			ConversationID: conversationID,
+			Action:         models.ActionPatch,
+			Actor:          "user:1",
+			RequestID:      "abc",
+			Time:           time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			Fields:         fields,
+			Before:         &models.AuditState{GeneralPrefs: &models.GeneralPrefs{Tag: models.All}},
+			After: &models.AuditState{
+				GeneralPrefs: &models.GeneralPrefs{Tag: models.None},
+				MutedUntil:   &mutedUntil,
+			},
+		}
+	}
+
+	entries := []*models.AuditEntry{
+		newEntry(1, nil, "tag"),
+		newEntry(1, &conversationID, "tag", "muted_until"),
+		newEntry(2, nil, "role"),
+		newEntry(1, nil, "role"),
+	}
+	entries[3].Before = nil
+	entries[3].PrevVersion, entries[3].Version = 0, 1
+	if err := db.RecordChanges(ctx, entries[:2]); err != nil {
+		t.Fatalf("RecordChanges returned unexpected error: %s", err)
+	}
+	if err := db.RecordChanges(ctx, entries[2:]); err != nil {
+		t.Fatalf("RecordChanges returned unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		Name     string
+		UserID   int
+		Query    *models.HistoryQuery
+		Expected []*models.AuditEntry
+	}{
+		{
+			Name:     "All entries",
+			UserID:   1,
+			Query:    &models.HistoryQuery{},
+			Expected: []*models.AuditEntry{entries[3], entries[1], entries[0]},
+		},
+		{
+			Name:     "First page",
+			UserID:   1,
+			Query:    &models.HistoryQuery{Limit: 2},
+			Expected: []*models.AuditEntry{entries[3], entries[1]},
+		},
+		{
+			Name:     "Last page",
+			UserID:   1,
+			Query:    &models.HistoryQuery{Limit: 2, Before: entries[1].ID},
+			Expected: []*models.AuditEntry{entries[0]},
+		},
+		{
+			Name:     "Entries of a conversation",
+			UserID:   1,
+			Query:    &models.HistoryQuery{ConversationID: &conversationID},
+			Expected: []*models.AuditEntry{entries[1]},
+		},
+		{
+			Name:     "Entries of a field",
+			UserID:   1,
+			Query:    &models.HistoryQuery{Field: "tag"},
+			Expected: []*models.AuditEntry{entries[1], entries[0]},
+		},
+		{
+			Name:     "Entries of another user",
+			UserID:   2,
+			Query:    &models.HistoryQuery{},
+			Expected: []*models.AuditEntry{entries[2]},
+		},
+		{
+			Name:     "User without entries",
+			UserID:   3,
+			Query:    &models.HistoryQuery{},
+			Expected: []*models.AuditEntry{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual, err := db.History(ctx, test.UserID, test.Query)
+			if err != nil {
+				t.Fatalf("History returned unexpected error: %s", err)
+			}
+			for _, e := range actual {
+				e.TenantID = ""
+				e.Time = e.Time.UTC()
+				if e.After != nil && e.After.MutedUntil != nil {
+					after := e.After.MutedUntil.UTC()
+					e.After.MutedUntil = &after
+				}
+			}
+			if !reflect.DeepEqual(test.Expected, actual) {
+				t.Errorf("History returned incorrect entries, expected %+v, got %+v", test.Expected, actual)
+			}
+		})
+	}
+
+	t.Run("RewritePrefs", func(t *testing.T) {
+		runRewritePrefs(t, newStore(t))
+	})
+	t.Run("RewritePrefsConcurrently", func(t *testing.T) {
+		runRewriteConflict(t, newStore(t))
+	})
+	t.Run("Changes", func(t *testing.T) {
+		runChanges(t, newStore(t))
+	})
+}
+
+// runRewritePrefs verifies that RewritePrefs creates, replaces and deletes
+// all of a user's preferences, and passes the current ones to rewrite
+func runRewritePrefs(t *testing.T, db models.AuditedDatastore) {
+	userID := 4
+	conv := models.NewConversationPrefs()
+	conv.ConversationID = 10
+	replaced := &models.Preferences{
+		Global:       &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Email}},
+		Conversation: []*models.ConversationPrefs{conv},
+	}
+
+	tests := []struct {
+		Name    string
+		Prefs   *models.Preferences
+		Current bool
+		Exists  bool
+	}{
+		{Name: "Create", Prefs: models.NewPreferences(), Exists: true},
+		{Name: "Replace", Prefs: replaced, Current: true, Exists: true},
+		{Name: "Delete", Current: true},
+		{Name: "Delete missing preferences"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := db.RewritePrefs(ctx, userID, func(current *models.Preferences) (*models.Preferences, error) {
+				if (current != nil) != test.Current {
+					t.Errorf("RewritePrefs passed incorrect current preferences %+v", current)
+				}
+				return test.Prefs, nil
+			})
+			if err != nil {
+				t.Fatalf("RewritePrefs returned unexpected error: %s", err)
+			}
+
+			global, err := db.GetPrefs(ctx, userID)
+			if !test.Exists {
+				if err != models.ErrPrefsDNE {
+					t.Errorf("GetPrefs returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetPrefs returned unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(test.Prefs.Global.GeneralPrefs, global.GeneralPrefs) {
+				t.Errorf("Incorrect global preferences, expected %+v, got %+v", test.Prefs.Global, global)
+			}
+			convs, err := db.ListPrefsConv(ctx, userID, &models.ListConvQuery{})
+			if err != nil || len(convs) != len(test.Prefs.Conversation) {
+				t.Errorf("Incorrect conversation preferences %+v, %v", convs, err)
+			}
+		})
+	}
+}
+
+// runRewriteConflict verifies that RewritePrefs fails with ErrVersionMismatch
+// when the preferences are written between reading and rewriting them, and
+// keeps the write that it lost against
+func runRewriteConflict(t *testing.T, db models.AuditedDatastore) {
+	userID := 5
+	mustCreatePrefs(t, db, userID)
+
+	err := db.RewritePrefs(ctx, userID, func(current *models.Preferences) (*models.Preferences, error) {
+		patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.None}}
+		if _, err := db.PatchPrefs(ctx, userID, patch, models.AnyVersion); err != nil {
+			t.Fatalf("PatchPrefs returned unexpected error: %s", err)
+		}
+		return models.NewPreferences(), nil
+	})
+	checkErr(t, "RewritePrefs with a concurrent write", models.ErrVersionMismatch, err)
+
+	global, err := db.GetPrefs(ctx, userID)
+	if err != nil || global.Tag != models.None {
+		t.Errorf("RewritePrefs overwrote the concurrent write, got %+v, %v", global, err)
+	}
+}
+
+// changeState returns the state of the global preferences of prefs, or of
+// their preferences for a conversation if conversationID is not nil
+func changeState(prefs *models.Preferences, conversationID *int) *models.AuditState {
+	if prefs == nil {
+		return nil
+	}
+	if conversationID == nil {
+		return models.GlobalState(prefs.Global)
+	}
+	for _, conv := range prefs.Conversation {
+		if conv != nil && conv.ConversationID == *conversationID {
+			return models.ConversationState(conv)
+		}
+	}
+	return nil
+}
+
+// runChanges verifies that the writes return the Change that they made, with
+// the part of the preferences that they touched before and after it, at the
+// versions that they found and left them at
+func runChanges(t *testing.T, db models.AuditedDatastore) {
+	userID := 6
+	mustCreatePrefs(t, db, userID, 10)
+	conv10, conv11 := 10, 11
+	until := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	defaults := models.GlobalState(models.NewGlobalPrefs())
+	defaultConv := models.ConversationState(newConversationPrefs(10))
+	patched := models.GlobalState(models.NewGlobalPrefs())
+	patched.Tag = models.None
+	patchedConv := models.ConversationState(newConversationPrefs(10))
+	patchedConv.Role = models.Email
+	mutedConv := models.ConversationState(newConversationPrefs(10))
+	mutedConv.Role = models.Email
+	mutedConv.MutedUntil = &until
+	replacedConv := &models.AuditState{GeneralPrefs: &models.GeneralPrefs{Tag: models.Email}}
+
+	tests := []struct {
+		Name           string
+		Write          func() (*models.Change, error)
+		ConversationID *int
+		Before, After  *models.AuditState
+		Version        int64
+		Deleted        bool
+	}{
+		{
+			Name: "PatchPrefs",
+			Write: func() (*models.Change, error) {
+				patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.None}}
+				return db.PatchPrefsChange(ctx, userID, patch, 1)
+			},
+			Before:  defaults,
+			After:   patched,
+			Version: 1,
+		},
+		{
+			Name: "PatchPrefsConv",
+			Write: func() (*models.Change, error) {
+				patch := &models.ConversationPrefs{GeneralPrefs: &models.GeneralPrefs{Role: models.Email}}
+				return db.PatchPrefsConvChange(ctx, userID, 10, patch, models.AnyVersion)
+			},
+			ConversationID: &conv10,
+			Before:         defaultConv,
+			After:          patchedConv,
+			Version:        2,
+		},
+		{
+			Name: "MutePrefsConv",
+			Write: func() (*models.Change, error) {
+				return db.MutePrefsConvChange(ctx, userID, 10, &until)
+			},
+			ConversationID: &conv10,
+			Before:         patchedConv,
+			After:          mutedConv,
+			Version:        3,
+		},
+		{
+			Name: "CreatePrefsConv",
+			Write: func() (*models.Change, error) {
+				return db.CreatePrefsConvChange(ctx, userID, newConversationPrefs(11))
+			},
+			ConversationID: &conv11,
+			After:          defaultConv,
+			Version:        4,
+		},
+		{
+			Name: "ReplacePrefsConv",
+			Write: func() (*models.Change, error) {
+				conv := &models.ConversationPrefs{
+					ConversationID: 11,
+					GeneralPrefs:   &models.GeneralPrefs{Tag: models.Email},
+				}
+				return db.ReplacePrefsConvChange(ctx, userID, conv)
+			},
+			ConversationID: &conv11,
+			Before:         defaultConv,
+			After:          replacedConv,
+			Version:        5,
+		},
+		{
+			Name: "DeletePrefsConv",
+			Write: func() (*models.Change, error) {
+				return db.DeletePrefsConvChange(ctx, userID, 11, 6)
+			},
+			ConversationID: &conv11,
+			Before:         replacedConv,
+			Version:        6,
+		},
+		{
+			Name: "ReplacePrefs",
+			Write: func() (*models.Change, error) {
+				prefs := models.NewPreferences()
+				prefs.UserID = userID
+				return db.ReplacePrefsChange(ctx, prefs)
+			},
+			Before:  patched,
+			After:   defaults,
+			Version: 7,
+		},
+		{
+			Name: "DeletePrefs",
+			Write: func() (*models.Change, error) {
+				return db.DeletePrefsChange(ctx, userID, models.AnyVersion)
+			},
+			Before:  defaults,
+			Version: 8,
+			Deleted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			change, err := test.Write()
+			if err != nil {
+				t.Fatalf("%s returned unexpected error: %s", test.Name, err)
+			}
+			before := changeState(change.Before, test.ConversationID)
+			if (before == nil) != (test.Before == nil) || len(models.ChangedFields(test.Before, before)) > 0 {
+				t.Errorf("%s returned incorrect state before it, expected %+v, got %+v", test.Name, test.Before, before)
+			}
+			after := changeState(change.After, test.ConversationID)
+			if (after == nil) != (test.After == nil) || len(models.ChangedFields(test.After, after)) > 0 {
+				t.Errorf("%s returned incorrect state after it, expected %+v, got %+v", test.Name, test.After, after)
+			}
+
+			if change.Before.Version != test.Version {
+				t.Errorf("%s returned incorrect version before it, expected %d, got %d", test.Name, test.Version, change.Before.Version)
+			}
+			if test.Deleted {
+				if change.After != nil {
+					t.Errorf("%s returned preferences after it %+v", test.Name, change.After)
+				}
+			} else if change.After.Version != test.Version+1 {
+				t.Errorf("%s returned incorrect version after it, expected %d, got %d", test.Name, test.Version+1, change.After.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,564 @@
+package storetest
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"pest-control/audit"
+	"pest-control/auth"
+	"pest-control/logging"
+	"pest-control/models"
+)
+
+// RunHistory verifies that the audit.Datastore of the AuditedDatastore
+// returned by newStore records the history of the preferences that it
+// stores, and restores them from it, including when its entries are recorded
+// out of order or lost and when the preferences are changed concurrently.
+func RunHistory(t *testing.T, newStore AuditFactory) {
+	t.Run("History", func(t *testing.T) {
+		runHistory(t, newStore)
+	})
+	t.Run("ConcurrentChanges", func(t *testing.T) {
+		runConcurrentChanges(t, newStore)
+	})
+	t.Run("RestorePrefs", func(t *testing.T) {
+		runRestorePrefs(t, newStore)
+	})
+	t.Run("RestorePrefsConcurrently", func(t *testing.T) {
+		runRestorePrefsConcurrently(t, newStore)
+	})
+	t.Run("RestorePrefsOutOfOrder", func(t *testing.T) {
+		runRestorePrefsOutOfOrder(t, newStore)
+	})
+	t.Run("RestorePrefsConflict", func(t *testing.T) {
+		runRestorePrefsConflict(t, newStore)
+	})
+	t.Run("RestorePrefsIncompleteHistory", func(t *testing.T) {
+		runRestorePrefsIncompleteHistory(t, newStore)
+	})
+}
+
+// restorePoint returns the current time as a restore point, once the writes
+// made after it are recorded after it at the millisecond precision of the
+// times of audit entries
+func restorePoint() time.Time {
+	at := time.Now()
+	time.Sleep(time.Millisecond)
+	return at
+}
+
+// entry is what runHistory checks of an audit entry
+type entry struct {
+	Action         models.AuditAction
+	ConversationID int
+	Fields         []string
+	Existed        bool
+	Exists         bool
+}
+
+func runHistory(t *testing.T, newStore AuditFactory) {
+	ctx := auth.WithUserID(context.Background(), 1)
+	ctx = logging.WithRequestID(ctx, "abc")
+	db := audit.NewDatastore(newStore(t))
+	until := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		Name     string
+		Write    func() error
+		Expected []entry
+	}{
+		{
+			Name: "Create",
+			Write: func() error {
+				prefs := models.NewPreferences()
+				prefs.UserID = 1
+				conv := models.NewConversationPrefs()
+				conv.ConversationID = 10
+				prefs.Conversation = []*models.ConversationPrefs{conv}
+				return db.CreatePrefs(ctx, prefs)
+			},
+			Expected: []entry{
+				{models.ActionCreate, 0, []string{"invitation", "text_entered", "text_modified", "tag", "role"}, false, true},
+				{models.ActionCreate, 10, []string{"text_entered", "text_modified", "tag", "role"}, false, true},
+			},
+		},
+		{
+			Name: "Patch",
+			Write: func() error {
+				patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Email}}
+				_, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion)
+				return err
+			},
+			Expected: []entry{{models.ActionPatch, 0, []string{"tag"}, true, true}},
+		},
+		{
+			// The write still changes the version of the preferences
+			Name: "Patch without changes",
+			Write: func() error {
+				patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Email}}
+				_, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion)
+				return err
+			},
+			Expected: []entry{{models.ActionPatch, 0, []string{}, true, true}},
+		},
+		{
+			Name: "Failed patch",
+			Write: func() error {
+				patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.None}}
+				if _, err := db.PatchPrefs(ctx, 1, patch, 1); err != models.ErrVersionMismatch {
+					t.Fatalf("PatchPrefs returned incorrect error, expected %v, got %v", models.ErrVersionMismatch, err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "Mute",
+			Write: func() error {
+				return db.MutePrefsConv(ctx, 1, 10, &until)
+			},
+			Expected: []entry{{models.ActionMute, 10, []string{"muted_until"}, true, true}},
+		},
+		{
+			Name: "Replace conversation",
+			Write: func() error {
+				conv := &models.ConversationPrefs{
+					ConversationID: 20,
+					GeneralPrefs:   &models.GeneralPrefs{Role: models.Browser},
+				}
+				_, err := db.ReplacePrefsConv(ctx, 1, conv)
+				return err
+			},
+			Expected: []entry{{models.ActionCreate, 20, []string{"role"}, false, true}},
+		},
+		{
+			Name: "Delete conversation",
+			Write: func() error {
+				return db.DeletePrefsConv(ctx, 1, 20, models.AnyVersion)
+			},
+			Expected: []entry{{models.ActionDelete, 20, []string{"role"}, true, false}},
+		},
+		{
+			Name: "Delete",
+			Write: func() error {
+				return db.DeletePrefs(ctx, 1, models.AnyVersion)
+			},
+			Expected: []entry{
+				{models.ActionDelete, 0, []string{"invitation", "text_entered", "text_modified", "tag", "role"}, true, false},
+				{models.ActionDelete, 10, []string{"text_entered", "text_modified", "tag", "role", "muted_until"}, true, false},
+			},
+		},
+	}
+
+	recorded, version := 0, int64(0)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := test.Write(); err != nil {
+				t.Fatalf("Write returned unexpected error: %s", err)
+			}
+
+			entries, err := db.History(ctx, 1, &models.HistoryQuery{})
+			if err != nil {
+				t.Fatalf("History returned unexpected error: %s", err)
+			}
+			if len(entries) != recorded+len(test.Expected) {
+				t.Fatalf("Incorrect number of new entries, expected %d, got %d", len(test.Expected), len(entries)-recorded)
+			}
+			recorded = len(entries)
+
+			// The entries of a write are recorded in the order of Expected,
+			// and returned newest first
+			for i, expected := range test.Expected {
+				e := entries[len(test.Expected)-1-i]
+				actual := entry{e.Action, 0, e.Fields, e.Before != nil, e.After != nil}
+				if e.ConversationID != nil {
+					actual.ConversationID = *e.ConversationID
+				}
+				if !reflect.DeepEqual(expected, actual) {
+					t.Errorf("Incorrect entry, expected %+v, got %+v", expected, actual)
+				}
+				if e.Actor != "user:1" || e.RequestID != "abc" || e.UserID != 1 {
+					t.Errorf("Entry has incorrect actor, request or user: %+v", e)
+				}
+			}
+
+			// The versions of a write follow those of the one before it
+			for _, e := range entries[:len(test.Expected)] {
+				if e.PrevVersion != version || e.Version == version {
+					t.Errorf("Entry has incorrect versions, expected to follow %d, got %d to %d",
+						version, e.PrevVersion, e.Version)
+				}
+			}
+			if len(test.Expected) > 0 {
+				version = entries[0].Version
+			}
+		})
+	}
+}
+
+func runConcurrentChanges(t *testing.T, newStore AuditFactory) {
+	ctx := context.Background()
+	db := audit.NewDatastore(newStore(t))
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	if err := db.CreatePrefs(ctx, prefs); err != nil {
+		t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+	}
+
+	options := []models.Option{models.None, models.Email, models.Browser, models.All}
+	var wg sync.WaitGroup
+	for _, option := range options {
+		wg.Add(1)
+		go func(option models.Option) {
+			defer wg.Done()
+			patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: option}}
+			if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+				t.Errorf("PatchPrefs returned unexpected error: %s", err)
+			}
+		}(option)
+	}
+	wg.Wait()
+
+	// Every entry starts from the state that the one before it left, in the
+	// order of their versions since concurrent writes can be recorded out of
+	// it
+	entries, err := db.History(ctx, 1, &models.HistoryQuery{})
+	if err != nil {
+		t.Fatalf("History returned unexpected error: %s", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Version > entries[j].Version })
+	for i := 0; i+1 < len(entries); i++ {
+		if !reflect.DeepEqual(entries[i].Before, entries[i+1].After) {
+			t.Errorf("Entry %s does not start from the state of %s, %+v and %+v",
+				entries[i].ID, entries[i+1].ID, entries[i].Before, entries[i+1].After)
+		}
+	}
+}
+
+func runRestorePrefs(t *testing.T, newStore AuditFactory) {
+	ctx := auth.WithUserID(context.Background(), 1)
+	db := audit.NewDatastore(newStore(t))
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	conv := models.NewConversationPrefs()
+	conv.ConversationID = 10
+	prefs.Conversation = []*models.ConversationPrefs{conv}
+	if err := db.CreatePrefs(ctx, prefs); err != nil {
+		t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+	}
+	if err := db.DeletePrefs(ctx, 1, models.AnyVersion); err != nil {
+		t.Fatalf("DeletePrefs returned unexpected error: %s", err)
+	}
+
+	// Restoring before the entry of the conversation also undoes the entry
+	// of the global preferences recorded by the same delete
+	deleted, err := db.History(ctx, 1, &models.HistoryQuery{Limit: 1})
+	if err != nil {
+		t.Fatalf("History returned unexpected error: %s", err)
+	}
+	entries, err := db.RestorePrefs(ctx, 1, &models.RestorePoint{EntryID: deleted[0].ID})
+	if err != nil {
+		t.Fatalf("RestorePrefs returned unexpected error: %s", err)
+	}
+	if len(entries) != 2 || entries[0].Before != nil || entries[1].Before != nil {
+		t.Errorf("RestorePrefs recorded incorrect entries %+v", entries)
+	}
+
+	global, err := db.GetPrefs(ctx, 1)
+	if err != nil || !reflect.DeepEqual(prefs.Global.GeneralPrefs, global.GeneralPrefs) {
+		t.Errorf("Global preferences were restored incorrectly, got %+v, %v", global, err)
+	}
+	restored, err := db.GetPrefsConv(ctx, 1, 10)
+	if err != nil || !reflect.DeepEqual(conv.GeneralPrefs, restored.GeneralPrefs) {
+		t.Errorf("Conversation preferences were restored incorrectly, got %+v, %v", restored, err)
+	}
+
+	history, err := db.History(ctx, 1, &models.HistoryQuery{Limit: 1})
+	if err != nil || len(history) != 1 || history[0].Action != models.ActionRestore {
+		t.Errorf("Restore was not recorded in the history, got %+v, %v", history, err)
+	}
+
+	// Nothing has changed since now, so restoring to it changes nothing
+	entries, err = db.RestorePrefs(ctx, 1, &models.RestorePoint{Time: time.Now()})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("RestorePrefs to the current state recorded entries %+v, %v", entries, err)
+	}
+}
+
+// replicaLog is an AuditedDatastore whose audit entries are given IDs that
+// order the entries recorded in the same second oldest first, as the IDs of
+// entries recorded by different replicas can be
+type replicaLog struct {
+	models.AuditedDatastore
+	recorded uint64
+}
+
+func (l *replicaLog) RecordChanges(ctx context.Context, entries []*models.AuditEntry) error {
+	for _, e := range entries {
+		var id primitive.ObjectID
+		binary.BigEndian.PutUint32(id[:4], uint32(e.Time.Unix()))
+		binary.BigEndian.PutUint64(id[4:], math.MaxUint64-l.recorded)
+		l.recorded++
+		e.ID = id.Hex()
+	}
+	return l.AuditedDatastore.RecordChanges(ctx, entries)
+}
+
+func (l *replicaLog) History(ctx context.Context, userID int, query *models.HistoryQuery) ([]*models.AuditEntry, error) {
+	all, err := l.AuditedDatastore.History(ctx, userID, &models.HistoryQuery{})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID > all[j].ID })
+
+	entries := []*models.AuditEntry{}
+	for _, e := range all {
+		if (query.Before == "" || e.ID < query.Before) && (query.Limit == 0 || len(entries) < query.Limit) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// racyLog is an AuditedDatastore whose first races calls of RewritePrefs run
+// concurrent between reading and writing the preferences
+type racyLog struct {
+	models.AuditedDatastore
+	races      int
+	concurrent func()
+}
+
+func (l *racyLog) RewritePrefs(
+	ctx context.Context,
+	userID int,
+	rewrite func(*models.Preferences) (*models.Preferences, error),
+) error {
+	return l.AuditedDatastore.RewritePrefs(ctx, userID, func(current *models.Preferences) (*models.Preferences, error) {
+		if l.races > 0 && l.concurrent != nil {
+			l.races--
+			l.concurrent()
+		}
+		return rewrite(current)
+	})
+}
+
+// lateLog is an AuditedDatastore that records the audit entries of the
+// writes made while hold is set after those of the next write, as the
+// entries of concurrent writes can be
+type lateLog struct {
+	models.AuditedDatastore
+	hold bool
+	held []*models.AuditEntry
+}
+
+func (l *lateLog) RecordChanges(ctx context.Context, entries []*models.AuditEntry) error {
+	if l.hold {
+		l.held = append(l.held, entries...)
+		return nil
+	}
+	if err := l.AuditedDatastore.RecordChanges(ctx, entries); err != nil {
+		return err
+	}
+	for _, e := range l.held {
+		e.ID = primitive.NewObjectID().Hex()
+		e.Time = entries[0].Time.Add(time.Millisecond)
+	}
+	held := l.held
+	l.held = nil
+	return l.AuditedDatastore.RecordChanges(ctx, held)
+}
+
+func runRestorePrefsConcurrently(t *testing.T, newStore AuditFactory) {
+	tests := []struct {
+		Name string
+		New  func(*testing.T) (models.AuditedDatastore, func(*audit.Datastore))
+	}{
+		{
+			Name: "Entries out of time order",
+			New: func(t *testing.T) (models.AuditedDatastore, func(*audit.Datastore)) {
+				return &replicaLog{AuditedDatastore: newStore(t)}, nil
+			},
+		},
+		{
+			Name: "Concurrent write",
+			New: func(t *testing.T) (models.AuditedDatastore, func(*audit.Datastore)) {
+				log := &racyLog{AuditedDatastore: newStore(t), races: 1}
+				return log, func(db *audit.Datastore) {
+					log.concurrent = func() {
+						patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.None}}
+						if _, err := db.PatchPrefs(context.Background(), 1, patch, models.AnyVersion); err != nil {
+							t.Errorf("PatchPrefs returned unexpected error: %s", err)
+						}
+					}
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.Background()
+			log, race := test.New(t)
+			db := audit.NewDatastore(log)
+
+			prefs := models.NewPreferences()
+			prefs.UserID = 1
+			if err := db.CreatePrefs(ctx, prefs); err != nil {
+				t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+			}
+			patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Email}}
+			if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+				t.Fatalf("PatchPrefs returned unexpected error: %s", err)
+			}
+			at := restorePoint()
+			patch = &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Browser}}
+			if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+				t.Fatalf("PatchPrefs returned unexpected error: %s", err)
+			}
+
+			if race != nil {
+				race(db)
+			}
+			if _, err := db.RestorePrefs(ctx, 1, &models.RestorePoint{Time: at}); err != nil {
+				t.Fatalf("RestorePrefs returned unexpected error: %s", err)
+			}
+			global, err := db.GetPrefs(ctx, 1)
+			if err != nil || global.Tag != models.Email {
+				t.Errorf("Preferences were restored incorrectly, got %+v, %v", global, err)
+			}
+		})
+	}
+}
+
+func runRestorePrefsOutOfOrder(t *testing.T, newStore AuditFactory) {
+	ctx := context.Background()
+	log := &lateLog{AuditedDatastore: newStore(t)}
+	db := audit.NewDatastore(log)
+
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	if err := db.CreatePrefs(ctx, prefs); err != nil {
+		t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+	}
+	at := restorePoint()
+	for _, option := range []models.Option{models.Email, models.None} {
+		log.hold = option == models.Email
+		patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: option}}
+		if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+			t.Fatalf("PatchPrefs returned unexpected error: %s", err)
+		}
+	}
+
+	// The first patch is recorded after the second, and is still undone last
+	if _, err := db.RestorePrefs(ctx, 1, &models.RestorePoint{Time: at}); err != nil {
+		t.Fatalf("RestorePrefs returned unexpected error: %s", err)
+	}
+	global, err := db.GetPrefs(ctx, 1)
+	if err != nil || global.Tag != prefs.Global.Tag {
+		t.Errorf("Preferences were restored incorrectly, expected tag %v, got %+v, %v", prefs.Global.Tag, global, err)
+	}
+}
+
+func runRestorePrefsConflict(t *testing.T, newStore AuditFactory) {
+	ctx := context.Background()
+	log := &racyLog{AuditedDatastore: newStore(t), races: math.MaxInt32}
+	db := audit.NewDatastore(log)
+
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	if err := db.CreatePrefs(ctx, prefs); err != nil {
+		t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+	}
+	at := restorePoint()
+	patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.Browser}}
+	if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+		t.Fatalf("PatchPrefs returned unexpected error: %s", err)
+	}
+	options := []models.Option{models.None, models.Email}
+	log.concurrent = func() {
+		options[0], options[1] = options[1], options[0]
+		patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: options[0]}}
+		if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+			t.Errorf("PatchPrefs returned unexpected error: %s", err)
+		}
+	}
+
+	// Every attempt loses against a concurrent write, which is not a failed
+	// precondition of the restore
+	if _, err := db.RestorePrefs(ctx, 1, &models.RestorePoint{Time: at}); err != models.ErrRestoreConflict {
+		t.Fatalf("RestorePrefs returned incorrect error, expected %v, got %v", models.ErrRestoreConflict, err)
+	}
+	global, err := db.GetPrefs(ctx, 1)
+	if err != nil || global.Tag != options[0] {
+		t.Errorf("Preferences were changed by the failed restore, got %+v, %v", global, err)
+	}
+	history, err := db.History(ctx, 1, &models.HistoryQuery{Limit: 1})
+	if err != nil || len(history) != 1 || history[0].Action != models.ActionPatch {
+		t.Errorf("Failed restore was recorded in the history, got %+v, %v", history, err)
+	}
+}
+
+// lossyLog is an AuditedDatastore that loses the audit entries recorded while
+// lose is set, as entries that fail to be recorded are
+type lossyLog struct {
+	models.AuditedDatastore
+	lose bool
+}
+
+func (l *lossyLog) RecordChanges(ctx context.Context, entries []*models.AuditEntry) error {
+	if l.lose {
+		return nil
+	}
+	return l.AuditedDatastore.RecordChanges(ctx, entries)
+}
+
+func runRestorePrefsIncompleteHistory(t *testing.T, newStore AuditFactory) {
+	tests := []struct {
+		Name string
+		// Lost is the index of the write of Options that isn't recorded
+		Lost    int
+		Options []models.Option
+	}{
+		{"Lost first change", 0, []models.Option{models.Email, models.None}},
+		{"Lost change", 1, []models.Option{models.Email, models.None, models.Browser}},
+		{"Lost newest change", 1, []models.Option{models.Email, models.None}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.Background()
+			log := &lossyLog{AuditedDatastore: newStore(t)}
+			db := audit.NewDatastore(log)
+
+			prefs := models.NewPreferences()
+			prefs.UserID = 1
+			if err := db.CreatePrefs(ctx, prefs); err != nil {
+				t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+			}
+			at := restorePoint()
+			for i, option := range test.Options {
+				log.lose = i == test.Lost
+				patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: option}}
+				if _, err := db.PatchPrefs(ctx, 1, patch, models.AnyVersion); err != nil {
+					t.Fatalf("PatchPrefs returned unexpected error: %s", err)
+				}
+			}
+			log.lose = false
+
+			// The lost change can't be undone, so nothing is
+			if _, err := db.RestorePrefs(ctx, 1, &models.RestorePoint{Time: at}); err != models.ErrHistoryIncomplete {
+				t.Fatalf("RestorePrefs returned incorrect error, expected %v, got %v", models.ErrHistoryIncomplete, err)
+			}
+			global, err := db.GetPrefs(ctx, 1)
+			if last := test.Options[len(test.Options)-1]; err != nil || global.Tag != last {
+				t.Errorf("Preferences were changed by the failed restore, got %+v, %v", global, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,726 @@
+// Package storetest provides a conformance test suite for implementations of
+// models.Datastore. Every backend should pass Run so that handlers behave the
+// same no matter which Datastore they are given.
+package storetest
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"pest-control/models"
+)
+
+// ctx is the context of every Datastore call made by the suite
+var ctx = context.Background()
+
+// Factory returns a new, empty Datastore. It is called once per subtest.
+type Factory func(t *testing.T) models.Datastore
+
+// Run verifies that the Datastore returned by newStore honours the contract
+// implemented by models.DB.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		Name string
+		Test func(t *testing.T, db models.Datastore)
+	}{
+		{"CreatePrefs", testCreatePrefs},
+		{"CreatePrefsConv", testCreatePrefsConv},
+		{"CreateConcurrently", testCreateConcurrently},
+		{"ReplacePrefs", testReplacePrefs},
+		{"ReplacePrefsConv", testReplacePrefsConv},
+		{"GetPrefs", testGetPrefs},
+		{"GetPrefsConv", testGetPrefsConv},
+		{"PatchPrefs", testPatchPrefs},
+		{"PatchPrefsConv", testPatchPrefsConv},
+		{"DeletePrefs", testDeletePrefs},
+		{"DeletePrefsConv", testDeletePrefsConv},
+		{"GetRecipients", testGetRecipients},
+		{"ListPrefsConv", testListPrefsConv},
+		{"MutePrefsConv", testMutePrefsConv},
+		{"GetDueDigests", testGetDueDigests},
+		{"Versions", testVersions},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			test.Test(t, newStore(t))
+		})
+	}
+}
+
+func newConversationPrefs(conversationID int) *models.ConversationPrefs {
+	convPrefs := models.NewConversationPrefs()
+	convPrefs.ConversationID = conversationID
+	return convPrefs
+}
+
+func mustCreatePrefs(t *testing.T, db models.Datastore, userID int, convIDs ...int) {
+	t.Helper()
+	prefs := models.NewPreferences()
+	prefs.UserID = userID
+	for _, convID := range convIDs {
+		prefs.Conversation = append(prefs.Conversation, newConversationPrefs(convID))
+	}
+	if err := db.CreatePrefs(ctx, prefs); err != nil {
+		t.Fatalf("Failed to create preferences for user %d: %s", userID, err)
+	}
+}
+
+func checkErr(t *testing.T, op string, expected, actual error) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("%s returned incorrect error, expected %v, got %v", op, expected, actual)
+	}
+}
+
+func checkGlobal(t *testing.T, db models.Datastore, userID int, expected *models.GlobalPrefs) {
+	t.Helper()
+	actual, err := db.GetPrefs(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetPrefs returned unexpected error: %s", err)
+	}
+	// Versions are checked by testVersions
+	actual.Version = expected.Version
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("GetPrefs returned incorrect preferences, expected %+v, got %+v", expected, actual)
+	}
+}
+
+func checkConv(t *testing.T, db models.Datastore, userID int, expected *models.ConversationPrefs) {
+	t.Helper()
+	actual, err := db.GetPrefsConv(ctx, userID, expected.ConversationID)
+	if err != nil {
+		t.Fatalf("GetPrefsConv returned unexpected error: %s", err)
+	}
+	actual.Version = expected.Version
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("GetPrefsConv returned incorrect preferences, expected %+v, got %+v", expected, actual)
+	}
+}
+
+// checkPatchPrefs checks the error of PatchPrefs, and that it returns the
+// global preferences that the user is left with
+func checkPatchPrefs(
+	t *testing.T,
+	op string,
+	expected error,
+	db models.Datastore,
+	userID int,
+	patch *models.GlobalPrefs,
+	version int64,
+) *models.GlobalPrefs {
+	t.Helper()
+	patched, err := db.PatchPrefs(ctx, userID, patch, version)
+	checkErr(t, op, expected, err)
+	if err != nil {
+		return &models.GlobalPrefs{}
+	}
+	stored, err := db.GetPrefs(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetPrefs returned unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(stored, patched) {
+		t.Errorf("%s returned incorrect preferences, expected %+v, got %+v", op, stored, patched)
+	}
+	return patched
+}
+
+// checkPatchPrefsConv checks the error of PatchPrefsConv, and that it returns
+// the preferences for the conversation that the user is left with
+func checkPatchPrefsConv(
+	t *testing.T,
+	op string,
+	expected error,
+	db models.Datastore,
+	userID,
+	conversationID int,
+	patch *models.ConversationPrefs,
+	version int64,
+) *models.ConversationPrefs {
+	t.Helper()
+	patched, err := db.PatchPrefsConv(ctx, userID, conversationID, patch, version)
+	checkErr(t, op, expected, err)
+	if err != nil {
+		return &models.ConversationPrefs{}
+	}
+	stored, err := db.GetPrefsConv(ctx, userID, conversationID)
+	if err != nil {
+		t.Fatalf("GetPrefsConv returned unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(stored, patched) {
+		t.Errorf("%s returned incorrect preferences, expected %+v, got %+v", op, stored, patched)
+	}
+	return patched
+}
+
+func testCreatePrefs(t *testing.T, db models.Datastore) {
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	prefs.Global.Tag = models.None
+	prefs.Conversation = append(prefs.Conversation, newConversationPrefs(10))
+
+	if err := db.CreatePrefs(ctx, prefs); err != nil {
+		t.Fatalf("CreatePrefs returned unexpected error: %s", err)
+	}
+	if prefs.ID == "" {
+		t.Errorf("CreatePrefs did not set the ID of the created preferences")
+	}
+	checkGlobal(t, db, 1, prefs.Global)
+	checkConv(t, db, 1, newConversationPrefs(10))
+
+	duplicate := models.NewPreferences()
+	duplicate.UserID = 1
+	checkErr(t, "CreatePrefs with existing user", models.ErrPrefsExists, db.CreatePrefs(ctx, duplicate))
+	checkGlobal(t, db, 1, prefs.Global)
+
+	other := models.NewPreferences()
+	other.UserID = 2
+	checkErr(t, "CreatePrefs with new user", nil, db.CreatePrefs(ctx, other))
+}
+
+func testCreatePrefsConv(t *testing.T, db models.Datastore) {
+	checkErr(
+		t,
+		"CreatePrefsConv with non-existent user",
+		models.ErrPrefsDNE,
+		db.CreatePrefsConv(ctx, 1, newConversationPrefs(10)),
+	)
+
+	mustCreatePrefs(t, db, 1)
+
+	convPrefs := newConversationPrefs(10)
+	convPrefs.TextModified = models.Browser
+	checkErr(t, "CreatePrefsConv", nil, db.CreatePrefsConv(ctx, 1, convPrefs))
+	checkConv(t, db, 1, convPrefs)
+
+	checkErr(
+		t,
+		"CreatePrefsConv with existing conversation",
+		models.ErrPrefsConvExists,
+		db.CreatePrefsConv(ctx, 1, newConversationPrefs(10)),
+	)
+	checkConv(t, db, 1, convPrefs)
+
+	checkErr(t, "CreatePrefsConv with new conversation", nil, db.CreatePrefsConv(ctx, 1, newConversationPrefs(11)))
+	checkConv(t, db, 1, convPrefs)
+	checkConv(t, db, 1, newConversationPrefs(11))
+}
+
+// concurrently runs f in n goroutines and returns the errors that it returned
+func concurrently(n int, f func() error) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f()
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func checkOneCreated(t *testing.T, op string, errs []error, exists error) {
+	t.Helper()
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else if err != exists {
+			t.Errorf("%s returned unexpected error: %s", op, err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%s created %d times, expected once", op, created)
+	}
+}
+
+func testCreateConcurrently(t *testing.T, db models.Datastore) {
+	const n = 8
+
+	errs := concurrently(n, func() error {
+		prefs := models.NewPreferences()
+		prefs.UserID = 1
+		return db.CreatePrefs(ctx, prefs)
+	})
+	checkOneCreated(t, "CreatePrefs", errs, models.ErrPrefsExists)
+
+	errs = concurrently(n, func() error {
+		return db.CreatePrefsConv(ctx, 1, newConversationPrefs(10))
+	})
+	checkOneCreated(t, "CreatePrefsConv", errs, models.ErrPrefsConvExists)
+
+	convs, err := db.ListPrefsConv(ctx, 1, &models.ListConvQuery{Limit: n})
+	if err != nil {
+		t.Fatalf("ListPrefsConv returned unexpected error: %s", err)
+	}
+	if len(convs) != 1 {
+		t.Errorf("ListPrefsConv returned %d conversations, expected 1", len(convs))
+	}
+}
+
+func testReplacePrefs(t *testing.T, db models.Datastore) {
+	prefs := models.NewPreferences()
+	prefs.UserID = 1
+	prefs.Global.Tag = models.None
+	prefs.Conversation = append(prefs.Conversation, newConversationPrefs(10))
+
+	created, err := db.ReplacePrefs(ctx, prefs)
+	checkErr(t, "ReplacePrefs with new user", nil, err)
+	if !created {
+		t.Errorf("ReplacePrefs with new user did not report a creation")
+	}
+	if prefs.ID == "" {
+		t.Errorf("ReplacePrefs did not set the ID of the created preferences")
+	}
+	checkGlobal(t, db, 1, prefs.Global)
+	checkConv(t, db, 1, newConversationPrefs(10))
+
+	replacement := models.NewPreferences()
+	replacement.UserID = 1
+	replacement.Global.Role = models.Email
+	replacement.Conversation = append(replacement.Conversation, newConversationPrefs(11))
+
+	created, err = db.ReplacePrefs(ctx, replacement)
+	checkErr(t, "ReplacePrefs with existing user", nil, err)
+	if created {
+		t.Errorf("ReplacePrefs with existing user reported a creation")
+	}
+	checkGlobal(t, db, 1, replacement.Global)
+	checkConv(t, db, 1, newConversationPrefs(11))
+	if _, err := db.GetPrefsConv(ctx, 1, 10); err != models.ErrPrefsConvDNE {
+		t.Errorf("ReplacePrefs kept a replaced conversation, GetPrefsConv returned %v", err)
+	}
+
+	global, _ := db.GetPrefs(ctx, 1)
+	if global.Version != 2 {
+		t.Errorf("ReplacePrefs did not increment the version, expected 2, got %d", global.Version)
+	}
+}
+
+func testReplacePrefsConv(t *testing.T, db models.Datastore) {
+	if _, err := db.ReplacePrefsConv(ctx, 1, newConversationPrefs(10)); err != models.ErrPrefsDNE {
+		t.Errorf("ReplacePrefsConv with non-existent user returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+	}
+
+	mustCreatePrefs(t, db, 1)
+
+	convPrefs := newConversationPrefs(10)
+	convPrefs.QuietHours = &models.QuietHours{Timezone: "UTC", Ranges: []models.QuietRange{}}
+	created, err := db.ReplacePrefsConv(ctx, 1, convPrefs)
+	checkErr(t, "ReplacePrefsConv with new conversation", nil, err)
+	if !created {
+		t.Errorf("ReplacePrefsConv with new conversation did not report a creation")
+	}
+	checkConv(t, db, 1, convPrefs)
+
+	until := time.Now().Add(time.Hour).Truncate(time.Millisecond).UTC()
+	checkErr(t, "MutePrefsConv", nil, db.MutePrefsConv(ctx, 1, 10, &until))
+
+	// Fields that are not set are removed, but the mute is kept
+	replacement := &models.ConversationPrefs{
+		ConversationID: 10,
+		GeneralPrefs:   &models.GeneralPrefs{Tag: models.Email},
+	}
+	created, err = db.ReplacePrefsConv(ctx, 1, replacement)
+	checkErr(t, "ReplacePrefsConv with existing conversation", nil, err)
+	if created {
+		t.Errorf("ReplacePrefsConv with existing conversation reported a creation")
+	}
+	replacement.MutedUntil = &until
+	checkConv(t, db, 1, replacement)
+}
+
+func testGetPrefs(t *testing.T, db models.Datastore) {
+	if _, err := db.GetPrefs(ctx, 1); err != models.ErrPrefsDNE {
+		t.Errorf("GetPrefs with non-existent user returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+	}
+
+	mustCreatePrefs(t, db, 1)
+	checkGlobal(t, db, 1, models.NewGlobalPrefs())
+
+	// Modifying returned preferences must not modify the stored preferences
+	prefs, _ := db.GetPrefs(ctx, 1)
+	prefs.Tag = models.None
+	checkGlobal(t, db, 1, models.NewGlobalPrefs())
+}
+
+func testGetPrefsConv(t *testing.T, db models.Datastore) {
+	if _, err := db.GetPrefsConv(ctx, 1, 10); err != models.ErrPrefsDNE {
+		t.Errorf("GetPrefsConv with non-existent user returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+	}
+
+	mustCreatePrefs(t, db, 1, 10)
+	if _, err := db.GetPrefsConv(ctx, 1, 11); err != models.ErrPrefsConvDNE {
+		t.Errorf("GetPrefsConv with non-existent conversation returned incorrect error, expected %v, got %v", models.ErrPrefsConvDNE, err)
+	}
+	checkConv(t, db, 1, newConversationPrefs(10))
+}
+
+func testPatchPrefs(t *testing.T, db models.Datastore) {
+	checkPatchPrefs(t, "PatchPrefs with non-existent user", models.ErrPrefsDNE, db, 1, &models.GlobalPrefs{}, models.AnyVersion)
+
+	mustCreatePrefs(t, db, 1)
+	mustCreatePrefs(t, db, 2)
+
+	// An empty patch changes nothing
+	checkPatchPrefs(t, "PatchPrefs with empty patch", nil, db, 1, &models.GlobalPrefs{}, models.AnyVersion)
+	checkGlobal(t, db, 1, models.NewGlobalPrefs())
+
+	patch := &models.GlobalPrefs{
+		Invitation:   models.None,
+		GeneralPrefs: &models.GeneralPrefs{TextEntered: models.Email},
+	}
+	checkPatchPrefs(t, "PatchPrefs", nil, db, 1, patch, models.AnyVersion)
+
+	expected := models.NewGlobalPrefs()
+	expected.Invitation = models.None
+	expected.TextEntered = models.Email
+	checkGlobal(t, db, 1, expected)
+
+	// Quiet hours are replaced as a whole
+	quietHours := &models.QuietHours{
+		Timezone: "UTC",
+		Ranges: []models.QuietRange{
+			{Days: []string{"mon"}, Start: "22:00", End: "07:00"},
+		},
+	}
+	checkPatchPrefs(t, "PatchPrefs with quiet hours", nil, db, 1, &models.GlobalPrefs{
+		GeneralPrefs: &models.GeneralPrefs{QuietHours: quietHours},
+	}, models.AnyVersion)
+	expected.QuietHours = quietHours
+	checkGlobal(t, db, 1, expected)
+
+	// Other users are untouched
+	checkGlobal(t, db, 2, models.NewGlobalPrefs())
+}
+
+func testPatchPrefsConv(t *testing.T, db models.Datastore) {
+	patch := &models.ConversationPrefs{
+		GeneralPrefs: &models.GeneralPrefs{Tag: models.None, Role: models.Email},
+	}
+
+	checkPatchPrefsConv(t, "PatchPrefsConv with non-existent user", models.ErrPrefsDNE, db, 1, 10, patch, models.AnyVersion)
+
+	mustCreatePrefs(t, db, 1, 10, 11)
+	checkPatchPrefsConv(t, "PatchPrefsConv with non-existent conversation", models.ErrPrefsConvDNE, db, 1, 12, patch, models.AnyVersion)
+
+	checkPatchPrefsConv(t, "PatchPrefsConv with empty patch", nil, db, 1, 10, &models.ConversationPrefs{}, models.AnyVersion)
+	checkConv(t, db, 1, newConversationPrefs(10))
+
+	checkPatchPrefsConv(t, "PatchPrefsConv", nil, db, 1, 10, patch, models.AnyVersion)
+
+	expected := newConversationPrefs(10)
+	expected.Tag = models.None
+	expected.Role = models.Email
+	checkConv(t, db, 1, expected)
+
+	// Other conversations and the global preferences are untouched
+	checkConv(t, db, 1, newConversationPrefs(11))
+	checkGlobal(t, db, 1, models.NewGlobalPrefs())
+}
+
+func testDeletePrefs(t *testing.T, db models.Datastore) {
+	checkErr(t, "DeletePrefs with non-existent user", models.ErrPrefsDNE, db.DeletePrefs(ctx, 1, models.AnyVersion))
+
+	mustCreatePrefs(t, db, 1, 10)
+	mustCreatePrefs(t, db, 2)
+	checkErr(t, "DeletePrefs", nil, db.DeletePrefs(ctx, 1, models.AnyVersion))
+
+	if _, err := db.GetPrefs(ctx, 1); err != models.ErrPrefsDNE {
+		t.Errorf("GetPrefs after DeletePrefs returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+	}
+	if _, err := db.GetPrefsConv(ctx, 1, 10); err != models.ErrPrefsDNE {
+		t.Errorf("GetPrefsConv after DeletePrefs returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+	}
+	checkErr(t, "DeletePrefs with deleted user", models.ErrPrefsDNE, db.DeletePrefs(ctx, 1, models.AnyVersion))
+	checkGlobal(t, db, 2, models.NewGlobalPrefs())
+
+	// The user can create new preferences after deleting them
+	mustCreatePrefs(t, db, 1)
+}
+
+func testDeletePrefsConv(t *testing.T, db models.Datastore) {
+	// A $pull against a missing user modifies nothing, so it is reported as
+	// a missing conversation
+	checkErr(t, "DeletePrefsConv with non-existent user", models.ErrPrefsConvDNE, db.DeletePrefsConv(ctx, 1, 10, models.AnyVersion))
+
+	mustCreatePrefs(t, db, 1, 10, 11)
+	checkErr(t, "DeletePrefsConv", nil, db.DeletePrefsConv(ctx, 1, 10, models.AnyVersion))
+
+	if _, err := db.GetPrefsConv(ctx, 1, 10); err != models.ErrPrefsConvDNE {
+		t.Errorf("GetPrefsConv after DeletePrefsConv returned incorrect error, expected %v, got %v", models.ErrPrefsConvDNE, err)
+	}
+	checkErr(t, "DeletePrefsConv with deleted conversation", models.ErrPrefsConvDNE, db.DeletePrefsConv(ctx, 1, 10, models.AnyVersion))
+	checkConv(t, db, 1, newConversationPrefs(11))
+
+	// The conversation can be created again after deleting it
+	checkErr(t, "CreatePrefsConv after DeletePrefsConv", nil, db.CreatePrefsConv(ctx, 1, newConversationPrefs(10)))
+}
+
+func testGetRecipients(t *testing.T, db models.Datastore) {
+	user1 := models.NewPreferences()
+	user1.UserID = 1
+	user1.Global.Invitation = models.None
+	user1.Global.TextModified = models.Email
+	user1.Conversation = append(user1.Conversation, newConversationPrefs(10))
+	user1.Conversation[0].TextModified = models.Browser
+	user2 := models.NewPreferences()
+	user2.UserID = 2
+	user2.Global.TextModified = models.Email
+	user2.Conversation = append(user2.Conversation, newConversationPrefs(11))
+	user2.Conversation[0].TextModified = models.None
+	for _, prefs := range []*models.Preferences{user1, user2} {
+		if err := db.CreatePrefs(ctx, prefs); err != nil {
+			t.Fatalf("Failed to create preferences for user %d: %s", prefs.UserID, err)
+		}
+	}
+
+	tests := []struct {
+		Name       string
+		Event      models.Event
+		Recipients models.Recipients
+	}{
+		{
+			Name:  "Conversation preferences override global preferences",
+			Event: models.EventTextModified,
+			Recipients: models.Recipients{
+				models.ChannelBrowser: {1, 3},
+				models.ChannelEmail:   {2, 3},
+			},
+		},
+		{
+			Name:  "Invitations only use global preferences",
+			Event: models.EventInvitation,
+			Recipients: models.Recipients{
+				models.ChannelBrowser: {2, 3},
+				models.ChannelEmail:   {2, 3},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		recipients, err := db.GetRecipients(ctx, 10, test.Event, []int{3, 2, 1, 2})
+		if err != nil {
+			t.Fatalf("%s: GetRecipients returned unexpected error: %s", test.Name, err)
+		}
+		if !reflect.DeepEqual(test.Recipients, recipients) {
+			t.Errorf("%s: GetRecipients returned incorrect recipients, expected %+v, got %+v", test.Name, test.Recipients, recipients)
+		}
+	}
+
+	if _, err := db.GetRecipients(ctx, 10, "something", []int{1}); err != models.ErrInvalidEvent {
+		t.Errorf("GetRecipients with invalid event returned incorrect error, expected %v, got %v", models.ErrInvalidEvent, err)
+	}
+}
+
+func testListPrefsConv(t *testing.T, db models.Datastore) {
+	if _, err := db.ListPrefsConv(ctx, 1, &models.ListConvQuery{}); err != models.ErrPrefsDNE {
+		t.Errorf("ListPrefsConv with non-existent user returned incorrect error, expected %v, got %v", models.ErrPrefsDNE, err)
+	}
+
+	mustCreatePrefs(t, db, 1, 13, 11, 14, 12)
+	mustCreatePrefs(t, db, 2)
+	checkPatchPrefsConv(t, "PatchPrefsConv", nil, db, 1, 12, &models.ConversationPrefs{
+		GeneralPrefs: &models.GeneralPrefs{Tag: models.None},
+	}, models.AnyVersion)
+
+	after := 12
+	tests := []struct {
+		Name    string
+		UserID  int
+		Query   models.ListConvQuery
+		ConvIDs []int
+	}{
+		{"All conversations", 1, models.ListConvQuery{}, []int{11, 12, 13, 14}},
+		{"Limit", 1, models.ListConvQuery{Limit: 2}, []int{11, 12}},
+		{"Cursor", 1, models.ListConvQuery{After: &after}, []int{13, 14}},
+		{"Descending", 1, models.ListConvQuery{Descending: true}, []int{14, 13, 12, 11}},
+		{"Descending with cursor", 1, models.ListConvQuery{After: &after, Descending: true}, []int{11}},
+		{"Filter", 1, models.ListConvQuery{Filter: models.GeneralPrefs{Tag: models.None}}, []int{12}},
+		{"No conversations", 2, models.ListConvQuery{}, []int{}},
+	}
+
+	for _, test := range tests {
+		convs, err := db.ListPrefsConv(ctx, test.UserID, &test.Query)
+		if err != nil {
+			t.Fatalf("%s: ListPrefsConv returned unexpected error: %s", test.Name, err)
+		}
+		convIDs := []int{}
+		for _, conv := range convs {
+			convIDs = append(convIDs, conv.ConversationID)
+		}
+		if !reflect.DeepEqual(test.ConvIDs, convIDs) {
+			t.Errorf("%s: ListPrefsConv returned incorrect conversations, expected %v, got %v", test.Name, test.ConvIDs, convIDs)
+		}
+	}
+}
+
+func checkMutedUntil(t *testing.T, db models.Datastore, userID, conversationID int, expected *time.Time) {
+	t.Helper()
+	conv, err := db.GetPrefsConv(ctx, userID, conversationID)
+	if err != nil {
+		t.Fatalf("GetPrefsConv returned unexpected error: %s", err)
+	}
+	if (expected == nil) != (conv.MutedUntil == nil) ||
+		(expected != nil && !expected.Equal(*conv.MutedUntil)) {
+		t.Errorf("GetPrefsConv returned incorrect mute, expected %v, got %v", expected, conv.MutedUntil)
+	}
+}
+
+func testMutePrefsConv(t *testing.T, db models.Datastore) {
+	// Stores may only keep millisecond precision
+	until := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	past := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	checkErr(t, "MutePrefsConv with non-existent user", models.ErrPrefsDNE, db.MutePrefsConv(ctx, 1, 10, &until))
+
+	mustCreatePrefs(t, db, 1, 10, 11)
+	checkErr(t, "MutePrefsConv with non-existent conversation", models.ErrPrefsConvDNE, db.MutePrefsConv(ctx, 1, 12, &until))
+
+	checkErr(t, "MutePrefsConv", nil, db.MutePrefsConv(ctx, 1, 10, &until))
+	checkMutedUntil(t, db, 1, 10, &until)
+	checkMutedUntil(t, db, 1, 11, nil)
+
+	// Muting keeps the configured preferences and patching keeps the mute
+	checkPatchPrefsConv(t, "PatchPrefsConv", nil, db, 1, 10, &models.ConversationPrefs{
+		GeneralPrefs: &models.GeneralPrefs{Tag: models.None},
+	}, models.AnyVersion)
+	conv, _ := db.GetPrefsConv(ctx, 1, 10)
+	if conv.Tag != models.None || conv.TextEntered != models.All {
+		t.Errorf("Muted conversation has incorrect preferences %+v", conv)
+	}
+	checkMutedUntil(t, db, 1, 10, &until)
+
+	recipients, err := db.GetRecipients(ctx, 10, models.EventTextEntered, []int{1})
+	if err != nil {
+		t.Fatalf("GetRecipients returned unexpected error: %s", err)
+	}
+	if len(recipients) != 0 {
+		t.Errorf("GetRecipients returned recipients for a muted conversation: %+v", recipients)
+	}
+
+	checkErr(t, "MutePrefsConv to unmute", nil, db.MutePrefsConv(ctx, 1, 10, nil))
+	checkMutedUntil(t, db, 1, 10, nil)
+
+	// Expired mutes are dropped when read
+	checkErr(t, "MutePrefsConv in the past", nil, db.MutePrefsConv(ctx, 1, 11, &past))
+	checkMutedUntil(t, db, 1, 11, nil)
+	convs, err := db.ListPrefsConv(ctx, 1, &models.ListConvQuery{})
+	if err != nil {
+		t.Fatalf("ListPrefsConv returned unexpected error: %s", err)
+	}
+	for _, conv := range convs {
+		if conv.MutedUntil != nil {
+			t.Errorf("ListPrefsConv returned an expired mute for conversation %d", conv.ConversationID)
+		}
+	}
+}
+
+func testGetDueDigests(t *testing.T, db models.Datastore) {
+	at := time.Date(2020, time.March, 2, 8, 30, 0, 0, time.UTC)
+	until := at.Add(time.Hour)
+
+	mustCreatePrefs(t, db, 1, 10, 11, 12)
+	mustCreatePrefs(t, db, 2)
+	mustCreatePrefs(t, db, 3)
+	patches := []struct {
+		UserID         int
+		ConversationID int
+		Digest         *models.Digest
+	}{
+		{1, 0, &models.Digest{Frequency: models.Daily, Hour: 8}},
+		{1, 10, &models.Digest{Frequency: models.Hourly}},
+		{1, 11, &models.Digest{Frequency: models.Weekly, Hour: 8, Day: "tue"}},
+		{1, 12, &models.Digest{Frequency: models.Hourly}},
+		{2, 0, &models.Digest{Frequency: models.Weekly, Hour: 8, Day: "mon"}},
+		{3, 0, models.NewDigest()},
+	}
+	for _, patch := range patches {
+		general := &models.GeneralPrefs{Digest: patch.Digest}
+		var err error
+		if patch.ConversationID == 0 {
+			_, err = db.PatchPrefs(ctx, patch.UserID, &models.GlobalPrefs{GeneralPrefs: general}, models.AnyVersion)
+		} else {
+			_, err = db.PatchPrefsConv(ctx, patch.UserID, patch.ConversationID, &models.ConversationPrefs{GeneralPrefs: general}, models.AnyVersion)
+		}
+		if err != nil {
+			t.Fatalf("Failed to set digest: %s", err)
+		}
+	}
+	checkErr(t, "MutePrefsConv", nil, db.MutePrefsConv(ctx, 1, 12, &until))
+
+	expected := []models.DueDigest{
+		{UserID: 1, Frequency: models.Daily},
+		{UserID: 1, ConversationID: 10, Frequency: models.Hourly},
+		{UserID: 2, Frequency: models.Weekly},
+	}
+	due, err := db.GetDueDigests(ctx, at)
+	if err != nil {
+		t.Fatalf("GetDueDigests returned unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(expected, due) {
+		t.Errorf("GetDueDigests returned incorrect digests, expected %+v, got %+v", expected, due)
+	}
+}
+
+func checkVersion(t *testing.T, db models.Datastore, userID int, expected int64) {
+	t.Helper()
+	global, err := db.GetPrefs(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetPrefs returned unexpected error: %s", err)
+	}
+	if global.Version != expected {
+		t.Errorf("GetPrefs returned incorrect version, expected %d, got %d", expected, global.Version)
+	}
+	conv, err := db.GetPrefsConv(ctx, userID, 10)
+	if err != nil {
+		t.Fatalf("GetPrefsConv returned unexpected error: %s", err)
+	}
+	if conv.Version != expected {
+		t.Errorf("GetPrefsConv returned incorrect version, expected %d, got %d", expected, conv.Version)
+	}
+}
+
+func testVersions(t *testing.T, db models.Datastore) {
+	mustCreatePrefs(t, db, 1, 10, 11)
+	checkVersion(t, db, 1, 1)
+
+	patch := &models.GlobalPrefs{GeneralPrefs: &models.GeneralPrefs{Tag: models.None}}
+	checkPatchPrefs(t, "PatchPrefs with stale version", models.ErrVersionMismatch, db, 1, patch, 2)
+	if patched := checkPatchPrefs(t, "PatchPrefs", nil, db, 1, patch, 1); patched.Version != 2 {
+		t.Errorf("PatchPrefs returned incorrect version, expected 2, got %d", patched.Version)
+	}
+	checkVersion(t, db, 1, 2)
+	if patched := checkPatchPrefs(t, "PatchPrefs with empty patch", nil, db, 1, &models.GlobalPrefs{}, 2); patched.Version != 2 {
+		t.Errorf("PatchPrefs with empty patch returned incorrect version, expected 2, got %d", patched.Version)
+	}
+	checkPatchPrefs(t, "PatchPrefs with empty patch and stale version", models.ErrVersionMismatch, db, 1, &models.GlobalPrefs{}, 1)
+	checkVersion(t, db, 1, 2)
+
+	convPatch := &models.ConversationPrefs{GeneralPrefs: &models.GeneralPrefs{Role: models.Email}}
+	checkPatchPrefsConv(t, "PatchPrefsConv with stale version", models.ErrVersionMismatch, db, 1, 10, convPatch, 1)
+	checkPatchPrefsConv(t, "PatchPrefsConv with non-existent conversation", models.ErrPrefsConvDNE, db, 1, 12, convPatch, 2)
+	if patched := checkPatchPrefsConv(t, "PatchPrefsConv", nil, db, 1, 10, convPatch, 2); patched.Version != 3 {
+		t.Errorf("PatchPrefsConv returned incorrect version, expected 3, got %d", patched.Version)
+	}
+	checkVersion(t, db, 1, 3)
+
+	until := time.Now().Add(time.Hour)
+	checkErr(t, "MutePrefsConv", nil, db.MutePrefsConv(ctx, 1, 10, &until))
+	checkErr(t, "CreatePrefsConv", nil, db.CreatePrefsConv(ctx, 1, newConversationPrefs(12)))
+	checkVersion(t, db, 1, 5)
+
+	checkErr(t, "DeletePrefsConv with stale version", models.ErrVersionMismatch, db.DeletePrefsConv(ctx, 1, 11, 4))
+	checkErr(t, "DeletePrefsConv with non-existent conversation", models.ErrPrefsConvDNE, db.DeletePrefsConv(ctx, 1, 13, 5))
+	checkErr(t, "DeletePrefsConv", nil, db.DeletePrefsConv(ctx, 1, 11, 5))
+	checkVersion(t, db, 1, 6)
+
+	checkErr(t, "DeletePrefs with stale version", models.ErrVersionMismatch, db.DeletePrefs(ctx, 1, 5))
+	checkErr(t, "DeletePrefs", nil, db.DeletePrefs(ctx, 1, 6))
+	checkErr(t, "DeletePrefs with deleted user", models.ErrPrefsDNE, db.DeletePrefs(ctx, 1, 6))
+}
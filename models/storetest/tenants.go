@@ -0,0 +1,46 @@
+package storetest
+
+import (
+	"testing"
+
+	"pest-control/models"
+)
+
+// TenantFactory returns a new, empty TenantDatastore
+type TenantFactory func(t *testing.T) models.TenantDatastore
+
+// RunTenants verifies that the tenants of the TenantDatastore returned by
+// newStore can't read or write each other's preferences.
+func RunTenants(t *testing.T, newStore TenantFactory) {
+	store := newStore(t)
+	a, b := store.ForTenant("a"), store.ForTenant("b")
+
+	mustCreatePrefs(t, a, 1, 10)
+
+	_, err := b.GetPrefs(ctx, 1)
+	checkErr(t, "GetPrefs of another tenant", models.ErrPrefsDNE, err)
+	err = b.DeletePrefs(ctx, 1, models.AnyVersion)
+	checkErr(t, "DeletePrefs of another tenant", models.ErrPrefsDNE, err)
+	err = b.MutePrefsConv(ctx, 1, 10, nil)
+	checkErr(t, "MutePrefsConv of another tenant", models.ErrPrefsDNE, err)
+
+	// Tenants have their own user IDs
+	mustCreatePrefs(t, b, 1)
+	_, err = b.GetPrefsConv(ctx, 1, 10)
+	checkErr(t, "GetPrefsConv of another tenant", models.ErrPrefsConvDNE, err)
+
+	convs, err := b.ListPrefsConv(ctx, 1, &models.ListConvQuery{})
+	if err != nil {
+		t.Fatalf("ListPrefsConv returned unexpected error: %s", err)
+	}
+	if len(convs) != 0 {
+		t.Errorf("ListPrefsConv returned another tenant's preferences: %+v", convs)
+	}
+
+	if err := b.DeletePrefs(ctx, 1, models.AnyVersion); err != nil {
+		t.Fatalf("DeletePrefs returned unexpected error: %s", err)
+	}
+	if _, err := store.ForTenant("a").GetPrefsConv(ctx, 1, 10); err != nil {
+		t.Errorf("GetPrefsConv returned unexpected error after another tenant's delete: %s", err)
+	}
+}
@@ -0,0 +1,225 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"pest-control/logging"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tenancy is how preferences are partitioned between tenants
+type Tenancy string
+
+const (
+	// NoTenancy stores the preferences of every tenant together
+	NoTenancy Tenancy = ""
+	// TenantDatabase stores the preferences of each tenant in a database of
+	// its own, named after the configured database and the tenant ID. The
+	// database of a new tenant is bootstrapped before its first preferences
+	// are created.
+	TenantDatabase Tenancy = "database"
+	// TenantField stores the preferences of every tenant in the configured
+	// collection and keeps them apart by their tenant_id field
+	TenantField Tenancy = "field"
+)
+
+// ParseTenancy parses the name of a Tenancy, "none" or empty for NoTenancy
+func ParseTenancy(s string) (Tenancy, error) {
+	switch t := Tenancy(s); t {
+	case "none", NoTenancy:
+		return NoTenancy, nil
+	case TenantDatabase, TenantField:
+		return t, nil
+	}
+	return NoTenancy, fmt.Errorf("unknown tenancy %q", s)
+}
+
+// DBConfig names the database and collections that DB stores preferences in.
+// Names that are left empty are given their default.
+type DBConfig struct {
+	Database             string
+	Collection           string
+	MigrationsCollection string
+	AuditCollection      string
+	Tenancy              Tenancy
+	// Timeout bounds every operation of the Datastore methods on top of the
+	// deadline of their context, there is no bound if it is zero
+	Timeout time.Duration
+}
+
+// DefaultDBConfig is the configuration of DB when none is given
+func DefaultDBConfig() DBConfig {
+	return DBConfig{
+		Database:             "pest-control",
+		Collection:           "prefs",
+		MigrationsCollection: "migrations",
+		AuditCollection:      "audit",
+	}
+}
+
+func (c DBConfig) withDefaults() DBConfig {
+	defaults := DefaultDBConfig()
+	if c.Database == "" {
+		c.Database = defaults.Database
+	}
+	if c.Collection == "" {
+		c.Collection = defaults.Collection
+	}
+	if c.MigrationsCollection == "" {
+		c.MigrationsCollection = defaults.MigrationsCollection
+	}
+	if c.AuditCollection == "" {
+		c.AuditCollection = defaults.AuditCollection
+	}
+	return c
+}
+
+// TenantDatastore is a Datastore that partitions preferences by tenant
+type TenantDatastore interface {
+	Datastore
+	// ForTenant returns the Datastore of a tenant's preferences
+	ForTenant(tenant string) Datastore
+}
+
+func (db *DB) ForTenant(tenant string) Datastore {
+	return db.TenantDB(tenant)
+}
+
+// TenantDB returns a DB that only reads and writes the preferences of tenant.
+// Without tenancy it returns db itself.
+func (db *DB) TenantDB(tenant string) *DB {
+	if db.config.Tenancy == NoTenancy {
+		return db
+	}
+	return &DB{
+		Client:       db.Client,
+		config:       db.config,
+		tenant:       tenant,
+		bootstrapped: db.bootstrapped,
+	}
+}
+
+// tenantBootstraps records the tenants whose databases have their indexes,
+// so that each one is bootstrapped once by a process
+type tenantBootstraps struct {
+	mu      sync.Mutex
+	indexed map[string]bool
+}
+
+// isIndexed reports whether the database of db's tenant has been indexed by
+// this process
+func (db *DB) isIndexed() bool {
+	db.bootstrapped.mu.Lock()
+	defer db.bootstrapped.mu.Unlock()
+	return db.bootstrapped.indexed[db.tenant]
+}
+
+// markIndexed records that the database of db's tenant has its indexes
+func (db *DB) markIndexed() {
+	if db.config.Tenancy != TenantDatabase || db.tenant == "" {
+		return
+	}
+	db.bootstrapped.mu.Lock()
+	defer db.bootstrapped.mu.Unlock()
+	if db.bootstrapped.indexed == nil {
+		db.bootstrapped.indexed = map[string]bool{}
+	}
+	db.bootstrapped.indexed[db.tenant] = true
+}
+
+// ensureBootstrapped bootstraps the database of db's tenant unless it has
+// been indexed by this process, so that the unique index on user_id exists
+// before the tenant's first preferences are created. The preferences of
+// every tenant share the collection that is bootstrapped on startup without
+// TenantDatabase tenancy. The validator is only installed by the bootstrap
+// of app bootstrap or on startup.
+func (db *DB) ensureBootstrapped(ctx context.Context) error {
+	if db.config.Tenancy != TenantDatabase || db.tenant == "" {
+		return nil
+	}
+	if db.isIndexed() {
+		return nil
+	}
+
+	// Bootstrap is safe to run concurrently, so a tenant's first writes
+	// don't have to wait for each other
+	report, err := db.Bootstrap(ctx, false)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to bootstrap tenant database", logging.Fields{
+			"tenant": db.tenant,
+			"error":  err,
+		})
+		return err
+	}
+	logging.FromContext(ctx).Info("bootstrapped tenant database", logging.Fields{
+		"tenant": db.tenant,
+		"report": report.String(),
+	})
+	return nil
+}
+
+func (db *DB) database() *mongo.Database {
+	name := db.config.Database
+	if db.config.Tenancy == TenantDatabase && db.tenant != "" {
+		name += "-" + db.tenant
+	}
+	return db.Database(name)
+}
+
+func (db *DB) prefsCollection() *mongo.Collection {
+	return db.database().Collection(db.config.Collection)
+}
+
+// scope restricts a filter to the preferences of db's tenant when tenants
+// are kept apart by their tenant_id field
+func (db *DB) scope(filter bson.D) bson.D {
+	if db.config.Tenancy != TenantField || db.tenant == "" {
+		return filter
+	}
+	return append(bson.D{{"tenant_id", db.tenant}}, filter...)
+}
+
+// Tenants lists the tenants that have a database of their own. It is empty
+// unless the tenancy is TenantDatabase.
+func (db *DB) Tenants(ctx context.Context) ([]string, error) {
+	if db.config.Tenancy != TenantDatabase {
+		return []string{}, nil
+	}
+
+	prefix := db.config.Database + "-"
+	filter := bson.D{{"name", bson.D{{"$regex", "^" + regexp.QuoteMeta(prefix)}}}}
+	names, err := db.ListDatabaseNames(ctx, filter)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to list MongoDB databases", logging.Fields{
+			"error": err,
+		})
+		return nil, err
+	}
+
+	tenants := make([]string, len(names))
+	for i, name := range names {
+		tenants[i] = strings.TrimPrefix(name, prefix)
+	}
+	return tenants, nil
+}
+
+// ForTenant returns a MemDB holding the preferences of tenant, which is
+// created on first use
+func (mdb *MemDB) ForTenant(tenant string) Datastore {
+	mdb.tenantsMu.Lock()
+	defer mdb.tenantsMu.Unlock()
+
+	if mdb.tenants == nil {
+		mdb.tenants = map[string]*MemDB{}
+	}
+	if _, ok := mdb.tenants[tenant]; !ok {
+		mdb.tenants[tenant] = NewMemDB()
+	}
+	return mdb.tenants[tenant]
+}
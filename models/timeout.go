@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// maxTimeMSExpiredCode is the code of the error returned by MongoDB for an
+// operation that ran out of its time limit
+const maxTimeMSExpiredCode = 50
+
+// withTimeout bounds ctx by the configured Timeout of DB
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.config.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.config.Timeout)
+}
+
+// IsTimeout reports whether a Datastore error was caused by the operation
+// running out of time
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == maxTimeMSExpiredCode {
+		return true
+	}
+	// The driver wraps context errors without exposing them to errors.Is
+	return strings.Contains(err.Error(), context.DeadlineExceeded.Error())
+}
+
+// IsUnavailable reports whether a Datastore error was caused by the database
+// being unreachable or by the operation being canceled, rather than by the
+// operation failing
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || err == mongo.ErrClientDisconnected {
+		return true
+	}
+	if _, ok := err.(topology.ConnectionError); ok {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "server selection error") ||
+		strings.Contains(msg, context.Canceled.Error())
+}
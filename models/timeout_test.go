@@ -0,0 +1,70 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"pest-control/models"
+)
+
+func TestDatastoreErrors(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Error       error
+		Timeout     bool
+		Unavailable bool
+	}{
+		{
+			Name:    "Context deadline",
+			Error:   context.DeadlineExceeded,
+			Timeout: true,
+		},
+		{
+			Name:    "Wrapped context deadline",
+			Error:   fmt.Errorf("connection(localhost:27017) failed to read: %s", context.DeadlineExceeded),
+			Timeout: true,
+		},
+		{
+			Name:    "Operation time limit",
+			Error:   mongo.CommandError{Code: 50, Message: "operation exceeded time limit"},
+			Timeout: true,
+		},
+		{
+			Name:        "Canceled context",
+			Error:       context.Canceled,
+			Unavailable: true,
+		},
+		{
+			Name:        "Server selection",
+			Error:       errors.New("server selection error: server selection timeout"),
+			Unavailable: true,
+		},
+		{
+			Name:        "Disconnected client",
+			Error:       mongo.ErrClientDisconnected,
+			Unavailable: true,
+		},
+		{
+			Name:  "Missing preferences",
+			Error: models.ErrPrefsDNE,
+		},
+		{
+			Name:  "Duplicate key",
+			Error: mongo.CommandError{Code: 11000, Message: "duplicate key"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if timeout := models.IsTimeout(test.Error); timeout != test.Timeout {
+				t.Errorf("IsTimeout returned %t, expected %t", timeout, test.Timeout)
+			}
+			if unavailable := models.IsUnavailable(test.Error); unavailable != test.Unavailable {
+				t.Errorf("IsUnavailable returned %t, expected %t", unavailable, test.Unavailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"pest-control/tracing"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// start starts the span of a DB operation and bounds its context by the
+// configured Timeout. The returned function ends both.
+func (db *DB) start(ctx context.Context, operation string) (context.Context, func()) {
+	ctx, span := tracing.Start(ctx, "DB."+operation)
+	span.SetAttribute("db.system", "mongodb")
+	if db.tenant != "" {
+		span.SetAttribute("tenant", db.tenant)
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	return ctx, func() {
+		cancel()
+		span.Finish()
+	}
+}
+
+// commandMonitor traces each command sent to MongoDB as a child of the span
+// of the operation that sent it. Commands are only described by their name
+// and collection, their documents hold preferences.
+func commandMonitor() *event.CommandMonitor {
+	// spans holds the span of each command in flight by its request ID
+	spans := sync.Map{}
+	finish := func(requestID int64, err error) {
+		if span, ok := spans.Load(requestID); ok {
+			spans.Delete(requestID)
+			span.(*tracing.Span).RecordError(err)
+			span.(*tracing.Span).Finish()
+		}
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			_, span := tracing.StartKind(ctx, "mongodb."+e.CommandName, tracing.Client)
+			if span == nil {
+				return
+			}
+			span.SetAttribute("db.system", "mongodb")
+			span.SetAttribute("db.name", e.DatabaseName)
+			span.SetAttribute("db.operation", e.CommandName)
+			if collection, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+				span.SetAttribute("db.mongodb.collection", collection)
+			}
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			finish(e.RequestID, nil)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			finish(e.RequestID, errors.New(e.Failure))
+		},
+	}
+}
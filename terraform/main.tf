@@ -65,4 +65,6 @@ module "pest-control" {
   db_port         = "27017"
   db_user         = var.db_user
   db_pw           = var.db_pw
+  jwt_rsa_key     = var.jwt_rsa_key
+  service_token   = var.service_token
 }
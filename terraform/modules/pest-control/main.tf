@@ -4,12 +4,96 @@ resource "aws_cloudwatch_log_group" "pest-control" {
   name = "${var.name}_pest-control"
 }
 
+locals {
+  secrets_dir      = "/run/secrets"
+  jwt_rsa_key_file   = "${local.secrets_dir}/jwt-rsa-key.pem"
+  service_token_file = "${local.secrets_dir}/service-token"
+}
+
+resource "aws_ssm_parameter" "jwt-rsa-key" {
+  name  = "/${var.name}/pest-control/jwt-rsa-key"
+  type  = "SecureString"
+  value = var.jwt_rsa_key
+}
+
+resource "aws_ssm_parameter" "service-token" {
+  name  = "/${var.name}/pest-control/service-token"
+  type  = "SecureString"
+  value = var.service_token
+}
+
+data "aws_iam_policy_document" "pest-control-assume" {
+  statement {
+    actions = ["sts:AssumeRole"]
+
+    principals {
+      type        = "Service"
+      identifiers = ["ecs-tasks.amazonaws.com"]
+    }
+  }
+}
+
+data "aws_iam_policy_document" "pest-control-secrets" {
+  statement {
+    actions   = ["ssm:GetParameters"]
+    resources = [
+      aws_ssm_parameter.jwt-rsa-key.arn,
+      aws_ssm_parameter.service-token.arn,
+    ]
+  }
+}
+
+# The execution role lets the ECS agent read the secrets of the task
+resource "aws_iam_role" "pest-control-execution" {
+  name               = "${var.name}_pest-control-execution"
+  assume_role_policy = data.aws_iam_policy_document.pest-control-assume.json
+}
+
+resource "aws_iam_role_policy" "pest-control-secrets" {
+  name   = "${var.name}_pest-control-secrets"
+  role   = aws_iam_role.pest-control-execution.id
+  policy = data.aws_iam_policy_document.pest-control-secrets.json
+}
+
 resource "aws_ecs_task_definition" "pest-control" {
-  family       = "${var.name}_pest-control"
-  network_mode = "bridge"
+  family             = "${var.name}_pest-control"
+  network_mode       = "bridge"
+  execution_role_arn = aws_iam_role.pest-control-execution.arn
+
+  # The image has no shell, so the secrets container writes the files that
+  # pest-control reads its secrets from to a volume that they share
+  volume {
+    name = "secrets"
+  }
 
   container_definitions = <<EOF
 [
+  {
+    "name": "${var.name}_pest-control-secrets",
+    "image": "busybox",
+    "essential": false,
+    "memory": 16,
+    "secrets": [
+        {
+            "name": "JWT_RSA_KEY",
+            "valueFrom": "${aws_ssm_parameter.jwt-rsa-key.arn}"
+        },
+        {
+            "name": "SERVICE_TOKEN",
+            "valueFrom": "${aws_ssm_parameter.service-token.arn}"
+        }
+    ],
+    "entryPoint": ["sh", "-c"],
+    "command": [
+        "umask 077 && printenv JWT_RSA_KEY > ${local.jwt_rsa_key_file} && printenv SERVICE_TOKEN > ${local.service_token_file}"
+    ],
+    "mountPoints": [
+        {
+            "sourceVolume": "secrets",
+            "containerPath": "${local.secrets_dir}"
+        }
+    ]
+  },
   {
     "name": "${var.name}_pest-control",
     "image": "343660461351.dkr.ecr.us-east-2.amazonaws.com/pest-control:${var.container_tag}",
@@ -39,6 +123,31 @@ resource "aws_ecs_task_definition" "pest-control" {
         {
             "name": "PESTCONTROL_DB_PW",
             "value": "${var.db_pw}"
+        },
+        {
+            "name": "PESTCONTROL_AUTH",
+            "value": "${var.auth_mode}"
+        },
+        {
+            "name": "PESTCONTROL_JWT_RSA_KEY_FILE",
+            "value": "${local.jwt_rsa_key_file}"
+        },
+        {
+            "name": "PESTCONTROL_SERVICE_TOKEN_FILE",
+            "value": "${local.service_token_file}"
+        }
+    ],
+    "dependsOn": [
+        {
+            "containerName": "${var.name}_pest-control-secrets",
+            "condition": "SUCCESS"
+        }
+    ],
+    "mountPoints": [
+        {
+            "sourceVolume": "secrets",
+            "containerPath": "${local.secrets_dir}",
+            "readOnly": true
         }
     ],
     "portMappings": [
@@ -64,6 +173,14 @@ resource "aws_elb" "pest-control" {
     lb_port           = 80
     lb_protocol       = "http"
   }
+
+  health_check {
+    target              = "HTTP:80/readyz"
+    interval            = 10
+    timeout             = 5
+    healthy_threshold   = 2
+    unhealthy_threshold = 2
+  }
 }
 
 resource "aws_ecs_service" "pest-control" {
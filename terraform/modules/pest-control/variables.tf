@@ -43,3 +43,19 @@ variable "db_pw" {
   type        = string
   description = "Master password for the database"
 }
+
+variable "auth_mode" {
+  type        = string
+  description = "How requests are authenticated, either jwt or header to trust the User-ID header set by heimdall, which has to be asked for"
+  default     = "jwt"
+}
+
+variable "jwt_rsa_key" {
+  type        = string
+  description = "PEM of the RSA public key of heimdall's JWTs, which is kept in SSM and written to a file in the container"
+}
+
+variable "service_token" {
+  type        = string
+  description = "Token that other services call the internal API with, which is kept in SSM and written to a file in the container"
+}
@@ -41,6 +41,16 @@ variable "db_pw" {
   description = "Password to connect to database"
 }
 
+variable "jwt_rsa_key" {
+  type        = string
+  description = "PEM of the RSA public key that heimdall signs JWTs with"
+}
+
+variable "service_token" {
+  type        = string
+  description = "Token that other services call the internal API of pest-control with"
+}
+
 variable "container_tag" {
   type        = string
   description = "Tag of the Docker container to be used in the pest-control container definition"
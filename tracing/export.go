@@ -0,0 +1,219 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans somewhere they can be looked at
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// WriterExporter writes spans to a writer as JSON, one per line
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterExporter returns a WriterExporter that writes to w, such as
+// os.Stdout
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+type writtenSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Start      time.Time              `json:"start"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func (e *WriterExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, span := range spans {
+		written := &writtenSpan{
+			TraceID:    span.SpanContext.TraceID.String(),
+			SpanID:     span.SpanContext.SpanID.String(),
+			Name:       span.Name,
+			Kind:       span.Kind.String(),
+			Start:      span.Start,
+			DurationMS: float64(span.End.Sub(span.Start)) / float64(time.Millisecond),
+			Attributes: span.Attributes,
+			Error:      span.Error,
+		}
+		if span.Parent.IsValid() {
+			written.ParentID = span.Parent.String()
+		}
+		if err := enc.Encode(written); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultOTLPEndpoint is the traces endpoint of OTLP over HTTP of a local
+// OpenTelemetry collector
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over HTTP,
+// encoded as JSON
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an OTLPExporter that sends spans to the traces
+// endpoint of a collector as those of service
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// The types below are the JSON encoding of the OTLP trace request, see
+// https://github.com/open-telemetry/opentelemetry-proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpStatusError is the status code of a failed span
+const otlpStatusError = 2
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	converted := []otlpAttribute{}
+	for _, key := range keys {
+		value := otlpValue{}
+		switch v := attributes[key].(type) {
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		converted = append(converted, otlpAttribute{key, value})
+	}
+	return converted
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	converted := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		converted[i] = otlpSpan{
+			TraceID:           span.SpanContext.TraceID.String(),
+			SpanID:            span.SpanContext.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Parent.IsValid() {
+			converted[i].ParentSpanID = span.Parent.String()
+		}
+		if span.Error != "" {
+			converted[i].Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+	}
+
+	body, err := json.Marshal(&otlpRequest{[]otlpResourceSpans{{
+		Resource: otlpResource{otlpAttributes(map[string]interface{}{
+			"service.name": e.service,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{"pest-control/tracing"},
+			Spans: converted,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	return nil
+}
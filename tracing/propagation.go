@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TraceparentHeader is the W3C Trace Context header that propagates the span
+// of a caller
+const TraceparentHeader = "traceparent"
+
+const sampledFlag = 0x01
+
+var errInvalidTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent parses a traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Versions after
+// 00 are parsed as far as version 00 goes, as the specification requires.
+func ParseTraceparent(header string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return sc, errInvalidTraceparent
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff ||
+		(version[0] == 0 && len(parts) != 4) {
+		return sc, errInvalidTraceparent
+	}
+	if err := decodeID(sc.TraceID[:], parts[1]); err != nil || !sc.TraceID.IsValid() {
+		return sc, errInvalidTraceparent
+	}
+	if err := decodeID(sc.SpanID[:], parts[2]); err != nil || !sc.SpanID.IsValid() {
+		return sc, errInvalidTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, errInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&sampledFlag != 0
+	return sc, nil
+}
+
+// decodeID decodes a lowercase hex ID of exactly len(id) bytes
+func decodeID(id []byte, s string) error {
+	if len(s) != 2*len(id) || strings.ToLower(s) != s {
+		return errInvalidTraceparent
+	}
+	_, err := hex.Decode(id, []byte(s))
+	return err
+}
+
+// Traceparent formats sc as a traceparent header
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags |= sampledFlag
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
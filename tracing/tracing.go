@@ -0,0 +1,316 @@
+// Package tracing records spans of the work done for requests, continues the
+// traces of callers through the W3C traceparent header, and exports spans to
+// stdout or an OpenTelemetry collector
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"pest-control/logging"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether id isn't all zeroes, which is an invalid ID
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether id isn't all zeroes, which is an invalid ID
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext is what is propagated of a span to the spans started from it
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled is whether the trace is recorded
+	Sampled bool
+}
+
+// IsValid reports whether sc has a trace and a span ID
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind is the kind of work that a span covers
+type SpanKind int
+
+// The values of SpanKind are those of OpenTelemetry
+const (
+	Internal SpanKind = 1
+	Server   SpanKind = 2
+	Client   SpanKind = 3
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	}
+	return "internal"
+}
+
+// Span is an operation of a trace. The methods of Span do nothing on a nil
+// Span, which is what is started when a trace isn't sampled.
+type Span struct {
+	tracer *Tracer
+
+	Name        string
+	Kind        SpanKind
+	SpanContext SpanContext
+	// Parent is the ID of the span that this span was started from, which is
+	// invalid for the root span of a trace
+	Parent SpanID
+	Start  time.Time
+	End    time.Time
+
+	mu         sync.Mutex
+	Attributes map[string]interface{}
+	// Error is the message of the error that the operation failed with
+	Error string
+}
+
+// SetAttribute records an attribute of the operation. Values should be
+// strings, ints or bools.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// RecordError marks the operation as failed with err
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and queues it for export
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	s.tracer.queue(s)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx holding span, which the spans started
+// from ctx are children of
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span held by ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts an internal span that is a child of the span held by ctx,
+// and returns a copy of ctx holding it. Without a span in ctx nothing is
+// traced and the span is nil.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, Internal)
+}
+
+// StartKind is Start for a span of the given kind
+func StartKind(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind, parent.SpanContext.TraceID, parent.SpanContext.SpanID)
+	return ContextWithSpan(ctx, span), span
+}
+
+const (
+	// batchSize is the most spans that are exported at once
+	batchSize = 512
+	// queueSize is the most spans that wait to be exported, beyond which
+	// spans are dropped
+	queueSize = 4096
+	// exportInterval is how often the waiting spans are exported
+	exportInterval = 5 * time.Second
+)
+
+// Tracer starts the root spans of traces and exports the spans that finish
+// in batches. A nil Tracer traces nothing.
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+
+	spans   chan *Span
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewTracer returns a Tracer that exports to exporter, and samples the given
+// ratio of the traces that it starts. Traces continued from a caller are
+// sampled if the caller sampled them.
+func NewTracer(exporter Exporter, sampleRatio float64) *Tracer {
+	t := &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		spans:       make(chan *Span, queueSize),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartServer starts the span of a request, which continues the trace of
+// remote if it is valid and starts a new one otherwise, and returns a copy
+// of ctx holding it
+func (t *Tracer) StartServer(
+	ctx context.Context,
+	name string,
+	remote SpanContext,
+) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	var (
+		traceID TraceID
+		parent  SpanID
+		sampled bool
+	)
+	if remote.IsValid() {
+		traceID, parent, sampled = remote.TraceID, remote.SpanID, remote.Sampled
+	} else {
+		rand.Read(traceID[:])
+		sampled = t.sample()
+	}
+	if !sampled {
+		return ctx, nil
+	}
+
+	span := t.newSpan(name, Server, traceID, parent)
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample decides whether a new trace is sampled, with a probability of the
+// sample ratio
+func (t *Tracer) sample() bool {
+	var b [8]byte
+	rand.Read(b[:])
+	// The top 53 bits are a uniform float64 in [0, 1)
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < t.sampleRatio
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, traceID TraceID, parent SpanID) *Span {
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Parent:     parent,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+	span.SpanContext = SpanContext{TraceID: traceID, Sampled: true}
+	rand.Read(span.SpanContext.SpanID[:])
+	return span
+}
+
+func (t *Tracer) queue(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		logging.Default().Warn("dropped span, the export queue is full", logging.Fields{
+			"span": span.Name,
+		})
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			logging.Default().Error("failed to export spans", logging.Fields{
+				"spans": len(batch),
+				"error": err,
+			})
+		}
+		batch = []*Span{}
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+					if len(batch) >= batchSize {
+						export()
+					}
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports the spans that have finished, waiting until ctx is done
+// at most. Spans that finish afterwards are not exported.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.once.Do(func() { close(t.stop) })
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,254 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pest-control/tracing"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recorder is an Exporter that keeps the spans that it is given
+type recorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *recorder) Export(spans []*tracing.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Header  string
+		Valid   bool
+		Sampled bool
+	}{
+		{
+			Name:    "Sampled",
+			Header:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			Valid:   true,
+			Sampled: true,
+		},
+		{
+			Name:   "Not sampled",
+			Header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			Valid:  true,
+		},
+		{
+			Name:    "Future version with more fields",
+			Header:  "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			Valid:   true,
+			Sampled: true,
+		},
+		{
+			Name:   "Version 00 with more fields",
+			Header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		},
+		{
+			Name:   "Invalid version",
+			Header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			Name:   "Zero trace ID",
+			Header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			Name:   "Zero span ID",
+			Header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		},
+		{
+			Name:   "Uppercase trace ID",
+			Header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		},
+		{
+			Name:   "Short span ID",
+			Header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01",
+		},
+		{
+			Name: "Empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			sc, err := tracing.ParseTraceparent(test.Header)
+			if (err == nil) != test.Valid {
+				t.Fatalf("Incorrect validity, expected %t, got error %v", test.Valid, err)
+			}
+			if !test.Valid {
+				return
+			}
+			if sc.Sampled != test.Sampled {
+				t.Errorf("Incorrect sampled flag, expected %t", test.Sampled)
+			}
+			if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+				sc.SpanID.String() != "00f067aa0ba902b7" {
+				t.Errorf("Incorrect IDs %s and %s", sc.TraceID, sc.SpanID)
+			}
+			if test.Header[:2] == "00" && sc.Traceparent() != test.Header {
+				t.Errorf("Incorrect traceparent, expected %s, got %s", test.Header, sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	exported := &recorder{}
+	tracer := tracing.NewTracer(exported, 1)
+
+	remote, _ := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := tracer.StartServer(context.Background(), "GET /prefs", remote)
+	_, child := tracing.StartKind(ctx, "DB.GetPrefs", tracing.Client)
+	child.SetAttribute("db.system", "mongodb")
+	child.RecordError(errors.New("timed out"))
+	child.Finish()
+	server.Finish()
+
+	// Spans of traces that the caller didn't sample aren't recorded
+	unsampled := remote
+	unsampled.Sampled = false
+	ctx, span := tracer.StartServer(context.Background(), "GET /prefs", unsampled)
+	if span != nil {
+		t.Errorf("Started span of trace that isn't sampled")
+	}
+	if _, span := tracing.Start(ctx, "parseReqBody"); span != nil {
+		t.Errorf("Started child span of trace that isn't sampled")
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned unexpected error: %s", err)
+	}
+	if len(exported.spans) != 2 {
+		t.Fatalf("Incorrect number of exported spans, expected 2, got %d", len(exported.spans))
+	}
+	if exported.spans[0] != child || exported.spans[1] != server {
+		t.Fatalf("Exported incorrect spans %v", exported.spans)
+	}
+	if server.SpanContext.TraceID != remote.TraceID || server.Parent != remote.SpanID {
+		t.Errorf("Server span doesn't continue the remote trace")
+	}
+	if child.SpanContext.TraceID != remote.TraceID || child.Parent != server.SpanContext.SpanID {
+		t.Errorf("Child span isn't a child of the server span")
+	}
+	if child.Error != "timed out" || child.Attributes["db.system"] != "mongodb" {
+		t.Errorf("Child span has incorrect error %q or attributes %v", child.Error, child.Attributes)
+	}
+}
+
+func TestTracerSampleRatio(t *testing.T) {
+	for _, ratio := range []float64{0, 1} {
+		tracer := tracing.NewTracer(&recorder{}, ratio)
+		_, span := tracer.StartServer(context.Background(), "GET /prefs", tracing.SpanContext{})
+		if (span != nil) != (ratio == 1) {
+			t.Errorf("Incorrect sampling with ratio %g", ratio)
+		}
+		if span != nil && span.Parent.IsValid() {
+			t.Errorf("Root span has a parent")
+		}
+		tracer.Shutdown(context.Background())
+	}
+
+	var tracer *tracing.Tracer
+	if _, span := tracer.StartServer(context.Background(), "GET /prefs", tracing.SpanContext{}); span != nil {
+		t.Errorf("Nil tracer started a span")
+	}
+}
+
+func TestExporters(t *testing.T) {
+	tracer := tracing.NewTracer(&recorder{}, 1)
+	ctx, server := tracer.StartServer(context.Background(), "PATCH /prefs", tracing.SpanContext{})
+	server.SetAttribute("http.status_code", 504)
+	_, child := tracing.Start(ctx, "parseReqBody")
+	child.Finish()
+	server.RecordError(errors.New("Gateway Timeout"))
+	server.Finish()
+	tracer.Shutdown(context.Background())
+	spans := []*tracing.Span{child, server}
+
+	t.Run("Writer", func(t *testing.T) {
+		b := new(bytes.Buffer)
+		if err := tracing.NewWriterExporter(b).Export(spans); err != nil {
+			t.Fatalf("Export returned unexpected error: %s", err)
+		}
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Incorrect number of lines, expected 2, got %d", len(lines))
+		}
+		written := map[string]interface{}{}
+		json.Unmarshal([]byte(lines[0]), &written)
+		if written["parent_span_id"] != server.SpanContext.SpanID.String() ||
+			written["name"] != "parseReqBody" {
+			t.Errorf("Incorrect span %s", lines[0])
+		}
+	})
+
+	t.Run("OTLP", func(t *testing.T) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID      string `json:"traceId"`
+						ParentSpanID string `json:"parentSpanId"`
+						Name         string `json:"name"`
+						Kind         int    `json:"kind"`
+						Attributes   []struct {
+							Key   string            `json:"key"`
+							Value map[string]string `json:"value"`
+						} `json:"attributes"`
+						Status struct {
+							Code    int    `json:"code"`
+							Message string `json:"message"`
+						} `json:"status"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+		}))
+		defer collector.Close()
+
+		exporter := tracing.NewOTLPExporter(collector.URL+"/v1/traces", "pest-control")
+		if err := exporter.Export(spans); err != nil {
+			t.Fatalf("Export returned unexpected error: %s", err)
+		}
+
+		exportedSpans := body.ResourceSpans[0].ScopeSpans[0].Spans
+		if len(exportedSpans) != 2 {
+			t.Fatalf("Incorrect number of spans, expected 2, got %d", len(exportedSpans))
+		}
+		s := exportedSpans[1]
+		if s.TraceID != server.SpanContext.TraceID.String() || s.ParentSpanID != "" ||
+			s.Kind != int(tracing.Server) {
+			t.Errorf("Incorrect server span %+v", s)
+		}
+		if s.Status.Code != 2 || s.Status.Message != "Gateway Timeout" {
+			t.Errorf("Incorrect status %+v", s.Status)
+		}
+		if len(s.Attributes) != 1 || s.Attributes[0].Value["intValue"] != "504" {
+			t.Errorf("Incorrect attributes %+v", s.Attributes)
+		}
+		if exportedSpans[0].ParentSpanID != server.SpanContext.SpanID.String() {
+			t.Errorf("Incorrect parent of child span %+v", exportedSpans[0])
+		}
+
+		failing := tracing.NewOTLPExporter(collector.URL+"/wrong", "pest-control")
+		if err := failing.Export(spans); err == nil {
+			t.Errorf("Export to failing collector returned no error")
+		}
+	})
+}